@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Machine-readable error codes returned by /oauth/* endpoints. The SPA branches on
+// these, so they are part of the API: add new codes rather than renaming existing ones.
+const (
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeRequestTooLarge      = "request_too_large"
+	errCodeChecksumMismatch     = "checksum_mismatch"
+	errCodeRateLimited          = "rate_limited"
+	errCodeLockedOut            = "locked_out"
+	errCodeCSRFRejected         = "csrf_rejected"
+	errCodeNotConfigured        = "not_configured"
+	errCodeServerError          = "server_error"
+	errCodeUpstreamError        = "upstream_error"
+	errCodeNotFound             = "not_found"
+	errCodeMissingAuthCode      = "missing_auth_code"
+	errCodeInvalidAuthCode      = "invalid_auth_code"
+	errCodeAuthCodeUsed         = "auth_code_used"
+	errCodeAuthCodeExpired      = "auth_code_expired"
+	errCodeMissingAuthorization = "missing_authorization"
+	errCodeInvalidAuthorization = "invalid_authorization"
+	errCodeInvalidToken         = "invalid_token"
+	errCodeTokenRevoked         = "token_revoked"
+	errCodeInvalidTokenHash     = "invalid_token_hash"
+	errCodeInvalidCSRFToken     = "invalid_csrf_token"
+	errCodeMissingRefreshToken  = "missing_refresh_token"
+	errCodeInvalidRefreshToken  = "invalid_refresh_token"
+	errCodeInvalidInclude       = "invalid_include"
+	errCodeInvalidOrg           = "invalid_org"
+	errCodeNoSession            = "no_session"
+	errCodeSessionExpired       = "session_expired"
+	errCodeMissingDeviceCode    = "missing_device_code"
+	errCodeMaintenance          = "maintenance"
+	errCodeTimeout              = "timeout"
+)
+
+// apiError is the body of an /oauth/* error response.
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// writeJSONError is http.Error for API endpoints: it replies with status and a JSON body
+// carrying a stable error code and a human-readable message.
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiError{Error: code, Message: msg}); err != nil {
+		errorf("Failed to encode %s error response: %v", code, err)
+	}
+}
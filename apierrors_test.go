@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeAPIError checks rr is a JSON error with status and returns its code.
+func decodeAPIError(t *testing.T, rr *httptest.ResponseRecorder, status int) string {
+	t.Helper()
+	if rr.Code != status {
+		t.Errorf("status = %d, want %d: %s", rr.Code, status, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body apiError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q is not JSON: %v", rr.Body, err)
+	}
+	if body.Message == "" {
+		t.Errorf("error %q has no message", body.Error)
+	}
+	return body.Error
+}
+
+func TestWriteJSONError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeJSONError(rr, http.StatusUnauthorized, errCodeInvalidAuthCode, "Invalid or expired auth code")
+
+	if got := decodeAPIError(t, rr, http.StatusUnauthorized); got != "invalid_auth_code" {
+		t.Errorf("error = %q, want invalid_auth_code", got)
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", rr.Header().Get("Cache-Control"))
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &raw); err != nil || len(raw) != 2 {
+		t.Errorf("body = %s, want exactly error and message", rr.Body)
+	}
+}
+
+func TestAPIErrorCodes(t *testing.T) {
+	resetFailedAttempts(t)
+	resetAuthCodes(t)
+	setClientSecret(t, "test_secret")
+	now := time.Now()
+	authCodesMutex.Lock()
+	authCodes["used"] = authCodeData{username: "octocat", issued: now, expiry: now.Add(time.Minute), used: true}
+	authCodes["stale"] = authCodeData{username: "octocat", issued: now.Add(-time.Minute), expiry: now.Add(-time.Second)}
+	authCodesMutex.Unlock()
+
+	post := func(path, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	get := func(path string, header ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return req
+	}
+	withCookie := func(req *http.Request, name, value string) *http.Request {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		status  int
+		code    string
+	}{
+		{"exchange bad JSON", handleExchangeAuthCode, post("/oauth/exchange", "{"), http.StatusBadRequest, "invalid_request"},
+		{"exchange no code", handleExchangeAuthCode, post("/oauth/exchange", `{}`), http.StatusBadRequest, "missing_auth_code"},
+		{"exchange unknown code", handleExchangeAuthCode, post("/oauth/exchange", `{"auth_code":"nope"}`), http.StatusUnauthorized, "invalid_auth_code"},
+		{"exchange reused code", handleExchangeAuthCode, post("/oauth/exchange", `{"auth_code":"used"}`), http.StatusUnauthorized, "auth_code_used"},
+		{"exchange expired code", handleExchangeAuthCode, post("/oauth/exchange", `{"auth_code":"stale"}`), http.StatusUnauthorized, "auth_code_expired"},
+		{"user without auth", handleGetUser, get("/oauth/user"), http.StatusUnauthorized, "missing_authorization"},
+		{"user with basic auth", handleGetUser, get("/oauth/user", "Authorization", "Basic abc"), http.StatusUnauthorized, "invalid_authorization"},
+		{"user bad include", handleGetUser, get("/oauth/user?include=repos", "Authorization", "Bearer "+testToken), http.StatusBadRequest, "invalid_include"},
+		{"user forged CSRF", handleGetUser, withCookie(get("/oauth/user", csrfHeaderName, "x"), tokenCookieName, testToken), http.StatusForbidden, "invalid_csrf_token"},
+		{"validate without auth", handleValidateToken, get("/oauth/validate"), http.StatusUnauthorized, "missing_authorization"},
+		{"org membership bad org", handleCheckOrgMembership, get("/oauth/org-membership?org=-bad-"), http.StatusBadRequest, "invalid_org"},
+		{"refresh no token", handleRefreshToken, post("/oauth/refresh", `{}`), http.StatusBadRequest, "missing_refresh_token"},
+		{"session without cookie", handleSession, get("/oauth/session"), http.StatusUnauthorized, "no_session"},
+		{"session unknown cookie", handleSession, withCookie(get("/oauth/session"), sessionCookieName, "gone"), http.StatusUnauthorized, "session_expired"},
+		{"device poll no code", handleDevicePoll, post("/oauth/device/token", `{}`), http.StatusBadRequest, "missing_device_code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler(rr, tt.req)
+			if got := decodeAPIError(t, rr, tt.status); got != tt.code {
+				t.Errorf("error = %q, want %q", got, tt.code)
+			}
+		})
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		setClientSecret(t, "")
+		rr := httptest.NewRecorder()
+		handleRefreshToken(rr, post("/oauth/refresh", `{"refresh_token":"r"}`))
+		if got := decodeAPIError(t, rr, http.StatusServiceUnavailable); got != "not_configured" {
+			t.Errorf("error = %q, want not_configured", got)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		limiter := &rateLimiter{requests: make(map[string][]time.Time), limit: 1, window: time.Minute}
+		handler := limiter.limitHandler(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+		handler(httptest.NewRecorder(), post("/oauth/exchange", `{}`))
+		rr := httptest.NewRecorder()
+		handler(rr, post("/oauth/exchange", `{}`))
+		if got := decodeAPIError(t, rr, http.StatusTooManyRequests); got != "rate_limited" {
+			t.Errorf("error = %q, want rate_limited", got)
+		}
+	})
+
+	t.Run("through the server", func(t *testing.T) {
+		server := newTestServer(t, Config{})
+
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/oauth/exchange", http.NoBody))
+		if got := decodeAPIError(t, rr, http.StatusMethodNotAllowed); got != "method_not_allowed" {
+			t.Errorf("error = %q, want method_not_allowed", got)
+		}
+
+		req := post("/oauth/exchange", `{"auth_code":"x"}`)
+		req.Header.Set("Origin", "https://evil.example")
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		rr = httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		if got := decodeAPIError(t, rr, http.StatusForbidden); got != "csrf_rejected" {
+			t.Errorf("error = %q, want csrf_rejected", got)
+		}
+	})
+}
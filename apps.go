@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// oauthApp holds the credentials for one GitHub OAuth app.
+type oauthApp struct {
+	clientID     string
+	clientSecret string
+}
+
+func (a oauthApp) configured() bool {
+	return a.clientID != "" && a.clientSecret != ""
+}
+
+// oauthAppsByHost maps hosts to OAuth apps other than the default, so staging and
+// production subdomains can be served by the same binary with different credentials.
+// Populated once at startup and read-only afterwards.
+var oauthAppsByHost = map[string]oauthApp{}
+
+// appForHost resolves OAuth credentials for a host, falling back to the default app.
+func appForHost(host string) oauthApp {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if app, ok := oauthAppsByHost[host]; ok {
+		return app
+	}
+	return oauthApp{clientID: *clientID, clientSecret: defaultClientSecret.get()}
+}
+
+// appForReturnTo resolves the app for the host a login will return to.
+// OAuth always runs on the base domain, so the return_to host identifies the deployment.
+func appForReturnTo(returnTo string) oauthApp {
+	if u, err := url.Parse(validateReturnToURL(returnTo)); err == nil && u.Host != "" {
+		return appForHost(u.Hostname())
+	}
+	return appForHost(baseDomain)
+}
+
+// parseOAuthApps parses comma-separated host=client_id entries. Each app's secret is read
+// with secret from GITHUB_CLIENT_SECRET_<CLIENT_ID> so secrets never appear in flags.
+func parseOAuthApps(spec string, secret func(string) string) (map[string]oauthApp, error) {
+	apps := make(map[string]oauthApp)
+	for entry := range strings.SplitSeq(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, id, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		id = strings.TrimSpace(id)
+		if !ok || host == "" || id == "" {
+			return nil, fmt.Errorf("invalid OAuth app %q: want host=client_id", entry)
+		}
+		if _, dup := apps[host]; dup {
+			return nil, fmt.Errorf("duplicate OAuth app for host %q", host)
+		}
+
+		secretVar := "GITHUB_CLIENT_SECRET_" + strings.ToUpper(id)
+		clientSecret := secret(secretVar)
+		if clientSecret == "" {
+			return nil, fmt.Errorf("OAuth app for host %q: $%s is not set", host, secretVar)
+		}
+		apps[host] = oauthApp{clientID: id, clientSecret: clientSecret}
+	}
+	return apps, nil
+}
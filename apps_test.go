@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseOAuthApps(t *testing.T) {
+	secrets := map[string]string{"GITHUB_CLIENT_SECRET_IV23STAGING": "staging_secret"}
+	lookup := func(name string) string { return secrets[name] }
+
+	apps, err := parseOAuthApps(" Staging.reviewGOOSE.dev = Iv23staging ", lookup)
+	if err != nil {
+		t.Fatalf("parseOAuthApps() error = %v", err)
+	}
+	want := oauthApp{clientID: "Iv23staging", clientSecret: "staging_secret"}
+	if got := apps["staging.reviewgoose.dev"]; got != want {
+		t.Errorf("app = %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"staging.reviewGOOSE.dev", "=Iv23staging", "a.dev=Iv23missing", "a.dev=Iv23staging,A.dev=Iv23staging"} {
+		if _, err := parseOAuthApps(spec, lookup); err == nil {
+			t.Errorf("parseOAuthApps(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestAppForHost(t *testing.T) {
+	setClientSecret(t, "default_secret")
+	orig := oauthAppsByHost
+	oauthAppsByHost = map[string]oauthApp{"staging.reviewgoose.dev": {clientID: "Iv23staging", clientSecret: "staging_secret"}}
+	t.Cleanup(func() { oauthAppsByHost = orig })
+
+	tests := []struct {
+		host       string
+		wantClient string
+	}{
+		{host: "staging." + baseDomain, wantClient: "Iv23staging"},
+		{host: "STAGING." + baseDomain + ":443", wantClient: "Iv23staging"},
+		{host: "my." + baseDomain, wantClient: *clientID},
+		{host: baseDomain, wantClient: *clientID},
+	}
+	for _, tt := range tests {
+		if got := appForHost(tt.host).clientID; got != tt.wantClient {
+			t.Errorf("appForHost(%q) = %q, want %q", tt.host, got, tt.wantClient)
+		}
+	}
+
+	// Login on the base domain picks the app for the return_to host
+	req := httptest.NewRequest(http.MethodGet,
+		"https://"+baseDomain+"/oauth/login?return_to="+url.QueryEscape("https://staging."+baseDomain+"/"), http.NoBody)
+	rr := httptest.NewRecorder()
+	handleOAuthLogin(rr, req)
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+	if got := location.Query().Get("client_id"); got != "Iv23staging" {
+		t.Errorf("authorize client_id = %q, want Iv23staging", got)
+	}
+}
+
+func TestPrintAuthorizeURLs(t *testing.T) {
+	setString(t, clientID, "Iv23printed")
+	setString(t, redirectURI, "https://auth."+baseDomain+"/oauth/callback")
+	setString(t, oauthScopes, "repo read:org")
+	orig := oauthAppsByHost
+	oauthAppsByHost = map[string]oauthApp{"staging.reviewgoose.dev": {clientID: "Iv23staging"}}
+	t.Cleanup(func() { oauthAppsByHost = orig })
+
+	var out strings.Builder
+	printAuthorizeURLs(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.String())
+	}
+
+	u, err := url.Parse(lines[0])
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", lines[0], err)
+	}
+	q := u.Query()
+	if u.Host != "github.com" || u.Path != "/login/oauth/authorize" {
+		t.Errorf("URL = %s, want the GitHub authorize endpoint", u)
+	}
+	if q.Get("client_id") != "Iv23printed" || q.Get("redirect_uri") != *redirectURI || q.Get("scope") != "repo read:org" || q.Get("state") == "" {
+		t.Errorf("query = %v, want the configured client_id, redirect_uri, and scope with a state", q)
+	}
+
+	if !strings.HasPrefix(lines[1], "staging.reviewgoose.dev: https://github.com/") || !strings.Contains(lines[1], "client_id=Iv23staging") {
+		t.Errorf("per-host line = %q", lines[1])
+	}
+}
@@ -251,13 +251,31 @@ export const Auth = (() => {
     console.log("[Auth] Found auth_code in fragment, exchanging for token...");
 
     try {
-      // Exchange auth code for token
+      // Browsers without Fetch Metadata must echo a CSRF token on the exchange
+      const csrfResponse = await fetch("/oauth/csrf");
+      if (!csrfResponse.ok) {
+        console.error("[Auth] Failed to get CSRF token:", csrfResponse.status);
+        return false;
+      }
+      const { csrf_token: csrfToken } = await csrfResponse.json();
+
+      // Exchange auth code for token. The body's SHA-256 lets the server reject a body
+      // mangled in transit; crypto.subtle is only available in secure contexts.
+      const body = JSON.stringify({ auth_code: authCode });
+      const headers = {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken,
+      };
+      if (window.crypto?.subtle) {
+        const digest = await window.crypto.subtle.digest("SHA-256", new TextEncoder().encode(body));
+        headers["X-Content-SHA256"] = Array.from(new Uint8Array(digest), (b) =>
+          b.toString(16).padStart(2, "0"),
+        ).join("");
+      }
       const response = await fetch("/oauth/exchange", {
         method: "POST",
-        headers: {
-          "Content-Type": "application/json",
-        },
-        body: JSON.stringify({ auth_code: authCode }),
+        headers,
+        body,
       });
 
       if (!response.ok) {
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Audit event types for security-relevant actions.
+const (
+	auditStateInvalid     = "oauth.state_invalid"
+	auditRateLimited      = "rate_limit.exceeded"
+	auditAuthCodeReuse    = "auth_code.reuse"
+	auditLockout          = "login.lockout"
+	auditLockoutRejection = "login.locked_out"
+	auditLoginSuccess     = "login.success"
+	auditWebhookSignature = "webhook.signature_invalid"
+	auditAdminDenied      = "admin.denied"
+	auditTokenRevoked     = "token.revoked"
+)
+
+// Audit outcomes.
+const (
+	auditDenied  = "denied"
+	auditAllowed = "allowed"
+)
+
+// auditLog emits a single-line JSON audit record for a security event, prefixed with [AUDIT]
+// so log pipelines can route it to a SIEM. Every record carries a timestamp and event type;
+// callers supply ip, request_id, and outcome via requestAuditFields plus any event details.
+func auditLog(event string, fields map[string]any) {
+	record := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["event"] = event
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		errorf("[AUDIT] Failed to encode %s event: %v", event, err)
+		return
+	}
+	logAt(levelAudit, "[AUDIT] "+string(line))
+}
+
+// requestAuditFields returns the standard audit fields for a request.
+func requestAuditFields(r *http.Request, outcome string) map[string]any {
+	return map[string]any{
+		"ip":         clientIP(r),
+		"request_id": r.Header.Get("X-Request-ID"),
+		"outcome":    outcome,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog redirects the standard logger into a buffer for the duration of a test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	origOutput, origFlags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(origOutput)
+		log.SetFlags(origFlags)
+	})
+	return &buf
+}
+
+func TestAuditLogAuthCodeReuse(t *testing.T) {
+	resetFailedAttempts(t)
+	const code = "reused_code"
+	authCodesMutex.Lock()
+	authCodes[code] = authCodeData{username: "octocat", expiry: time.Now().Add(time.Minute), used: true}
+	authCodesMutex.Unlock()
+	t.Cleanup(func() {
+		authCodesMutex.Lock()
+		delete(authCodes, code)
+		authCodesMutex.Unlock()
+	})
+
+	logs := captureLog(t)
+	req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", strings.NewReader(`{"auth_code":"`+code+`"}`))
+	req.RemoteAddr = "192.0.2.10:4321"
+	rr := httptest.NewRecorder()
+	securityHeaders(http.HandlerFunc(handleExchangeAuthCode)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rr.Code)
+	}
+
+	var record map[string]any
+	for line := range strings.SplitSeq(logs.String(), "\n") {
+		if payload, ok := strings.CutPrefix(line, "[AUDIT] "); ok {
+			if err := json.Unmarshal([]byte(payload), &record); err != nil {
+				t.Fatalf("audit record is not JSON: %v: %s", err, payload)
+			}
+		}
+	}
+	if record == nil {
+		t.Fatalf("no audit record logged:\n%s", logs)
+	}
+
+	want := map[string]any{
+		"event":      auditAuthCodeReuse,
+		"ip":         "192.0.2.10",
+		"request_id": rr.Header().Get("X-Request-ID"),
+		"outcome":    auditDenied,
+		"username":   "octocat",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s = %v, want %v", k, record[k], v)
+		}
+	}
+	if ts, ok := record["timestamp"].(string); !ok {
+		t.Error("missing timestamp")
+	} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+		t.Errorf("timestamp %q is not RFC 3339: %v", ts, err)
+	}
+}
+
+func TestAuditLogLoginFlowDuration(t *testing.T) {
+	resetAuthCodes(t)
+	resetFailedAttempts(t)
+	setClientSecret(t, "test_secret")
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"access_token":"`+testToken+`","token_type":"bearer","scope":"repo"}`), nil
+	})
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	// The user spent about 30s on GitHub's consent screen
+	state := testOAuthState(t, time.Now().Add(-30*time.Second))
+	req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/oauth/callback?code=abc&state="+url.QueryEscape(state), http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "oauth_state", Value: state})
+	rr := httptest.NewRecorder()
+	handleOAuthCallback(rr, req)
+	_, fragment, _ := strings.Cut(rr.Header().Get("Location"), "#auth_code=")
+	code, err := url.QueryUnescape(fragment)
+	if err != nil || code == "" {
+		t.Fatalf("no auth code in redirect %q", rr.Header().Get("Location"))
+	}
+
+	logs := captureLog(t)
+	if rr := exchangeAuthCode(code); rr.Code != http.StatusOK {
+		t.Fatalf("exchange status = %d, want 200", rr.Code)
+	}
+
+	var record map[string]any
+	for line := range strings.SplitSeq(logs.String(), "\n") {
+		if payload, ok := strings.CutPrefix(line, "[AUDIT] "); ok {
+			if err := json.Unmarshal([]byte(payload), &record); err != nil {
+				t.Fatalf("audit record is not JSON: %v: %s", err, payload)
+			}
+		}
+	}
+	if record["event"] != auditLoginSuccess {
+		t.Fatalf("last audit record = %v, want %s", record, auditLoginSuccess)
+	}
+	// The state timestamp is second-accurate, so allow a second either way
+	total, _ := record["flow_duration_ms"].(float64)
+	github, _ := record["github_ms"].(float64)
+	handoff, hasHandoff := record["handoff_ms"].(float64)
+	if total < 29000 || total > 32000 {
+		t.Errorf("flow_duration_ms = %v, want about 30000", record["flow_duration_ms"])
+	}
+	if github < 29000 || github > total {
+		t.Errorf("github_ms = %v, want about 30000 and at most the total", record["github_ms"])
+	}
+	if !hasHandoff || handoff < 0 || handoff > 1000 {
+		t.Errorf("handoff_ms = %v, want under a second", record["handoff_ms"])
+	}
+}
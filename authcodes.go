@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// authCodeChurn counts how auth codes left the store during one cleanup window.
+// A high expired count relative to used suggests --auth-code-ttl is too short.
+type authCodeChurn struct {
+	Used              int `json:"used"`                // exchanged successfully
+	Expired           int `json:"expired"`             // swept by cleanup without being exchanged
+	ExpiredAtExchange int `json:"expired_at_exchange"` // exchange attempted after expiry
+	Evicted           int `json:"evicted"`             // dropped unexchanged because the store was full
+	Reused            int `json:"reused"`              // exchange attempted with an already exchanged code
+}
+
+// authCodeStats is the /debug/authcodes report.
+type authCodeStats struct {
+	Live          int           `json:"live"`
+	ReusedTotal   int64         `json:"reused_total"`
+	OldestAge     string        `json:"oldest_age,omitempty"`
+	TTL           string        `json:"ttl"`
+	Window        string        `json:"window"`
+	LastWindow    authCodeChurn `json:"last_window"`
+	CurrentWindow authCodeChurn `json:"current_window"`
+}
+
+const (
+	authCodeCleanupInterval = time.Minute
+
+	defaultReuseAlertThreshold = 5
+	defaultReuseAlertWindow    = 5 * time.Minute
+)
+
+// maxAuthCodes caps the store so a burst of logins between cleanups can't exhaust memory.
+// It is a variable so tests can lower it.
+var maxAuthCodes = 10000
+
+// Churn counters, guarded by authCodesMutex and rolled over on each cleanup.
+var (
+	authCodeCurrent authCodeChurn
+	authCodeLast    authCodeChurn
+)
+
+// authCodeOrder queues stored codes in insertion order, which is expiry order as the
+// TTL is fixed, so a full store evicts from the front instead of scanning for the
+// oldest. Guarded by authCodesMutex.
+var authCodeOrder []string
+
+// authCodeFullLog throttles the store-full warning, which a flood would otherwise log
+// on every login.
+var authCodeFullLog = &logThrottle{interval: time.Minute}
+
+// authCodeReuses counts reuse attempts since startup. Reuse means a leaked code or a
+// client bug, so unlike the windowed churn it is never reset.
+var authCodeReuses atomic.Int64
+
+// spentAuthCode is what remains of an exchanged code until it would have expired: enough
+// to recognize a reuse attempt, with the sealed tokens dropped.
+func spentAuthCode(data authCodeData) authCodeData {
+	return authCodeData{issued: data.issued, expiry: data.expiry, username: data.username, used: true}
+}
+
+// cleanupAuthCodes drops expired codes and starts a new churn window.
+func cleanupAuthCodes(now time.Time) {
+	authCodesMutex.Lock()
+	defer authCodesMutex.Unlock()
+	for code, data := range authCodes {
+		if now.After(data.expiry) {
+			delete(authCodes, code)
+			if !data.used && !data.expiredAtExchange {
+				authCodeCurrent.Expired++
+			}
+		}
+	}
+	// Everything queued ahead of a stored code expires before it, so was just deleted
+	for len(authCodeOrder) > 0 {
+		if _, ok := authCodes[authCodeOrder[0]]; ok {
+			break
+		}
+		authCodeOrder = authCodeOrder[1:]
+	}
+	authCodeLast = authCodeCurrent
+	authCodeCurrent = authCodeChurn{}
+}
+
+// storeAuthCode adds a code, first evicting the oldest codes if the store is full.
+// Legitimate codes are exchanged within seconds, so reaching the cap means either a
+// login surge far beyond normal or someone minting codes without exchanging them.
+func storeAuthCode(code string, data authCodeData) {
+	authCodesMutex.Lock()
+	defer authCodesMutex.Unlock()
+	for len(authCodes) >= maxAuthCodes && len(authCodeOrder) > 0 {
+		oldestCode := authCodeOrder[0]
+		authCodeOrder = authCodeOrder[1:]
+		evicted, ok := authCodes[oldestCode]
+		if !ok {
+			continue
+		}
+		delete(authCodes, oldestCode)
+		switch {
+		case evicted.used, evicted.expiredAtExchange:
+		case data.issued.After(evicted.expiry):
+			authCodeCurrent.Expired++ // not yet swept by cleanup
+		default:
+			authCodeCurrent.Evicted++
+			if ok, dropped := authCodeFullLog.allow(data.issued); ok {
+				warnf("[SECURITY] Auth code store full (%d entries), evicted code issued %v ago (%d more since the last warning)",
+					maxAuthCodes, data.issued.Sub(evicted.issued).Round(time.Millisecond), dropped)
+			}
+		}
+	}
+	authCodes[code] = data
+	authCodeOrder = append(authCodeOrder, code)
+}
+
+// snapshotAuthCodes reports the store's outstanding codes and churn. Expired codes awaiting
+// cleanup aren't outstanding; they're counted once, when cleanup sweeps them. The lock is only
+// held for a single pass over the map, which is bounded by the auth code TTL.
+func snapshotAuthCodes(now time.Time) authCodeStats {
+	authCodesMutex.Lock()
+	stats := authCodeStats{
+		ReusedTotal:   authCodeReuses.Load(),
+		LastWindow:    authCodeLast,
+		CurrentWindow: authCodeCurrent,
+	}
+	var oldest time.Time
+	for _, data := range authCodes {
+		if data.used || now.After(data.expiry) {
+			continue
+		}
+		stats.Live++
+		if oldest.IsZero() || data.issued.Before(oldest) {
+			oldest = data.issued
+		}
+	}
+	authCodesMutex.Unlock()
+
+	stats.TTL = authCodeTTL.String()
+	stats.Window = authCodeCleanupInterval.String()
+	if !oldest.IsZero() {
+		stats.OldestAge = now.Sub(oldest).Round(time.Millisecond).String()
+	}
+	return stats
+}
+
+// handleAuthCodeStats serves auth code metrics on the loopback debug listener.
+func handleAuthCodeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(snapshotAuthCodes(time.Now())); err != nil {
+		errorf("Failed to encode auth code stats: %v", err)
+	}
+}
+
+// reuseAlert fires when more than threshold auth code reuse attempts land within window,
+// then stays quiet for a window so an attack yields one alert rather than thousands.
+type reuseAlert struct {
+	fire      func(attempts int)
+	attempts  []time.Time
+	lastFired time.Time
+	window    time.Duration
+	threshold int
+	mu        sync.Mutex
+}
+
+// authCodeReuseAlert is set up by newServer; nil disables alerting.
+var authCodeReuseAlert *reuseAlert
+
+// record notes one reuse attempt and fires the alert if the threshold is crossed.
+func (a *reuseAlert) record(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	cutoff := now.Add(-a.window)
+	kept := a.attempts[:0]
+	for _, t := range a.attempts {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	a.attempts = append(kept, now)
+	count := len(a.attempts)
+	fire := count > a.threshold && now.Sub(a.lastFired) >= a.window
+	if fire {
+		a.lastFired = now
+	}
+	a.mu.Unlock()
+
+	if fire {
+		a.fire(count)
+	}
+}
+
+// reuseAlertHook posts the alert to url, if set, alongside the [SECURITY] log line.
+func reuseAlertHook(url string, window time.Duration) func(attempts int) {
+	return func(attempts int) {
+		errorf("[SECURITY] ALERT: %d auth code reuse attempts in the last %v", attempts, window)
+		if url == "" {
+			return
+		}
+		body, err := json.Marshal(map[string]any{
+			"event":     auditAuthCodeReuse,
+			"attempts":  attempts,
+			"window":    window.String(),
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			errorf("Failed to encode auth code reuse alert: %v", err)
+			return
+		}
+		// Don't hold up the request that crossed the threshold
+		go postAlert(url, body)
+	}
+}
+
+// postAlert delivers one alert payload to an operator webhook.
+func postAlert(url string, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		errorf("Failed to build alert request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		errorf("Failed to send alert: %v", err)
+		return
+	}
+	if err := resp.Body.Close(); err != nil {
+		debugf(ctx, "Failed to close alert response body: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		errorf("Alert webhook answered %d", resp.StatusCode)
+	}
+}
+
+// alertClient posts operator alerts. It is a variable so tests can stub it.
+var alertClient = &http.Client{Timeout: httpTimeout}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetAuthCodes gives the test an empty auth code store, restoring the original afterwards.
+func resetAuthCodes(t *testing.T) {
+	t.Helper()
+	authCodesMutex.Lock()
+	origCodes, origOrder, origCurrent, origLast := authCodes, authCodeOrder, authCodeCurrent, authCodeLast
+	authCodes, authCodeOrder, authCodeCurrent, authCodeLast = make(map[string]authCodeData), nil, authCodeChurn{}, authCodeChurn{}
+	authCodesMutex.Unlock()
+	t.Cleanup(func() {
+		authCodesMutex.Lock()
+		authCodes, authCodeOrder, authCodeCurrent, authCodeLast = origCodes, origOrder, origCurrent, origLast
+		authCodesMutex.Unlock()
+	})
+}
+
+func TestAuthCodeStats(t *testing.T) {
+	resetAuthCodes(t)
+
+	now := time.Now()
+	authCodesMutex.Lock()
+	authCodes["live1"] = authCodeData{issued: now.Add(-5 * time.Second), expiry: now.Add(25 * time.Second)}
+	authCodes["live2"] = authCodeData{issued: now.Add(-2 * time.Second), expiry: now.Add(28 * time.Second)}
+	authCodes["stale1"] = authCodeData{issued: now.Add(-40 * time.Second), expiry: now.Add(-10 * time.Second)}
+	authCodes["stale2"] = authCodeData{issued: now.Add(-35 * time.Second), expiry: now.Add(-5 * time.Second)}
+	authCodes["late"] = authCodeData{issued: now.Add(-31 * time.Second), expiry: now.Add(-time.Second)}
+	authCodesMutex.Unlock()
+
+	// An exchange after expiry is counted as such, once however often it's retried, and
+	// leaves the code for cleanup
+	for range 2 {
+		if rr := exchangeAuthCode("late"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expired exchange status = %d, want 401", rr.Code)
+		}
+	}
+
+	// Expired codes awaiting cleanup aren't outstanding
+	stats := snapshotAuthCodes(now)
+	if stats.Live != 2 {
+		t.Errorf("Live = %d, want 2", stats.Live)
+	}
+	if stats.OldestAge != "5s" {
+		t.Errorf("OldestAge = %q, want 5s", stats.OldestAge)
+	}
+	if want := (authCodeChurn{ExpiredAtExchange: 1}); stats.CurrentWindow != want {
+		t.Errorf("CurrentWindow = %+v, want %+v", stats.CurrentWindow, want)
+	}
+
+	cleanupAuthCodes(now)
+
+	rr := httptest.NewRecorder()
+	handleAuthCodeStats(rr, httptest.NewRequest(http.MethodGet, "/debug/authcodes", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	var got authCodeStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if got.Live != 2 {
+		t.Errorf("Live after cleanup = %d, want 2", got.Live)
+	}
+	// The code already counted at exchange isn't counted again as it's swept
+	if want := (authCodeChurn{Expired: 2, ExpiredAtExchange: 1}); got.LastWindow != want {
+		t.Errorf("LastWindow = %+v, want %+v", got.LastWindow, want)
+	}
+	if got.CurrentWindow != (authCodeChurn{}) {
+		t.Errorf("CurrentWindow = %+v, want empty after rollover", got.CurrentWindow)
+	}
+}
+
+func TestAuthCodeStoreCap(t *testing.T) {
+	resetAuthCodes(t)
+	orig, origLog := maxAuthCodes, authCodeFullLog
+	maxAuthCodes, authCodeFullLog = 3, &logThrottle{interval: time.Minute}
+	t.Cleanup(func() { maxAuthCodes, authCodeFullLog = orig, origLog })
+	logs := captureLog(t)
+
+	now := time.Now()
+	for i, code := range []string{"a", "b", "c", "d", "e"} {
+		issued := now.Add(time.Duration(i) * time.Second)
+		storeAuthCode(code, authCodeData{issued: issued, expiry: issued.Add(30 * time.Second)})
+	}
+	// Evictions within a minute of the warning aren't logged again
+	if n := strings.Count(logs.String(), "[SECURITY] Auth code store full"); n != 1 {
+		t.Errorf("store full warnings = %d, want 1: %q", n, logs.String())
+	}
+
+	authCodesMutex.Lock()
+	defer authCodesMutex.Unlock()
+	if len(authCodes) != 3 {
+		t.Errorf("store holds %d codes, want 3", len(authCodes))
+	}
+	for _, code := range []string{"a", "b"} {
+		if _, ok := authCodes[code]; ok {
+			t.Errorf("oldest code %q survived eviction", code)
+		}
+	}
+	for _, code := range []string{"c", "d", "e"} {
+		if _, ok := authCodes[code]; !ok {
+			t.Errorf("newer code %q was evicted", code)
+		}
+	}
+	if authCodeCurrent.Evicted != 2 {
+		t.Errorf("Evicted = %d, want 2", authCodeCurrent.Evicted)
+	}
+}
+
+func TestAuthCodeStoreCapDropsExpiredFirst(t *testing.T) {
+	resetAuthCodes(t)
+	orig := maxAuthCodes
+	maxAuthCodes = 2
+	t.Cleanup(func() { maxAuthCodes = orig })
+
+	now := time.Now()
+	storeAuthCode("stale", authCodeData{issued: now.Add(-time.Minute), expiry: now.Add(-30 * time.Second)})
+	storeAuthCode("live", authCodeData{issued: now, expiry: now.Add(30 * time.Second)})
+	storeAuthCode("new", authCodeData{issued: now, expiry: now.Add(30 * time.Second)})
+
+	authCodesMutex.Lock()
+	defer authCodesMutex.Unlock()
+	if _, ok := authCodes["live"]; !ok {
+		t.Error("live code was evicted while an expired one could be dropped")
+	}
+	if want := (authCodeChurn{Expired: 1}); authCodeCurrent != want {
+		t.Errorf("churn = %+v, want %+v", authCodeCurrent, want)
+	}
+}
+
+func TestAuthCodeReuse(t *testing.T) {
+	resetAuthCodes(t)
+	resetFailedAttempts(t)
+	orig := authCodeReuseAlert
+	var fired []int
+	authCodeReuseAlert = &reuseAlert{threshold: 3, window: time.Minute, fire: func(n int) { fired = append(fired, n) }}
+	t.Cleanup(func() { authCodeReuseAlert = orig })
+	before := authCodeReuses.Load()
+
+	code := completeOAuthCallback(t)
+	if rr := exchangeAuthCode(code); rr.Code != http.StatusOK {
+		t.Fatalf("first exchange status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	if stats := snapshotAuthCodes(time.Now()); stats.Live != 0 {
+		t.Errorf("Live after exchange = %d, want 0", stats.Live)
+	}
+
+	for i := range 5 {
+		rr := exchangeAuthCode(code)
+		var body apiError
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusUnauthorized || body.Error != errCodeAuthCodeUsed {
+			t.Fatalf("reuse %d: status = %d, body = %s", i+1, rr.Code, rr.Body)
+		}
+	}
+
+	if got := authCodeReuses.Load() - before; got != 5 {
+		t.Errorf("reuse counter grew by %d, want 5", got)
+	}
+	stats := snapshotAuthCodes(time.Now())
+	if stats.CurrentWindow.Reused != 5 || stats.CurrentWindow.Used != 1 {
+		t.Errorf("CurrentWindow = %+v, want 1 used and 5 reused", stats.CurrentWindow)
+	}
+	// Fires once past the threshold, then stays quiet for the window
+	if len(fired) != 1 || fired[0] != 4 {
+		t.Errorf("alert fired with %v, want [4]", fired)
+	}
+
+	// The spent code is swept at expiry without counting as an unexchanged expiry
+	cleanupAuthCodes(time.Now().Add(time.Hour))
+	if authCodeLast.Expired != 0 {
+		t.Errorf("Expired = %d, want 0 for a spent code", authCodeLast.Expired)
+	}
+}
+
+func TestReuseAlertWindow(t *testing.T) {
+	var fired []int
+	a := &reuseAlert{threshold: 2, window: time.Minute, fire: func(n int) { fired = append(fired, n) }}
+	start := time.Now()
+	for _, offset := range []time.Duration{0, 10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		a.record(start.Add(offset))
+	}
+	// Old attempts age out, so a slow trickle doesn't refire
+	a.record(start.Add(85 * time.Second))
+	a.record(start.Add(3 * time.Minute))
+	if len(fired) != 1 || fired[0] != 3 {
+		t.Errorf("alert fired with %v, want [3]", fired)
+	}
+
+	// Webhook alerts post JSON to the configured URL
+	posted := make(chan string, 1)
+	stubClient(t, &alertClient, func(r *http.Request) (*http.Response, error) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid alert body: %v", err)
+		}
+		posted <- r.URL.String() + " " + body["event"].(string)
+		return stubResponse(http.StatusNoContent, ""), nil
+	})
+	reuseAlertHook("https://alerts.example.com/hook", time.Minute)(7)
+	select {
+	case got := <-posted:
+		if want := "https://alerts.example.com/hook " + auditAuthCodeReuse; got != want {
+			t.Errorf("posted %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert webhook was not called")
+	}
+}
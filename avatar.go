@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultAvatarCacheTTL = time.Hour
+
+	// maxAvatarSize caps a proxied avatar; GitHub's are 460px and well under this.
+	maxAvatarSize = 256 << 10
+
+	// maxCachedAvatars bounds the cache at maxAvatarSize*maxCachedAvatars bytes.
+	maxCachedAvatars = 512
+
+	// avatarsPerMinute caps /avatar requests per IP. A dashboard shows a few dozen
+	// users, and cached avatars are then served by the browser.
+	avatarsPerMinute = 120
+
+	// avatarMaxRedirects covers github.com/<login>.png redirecting to the avatar CDN.
+	avatarMaxRedirects = 3
+)
+
+// avatarBaseURL serves <login>.png, redirecting to avatars.githubusercontent.com.
+const avatarBaseURL = "https://github.com/"
+
+// avatarHosts are the only hosts an avatar fetch may be redirected to.
+var avatarHosts = map[string]bool{
+	"github.com":                    true,
+	"avatars.githubusercontent.com": true,
+}
+
+// newAvatarClient returns a GitHub client for avatar fetches that follows up to
+// avatarMaxRedirects redirects, whatever --github-max-redirects says, since every avatar
+// is one. On top of newGitHubClient's checks, it refuses redirects off avatarHosts.
+func newAvatarClient() *http.Client {
+	client := newGitHubClient(avatarMaxRedirects)
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !avatarHosts[req.URL.Hostname()] {
+			return fmt.Errorf("refusing avatar redirect to %s", req.URL.Redacted())
+		}
+		return checkRedirect(req, via)
+	}
+	return client
+}
+
+// avatarTypes are the image types accepted from GitHub. Anything else, including a body
+// that doesn't sniff as its declared type, is refused so /avatar can't serve HTML same-origin.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var (
+	errAvatarNotFound = errors.New("avatar not found")
+	errAvatarTooLarge = errors.New("avatar too large")
+)
+
+// avatars caches proxied avatars; nil unless --avatar-proxy is set.
+var avatars *avatarCache
+
+// avatarRateLimiter limits /avatar per IP, since each miss costs a GitHub fetch; nil
+// unless --avatar-proxy is set.
+var avatarRateLimiter *rateLimiter
+
+// avatarCache caches avatar images by lowercased login, since handles are case-insensitive.
+type avatarCache struct {
+	entries map[string]avatarEntry
+	ttl     time.Duration
+	mu      sync.Mutex
+
+	// fetches coalesces concurrent misses for the same login into one GitHub fetch.
+	fetches singleflight.Group
+}
+
+type avatarEntry struct {
+	expiry      time.Time
+	contentType string
+	body        []byte
+}
+
+func newAvatarCache(ttl time.Duration) *avatarCache {
+	return &avatarCache{entries: make(map[string]avatarEntry), ttl: ttl}
+}
+
+// get returns the avatar for login, fetching from GitHub on a miss. Concurrent misses for
+// one login share a fetch, which runs detached from any one caller's cancellation so a
+// client going away doesn't fail the others. A zero TTL disables caching.
+func (c *avatarCache) get(ctx context.Context, login string) (avatarEntry, error) {
+	key := strings.ToLower(login)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry, nil
+	}
+
+	v, err, _ := c.fetches.Do(key, func() (any, error) {
+		entry, err := fetchAvatar(context.WithoutCancel(ctx), login)
+		if err != nil || c.ttl <= 0 {
+			return entry, err
+		}
+		c.store(key, entry, time.Now())
+		return entry, nil
+	})
+	entry, _ = v.(avatarEntry)
+	return entry, err
+}
+
+// store caches entry under key until now+ttl. When the cache is full it drops expired
+// entries and then, if none had expired, the one closest to expiring, which is the oldest.
+func (c *avatarCache) store(key string, entry avatarEntry, now time.Time) {
+	entry.expiry = now.Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedAvatars && c.dropExpired(now) == 0 {
+		oldest := ""
+		for k, e := range c.entries {
+			if oldest == "" || e.expiry.Before(c.entries[oldest].expiry) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = entry
+}
+
+// dropExpired removes expired entries. The caller must hold c.mu.
+func (c *avatarCache) dropExpired(now time.Time) int {
+	removed := 0
+	for key, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// cleanup removes expired entries.
+func (c *avatarCache) cleanup(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if removed := c.dropExpired(now); removed > 0 {
+		debugf(context.Background(), "[cache] Removed %d expired avatars (%d remaining)", removed, len(c.entries))
+	}
+}
+
+// fetchAvatar downloads login's avatar, refusing bodies over maxAvatarSize and anything
+// that isn't one of avatarTypes. Avatars are cosmetic, so there are no retries, but
+// each fetch takes a githubCalls slot like any other outbound GitHub call.
+func fetchAvatar(ctx context.Context, login string) (avatarEntry, error) {
+	ctx, sp := startSpan(ctx, "github.avatar", spanKindClient)
+	sp.setAttr("server.address", "github.com")
+	defer sp.finish()
+
+	reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, avatarBaseURL+login+".png", http.NoBody)
+	if err != nil {
+		sp.setError(err)
+		return avatarEntry{}, err
+	}
+	injectTraceparent(ctx, req)
+	release, err := githubCalls.acquire(ctx)
+	if err != nil {
+		sp.setError(err)
+		return avatarEntry{}, err
+	}
+	defer release()
+	resp, err := avatarClient.Do(req)
+	if err != nil {
+		sp.setError(err)
+		return avatarEntry{}, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logf(ctx, "Failed to close response body: %v", err)
+		}
+	}()
+	sp.setAttr("http.response.status_code", resp.StatusCode)
+
+	entry, err := readAvatar(resp)
+	sp.setError(err)
+	return entry, err
+}
+
+// readAvatar validates an avatar response's status, size, and content type.
+func readAvatar(resp *http.Response) (avatarEntry, error) {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return avatarEntry{}, errAvatarNotFound
+	case resp.StatusCode != http.StatusOK:
+		return avatarEntry{}, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	case resp.ContentLength > maxAvatarSize:
+		return avatarEntry{}, fmt.Errorf("%w: %d bytes", errAvatarTooLarge, resp.ContentLength)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarSize+1))
+	if err != nil {
+		return avatarEntry{}, err
+	}
+	if len(body) > maxAvatarSize {
+		return avatarEntry{}, fmt.Errorf("%w: over %d bytes", errAvatarTooLarge, maxAvatarSize)
+	}
+
+	declared, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !avatarTypes[declared] {
+		return avatarEntry{}, fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if sniffed := http.DetectContentType(body); sniffed != declared {
+		return avatarEntry{}, fmt.Errorf("content type %s does not match body (%s)", declared, sniffed)
+	}
+	return avatarEntry{contentType: declared, body: body}, nil
+}
+
+// handleAvatar serves a GitHub user's avatar same-origin, for networks that block
+// avatars.githubusercontent.com.
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	login := r.URL.Query().Get("login")
+	if !isValidGitHubHandle(login) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid login")
+		return
+	}
+
+	entry, err := avatars.get(r.Context(), login)
+	if errors.Is(err, errAvatarNotFound) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Avatar not found")
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Failed to fetch avatar for %s: %v", login, err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to fetch avatar")
+		return
+	}
+
+	w.Header().Set("Content-Type", entry.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	if avatars.ttl > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(avatars.ttl.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if _, err := w.Write(entry.body); err != nil {
+		debugf(r.Context(), "Failed to write avatar: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pngHeader is enough of a PNG for http.DetectContentType to recognize it.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// stubAvatar serves body as contentType for every avatar fetch and counts the fetches.
+func stubAvatar(t *testing.T, contentType string, body []byte) *atomic.Int32 {
+	t.Helper()
+	var fetches atomic.Int32
+	stubClient(t, &avatarClient, func(r *http.Request) (*http.Response, error) {
+		fetches.Add(1)
+		if r.URL.String() != "https://github.com/octocat.png" {
+			t.Errorf("fetched %s, want https://github.com/octocat.png", r.URL)
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": []string{contentType}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: -1,
+		}, nil
+	})
+	return &fetches
+}
+
+func getAvatar(handler http.Handler, login string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/avatar?login="+login, http.NoBody))
+	return rr
+}
+
+func TestAvatarProxy(t *testing.T) {
+	handler := newTestServer(t, Config{AvatarProxy: true, AvatarCacheTTL: time.Hour})
+	img := append(append([]byte{}, pngHeader...), make([]byte, 1024)...)
+	fetches := stubAvatar(t, "image/png", img)
+
+	rr := getAvatar(handler, "octocat")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", ct)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "public, max-age=3600" {
+		t.Errorf("Cache-Control = %q, want public, max-age=3600", cc)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), img) {
+		t.Error("body differs from the upstream avatar")
+	}
+
+	// Handles are case-insensitive, so a differently cased login hits the cache
+	if rr := getAvatar(handler, "OctoCat"); rr.Code != http.StatusOK || fetches.Load() != 1 {
+		t.Errorf("cached fetch: status = %d, upstream fetches = %d, want 200 and 1", rr.Code, fetches.Load())
+	}
+
+	if rr := getAvatar(handler, "-bad-"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid login status = %d, want 400", rr.Code)
+	}
+}
+
+func TestAvatarProxyRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{name: "oversized", contentType: "image/png", body: append(append([]byte{}, pngHeader...), make([]byte, maxAvatarSize)...)},
+		{name: "not an image", contentType: "text/html", body: []byte("<html><script>alert(1)</script></html>")},
+		{name: "mislabeled", contentType: "image/png", body: []byte("<html><script>alert(1)</script></html>")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestServer(t, Config{AvatarProxy: true, AvatarCacheTTL: time.Hour})
+			stubAvatar(t, tt.contentType, tt.body)
+
+			rr := getAvatar(handler, "octocat")
+			if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), errCodeUpstreamError) {
+				t.Errorf("status = %d, body = %s, want 502 %s", rr.Code, rr.Body, errCodeUpstreamError)
+			}
+			if len(avatars.entries) != 0 {
+				t.Error("rejected avatar was cached")
+			}
+		})
+	}
+}
+
+func TestAvatarProxyDisabled(t *testing.T) {
+	handler := newTestServer(t, Config{})
+	stubAvatar(t, "image/png", pngHeader)
+	if rr := getAvatar(handler, "octocat"); rr.Header().Get("Content-Type") == "image/png" {
+		t.Error("/avatar served an avatar without --avatar-proxy")
+	}
+}
+
+func TestAvatarProxyCoalescesFetches(t *testing.T) {
+	handler := newTestServer(t, Config{AvatarProxy: true, AvatarCacheTTL: time.Hour})
+	var fetches atomic.Int32
+	fetching, release := make(chan struct{}), make(chan struct{})
+	stubClient(t, &avatarClient, func(_ *http.Request) (*http.Response, error) {
+		if fetches.Add(1) == 1 {
+			close(fetching)
+		}
+		<-release
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"image/png"}},
+			Body:       io.NopCloser(bytes.NewReader(pngHeader)),
+		}, nil
+	})
+
+	var wg sync.WaitGroup
+	request := func(i int) {
+		req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/avatar?login=octocat", http.NoBody)
+		req.RemoteAddr = "192.0.2." + strconv.Itoa(i+1) + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", rr.Code)
+		}
+	}
+	// The first request's fetch is held open while the rest miss the cache
+	wg.Go(func() { request(0) })
+	<-fetching
+	for i := 1; i < 5; i++ {
+		wg.Go(func() { request(i) })
+	}
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("upstream fetches = %d, want 1 for concurrent requests", got)
+	}
+}
+
+func TestAvatarCacheEvictsOldest(t *testing.T) {
+	cache := newAvatarCache(time.Hour)
+	now := time.Now()
+	for i := range maxCachedAvatars {
+		cache.store("user"+strconv.Itoa(i), avatarEntry{}, now.Add(time.Duration(i)*time.Second))
+	}
+	cache.store("newcomer", avatarEntry{}, now.Add(time.Hour))
+
+	if len(cache.entries) != maxCachedAvatars {
+		t.Errorf("entries = %d, want %d", len(cache.entries), maxCachedAvatars)
+	}
+	if _, ok := cache.entries["user0"]; ok {
+		t.Error("oldest entry survived a full cache")
+	}
+	if _, ok := cache.entries["newcomer"]; !ok {
+		t.Error("new entry wasn't cached when the cache was full")
+	}
+}
+
+func TestAvatarClientRedirects(t *testing.T) {
+	client := newAvatarClient()
+	via := []*http.Request{{URL: &url.URL{Scheme: "https", Host: "github.com", Path: "/octocat.png"}}}
+	for target, wantOK := range map[string]bool{
+		"https://avatars.githubusercontent.com/u/1?v=4": true,
+		"https://github.com/octocat.png":                true,
+		"https://evil.example.com/payload.png":          false,
+		"http://avatars.githubusercontent.com/u/1":      false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, http.NoBody)
+		if err := client.CheckRedirect(req, via); (err == nil) != wantOK {
+			t.Errorf("redirect to %s: error = %v, want allowed %v", target, err, wantOK)
+		}
+	}
+
+	// API calls refuse redirects by default, but avatars are always one
+	req := httptest.NewRequest(http.MethodGet, "https://avatars.githubusercontent.com/u/1?v=4", http.NoBody)
+	if err := newGitHubClient(defaultMaxRedirects).CheckRedirect(req, via); err == nil {
+		t.Error("API client followed a redirect by default")
+	}
+}
+
+func TestAvatarProxyRateLimited(t *testing.T) {
+	resetFailedAttempts(t)
+	handler := newTestServer(t, Config{AvatarProxy: true, AvatarCacheTTL: time.Hour})
+	stubAvatar(t, "image/png", pngHeader)
+
+	for range avatarsPerMinute {
+		if rr := getAvatar(handler, "octocat"); rr.Code != http.StatusOK {
+			t.Fatalf("status = %d within the limit, want 200", rr.Code)
+		}
+	}
+	if rr := getAvatar(handler, "octocat"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d over the limit, want 429", rr.Code)
+	}
+}
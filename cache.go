@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// userCache caches GitHub user lookups to reduce API calls and latency.
+// Entries are keyed by a SHA-256 hash of the token so raw tokens are never stored as keys.
+// Concurrent misses for the same token share one GitHub call.
+type userCache struct {
+	entries map[string]userCacheEntry
+	lookups singleflight.Group // keyed by token hash
+	ttl     time.Duration
+	mu      sync.Mutex
+}
+
+type userCacheEntry struct {
+	expiry time.Time
+	user   *githubUser
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		entries: make(map[string]userCacheEntry),
+		ttl:     ttl,
+	}
+}
+
+// tokenHash returns a hex-encoded SHA-256 hash of a token, safe to use as a map key or in logs.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the cached user for a token, fetching from GitHub on a miss.
+// A zero TTL disables caching but still coalesces concurrent lookups.
+func (c *userCache) lookup(ctx context.Context, token string) (*githubUser, error) {
+	key := tokenHash(token)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiry) {
+		return entry.user, nil
+	}
+
+	// Fetch outside the lock so a slow GitHub call never blocks other lookups. Other
+	// requests may be waiting on this call, so one caller going away mustn't cancel it;
+	// the API client's timeout still bounds it, and a panic reaches every waiter.
+	v, err, _ := c.lookups.Do(key, func() (any, error) {
+		user, err := userInfo(context.WithoutCancel(ctx), token)
+		if err == nil && c.ttl > 0 {
+			c.mu.Lock()
+			c.entries[key] = userCacheEntry{user: user, expiry: now.Add(c.ttl)}
+			c.mu.Unlock()
+		}
+		return user, err
+	})
+	user, _ := v.(*githubUser)
+	return user, err
+}
+
+// cleanup removes expired entries.
+func (c *userCache) cleanup(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("[cache] Removed %d expired user info entries (%d remaining)", removed, len(c.entries))
+	}
+}
+
+// invalidTokenCache briefly remembers tokens GitHub reported as invalid,
+// so repeatedly validating a bad token doesn't cost an upstream call each time.
+// It holds at most maxInvalidTokens, dropping the oldest first.
+type invalidTokenCache struct {
+	entries map[string]time.Time // token hash -> expiry
+	order   []invalidToken       // insertion order, which is expiry order as the TTL is fixed
+	ttl     time.Duration
+	mu      sync.Mutex
+}
+
+// invalidToken is one queued insertion. A token re-added after expiring is queued again,
+// so an entry only removes its hash while the expiry still matches.
+type invalidToken struct {
+	hash   string
+	expiry time.Time
+}
+
+func newInvalidTokenCache(ttl time.Duration) *invalidTokenCache {
+	return &invalidTokenCache{
+		entries: make(map[string]time.Time),
+		ttl:     ttl,
+	}
+}
+
+func (c *invalidTokenCache) contains(token string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.entries[tokenHash(token)]
+	return ok && now.Before(expiry)
+}
+
+func (c *invalidTokenCache) add(token string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.entries) >= maxInvalidTokens && len(c.order) > 0 {
+		c.dropOldest()
+	}
+	hash, expiry := tokenHash(token), now.Add(c.ttl)
+	c.entries[hash] = expiry
+	c.order = append(c.order, invalidToken{hash: hash, expiry: expiry})
+}
+
+// dropOldest dequeues the oldest insertion. The caller must hold c.mu.
+func (c *invalidTokenCache) dropOldest() {
+	oldest := c.order[0]
+	c.order = c.order[1:]
+	if c.entries[oldest.hash].Equal(oldest.expiry) {
+		delete(c.entries, oldest.hash)
+	}
+}
+
+// cleanup removes expired entries.
+func (c *invalidTokenCache) cleanup(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) > 0 && now.After(c.order[0].expiry) {
+		c.dropOldest()
+	}
+}
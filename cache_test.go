@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// TestUserCacheHit verifies that a second lookup within the TTL is served from cache.
+func TestUserCacheHit(t *testing.T) {
+	var calls atomic.Int32
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return stubResponse(http.StatusOK, `{"login":"octocat","name":"The Octocat","id":1}`), nil
+	})
+
+	cache := newUserCache(time.Minute)
+	ctx := context.Background()
+
+	for range 2 {
+		user, err := cache.lookup(ctx, "gho_testtoken")
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		if user.Login != "octocat" {
+			t.Errorf("Login = %q, want %q", user.Login, "octocat")
+		}
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("GitHub called %d times, want 1", got)
+	}
+
+	// Expired entries are removed by cleanup and refetched
+	cache.cleanup(time.Now().Add(2 * time.Minute))
+	if _, err := cache.lookup(ctx, "gho_testtoken"); err != nil {
+		t.Fatalf("lookup after cleanup failed: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("GitHub called %d times after cleanup, want 2", got)
+	}
+}
+
+// TestUserCacheCoalescesLookups verifies concurrent lookups for one token share a single GitHub call.
+func TestUserCacheCoalescesLookups(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const lookups = 10
+		var calls atomic.Int32
+		release := make(chan struct{})
+		stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			<-release
+			return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+		})
+
+		// With caching disabled, only coalescing can keep this to one call
+		cache := newUserCache(0)
+		var done sync.WaitGroup
+		errs := make(chan error, lookups)
+		for range lookups {
+			done.Go(func() {
+				user, err := cache.lookup(context.Background(), "gho_testtoken")
+				if err == nil && user.Login != "octocat" {
+					err = fmt.Errorf("Login = %q, want octocat", user.Login)
+				}
+				errs <- err
+			})
+		}
+		synctest.Wait() // every lookup is now in GitHub's stub or waiting on it
+		close(release)
+		done.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("lookup: %v", err)
+			}
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("GitHub called %d times for %d concurrent lookups, want 1", got, lookups)
+		}
+
+		// Once the call finishes a later lookup fetches again
+		if _, err := cache.lookup(context.Background(), "gho_testtoken"); err != nil || calls.Load() != 2 {
+			t.Errorf("later lookup: err %v, %d calls; want a fresh call", err, calls.Load())
+		}
+	})
+}
+
+// TestUserCachePanicReleasesWaiters verifies a lookup that panics doesn't strand the
+// lookups waiting on it.
+func TestUserCachePanicReleasesWaiters(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		release := make(chan struct{})
+		stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+			<-release
+			panic("boom")
+		})
+
+		cache := newUserCache(time.Minute)
+		var done sync.WaitGroup
+		var panicked atomic.Int32
+		for range 3 {
+			done.Go(func() {
+				defer func() {
+					if recover() != nil {
+						panicked.Add(1)
+					}
+				}()
+				_, _ = cache.lookup(context.Background(), "gho_testtoken")
+			})
+		}
+		synctest.Wait()
+		close(release)
+		done.Wait()
+
+		if got := panicked.Load(); got != 3 {
+			t.Errorf("%d of 3 lookups saw the panic, want all of them", got)
+		}
+	})
+}
+
+// TestUserCacheKeyIsHashed verifies raw tokens are never used as cache keys.
+func TestUserCacheKeyIsHashed(t *testing.T) {
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	cache := newUserCache(time.Minute)
+	token := "gho_secrettoken"
+	if _, err := cache.lookup(context.Background(), token); err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+
+	for key := range cache.entries {
+		if strings.Contains(key, token) {
+			t.Errorf("cache key contains raw token: %q", key)
+		}
+	}
+}
+
+func TestInvalidTokenCacheBounded(t *testing.T) {
+	cache := newInvalidTokenCache(time.Minute)
+	now := time.Now()
+	for i := range maxInvalidTokens + 10 {
+		cache.add("gho_bad"+strconv.Itoa(i), now)
+	}
+	if len(cache.entries) != maxInvalidTokens {
+		t.Errorf("entries = %d, want the %d cap", len(cache.entries), maxInvalidTokens)
+	}
+	if cache.contains("gho_bad0", now) || !cache.contains("gho_bad"+strconv.Itoa(maxInvalidTokens+9), now) {
+		t.Error("a full cache should drop the oldest token and keep the newest")
+	}
+
+	// A token re-added after expiring outlives its first, expired insertion
+	cache = newInvalidTokenCache(time.Minute)
+	cache.add("gho_again", now)
+	cache.add("gho_again", now.Add(2*time.Minute))
+	cache.cleanup(now.Add(90 * time.Second))
+	if !cache.contains("gho_again", now.Add(90*time.Second)) {
+		t.Error("cleanup of the expired insertion dropped the live one")
+	}
+}
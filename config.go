@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configKeys lists the settings a config file may set, mapped to the environment
+// variable that takes precedence over it (empty when there is none).
+// Keys match flag names so values are applied through the flag package. Every flag is
+// here except the secrets (client-secret, webhook-secret, admin-token), which belong in
+// the environment or Secret Manager rather than a file, and the one-shot commands
+// (config, check-config, print-authorize-url).
+var configKeys = map[string]string{
+	"port":                     "PORT",
+	"listen-addr":              "LISTEN_ADDR",
+	"app-id":                   "GITHUB_APP_ID",
+	"client-id":                "GITHUB_CLIENT_ID",
+	"redirect-uri":             "OAUTH_REDIRECT_URI",
+	"oauth-apps":               "OAUTH_APPS",
+	"default-landing":          "",
+	"return-to-hosts":          "",
+	"allowed-origins":          "ALLOWED_ORIGINS",
+	"trusted-proxies":          "TRUSTED_PROXIES",
+	"ua-denylist":              "",
+	"reject-empty-ua":          "",
+	"csp-asset-origins":        "",
+	"csp-connect-origins":      "",
+	"csp-report":               "",
+	"oauth-scopes":             "",
+	"install-success-template": "",
+	"install-failure-template": "",
+	"session-mode":             "",
+	"oauth-state-ttl":          "",
+	"auth-code-ttl":            "",
+	"cookie-domain":            "",
+	"oauth-debug-errors":       "",
+	"secret-refresh-interval":  "",
+	"rate-limit-requests":      "",
+	"rate-limit-window":        "",
+	"rate-limit-sweep":         "",
+	"lockout-duration":         "",
+	"debug-hash-ips":           "",
+	"max-concurrent":           "",
+	"max-header-count":         "",
+	"compress-min-size":        "",
+	"exchange-body-limit":      "",
+	"asset-cache-max-age":      "",
+	"read-header-timeout":      "",
+	"read-timeout":             "",
+	"write-timeout":            "",
+	"idle-timeout":             "",
+	"request-timeout":          "",
+	"tls-cert":                 "",
+	"tls-key":                  "",
+	"tls-auto":                 "",
+	"tls-cache-dir":            "",
+	"http-redirect-port":       "",
+	"enable-h2c":               "",
+	"dev":                      "",
+	"dev-dir":                  "",
+	"log-level":                "",
+	"token-prefixes":           "",
+	"token-prefix-check":       "",
+	"security-contact":         "",
+	"security-policy":          "",
+	"security-txt-expiry":      "",
+	"hsts-max-age":             "",
+	"hsts-include-subdomains":  "",
+	"hsts-preload":             "",
+	"extra-headers":            "",
+	"avatar-proxy":             "",
+	"avatar-cache-ttl":         "",
+	"user-cache-ttl":           "",
+	"github-max-redirects":     "",
+	"github-heartbeat":         "",
+	"github-retry-attempts":    "",
+	"github-retry-delay":       "",
+	"github-retry-max-delay":   "",
+	"github-retry-jitter":      "",
+	"github-max-concurrent":    "",
+	"github-queue-timeout":     "",
+	"auth-code-reuse-alert":    "",
+	"auth-code-reuse-window":   "",
+	"auth-code-reuse-webhook":  "",
+	"maintenance":              "",
+	"verify-credentials":       "",
+	"enable-pprof":             "",
+	"pprof-addr":               "",
+}
+
+// loadConfigFile applies settings from a JSON config file to fs.
+// Precedence is flag > env > config file > default: a value is only applied when
+// its flag wasn't set on the command line and its environment variable is empty.
+// Unknown keys are rejected so typos fail fast.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		envVar, known := configKeys[key]
+		if !known || fs.Lookup(key) == nil {
+			errs = append(errs, fmt.Errorf("unknown config key %q", key))
+			continue
+		}
+
+		value, err := configValue(raw[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config key %q: %w", key, err))
+			continue
+		}
+
+		if explicit[key] {
+			log.Printf("[config] Ignoring %s from config file: set by flag", key)
+			continue
+		}
+		if envVar != "" && os.Getenv(envVar) != "" {
+			log.Printf("[config] Ignoring %s from config file: set by $%s", key, envVar)
+			continue
+		}
+
+		if err := fs.Set(key, value); err != nil {
+			errs = append(errs, fmt.Errorf("config key %q: %w", key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// configValue converts a JSON scalar into the string form accepted by flag.Set.
+func configValue(raw json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// applyConfig validates the parsed flags and installs the derived settings (OAuth apps,
+// trusted proxies, page templates, CSP origins). Every problem is
+// reported at once so a bad deploy can be fixed in one pass; it backs both normal
+// startup and --check-config.
+func applyConfig() error {
+	var errs []error
+
+	apps, err := parseOAuthApps(*oauthApps, os.Getenv)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("oauth apps: %w", err))
+	}
+	oauthAppsByHost = apps
+
+	if err := parseLogLevel(*logLevelName); err != nil {
+		errs = append(errs, fmt.Errorf("--log-level %q: %w", *logLevelName, err))
+	}
+
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("--trusted-proxies: %w", err))
+	}
+	trustedProxyNets = proxies
+	uaDenylist = parseUADenylist(*uaDeny)
+
+	hosts, err := parseReturnToHosts(*returnToAllow)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("--return-to-hosts: %w", err))
+	}
+	returnToHosts = hosts
+
+	headers, err := parseExtraHeaders(*extraHdrs)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("--extra-headers: %w", err))
+	}
+	extraHeaders = headers
+
+	acceptedTokenPrefixes = nil
+	if *checkTokenFmt {
+		acceptedTokenPrefixes = parseTokenPrefixes(*tokenPrefixes)
+		if len(acceptedTokenPrefixes) == 0 {
+			errs = append(errs, errors.New("--token-prefixes: empty; use --token-prefix-check=false to accept any token format"))
+		}
+	}
+
+	if *successPage != "" {
+		if tmpl, err := loadPageTemplate(*successPage); err != nil {
+			errs = append(errs, fmt.Errorf("--install-success-template: %w", err))
+		} else {
+			installSuccessPage = tmpl
+		}
+	}
+	if *failurePage != "" {
+		if tmpl, err := loadPageTemplate(*failurePage); err != nil {
+			errs = append(errs, fmt.Errorf("--install-failure-template: %w", err))
+		} else {
+			installFailurePage = tmpl
+		}
+	}
+
+	if err := validateListenAddr(*listenAddr, *port); err != nil {
+		errs = append(errs, fmt.Errorf("--listen-addr/--port: %w", err))
+	}
+	*listenAddr = strings.Trim(*listenAddr, "[]") // net.JoinHostPort adds IPv6 brackets itself
+	if *redirectPort != "" {
+		if err := validateListenAddr(*listenAddr, *redirectPort); err != nil {
+			errs = append(errs, fmt.Errorf("--http-redirect-port: %w", err))
+		}
+	}
+
+	if err := validateSessionMode(*sessionMode); err != nil {
+		errs = append(errs, fmt.Errorf("--session-mode: %w", err))
+	}
+
+	if err := validateTLSFlags(*tlsCert, *tlsKey, *tlsAuto); err != nil {
+		errs = append(errs, err)
+	}
+	if *redirectPort != "" && *tlsCert == "" && !*tlsAuto {
+		errs = append(errs, errors.New("--http-redirect-port requires --tls-cert and --tls-key, or --tls-auto"))
+	}
+
+	if origins := splitOrigins(*cspAssets); len(origins) > 0 {
+		csp.AssetOrigins = origins
+	}
+	if origins := splitOrigins(*cspConnect); len(origins) > 0 {
+		csp.ConnectOrigins = origins
+	}
+	if *cspReport {
+		csp.ReportURI = cspReportPath
+	}
+
+	if err := validateOrigins(*allowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("--allowed-origins: %w", err))
+	}
+	if err := validateRedirectURI(*redirectURI, *allowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("redirect URI %q: %w", *redirectURI, err))
+	}
+	if *defaultLanding != "" && validateReturnToURL(*defaultLanding) == "" {
+		errs = append(errs, fmt.Errorf("--default-landing %q: must be an http(s) URL on %s, a valid subdomain, or a --return-to-hosts host", *defaultLanding, baseDomain))
+	}
+
+	if *stateTTL < time.Minute {
+		errs = append(errs, fmt.Errorf("--oauth-state-ttl %v: must be at least 1m", *stateTTL))
+	}
+	if *authCodeTTL <= 0 || *authCodeTTL > maxAuthCodeTTL {
+		errs = append(errs, fmt.Errorf("--auth-code-ttl %v: must be between 0 and %v", *authCodeTTL, maxAuthCodeTTL))
+	}
+
+	if *limiterSweep <= 0 {
+		errs = append(errs, fmt.Errorf("--rate-limit-sweep %v: must be positive", *limiterSweep))
+	}
+
+	if *devMode {
+		if info, err := os.Stat(*devDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("--dev-dir %q: not a directory", *devDir))
+		}
+	}
+
+	if *reuseAlertMax < 0 {
+		errs = append(errs, fmt.Errorf("--auth-code-reuse-alert %d: must not be negative", *reuseAlertMax))
+	}
+	if *reuseAlertMax > 0 && *reuseAlertWin <= 0 {
+		errs = append(errs, fmt.Errorf("--auth-code-reuse-window %v: must be positive", *reuseAlertWin))
+	}
+	if *reuseAlertURL != "" {
+		if u, err := url.Parse(*reuseAlertURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("--auth-code-reuse-webhook %q: must be an https:// URL", *reuseAlertURL))
+		}
+	}
+
+	if *heartbeatEvery < 0 {
+		errs = append(errs, fmt.Errorf("--github-heartbeat %v: must not be negative", *heartbeatEvery))
+	}
+
+	if *retryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("--github-retry-attempts %d: must be at least 1", *retryAttempts))
+	}
+	if *githubMaxCalls < 0 || *ghQueueTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--github-max-concurrent %d and --github-queue-timeout %v: must not be negative", *githubMaxCalls, *ghQueueTimeout))
+	}
+	if *retryDelay < 0 || *retryJitter < 0 {
+		errs = append(errs, fmt.Errorf("--github-retry-delay %v and --github-retry-jitter %v: must not be negative", *retryDelay, *retryJitter))
+	}
+	if *retryMaxDelay < *retryDelay {
+		errs = append(errs, fmt.Errorf("--github-retry-max-delay %v: must be at least --github-retry-delay %v", *retryMaxDelay, *retryDelay))
+	}
+
+	if *maxHeaders < 0 {
+		errs = append(errs, fmt.Errorf("--max-header-count %d: must not be negative", *maxHeaders))
+	}
+	if *avatarTTL < 0 {
+		errs = append(errs, fmt.Errorf("--avatar-cache-ttl %v: must not be negative", *avatarTTL))
+	}
+	if *compressMin < 0 {
+		errs = append(errs, fmt.Errorf("--compress-min-size %d: must not be negative", *compressMin))
+	}
+	if *maxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("--github-max-redirects %d: must not be negative", *maxRedirects))
+	}
+
+	if *exchangeLimit <= 0 || *exchangeLimit > maxRequestSize {
+		errs = append(errs, fmt.Errorf("--exchange-body-limit %d: must be between 1 and %d", *exchangeLimit, maxRequestSize))
+	}
+
+	if err := validateSecurityContacts(*contactURIs); err != nil {
+		errs = append(errs, fmt.Errorf("--security-contact: %w", err))
+	}
+	if *disclosureURL != "" {
+		if u, err := url.Parse(*disclosureURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("--security-policy %q: must be an https:// URL", *disclosureURL))
+		}
+	}
+	if *securityTxtTTL <= 0 || *securityTxtTTL > 365*24*time.Hour {
+		errs = append(errs, fmt.Errorf("--security-txt-expiry %v: must be between 0 and 1 year", *securityTxtTTL))
+	}
+
+	if *maxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("--max-concurrent %d: must not be negative", *maxConcurrent))
+	}
+
+	for _, timeout := range []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"--read-header-timeout", *headerTimeout},
+		{"--read-timeout", *readTimeout},
+		{"--write-timeout", *writeTimeout},
+		{"--idle-timeout", *idleTimeout},
+	} {
+		if timeout.value < 0 {
+			errs = append(errs, fmt.Errorf("%s %v: must not be negative", timeout.flag, timeout.value))
+		}
+	}
+	if *readTimeout > 0 && *headerTimeout > *readTimeout {
+		errs = append(errs, fmt.Errorf("--read-header-timeout %v: must not exceed --read-timeout %v", *headerTimeout, *readTimeout))
+	}
+
+	if *hstsMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("--hsts-max-age %v: must not be negative", *hstsMaxAge))
+	}
+	if *hstsPreload && (!*hstsSubdomains || *hstsMaxAge < minPreloadMaxAge) {
+		errs = append(errs, fmt.Errorf("--hsts-preload requires --hsts-include-subdomains and --hsts-max-age of at least %v", minPreloadMaxAge))
+	}
+
+	if *assetMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("--asset-cache-max-age %v: must not be negative", *assetMaxAge))
+	}
+
+	if _, err := newCSRFProtection(); err != nil {
+		errs = append(errs, fmt.Errorf("CSRF protection: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateListenAddr checks the interface to bind (an IP literal, or empty for all
+// interfaces) and port, so a typo fails at startup instead of binding somewhere unexpected.
+func validateListenAddr(host, port string) error {
+	if host != "" {
+		if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err != nil {
+			return fmt.Errorf("listen address %q must be an IP address: %w", host, err)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// newCSRFProtection trusts our own domain, its subdomains, and localhost for development.
+// Uses Go 1.25's CrossOriginProtection (Fetch Metadata) for cross-origin detection.
+func newCSRFProtection() (*http.CrossOriginProtection, error) {
+	protection := http.NewCrossOriginProtection()
+	for _, origin := range []string{"https://" + baseDomain, "https://*." + baseDomain, "http://localhost"} {
+		if err := protection.AddTrustedOrigin(origin); err != nil {
+			return nil, fmt.Errorf("trust %s: %w", origin, err)
+		}
+	}
+	// It only guards /oauth/* endpoints, so rejections use their JSON error format
+	protection.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSONError(w, http.StatusForbidden, errCodeCSRFRejected, "Cross-origin request rejected")
+	}))
+	return protection, nil
+}
+
+// validateOrigins checks a comma-separated list of scheme://host[:port] origins.
+func validateOrigins(origins string) error {
+	for origin := range strings.SplitSeq(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return fmt.Errorf("origin %q: %w", origin, err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("origin %q must be scheme://host[:port]", origin)
+		}
+	}
+	return nil
+}
+
+// printConfigSummary writes the effective configuration for --check-config. Secrets are
+// reported only as set or unset.
+func printConfigSummary(w io.Writer, serverPort string) {
+	set := func(v string) string {
+		if v == "" {
+			return "unset"
+		}
+		return "set"
+	}
+	tlsMode := "off (terminated upstream)"
+	switch {
+	case *tlsAuto:
+		tlsMode = "on (Let's Encrypt for " + strings.Join(tlsAutoHosts(), ", ") + ", cached in " + *tlsCacheDir + ")"
+	case *tlsCert != "":
+		tlsMode = "on"
+	}
+	lines := []string{
+		"Configuration OK",
+		"  listen address:   " + net.JoinHostPort(*listenAddr, serverPort),
+		"  tls:              " + tlsMode,
+		"  client id:        " + *clientID,
+		"  client secret:    " + set(defaultClientSecret.get()),
+		"  webhook secret:   " + set(*webhookSecret),
+		"  redirect uri:     " + *redirectURI,
+		"  allowed origins:  " + *allowedOrigins,
+		"  trusted proxies:  " + fmt.Sprint(trustedProxyNets),
+		"  oauth apps:       " + strconv.Itoa(len(oauthAppsByHost)),
+		"  session mode:     " + *sessionMode,
+		"  oauth state ttl:  " + stateTTL.String(),
+		"  auth code ttl:    " + authCodeTTL.String(),
+	}
+	if _, err := fmt.Fprintln(w, strings.Join(lines, "\n")); err != nil {
+		errorf("Failed to write config summary: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.String("port", "", "")
+	appID := fs.Int("app-id", defaultAppID, "")
+	clientID := fs.String("client-id", defaultClientID, "")
+	redirect := fs.String("redirect-uri", defaultRedirectURI, "")
+	scopes := fs.String("oauth-scopes", defaultScopes, "")
+	window := fs.Duration("rate-limit-window", defaultRateLimitWindow, "")
+	requests := fs.Int("rate-limit-requests", defaultRateLimitRequests, "")
+
+	if err := fs.Parse([]string{"--port=9090"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	t.Setenv("GITHUB_CLIENT_ID", "env_client_id")
+	t.Setenv("OAUTH_REDIRECT_URI", "")
+
+	path := writeConfig(t, `{
+		"port": "7070",
+		"app-id": 42,
+		"client-id": "config_client_id",
+		"redirect-uri": "https://example.reviewGOOSE.dev/oauth/callback",
+		"oauth-scopes": "read:org",
+		"rate-limit-requests": 3,
+		"rate-limit-window": "30s"
+	}`)
+	if err := loadConfigFile(fs, path); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+
+	// Flag beats config
+	if *port != "9090" {
+		t.Errorf("port = %q, want flag value 9090", *port)
+	}
+	// Env beats config (the env fallback in main applies it later)
+	if *clientID != defaultClientID {
+		t.Errorf("client-id = %q, want default left for env fallback", *clientID)
+	}
+	// Config beats default
+	if *appID != 42 || *redirect != "https://example.reviewGOOSE.dev/oauth/callback" || *scopes != "read:org" ||
+		*requests != 3 || *window != 30*time.Second {
+		t.Errorf("config values not applied: app-id=%d redirect-uri=%q scopes=%q requests=%d window=%v",
+			*appID, *redirect, *scopes, *requests, *window)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{name: "unknown key", contents: `{"prot": "8080"}`, wantErr: `unknown config key "prot"`},
+		{name: "bad value", contents: `{"app-id": "abc"}`, wantErr: `config key "app-id"`},
+		{name: "nested value", contents: `{"port": {"value": 1}}`, wantErr: "unsupported value type"},
+		{name: "invalid JSON", contents: `port: 8080`, wantErr: "parse config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.String("port", "", "")
+			fs.Int("app-id", defaultAppID, "")
+
+			err := loadConfigFile(fs, writeConfig(t, tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfigFile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Every flag can be set from a config file unless configKeys says why not.
+func TestConfigKeysCoverFlags(t *testing.T) {
+	excluded := map[string]bool{
+		"client-secret": true, "webhook-secret": true, "admin-token": true,
+		"config": true, "check-config": true, "print-authorize-url": true,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") || excluded[f.Name] {
+			return
+		}
+		if _, ok := configKeys[f.Name]; !ok {
+			t.Errorf("flag --%s has no config key", f.Name)
+		}
+	})
+	for key := range configKeys {
+		if flag.Lookup(key) == nil {
+			t.Errorf("config key %q has no flag", key)
+		}
+	}
+}
+
+// TestCheckConfigMain runs main() when re-executed by TestCheckConfig; otherwise it's a no-op.
+func TestCheckConfigMain(t *testing.T) {
+	if os.Getenv("DASHBOARD_CHECK_CONFIG_MAIN") != "1" {
+		t.Skip("only runs as a subprocess of TestCheckConfig")
+	}
+	main()
+}
+
+func TestCheckConfig(t *testing.T) {
+	if testing.Short() {
+		t.Skip("re-executes the test binary")
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		secret   string
+		wantOK   bool
+		wantText []string
+	}{
+		{
+			name:     "valid",
+			args:     []string{"--redirect-uri=https://auth." + baseDomain + "/oauth/callback"},
+			secret:   "test_secret",
+			wantOK:   true,
+			wantText: []string{"Configuration OK", "client secret:    set"},
+		},
+		{
+			name:     "bad redirect, origins, landing, and HSTS",
+			args:     []string{"--redirect-uri=https://evil.example/oauth/callback", "--allowed-origins=ftp://nope", "--default-landing=https://evil.example/", "--hsts-include-subdomains=false"},
+			secret:   "test_secret",
+			wantText: []string{"redirect URI", "--allowed-origins", "--default-landing", "--hsts-preload"},
+		},
+		{
+			name:     "wildcard return_to host",
+			args:     []string{"--redirect-uri=https://auth." + baseDomain + "/oauth/callback", "--return-to-hosts=partner.example.com,*.example.com"},
+			secret:   "test_secret",
+			wantText: []string{"--return-to-hosts", `"*.example.com"`},
+		},
+		{
+			name:     "missing client secret",
+			args:     []string{"--redirect-uri=https://auth." + baseDomain + "/oauth/callback"},
+			wantText: []string{"client secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-test.run=^TestCheckConfigMain$", "--check-config"}, tt.args...)
+			cmd := exec.Command(os.Args[0], args...)
+			cmd.Env = append(os.Environ(),
+				"DASHBOARD_CHECK_CONFIG_MAIN=1",
+				"GITHUB_CLIENT_SECRET="+tt.secret,
+				"K_SERVICE=", "CLOUD_RUN_TIMEOUT_SECONDS=", // keep Secret Manager out of it
+				"OAUTH_REDIRECT_URI=",
+				"ALLOWED_ORIGINS=",
+			)
+			out, err := cmd.CombinedOutput()
+
+			var exitErr *exec.ExitError
+			switch {
+			case tt.wantOK && err != nil:
+				t.Fatalf("--check-config failed: %v\n%s", err, out)
+			case !tt.wantOK && !errors.As(err, &exitErr):
+				t.Fatalf("--check-config error = %v, want non-zero exit\n%s", err, out)
+			}
+			for _, s := range tt.wantText {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("output missing %q:\n%s", s, out)
+				}
+			}
+			if strings.Contains(string(out), "Starting server") {
+				t.Error("--check-config started the server")
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isAllowedOrigin reports whether a browser Origin may call us cross-origin: the base
+// domain or any of its subdomains over HTTPS, or an origin listed in --allowed-origins.
+func isAllowedOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	base := strings.ToLower(baseDomain)
+	if u.Scheme == "https" && (host == base || strings.HasSuffix(host, "."+base)) {
+		return true
+	}
+	for allowed := range strings.SplitSeq(*allowedOrigins, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossSiteAssetBlocked reports whether a static file request is a cross-site script or
+// style load from an origin we don't trust, going by Fetch Metadata. Such a load lets
+// another site execute or inspect our assets (XSSI); our own pages load them same-origin
+// or same-site, and --allowed-origins pages load them in CORS mode with an Origin.
+// Browsers without Fetch Metadata send no Sec-Fetch-Site and fall back to Origin checks.
+func crossSiteAssetBlocked(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Site") != "cross-site" {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "script", "style", "worker", "sharedworker", "serviceworker":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || !isAllowedOrigin(origin)
+}
+
+// apiCORS lets the SPA on a workspace subdomain call API endpoints on another host.
+// Allowed origins are echoed back. Wrap next in allowMethods so preflight requests are
+// answered with 204 before reaching CSRF checks or rate limiting, and never count
+// against a client.
+func apiCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && isAllowedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+contentSHA256Header+", "+csrfHeaderName)
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfProtect wraps next in CrossOriginProtection, first letting through requests from
+// allowed origins. CrossOriginProtection only matches trusted origins exactly, so its
+// https://*.<base domain> entry alone never admits a workspace subdomain.
+func csrfProtect(next http.Handler) http.Handler {
+	protected := csrfProtection.Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && isAllowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPICORSPreflight(t *testing.T) {
+	protection, err := newCSRFProtection()
+	if err != nil {
+		t.Fatalf("newCSRFProtection() error = %v", err)
+	}
+	orig := csrfProtection
+	csrfProtection = protection
+	t.Cleanup(func() { csrfProtection = orig })
+	// A one-request budget shows preflights never reach the rate limiter
+	limiter := &rateLimiter{requests: make(map[string][]time.Time), limit: 1, window: time.Minute}
+	var reached int
+	exchange := apiCORS(allowMethods(csrfProtect(limiter.limitHandler(func(w http.ResponseWriter, _ *http.Request) {
+		reached++
+		w.WriteHeader(http.StatusOK)
+	})), http.MethodPost))
+
+	tests := []struct {
+		name       string
+		origin     string
+		wantOrigin string
+	}{
+		{name: "workspace subdomain", origin: "https://my." + baseDomain, wantOrigin: "https://my." + baseDomain},
+		{name: "base domain", origin: "https://" + baseDomain, wantOrigin: "https://" + baseDomain},
+		{name: "foreign origin", origin: "https://evil.example"},
+		{name: "lookalike suffix", origin: "https://evil" + baseDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "https://auth."+baseDomain+"/oauth/exchange", http.NoBody)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			req.Header.Set("Access-Control-Request-Headers", "content-type,x-content-sha256,x-csrf-token")
+			req.RemoteAddr = "192.0.2.40:1234"
+			rr := httptest.NewRecorder()
+			exchange.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", rr.Code)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if tt.wantOrigin != "" {
+				allowed := make(map[string]bool)
+				for h := range strings.SplitSeq(rr.Header().Get("Access-Control-Allow-Headers"), ",") {
+					allowed[strings.ToLower(strings.TrimSpace(h))] = true
+				}
+				for h := range strings.SplitSeq(req.Header.Get("Access-Control-Request-Headers"), ",") {
+					if !allowed[h] {
+						t.Errorf("Access-Control-Allow-Headers = %q, missing requested %s", rr.Header().Get("Access-Control-Allow-Headers"), h)
+					}
+				}
+				if got := rr.Header().Get("Access-Control-Allow-Methods"); got != "POST, OPTIONS" {
+					t.Errorf("Access-Control-Allow-Methods = %q, want POST, OPTIONS", got)
+				}
+			}
+			if got := rr.Header().Get("Vary"); got != "Origin" {
+				t.Errorf("Vary = %q, want Origin", got)
+			}
+		})
+	}
+	if reached != 0 {
+		t.Errorf("preflight reached the handler %d times", reached)
+	}
+
+	// The actual cross-subdomain POST still goes through and carries the CORS header
+	req := httptest.NewRequest(http.MethodPost, "https://auth."+baseDomain+"/oauth/exchange", http.NoBody)
+	req.Header.Set("Origin", "https://my."+baseDomain)
+	req.Header.Set("Sec-Fetch-Site", "same-site")
+	req.RemoteAddr = "192.0.2.40:1234"
+	rr := httptest.NewRecorder()
+	exchange.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || reached != 1 {
+		t.Errorf("POST status = %d, reached = %d, want 200 and 1", rr.Code, reached)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://my."+baseDomain {
+		t.Errorf("POST Access-Control-Allow-Origin = %q", got)
+	}
+
+	// Other sites are still refused by CSRF protection
+	req = httptest.NewRequest(http.MethodPost, "https://auth."+baseDomain+"/oauth/exchange", http.NoBody)
+	req.Header.Set("Origin", "https://evil.example")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	req.RemoteAddr = "192.0.2.41:1234"
+	rr = httptest.NewRecorder()
+	exchange.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden || reached != 1 {
+		t.Errorf("cross-site POST status = %d, reached = %d, want 403 and 1", rr.Code, reached)
+	}
+}
+
+func TestStaticFetchMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		site       string
+		dest       string
+		origin     string
+		path       string
+		wantStatus int
+	}{
+		{name: "same-origin script", site: "same-origin", dest: "script", path: "/assets/app.js", wantStatus: http.StatusOK},
+		{name: "same-site script from subdomain", site: "same-site", dest: "script", path: "/assets/app.js", wantStatus: http.StatusOK},
+		{name: "user navigation", site: "none", dest: "document", path: "/assets/app.js", wantStatus: http.StatusOK},
+		{name: "cross-site script", site: "cross-site", dest: "script", path: "/assets/app.js", wantStatus: http.StatusForbidden},
+		{name: "cross-site style", site: "cross-site", dest: "style", path: "/assets/styles.css", wantStatus: http.StatusForbidden},
+		{name: "cross-site module from untrusted origin", site: "cross-site", dest: "script", origin: "https://evil.example", path: "/assets/app.js", wantStatus: http.StatusForbidden},
+		{name: "cross-site module from allowed origin", site: "cross-site", dest: "script", origin: "https://my." + baseDomain, path: "/assets/app.js", wantStatus: http.StatusOK},
+		{name: "cross-site image", site: "cross-site", dest: "image", path: "/assets/army.png", wantStatus: http.StatusOK},
+		{name: "no fetch metadata, untrusted origin", origin: "https://evil.example", path: "/assets/app.js", wantStatus: http.StatusOK},
+		{name: "no fetch metadata, no origin", path: "/assets/app.js", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+tt.path, http.NoBody)
+			for header, value := range map[string]string{"Sec-Fetch-Site": tt.site, "Sec-Fetch-Dest": tt.dest, "Origin": tt.origin} {
+				if value != "" {
+					req.Header.Set(header, value)
+				}
+			}
+			rr := httptest.NewRecorder()
+			serveStaticFiles(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			// Older browsers still get CORS headers only for allowed origins
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" && !isAllowedOrigin(got) {
+				t.Errorf("Access-Control-Allow-Origin = %q for an untrusted origin", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// randomKeyID identifies the per-process key used when no keyring is configured.
+// Configured key IDs start at 1.
+const randomKeyID = 0
+
+// tokenKeyring encrypts OAuth tokens held in memory between the callback and the exchange
+// (and in cookie-mode sessions), so a heap dump doesn't expose them in plaintext.
+// New tokens are sealed with the primary key; any key still in the ring can open them,
+// so rotating the primary doesn't invalidate codes and sessions already issued.
+type tokenKeyring struct {
+	mu      sync.RWMutex
+	primary byte
+	keys    map[byte]cipher.AEAD
+	spec    string // the TOKEN_ENCRYPTION_KEYS value last loaded, to skip no-op reloads
+}
+
+// tokenKeys is the active keyring. Without TOKEN_ENCRYPTION_KEYS it holds a single random
+// key: auth codes only live for seconds and never need to survive a restart.
+var tokenKeys = newRandomKeyring()
+
+func newRandomKeyring() *tokenKeyring {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("CRITICAL: Failed to generate token encryption key: %v", err))
+	}
+	aead, err := newTokenAEAD(key)
+	if err != nil {
+		panic(fmt.Sprintf("CRITICAL: Failed to create token cipher: %v", err))
+	}
+	return &tokenKeyring{primary: randomKeyID, keys: map[byte]cipher.AEAD{randomKeyID: aead}}
+}
+
+func newTokenAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseKeyring parses a TOKEN_ENCRYPTION_KEYS value: comma-separated id:base64-key
+// entries with 32-byte keys and IDs from 1 to 255. The first entry is the primary key;
+// the rest only decrypt. To rotate, prepend the new key and drop the old one once
+// everything sealed with it has expired.
+func parseKeyring(spec string) (*tokenKeyring, error) {
+	kr := &tokenKeyring{keys: make(map[byte]cipher.AEAD), spec: spec}
+	for i, entry := range strings.Split(spec, ",") {
+		idStr, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %d: want id:base64-key", i+1)
+		}
+		id, err := strconv.ParseUint(idStr, 10, 8)
+		if err != nil || id == randomKeyID {
+			return nil, fmt.Errorf("key entry %d: id %q must be 1-255", i+1, idStr)
+		}
+		if _, dup := kr.keys[byte(id)]; dup {
+			return nil, fmt.Errorf("key entry %d: duplicate id %d", i+1, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		aead, err := newTokenAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		if i == 0 {
+			kr.primary = byte(id)
+		}
+		kr.keys[byte(id)] = aead
+	}
+	return kr, nil
+}
+
+// set replaces the ring's keys with those in spec, reporting whether anything changed.
+// An invalid spec is logged and ignored so a bad Secret Manager version can't break
+// decryption. It lets watchSecret apply rotated TOKEN_ENCRYPTION_KEYS versions.
+func (kr *tokenKeyring) set(spec string) bool {
+	kr.mu.RLock()
+	unchanged := spec == kr.spec
+	kr.mu.RUnlock()
+	if unchanged {
+		return false
+	}
+
+	next, err := parseKeyring(spec)
+	if err != nil {
+		log.Printf("Ignoring invalid TOKEN_ENCRYPTION_KEYS: %v", err)
+		return false
+	}
+	kr.mu.Lock()
+	kr.primary, kr.keys, kr.spec = next.primary, next.keys, next.spec
+	kr.mu.Unlock()
+	return true
+}
+
+// seal encrypts plaintext with the primary key as keyID || nonce || ciphertext.
+func (kr *tokenKeyring) seal(plaintext string) ([]byte, error) {
+	kr.mu.RLock()
+	id := kr.primary
+	aead := kr.keys[id]
+	kr.mu.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	out := append([]byte{id}, nonce...)
+	return aead.Seal(out, nonce, []byte(plaintext), nil), nil
+}
+
+// open decrypts a value sealed by seal with any key still in the ring.
+func (kr *tokenKeyring) open(sealed []byte) (string, error) {
+	if len(sealed) == 0 {
+		return "", errors.New("sealed token too short")
+	}
+	kr.mu.RLock()
+	aead, ok := kr.keys[sealed[0]]
+	kr.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("sealed with unknown key %d", sealed[0])
+	}
+
+	size := aead.NonceSize()
+	if len(sealed) < 1+size {
+		return "", errors.New("sealed token too short")
+	}
+	plain, err := aead.Open(nil, sealed[1:1+size], sealed[1+size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt token: %w", err)
+	}
+	return string(plain), nil
+}
+
+// sealToken encrypts a token with AES-GCM under the primary key.
+func sealToken(token string) ([]byte, error) {
+	return tokenKeys.seal(token)
+}
+
+// openToken decrypts a token sealed by sealToken.
+func openToken(sealed []byte) (string, error) {
+	return tokenKeys.open(sealed)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSealToken(t *testing.T) {
+	sealed, err := sealToken(testToken)
+	if err != nil {
+		t.Fatalf("sealToken() error = %v", err)
+	}
+	if bytes.Contains(sealed, []byte(testToken)) {
+		t.Error("sealed bytes contain the plaintext token")
+	}
+
+	got, err := openToken(sealed)
+	if err != nil {
+		t.Fatalf("openToken() error = %v", err)
+	}
+	if got != testToken {
+		t.Errorf("openToken() = %q, want %q", got, testToken)
+	}
+
+	// Nonces are random, so sealing twice yields different ciphertext
+	again, err := sealToken(testToken)
+	if err != nil {
+		t.Fatalf("sealToken() error = %v", err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing the same token twice produced identical ciphertext")
+	}
+
+	// Tampering is detected
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := openToken(sealed); err == nil {
+		t.Error("openToken() accepted tampered ciphertext")
+	}
+	if _, err := openToken([]byte("short")); err == nil {
+		t.Error("openToken() accepted truncated ciphertext")
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	oldSpec := "1:" + key('a')
+	rotatedSpec := "2:" + key('b') + ", 1:" + key('a')
+
+	kr, err := parseKeyring(oldSpec)
+	if err != nil {
+		t.Fatalf("parseKeyring() error = %v", err)
+	}
+	orig := tokenKeys
+	tokenKeys = kr
+	t.Cleanup(func() { tokenKeys = orig })
+
+	sealedOld, err := sealToken(testToken)
+	if err != nil {
+		t.Fatalf("sealToken() error = %v", err)
+	}
+
+	// After rotation new tokens use key 2, and tokens sealed with key 1 still open
+	if !kr.set(rotatedSpec) {
+		t.Fatal("set() reported no change for a rotated keyring")
+	}
+	if kr.set(rotatedSpec) {
+		t.Error("set() reported a change for the same keyring")
+	}
+	sealedNew, err := sealToken(testToken)
+	if err != nil {
+		t.Fatalf("sealToken() error = %v", err)
+	}
+	if sealedOld[0] != 1 || sealedNew[0] != 2 {
+		t.Errorf("key IDs = %d, %d, want 1 then 2", sealedOld[0], sealedNew[0])
+	}
+	for _, sealed := range [][]byte{sealedOld, sealedNew} {
+		if got, err := openToken(sealed); err != nil || got != testToken {
+			t.Errorf("openToken() = %q, %v after rotation", got, err)
+		}
+	}
+
+	// An invalid version is ignored rather than breaking decryption
+	if kr.set("2:not-base64") {
+		t.Error("set() accepted an invalid keyring")
+	}
+	if _, err := openToken(sealedNew); err != nil {
+		t.Errorf("openToken() after invalid update: %v", err)
+	}
+
+	// Once the old key is retired, tokens sealed with it no longer open
+	kr.set("2:" + key('b'))
+	if _, err := openToken(sealedOld); err == nil {
+		t.Error("openToken() opened a token sealed with a retired key")
+	}
+	if got, err := openToken(sealedNew); err != nil || got != testToken {
+		t.Errorf("openToken() = %q, %v with the primary key", got, err)
+	}
+
+	for _, spec := range []string{"", "1", "0:" + key('a'), "256:" + key('a'), "1:" + key('a') + ",1:" + key('b'), "1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseKeyring(spec); err == nil {
+			t.Errorf("parseKeyring(%q) succeeded, want error", spec)
+		}
+	}
+}
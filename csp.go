@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// cspNoncePlaceholder is replaced with the per-request nonce in served HTML, e.g.
+// <script nonce="CSP_NONCE">, so inline scripts and styles can run under the CSP.
+const cspNoncePlaceholder = "CSP_NONCE"
+
+const (
+	// cspReportPath receives violation reports when --csp-report is set.
+	cspReportPath = "/csp-report"
+	// cspReportGroup names the Reporting-Endpoints entry used by report-to.
+	cspReportGroup = "csp-endpoint"
+	// maxCSPReportSize bounds a report body; real reports are a few hundred bytes.
+	maxCSPReportSize = 64 << 10
+	// cspReportsPerMinute caps reports per IP, since one page load can trigger many.
+	cspReportsPerMinute = 30
+)
+
+// cspConfig holds the deployment-specific sources used to assemble the Content-Security-Policy.
+type cspConfig struct {
+	// AssetOrigins serve the app's scripts, styles, fonts, and images.
+	AssetOrigins []string
+	// ImageOrigins are additional image hosts, such as GitHub avatars.
+	ImageOrigins []string
+	// ConnectOrigins are the APIs the frontend may call.
+	ConnectOrigins []string
+	// ReportURI, when set, is where browsers send violation reports.
+	ReportURI string
+}
+
+// defaultCSPConfig returns the policy for the reviewGOOSE.dev deployment.
+func defaultCSPConfig() cspConfig {
+	return cspConfig{
+		AssetOrigins:   []string{"https://reviewGOOSE.dev", "https://*.reviewGOOSE.dev"},
+		ImageOrigins:   []string{"https://avatars.githubusercontent.com", "data:"},
+		ConnectOrigins: []string{"https://api.github.com", "https://turn.github.codegroove.app"},
+	}
+}
+
+// csp is the active policy, adjusted from flags at startup.
+var csp = defaultCSPConfig()
+
+// header assembles the policy, allowing inline scripts and styles that carry nonce.
+func (c cspConfig) header(nonce string) string {
+	self := append([]string{"'self'"}, c.AssetOrigins...)
+	withNonce := self
+	if nonce != "" {
+		withNonce = append(append([]string{}, self...), "'nonce-"+nonce+"'")
+	}
+	src := func(name string, sources ...[]string) string {
+		var all []string
+		for _, s := range sources {
+			all = append(all, s...)
+		}
+		return name + " " + strings.Join(all, " ")
+	}
+
+	directives := []string{
+		src("default-src", self),
+		src("script-src", withNonce),
+		src("style-src", withNonce),
+		src("img-src", self, c.ImageOrigins),
+		src("connect-src", []string{"'self'"}, c.ConnectOrigins),
+		src("font-src", self),
+		"object-src 'none'",
+		"frame-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"upgrade-insecure-requests",
+	}
+	if c.ReportURI != "" {
+		// report-uri for browsers without the Reporting API; those with it prefer report-to
+		directives = append(directives, "report-uri "+c.ReportURI, "report-to "+cspReportGroup)
+	}
+	return strings.Join(directives, "; ")
+}
+
+// splitOrigins parses a comma-separated origin list flag.
+func splitOrigins(spec string) []string {
+	var origins []string
+	for origin := range strings.SplitSeq(spec, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+type cspNonceKey struct{}
+
+// withCSPNonce attaches the request's CSP nonce to its context.
+func withCSPNonce(r *http.Request, nonce string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+}
+
+// cspNonce returns the nonce securityHeaders generated for this request, or "" outside that middleware.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// cspViolation is the part of a violation report worth logging. Field names follow
+// the legacy report-uri format; Reporting API reports are mapped onto it.
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	Disposition        string `json:"disposition,omitempty"`
+	SourceFile         string `json:"source-file,omitempty"`
+	LineNumber         int    `json:"line-number,omitempty"`
+}
+
+// parseCSPReport decodes either a legacy application/csp-report body or a
+// Reporting API application/reports+json batch.
+func parseCSPReport(contentType string, body []byte) ([]cspViolation, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var reports []struct {
+			Type string `json:"type"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				BlockedURL         string `json:"blockedURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+				Disposition        string `json:"disposition"`
+				SourceFile         string `json:"sourceFile"`
+				LineNumber         int    `json:"lineNumber"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var violations []cspViolation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        r.Body.DocumentURL,
+				BlockedURI:         r.Body.BlockedURL,
+				ViolatedDirective:  r.Body.EffectiveDirective,
+				EffectiveDirective: r.Body.EffectiveDirective,
+				Disposition:        r.Body.Disposition,
+				SourceFile:         r.Body.SourceFile,
+				LineNumber:         r.Body.LineNumber,
+			})
+		}
+		return violations, nil
+	}
+
+	var legacy struct {
+		Report cspViolation `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return nil, err
+	}
+	return []cspViolation{legacy.Report}, nil
+}
+
+// handleCSPReport logs violation reports as JSON lines tagged [CSP].
+// Report URLs can carry query strings, so they are sanitized before logging.
+func handleCSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize+1))
+	if err != nil || len(body) > maxCSPReportSize {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	violations, err := parseCSPReport(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+
+	for _, v := range violations {
+		v.DocumentURI = sanitizeURL(v.DocumentURI)
+		v.BlockedURI = sanitizeURL(v.BlockedURI)
+		v.SourceFile = sanitizeURL(v.SourceFile)
+		line, err := json.Marshal(struct {
+			cspViolation
+			IP        string `json:"ip"`
+			UserAgent string `json:"user_agent"`
+		}{v, clientIP(r), r.UserAgent()})
+		if err != nil {
+			errorf("[CSP] Failed to encode violation report: %v", err)
+			continue
+		}
+		log.Printf("[CSP] %s", line)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// withHTMLPage temporarily serves an extra embedded HTML page.
+func withHTMLPage(t *testing.T, path, content string) {
+	t.Helper()
+	data := []byte(content)
+	staticAssets[path] = staticAsset{data: data}
+	htmlPages[path] = htmlPage{asset: staticAsset{data: data}, parts: bytes.Split(templateHTML(data, buildTimestamp), []byte(cspNoncePlaceholder))}
+	t.Cleanup(func() {
+		delete(staticAssets, path)
+		delete(htmlPages, path)
+	})
+}
+
+func TestCSPNonce(t *testing.T) {
+	withHTMLPage(t, "inline.html", `<html><script nonce="CSP_NONCE">go()</script><style nonce="CSP_NONCE"></style></html>`)
+	handler := securityHeaders(http.HandlerFunc(serveStaticFiles))
+	nonces := make(map[string]bool)
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/inline.html", http.NoBody)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		header := rr.Header().Get("Content-Security-Policy")
+		m := regexp.MustCompile(`script-src [^;]*'nonce-([^']+)'`).FindStringSubmatch(header)
+		if m == nil {
+			t.Fatalf("CSP has no script nonce: %s", header)
+		}
+		nonce := m[1]
+		if !strings.Contains(header, "style-src") || !strings.Contains(header, "'nonce-"+nonce+"'; img-src") {
+			t.Errorf("style-src does not carry the nonce: %s", header)
+		}
+		if body := rr.Body.String(); strings.Count(body, `nonce="`+nonce+`"`) != 2 || strings.Contains(body, cspNoncePlaceholder) {
+			t.Errorf("served HTML does not carry nonce %q", nonce)
+		}
+		nonces[nonce] = true
+	}
+
+	if len(nonces) != 2 {
+		t.Error("nonce was reused across requests")
+	}
+}
+
+func TestCSPConfig(t *testing.T) {
+	c := cspConfig{
+		AssetOrigins:   []string{"https://dash.example.com"},
+		ConnectOrigins: []string{"https://api.github.com"},
+	}
+	header := c.header("abc")
+
+	for _, want := range []string{
+		"default-src 'self' https://dash.example.com;",
+		"script-src 'self' https://dash.example.com 'nonce-abc';",
+		"connect-src 'self' https://api.github.com;",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("CSP missing %q: %s", want, header)
+		}
+	}
+	if strings.Contains(header, "reviewGOOSE") || strings.Contains(header, "codegroove") {
+		t.Errorf("CSP still contains default origins: %s", header)
+	}
+}
+
+func TestCSPReport(t *testing.T) {
+	orig := csp
+	csp.ReportURI = cspReportPath
+	t.Cleanup(func() { csp = orig })
+	logs := captureLog(t)
+	handler := newTestServer(t, Config{})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	if header := rr.Header().Get("Content-Security-Policy"); !strings.Contains(header, "report-uri /csp-report; report-to csp-endpoint") {
+		t.Errorf("CSP lacks report directives: %s", header)
+	}
+	if got := rr.Header().Get("Reporting-Endpoints"); got != `csp-endpoint="/csp-report"` {
+		t.Errorf("Reporting-Endpoints = %q", got)
+	}
+
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/csp-report", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.RemoteAddr = "192.0.2.7:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	legacy := `{"csp-report":{"document-uri":"https://my.` + baseDomain + `/?auth_code=secret","blocked-uri":"https://evil.example/x.js",` +
+		`"violated-directive":"script-src-elem","effective-directive":"script-src-elem","line-number":12}}`
+	if rr := post("application/csp-report", legacy); rr.Code != http.StatusNoContent {
+		t.Fatalf("legacy report status = %d, want 204", rr.Code)
+	}
+	reporting := `[{"type":"csp-violation","body":{"documentURL":"https://my.` + baseDomain + `/","blockedURL":"inline",` +
+		`"effectiveDirective":"style-src-attr","disposition":"enforce"}},{"type":"deprecation","body":{}}]`
+	if rr := post("application/reports+json", reporting); rr.Code != http.StatusNoContent {
+		t.Fatalf("Reporting API report status = %d, want 204", rr.Code)
+	}
+	if rr := post("application/csp-report", "not json"); rr.Code != http.StatusBadRequest {
+		t.Errorf("malformed report status = %d, want 400", rr.Code)
+	}
+
+	var violations []map[string]any
+	for line := range strings.SplitSeq(logs.String(), "\n") {
+		if entry, ok := strings.CutPrefix(line, "[CSP] "); ok {
+			var v map[string]any
+			if err := json.Unmarshal([]byte(entry), &v); err != nil {
+				t.Fatalf("CSP log line is not JSON: %q", line)
+			}
+			violations = append(violations, v)
+		}
+	}
+	if len(violations) != 2 {
+		t.Fatalf("logged %d violations, want 2: %s", len(violations), logs)
+	}
+	if v := violations[0]; v["blocked-uri"] != "https://evil.example/x.js" || v["effective-directive"] != "script-src-elem" || v["ip"] != "192.0.2.7" {
+		t.Errorf("legacy violation = %v", v)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Error("document URI query was logged unredacted")
+	}
+	if v := violations[1]; v["blocked-uri"] != "inline" || v["effective-directive"] != "style-src-attr" {
+		t.Errorf("Reporting API violation = %v", v)
+	}
+
+	// Browsers can flood the endpoint, so it is rate limited per IP
+	limited := false
+	for range cspReportsPerMinute {
+		if post("application/csp-report", legacy).Code == http.StatusTooManyRequests {
+			limited = true
+			break
+		}
+	}
+	if !limited {
+		t.Error("CSP report endpoint was not rate limited")
+	}
+}
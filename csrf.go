@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// validCSRFToken reports whether r echoes the __Host-csrf cookie in X-CSRF-Token
+// (double-submit). Another site can make the browser send the cookie, but can't read it.
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeaderName)), []byte(cookie.Value)) == 1
+}
+
+// setCSRFCookie sets the CSRF cookie the SPA reads and echoes. It isn't HttpOnly on purpose.
+func setCSRFCookie(w http.ResponseWriter, csrf string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleCSRFToken issues a CSRF token for requireCSRFToken, keeping the caller's current
+// one if it has a cookie already so a token-cookie session's CSRF token stays valid.
+func handleCSRFToken(w http.ResponseWriter, r *http.Request) {
+	var csrf string
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		csrf = cookie.Value
+	} else {
+		id, err := generateIDE(32)
+		if err != nil {
+			errorf("Failed to generate CSRF token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Failed to generate CSRF token")
+			return
+		}
+		csrf = id
+	}
+	setCSRFCookie(w, csrf)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]string{"csrf_token": csrf}); err != nil {
+		errorf("Failed to encode CSRF token response: %v", err)
+	}
+}
+
+// requireCSRFToken backs up csrfProtect for browsers that don't send Sec-Fetch-Site, where
+// Fetch Metadata can't tell a forged request apart: those must echo the token from
+// /oauth/csrf in X-CSRF-Token.
+func requireCSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Sec-Fetch-Site") == "" && !validCSRFToken(r) {
+			warnf("[SECURITY] [%s] Missing or mismatched CSRF token on %s from %s", requestIDFrom(r.Context()), r.URL.Path, clientIP(r))
+			writeJSONError(w, http.StatusForbidden, errCodeInvalidCSRFToken, "Invalid CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExchangeCSRFTokenFallback(t *testing.T) {
+	resetFailedAttempts(t)
+	server := newTestServer(t, Config{RateLimitRequests: 100})
+
+	// Issue a token the way the SPA does
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/csrf", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /oauth/csrf status = %d, want 200", rr.Code)
+	}
+	var resp struct {
+		CSRFToken string `json:"csrf_token"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || resp.CSRFToken == "" {
+		t.Fatalf("invalid /oauth/csrf response (%v): %+v", err, resp)
+	}
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != resp.CSRFToken || cookie.HttpOnly || !cookie.Secure {
+		t.Fatalf("CSRF cookie = %+v, want readable Secure cookie holding %q", cookie, resp.CSRFToken)
+	}
+
+	// An existing cookie is kept rather than rotated
+	req := httptest.NewRequest(http.MethodGet, "/oauth/csrf", http.NoBody)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), resp.CSRFToken) {
+		t.Errorf("second /oauth/csrf = %s, want the existing token", rr.Body)
+	}
+
+	exchange := func(code, header string, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", strings.NewReader(`{"auth_code":"`+code+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set(csrfHeaderName, header)
+		}
+		if withCookie {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	code := completeOAuthCallback(t)
+	tests := []struct {
+		name       string
+		header     string
+		withCookie bool
+	}{
+		{"missing header", "", true},
+		{"missing cookie", resp.CSRFToken, false},
+		{"mismatched token", "not-the-token", true},
+	}
+	for _, tt := range tests {
+		if got := decodeAPIError(t, exchange(code, tt.header, tt.withCookie), http.StatusForbidden); got != "invalid_csrf_token" {
+			t.Errorf("%s: error = %q, want invalid_csrf_token", tt.name, got)
+		}
+	}
+
+	// A rejected request doesn't consume the code
+	if rr := exchange(code, resp.CSRFToken, true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), testToken) {
+		t.Errorf("exchange with valid token: status = %d, body = %s", rr.Code, rr.Body)
+	}
+
+	// Browsers sending Fetch Metadata are covered by CrossOriginProtection instead
+	req = httptest.NewRequest(http.MethodPost, "/oauth/exchange", strings.NewReader(`{"auth_code":"`+completeOAuthCallback(t)+`"}`))
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("same-origin exchange without token: status = %d, want 200", rr.Code)
+	}
+}
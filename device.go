@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDeviceInterval is the polling interval RFC 8628 prescribes when GitHub sends none.
+	defaultDeviceInterval = 5
+	// deviceSlowDownStep is how much each slow_down adds to the polling interval (RFC 8628 §3.5).
+	deviceSlowDownStep = 5
+)
+
+// deviceFlow tracks polling for one device authorization so clients that poll faster
+// than GitHub allows are told to slow down without spending a GitHub request.
+type deviceFlow struct {
+	nextPoll time.Time
+	expiry   time.Time
+	interval int // seconds
+}
+
+// deviceFlowStore is keyed by a hash of the device code, which is a bearer credential.
+// Codes issued by another instance are unknown here and simply aren't throttled.
+type deviceFlowStore struct {
+	entries map[[sha256.Size]byte]deviceFlow
+	mu      sync.Mutex
+}
+
+func newDeviceFlowStore() *deviceFlowStore {
+	return &deviceFlowStore{entries: make(map[[sha256.Size]byte]deviceFlow)}
+}
+
+var deviceFlows = newDeviceFlowStore()
+
+func (s *deviceFlowStore) start(deviceCode string, interval int, expiry, now time.Time) {
+	s.mu.Lock()
+	s.entries[sha256.Sum256([]byte(deviceCode))] = deviceFlow{
+		nextPoll: now.Add(time.Duration(interval) * time.Second),
+		expiry:   expiry,
+		interval: interval,
+	}
+	s.mu.Unlock()
+}
+
+// poll records a poll attempt. It reports false with the raised interval if the client
+// came back too early, in which case GitHub must not be asked.
+func (s *deviceFlowStore) poll(deviceCode string, now time.Time) (interval int, ok bool) {
+	key := sha256.Sum256([]byte(deviceCode))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flow, known := s.entries[key]
+	if !known {
+		return defaultDeviceInterval, true
+	}
+	if now.Before(flow.nextPoll) {
+		flow.interval += deviceSlowDownStep
+		ok = false
+	} else {
+		ok = true
+	}
+	flow.nextPoll = now.Add(time.Duration(flow.interval) * time.Second)
+	s.entries[key] = flow
+	return flow.interval, ok
+}
+
+// slowDown applies an interval GitHub asked for, or the standard step if it gave none.
+func (s *deviceFlowStore) slowDown(deviceCode string, interval int, now time.Time) int {
+	key := sha256.Sum256([]byte(deviceCode))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flow, known := s.entries[key]
+	if !known {
+		flow = deviceFlow{interval: defaultDeviceInterval, expiry: now.Add(15 * time.Minute)}
+	}
+	if interval > flow.interval {
+		flow.interval = interval
+	} else {
+		flow.interval += deviceSlowDownStep
+	}
+	flow.nextPoll = now.Add(time.Duration(flow.interval) * time.Second)
+	s.entries[key] = flow
+	return flow.interval
+}
+
+func (s *deviceFlowStore) finish(deviceCode string) {
+	s.mu.Lock()
+	delete(s.entries, sha256.Sum256([]byte(deviceCode)))
+	s.mu.Unlock()
+}
+
+// cleanup removes expired device authorizations.
+func (s *deviceFlowStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, flow := range s.entries {
+		if now.After(flow.expiry) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// handleDeviceCode starts a GitHub device authorization for clients that can't follow
+// a browser redirect, such as CLI companions.
+func handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// The device flow only needs the client ID; GitHub never sees a secret here
+	app := appForHost(requestHost(r))
+	if app.clientID == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeNotConfigured, "OAuth not configured")
+		return
+	}
+
+	codeResp, err := requestDeviceCode(r.Context(), app, *oauthScopes)
+	if err != nil {
+		errorf("[OAuth] Device code request failed for %s: %v", clientIP(r), err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to start device authorization")
+		return
+	}
+	if codeResp.Interval <= 0 {
+		codeResp.Interval = defaultDeviceInterval
+	}
+	now := time.Now()
+	deviceFlows.start(codeResp.DeviceCode, codeResp.Interval, now.Add(time.Duration(codeResp.ExpiresIn)*time.Second), now)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(codeResp); err != nil {
+		errorf("Failed to encode device code response: %v", err)
+	}
+}
+
+// handleDevicePoll exchanges an approved device code for a token. Until the user approves,
+// it answers 400 with authorization_pending or slow_down and the interval to wait, as
+// RFC 8628 token endpoints do, so clients can poll it like GitHub itself.
+func handleDevicePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		DeviceCode string `json:"device_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+		return
+	}
+	if req.DeviceCode == "" || len(req.DeviceCode) > 512 {
+		writeJSONError(w, http.StatusBadRequest, errCodeMissingDeviceCode, "Missing device_code")
+		return
+	}
+
+	now := time.Now()
+	interval, ok := deviceFlows.poll(req.DeviceCode, now)
+	if !ok {
+		writeDeviceError(w, "slow_down", interval)
+		return
+	}
+
+	app := appForHost(requestHost(r))
+	tokenResp, err := pollDeviceToken(r.Context(), app, req.DeviceCode)
+	var oauthErr *oauthError
+	switch {
+	case errors.As(err, &oauthErr) && oauthErr.Code == "authorization_pending":
+		writeDeviceError(w, oauthErr.Code, interval)
+		return
+	case errors.As(err, &oauthErr) && oauthErr.Code == "slow_down":
+		writeDeviceError(w, oauthErr.Code, deviceFlows.slowDown(req.DeviceCode, oauthErr.Interval, now))
+		return
+	case errors.As(err, &oauthErr):
+		// expired_token, access_denied, and the like end the flow
+		deviceFlows.finish(req.DeviceCode)
+		warnf("[OAuth] Device authorization from %s failed: %s", clientIP(r), oauthErr.Code)
+		writeDeviceError(w, oauthErr.Code, 0)
+		return
+	case err != nil:
+		errorf("[OAuth] Device token poll failed for %s: %v", clientIP(r), err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to check device authorization")
+		return
+	}
+	deviceFlows.finish(req.DeviceCode)
+	issuedTokens.record(tokenResp, time.Now())
+
+	user, err := userInfo(r.Context(), tokenResp.AccessToken)
+	if err != nil {
+		errorf("Failed to get user info for device flow: %v", err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to get user info")
+		return
+	}
+
+	response := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Username     string `json:"username"`
+	}{
+		Token:        tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		Username:     user.Login,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode device token response: %v", err)
+	}
+
+	fields := requestAuditFields(r, auditAllowed)
+	fields["username"] = user.Login
+	fields["flow"] = "device"
+	auditLog(auditLoginSuccess, fields)
+}
+
+// writeDeviceError writes an RFC 8628 style error, with the polling interval when the
+// client should keep trying.
+func writeDeviceError(w http.ResponseWriter, code string, interval int) {
+	response := struct {
+		Error    string `json:"error"`
+		Interval int    `json:"interval,omitempty"`
+	}{Error: code, Interval: interval}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode device error response: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rewindDeviceFlows makes every tracked device authorization due for polling.
+func rewindDeviceFlows() {
+	deviceFlows.mu.Lock()
+	defer deviceFlows.mu.Unlock()
+	for key, flow := range deviceFlows.entries {
+		flow.nextPoll = time.Time{}
+		deviceFlows.entries[key] = flow
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	setClientSecret(t, "test_secret")
+	const deviceCode = "3584d83530557fdd1f46af8289938c8ef79f9dc5"
+
+	tokenResponses := []string{
+		`{"error":"authorization_pending","error_description":"The authorization request is still pending."}`,
+		`{"error":"slow_down","interval":15}`,
+		`{"access_token":"` + testToken + `","token_type":"bearer","scope":"repo"}`,
+	}
+	var tokenCalls atomic.Int32
+	stubClient(t, &oauthClient, func(r *http.Request) (*http.Response, error) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm() error = %v", err)
+		}
+		switch r.URL.Path {
+		case "/login/device/code":
+			if r.PostForm.Get("client_id") == "" {
+				t.Error("device code request missing client_id")
+			}
+			return stubResponse(http.StatusOK, `{"device_code":"`+deviceCode+`","user_code":"WDJB-MJHT","verification_uri":"https://github.com/login/device","expires_in":900,"interval":5}`), nil
+		case "/login/oauth/access_token":
+			if got := r.PostForm.Get("grant_type"); got != "urn:ietf:params:oauth:grant-type:device_code" {
+				t.Errorf("grant_type = %q", got)
+			}
+			if got := r.PostForm.Get("device_code"); got != deviceCode {
+				t.Errorf("device_code = %q", got)
+			}
+			n := tokenCalls.Add(1)
+			return stubResponse(http.StatusOK, tokenResponses[min(int(n), len(tokenResponses))-1]), nil
+		default:
+			t.Errorf("unexpected request to %s", r.URL)
+			return stubResponse(http.StatusNotFound, ""), nil
+		}
+	})
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	rr := httptest.NewRecorder()
+	handleDeviceCode(rr, httptest.NewRequest(http.MethodPost, "/oauth/device/code", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("device code status = %d: %s", rr.Code, rr.Body)
+	}
+	var codeResp deviceCodeResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &codeResp); err != nil {
+		t.Fatalf("invalid device code response: %v", err)
+	}
+	if codeResp.UserCode != "WDJB-MJHT" || codeResp.VerificationURI == "" || codeResp.DeviceCode != deviceCode {
+		t.Errorf("device code response = %+v", codeResp)
+	}
+	t.Cleanup(func() { deviceFlows.finish(deviceCode) })
+
+	poll := func() (int, map[string]any) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/oauth/device/token", strings.NewReader(`{"device_code":"`+deviceCode+`"}`))
+		handleDevicePoll(rr, req)
+		var body map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid poll response %q: %v", rr.Body.String(), err)
+		}
+		return rr.Code, body
+	}
+
+	steps := []struct {
+		name         string
+		rewind       bool
+		wantStatus   int
+		wantError    string
+		wantInterval float64
+		wantCalls    int32
+	}{
+		{name: "polling early is slowed down locally", wantStatus: http.StatusBadRequest, wantError: "slow_down", wantInterval: 10, wantCalls: 0},
+		{name: "pending", rewind: true, wantStatus: http.StatusBadRequest, wantError: "authorization_pending", wantInterval: 10, wantCalls: 1},
+		{name: "GitHub slow_down raises interval", rewind: true, wantStatus: http.StatusBadRequest, wantError: "slow_down", wantInterval: 15, wantCalls: 2},
+		{name: "approved", rewind: true, wantStatus: http.StatusOK, wantCalls: 3},
+	}
+	for _, step := range steps {
+		if step.rewind {
+			rewindDeviceFlows()
+		}
+		status, body := poll()
+		if status != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d (%v)", step.name, status, step.wantStatus, body)
+		}
+		if got := tokenCalls.Load(); got != step.wantCalls {
+			t.Errorf("%s: GitHub polled %d times, want %d", step.name, got, step.wantCalls)
+		}
+		if step.wantError != "" {
+			if body["error"] != step.wantError || body["interval"] != step.wantInterval {
+				t.Errorf("%s: body = %v, want error %q interval %v", step.name, body, step.wantError, step.wantInterval)
+			}
+			continue
+		}
+		if body["token"] != testToken || body["username"] != "octocat" {
+			t.Errorf("%s: body = %v", step.name, body)
+		}
+	}
+
+	deviceFlows.mu.Lock()
+	remaining := len(deviceFlows.entries)
+	deviceFlows.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d device flows still tracked after success", remaining)
+	}
+}
+
+// Device code requests share the exchange limiter; a request waiting on GitHub must not
+// hold its lock and serialize everyone else's.
+func TestDeviceCodeRequestsRunConcurrently(t *testing.T) {
+	newTestServer(t, Config{RateLimitRequests: 10, RateLimitWindow: time.Minute})
+	setClientSecret(t, "test_secret")
+
+	var inFlight, issued atomic.Int32
+	both := make(chan struct{})
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		if inFlight.Add(1) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			t.Error("device code requests were serialized by the rate limiter")
+		}
+		code := "concurrent-" + strconv.Itoa(int(issued.Add(1)))
+		t.Cleanup(func() { deviceFlows.finish(code) })
+		return stubResponse(http.StatusOK, `{"device_code":"`+code+`","user_code":"WDJB-MJHT","verification_uri":"https://github.com/login/device","expires_in":900,"interval":5}`), nil
+	})
+
+	handler := exchangeRateLimiter.limitHandler(handleDeviceCode)
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodPost, "/oauth/device/code", http.NoBody)
+			req.RemoteAddr = "192.0.2." + strconv.Itoa(i+1) + ":1234"
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("device code status = %d: %s", rr.Code, rr.Body)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Unknown device codes skip the per-code throttle and each cost a GitHub call, so a flood of
+// them from one IP must hit the per-IP limit.
+func TestDevicePollRateLimited(t *testing.T) {
+	resetFailedAttempts(t)
+	handler := newTestServer(t, Config{})
+	setClientSecret(t, "test_secret")
+
+	var calls atomic.Int32
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return stubResponse(http.StatusOK, `{"error":"incorrect_device_code"}`), nil
+	})
+
+	for i := range devicePollsPerMinute + 1 {
+		body := `{"device_code":"unknown-` + strconv.Itoa(i) + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/oauth/device/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if limited := rr.Code == http.StatusTooManyRequests; limited != (i == devicePollsPerMinute) {
+			t.Fatalf("poll %d: status = %d: %s", i+1, rr.Code, rr.Body)
+		}
+	}
+	if got := calls.Load(); got != devicePollsPerMinute {
+		t.Errorf("GitHub polled %d times, want %d", got, devicePollsPerMinute)
+	}
+}
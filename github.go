@@ -0,0 +1,967 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/codeGROOVE-dev/retry"
+)
+
+// HTTP clients for outbound GitHub calls, rebuilt at startup with --github-max-redirects
+// (except avatarClient, whose redirects are expected). Tests replace these with stubs.
+var (
+	// oauthClient talks to github.com's OAuth endpoints.
+	oauthClient = newGitHubClient(defaultMaxRedirects)
+
+	// apiClient talks to api.github.com.
+	apiClient = newGitHubClient(defaultMaxRedirects)
+
+	// avatarClient fetches avatars for /avatar from github.com and its avatar CDN.
+	avatarClient = newAvatarClient()
+)
+
+const (
+	defaultGitHubConcurrency  = 64
+	defaultGitHubQueueTimeout = 2 * time.Second
+)
+
+// errGitHubBusy means an outbound GitHub call found no free slot in time.
+var errGitHubBusy = errors.New("too many concurrent GitHub calls")
+
+// githubCalls bounds concurrent outbound GitHub calls, so a login rush can't open more
+// connections than GitHub (or the NAT in front of us) tolerates. Nil is unlimited.
+var githubCalls *callLimiter
+
+// busyWarnInterval spaces out the warning logged when a call finds every slot busy.
+const busyWarnInterval = time.Minute
+
+// callLimiter is a counting semaphore whose waiters give up after wait.
+type callLimiter struct {
+	slots   chan struct{}
+	wait    time.Duration
+	busyLog *logThrottle
+}
+
+// newCallLimiter returns a limiter allowing limit calls at once, or nil when limit is zero.
+func newCallLimiter(limit int, wait time.Duration) *callLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &callLimiter{slots: make(chan struct{}, limit), wait: wait, busyLog: &logThrottle{interval: busyWarnInterval}}
+}
+
+// acquire takes a slot, waiting at most l.wait, and returns the func that gives it back.
+// Each attempt of a retried call acquires separately so backoff sleeps don't hold a slot.
+func (l *callLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		if ok, dropped := l.busyLog.allow(time.Now()); ok {
+			warnf("All %d GitHub call slots busy for %v; failing the call (%d more since the last warning)", cap(l.slots), l.wait, dropped)
+		}
+		return nil, fmt.Errorf("%w: no slot free within %v", errGitHubBusy, l.wait)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newGitHubClient returns a client for GitHub calls that follows at most maxRedirects
+// redirects, and only to HTTPS URLs. Zero refuses all redirects.
+func newGitHubClient(maxRedirects int) *http.Client {
+	return &http.Client{
+		Timeout: httpTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing redirect to non-HTTPS URL %s", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// defaultTokenPrefixes are the GitHub token prefixes accepted from OAuth token responses:
+// classic and fine-grained PATs, OAuth app, GitHub App user-to-server, and installation tokens.
+const defaultTokenPrefixes = "ghp_,github_pat_,gho_,ghu_,ghs_"
+
+// acceptedTokenPrefixes is --token-prefixes parsed; empty accepts any format.
+var acceptedTokenPrefixes = parseTokenPrefixes(defaultTokenPrefixes)
+
+// parseTokenPrefixes splits a comma-separated prefix list, dropping blanks.
+func parseTokenPrefixes(spec string) []string {
+	var prefixes []string
+	for prefix := range strings.SplitSeq(spec, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// knownTokenFormat reports whether token starts with an accepted prefix.
+// With --token-prefix-check=false the list is empty and every token passes.
+func knownTokenFormat(token string) bool {
+	if len(acceptedTokenPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range acceptedTokenPrefixes {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthTokenResponse represents the GitHub OAuth token response.
+// RefreshToken and the expiry fields are only set for apps with token expiration enabled.
+type oauthTokenResponse struct {
+	AccessToken           string `json:"access_token"`
+	TokenType             string `json:"token_type"`
+	Scope                 string `json:"scope"`
+	RefreshToken          string `json:"refresh_token"`
+	Error                 string `json:"error"`
+	ErrorDescription      string `json:"error_description"`
+	ExpiresIn             int    `json:"expires_in"`
+	RefreshTokenExpiresIn int    `json:"refresh_token_expires_in"`
+	Interval              int    `json:"interval"` // device flow: minimum seconds between polls, sent with slow_down
+}
+
+// expiries converts expires_in and refresh_token_expires_in into absolute times from
+// now. Either is zero when GitHub didn't send it, as for apps without token expiration.
+func (t *oauthTokenResponse) expiries(now time.Time) (token, refresh time.Time) {
+	if t.ExpiresIn > 0 {
+		token = now.Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	if t.RefreshTokenExpiresIn > 0 {
+		refresh = now.Add(time.Duration(t.RefreshTokenExpiresIn) * time.Second)
+	}
+	return token, refresh
+}
+
+// parseScopes splits GitHub's granted scope string, which may be comma- or
+// space-separated (or both), into individual scopes. It never returns nil.
+func parseScopes(scope string) []string {
+	scopes := []string{}
+	for s := range strings.FieldsFuncSeq(scope, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		scopes = append(scopes, s)
+	}
+	return scopes
+}
+
+// deviceCodeResponse is GitHub's answer to a device authorization request.
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// tokenDetails is the subset of GitHub's token check response exposed to clients.
+type tokenDetails struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	Scopes    []string   `json:"scopes"`
+}
+
+// githubUser represents a GitHub user.
+type githubUser struct {
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	ID        int    `json:"id"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// githubEmail is an address from GET /user/emails.
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// githubOrg is an organization from GET /user/orgs.
+type githubOrg struct {
+	Login string `json:"login"`
+	ID    int    `json:"id"`
+}
+
+// orgMembership is a user's membership in a GitHub organization.
+type orgMembership struct {
+	State string `json:"state"` // "active" or "pending"
+	Role  string `json:"role"`  // "admin" or "member"
+}
+
+// errTokenRejected indicates GitHub refused to issue a token, e.g. for a bad or expired
+// authorization code or refresh token.
+var errTokenRejected = errors.New("token request rejected")
+
+// oauthError is an OAuth error response from the token endpoint, such as
+// bad_verification_code or, during the device flow, authorization_pending.
+type oauthError struct {
+	Code        string
+	Description string
+	Interval    int // seconds; only set with slow_down
+}
+
+func (e *oauthError) Error() string {
+	return fmt.Sprintf("%v: no access token in response (%s)", errTokenRejected, e.Code)
+}
+
+func (e *oauthError) Unwrap() error { return errTokenRejected }
+
+func exchangeCodeForToken(ctx context.Context, app oauthApp, code, redirectURI string) (*oauthTokenResponse, error) {
+	// Validate inputs
+	if code == "" || redirectURI == "" {
+		return nil, errors.New("invalid parameters")
+	}
+
+	// Additional validation for code length to prevent injection
+	if len(code) > 512 {
+		return nil, errors.New("authorization code too long")
+	}
+
+	form := url.Values{}
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+
+	tokenResp, err := requestToken(ctx, app, "github.token_exchange", form)
+	if err != nil {
+		return nil, err
+	}
+
+	logf(ctx, "Successfully exchanged OAuth code for token")
+	return tokenResp, nil
+}
+
+// refreshAccessToken exchanges a refresh token for a new access token and rotated refresh token.
+// Only OAuth apps with token expiration enabled issue refresh tokens.
+func refreshAccessToken(ctx context.Context, app oauthApp, refreshToken string) (*oauthTokenResponse, error) {
+	if refreshToken == "" || len(refreshToken) > 512 {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	tokenResp, err := requestToken(ctx, app, "github.token_refresh", form)
+	if err != nil {
+		return nil, err
+	}
+
+	logf(ctx, "Successfully refreshed OAuth token")
+	return tokenResp, nil
+}
+
+// pollDeviceToken asks GitHub whether the user has approved a device authorization.
+// Until they do, it returns an *oauthError with Code authorization_pending or slow_down.
+func pollDeviceToken(ctx context.Context, app oauthApp, deviceCode string) (*oauthTokenResponse, error) {
+	if deviceCode == "" || len(deviceCode) > 512 {
+		return nil, errors.New("invalid device code")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+	form.Set("device_code", deviceCode)
+
+	tokenResp, err := requestToken(ctx, app, "github.device_token", form)
+	if err != nil {
+		return nil, err
+	}
+
+	logf(ctx, "Successfully completed device authorization")
+	return tokenResp, nil
+}
+
+// requestDeviceCode starts a device authorization for the app, returning the code
+// the user enters at GitHub's verification URI.
+func requestDeviceCode(ctx context.Context, app oauthApp, scopes string) (*deviceCodeResponse, error) {
+	var codeResp deviceCodeResponse
+
+	ctx, sp := startSpan(ctx, "github.device_code", spanKindClient)
+	sp.setAttr("server.address", "github.com")
+	attempts, status := 0, 0
+
+	err := githubRetry.do(
+		ctx,
+		func() error {
+			attempts++
+			data := url.Values{}
+			data.Set("client_id", app.clientID)
+			data.Set("scope", scopes)
+
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(
+				reqCtx,
+				http.MethodPost,
+				"https://github.com/login/device/code",
+				strings.NewReader(data.Encode()),
+			)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Accept", "application/json")
+
+			injectTraceparent(ctx, req)
+			resp, err := oauthClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] Device code request network error (will retry): %v", err)
+				return fmt.Errorf("device code request failed: %w", err)
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+			status = resp.StatusCode
+
+			if resp.StatusCode >= 500 {
+				debugf(ctx, "[RETRY] Device code request returned %d (will retry)", resp.StatusCode)
+				return fmt.Errorf("device code request returned status %d", resp.StatusCode)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return retry.Unrecoverable(fmt.Errorf("device code request returned status %d", resp.StatusCode))
+			}
+
+			if err := json.NewDecoder(resp.Body).Decode(&codeResp); err != nil {
+				return retry.Unrecoverable(fmt.Errorf("failed to parse device code response: %w", err))
+			}
+			// GitHub answers 200 with an error body when the app hasn't enabled the device flow
+			if codeResp.DeviceCode == "" || codeResp.UserCode == "" {
+				return retry.Unrecoverable(errors.New("no device code in response"))
+			}
+			return nil
+		},
+		retry.BackOffDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] Attempt %d: %v", n+1, err)
+		},
+	)
+	sp.setAttr("http.response.status_code", status)
+	sp.setAttr("retry.count", max(attempts-1, 0))
+	sp.setError(err)
+	sp.finish()
+	if err != nil {
+		return nil, err
+	}
+	return &codeResp, nil
+}
+
+// requestToken posts form to GitHub's OAuth token endpoint with the app's credentials,
+// retrying transient failures, and validates the issued access token.
+func requestToken(ctx context.Context, app oauthApp, spanName string, form url.Values) (*oauthTokenResponse, error) {
+	var tokenResp oauthTokenResponse
+
+	ctx, sp := startSpan(ctx, spanName, spanKindClient)
+	sp.setAttr("server.address", "github.com")
+	attempts, status := 0, 0
+
+	// Retry with exponential backoff per githubRetry
+	err := githubRetry.do(
+		ctx,
+		func() error {
+			attempts++
+			// Prepare request
+			data := url.Values{}
+			for key, values := range form {
+				data[key] = values
+			}
+			data.Set("client_id", app.clientID)
+			data.Set("client_secret", app.clientSecret)
+
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(
+				reqCtx,
+				http.MethodPost,
+				"https://github.com/login/oauth/access_token",
+				strings.NewReader(data.Encode()),
+			)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Accept", "application/json")
+
+			injectTraceparent(ctx, req)
+			resp, err := oauthClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] Token exchange network error (will retry): %v", err)
+				return fmt.Errorf("token exchange failed: %w", err)
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+			status = resp.StatusCode
+
+			// Retry on 5xx server errors
+			if resp.StatusCode >= 500 {
+				debugf(ctx, "[RETRY] Token exchange returned %d (will retry)", resp.StatusCode)
+				return fmt.Errorf("token exchange returned status %d", resp.StatusCode)
+			}
+
+			// Don't retry on 4xx client errors
+			if resp.StatusCode != http.StatusOK {
+				return retry.Unrecoverable(fmt.Errorf("token exchange returned status %d", resp.StatusCode))
+			}
+
+			// Read the entire response body
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return retry.Unrecoverable(fmt.Errorf("failed to read response body: %w", err))
+			}
+
+			// Parse response
+			if err := json.Unmarshal(body, &tokenResp); err != nil {
+				logf(ctx, "Failed to parse token response: %v", err)
+				return retry.Unrecoverable(fmt.Errorf("failed to parse token response: %w", err))
+			}
+
+			if tokenResp.AccessToken == "" {
+				// Pending device authorizations are routine and polled every few seconds
+				if tokenResp.Error != "authorization_pending" && tokenResp.Error != "slow_down" {
+					logf(ctx, "Token response error: %s, description: %s", tokenResp.Error, tokenResp.ErrorDescription)
+				}
+				return retry.Unrecoverable(&oauthError{
+					Code:        tokenResp.Error,
+					Description: tokenResp.ErrorDescription,
+					Interval:    tokenResp.Interval,
+				})
+			}
+
+			return nil
+		},
+		retry.BackOffDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] Attempt %d: %v", n+1, err)
+		},
+	)
+	sp.setAttr("http.response.status_code", status)
+	sp.setAttr("retry.count", max(attempts-1, 0))
+	sp.setError(err)
+	sp.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate token before returning
+	if len(tokenResp.AccessToken) < 40 || len(tokenResp.AccessToken) > 255 {
+		return nil, errors.New("invalid token length")
+	}
+
+	// Check token format
+	if !knownTokenFormat(tokenResp.AccessToken) {
+		return nil, errors.New("unknown token format")
+	}
+
+	return &tokenResp, nil
+}
+
+func userInfo(ctx context.Context, token string) (*githubUser, error) {
+	var user githubUser
+
+	ctx, sp := startSpan(ctx, "github.user_info", spanKindClient)
+	sp.setAttr("server.address", "api.github.com")
+	attempts, status := 0, 0
+
+	// Retry with exponential backoff per githubRetry
+	err := githubRetry.do(
+		ctx,
+		func() error {
+			attempts++
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "https://api.github.com/user", http.NoBody)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+			injectTraceparent(ctx, req)
+			resp, err := apiClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] GitHub user info network error (will retry): %v", err)
+				return err
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+			status = resp.StatusCode
+
+			// Retry on 5xx server errors
+			if resp.StatusCode >= 500 {
+				debugf(ctx, "[RETRY] GitHub user info returned %d (will retry)", resp.StatusCode)
+				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+			}
+
+			// Rate limits clear on their own; wait as long as GitHub asks
+			if err := checkRateLimit(ctx, resp, "user info"); err != nil {
+				return err
+			}
+
+			if resp.StatusCode == http.StatusUnauthorized {
+				return retry.Unrecoverable(fmt.Errorf("%w: unauthorized", errTokenRejected))
+			}
+
+			// Don't retry on other 4xx client errors
+			if resp.StatusCode != http.StatusOK {
+				return retry.Unrecoverable(fmt.Errorf("unexpected status: %d", resp.StatusCode))
+			}
+
+			if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			return nil
+		},
+		githubRetryDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] User info attempt %d: %v", n+1, err)
+		},
+	)
+	sp.setAttr("http.response.status_code", status)
+	sp.setAttr("retry.count", max(attempts-1, 0))
+	sp.setError(err)
+	sp.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	debugf(ctx, "Successfully fetched user info for: %s", user.Login)
+	return &user, nil
+}
+
+// checkToken asks GitHub whether a token issued to our OAuth app is still valid.
+// Returns nil details and no error when GitHub reports the token as invalid.
+func checkToken(ctx context.Context, app oauthApp, token string) (*tokenDetails, error) {
+	var details *tokenDetails
+
+	body, err := json.Marshal(map[string]string{"access_token": token})
+	if err != nil {
+		return nil, err
+	}
+
+	err = githubRetry.do(
+		ctx,
+		func() error {
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(
+				reqCtx,
+				http.MethodPost,
+				"https://api.github.com/applications/"+url.PathEscape(app.clientID)+"/token",
+				bytes.NewReader(body),
+			)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			req.SetBasicAuth(app.clientID, app.clientSecret)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/vnd.github+json")
+
+			resp, err := apiClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] GitHub token check network error (will retry): %v", err)
+				return err
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+
+			switch {
+			case resp.StatusCode >= 500:
+				debugf(ctx, "[RETRY] GitHub token check returned %d (will retry)", resp.StatusCode)
+				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+			case isRateLimited(resp):
+				return checkRateLimit(ctx, resp, "token check")
+			case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusUnprocessableEntity:
+				// GitHub reports unknown, revoked, or malformed tokens this way
+				details = nil
+				return nil
+			case resp.StatusCode != http.StatusOK:
+				return retry.Unrecoverable(fmt.Errorf("unexpected status: %d", resp.StatusCode))
+			default:
+			}
+
+			var d tokenDetails
+			if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+				return retry.Unrecoverable(err)
+			}
+			details = &d
+			return nil
+		},
+		githubRetryDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] Token check attempt %d: %v", n+1, err)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return details, nil
+}
+
+// userOrgMembership fetches the token owner's membership in org.
+// Returns nil membership and no error when GitHub reports the user isn't a member.
+func userOrgMembership(ctx context.Context, token, org string) (*orgMembership, error) {
+	var membership *orgMembership
+
+	ctx, sp := startSpan(ctx, "github.org_membership", spanKindClient)
+	sp.setAttr("server.address", "api.github.com")
+	status := 0
+
+	err := githubRetry.do(
+		ctx,
+		func() error {
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet,
+				"https://api.github.com/user/memberships/orgs/"+url.PathEscape(org), http.NoBody)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Accept", "application/vnd.github+json")
+
+			injectTraceparent(ctx, req)
+			resp, err := apiClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] GitHub org membership network error (will retry): %v", err)
+				return err
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+			status = resp.StatusCode
+
+			switch {
+			case resp.StatusCode >= 500:
+				debugf(ctx, "[RETRY] GitHub org membership returned %d (will retry)", resp.StatusCode)
+				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+			case isRateLimited(resp):
+				return checkRateLimit(ctx, resp, "org membership")
+			case resp.StatusCode == http.StatusNotFound:
+				// GitHub answers 404 both for non-members and for orgs that don't exist
+				membership = nil
+				return nil
+			case resp.StatusCode == http.StatusUnauthorized:
+				return retry.Unrecoverable(fmt.Errorf("%w: unauthorized", errTokenRejected))
+			case resp.StatusCode != http.StatusOK:
+				return retry.Unrecoverable(fmt.Errorf("unexpected status: %d", resp.StatusCode))
+			default:
+			}
+
+			var m orgMembership
+			if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+				return retry.Unrecoverable(err)
+			}
+			membership = &m
+			return nil
+		},
+		githubRetryDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] Org membership attempt %d: %v", n+1, err)
+		},
+	)
+	sp.setAttr("http.response.status_code", status)
+	sp.setError(err)
+	sp.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	return membership, nil
+}
+
+// userPrimaryEmail returns the token owner's primary verified email, or "" when there is none.
+func userPrimaryEmail(ctx context.Context, token string) (string, error) {
+	var emails []githubEmail
+	if err := getGitHubJSON(ctx, token, "github.user_emails", "/user/emails", &emails); err != nil {
+		return "", err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// userOrgs returns the organizations the token owner belongs to.
+func userOrgs(ctx context.Context, token string) ([]githubOrg, error) {
+	orgs := []githubOrg{}
+	if err := getGitHubJSON(ctx, token, "github.user_orgs", "/user/orgs?per_page=100", &orgs); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// rateLimitBucket is one of GitHub's rate limit resources. Reset is Unix seconds.
+type rateLimitBucket struct {
+	Limit     int   `json:"limit"`
+	Remaining int   `json:"remaining"`
+	Used      int   `json:"used"`
+	Reset     int64 `json:"reset"`
+}
+
+// githubRateLimits is the subset of GET /rate_limit the dashboard reports.
+type githubRateLimits struct {
+	Resources struct {
+		Core    rateLimitBucket `json:"core"`
+		Search  rateLimitBucket `json:"search"`
+		GraphQL rateLimitBucket `json:"graphql"`
+	} `json:"resources"`
+}
+
+// tokenRateLimits returns the token owner's remaining GitHub API quota.
+// GitHub doesn't count /rate_limit calls against it.
+func tokenRateLimits(ctx context.Context, token string) (*githubRateLimits, error) {
+	var limits githubRateLimits
+	if err := getGitHubJSON(ctx, token, "github.rate_limit", "/rate_limit", &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// getGitHubJSON fetches an api.github.com path as the token owner and decodes the JSON response into v,
+// retrying network errors and 5xx responses.
+func getGitHubJSON(ctx context.Context, token, spanName, path string, v any) error {
+	ctx, sp := startSpan(ctx, spanName, spanKindClient)
+	sp.setAttr("server.address", "api.github.com")
+	status := 0
+
+	err := githubRetry.do(
+		ctx,
+		func() error {
+			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "https://api.github.com"+path, http.NoBody)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Accept", "application/vnd.github+json")
+
+			injectTraceparent(ctx, req)
+			resp, err := apiClient.Do(req)
+			if err != nil {
+				debugf(ctx, "[RETRY] GitHub %s network error (will retry): %v", path, err)
+				return err
+			}
+			defer func() {
+				if err := resp.Body.Close(); err != nil {
+					logf(ctx, "Failed to close response body: %v", err)
+				}
+			}()
+			status = resp.StatusCode
+
+			switch {
+			case resp.StatusCode >= 500:
+				debugf(ctx, "[RETRY] GitHub %s returned %d (will retry)", path, resp.StatusCode)
+				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+			case isRateLimited(resp):
+				return checkRateLimit(ctx, resp, path)
+			case resp.StatusCode == http.StatusUnauthorized:
+				return retry.Unrecoverable(fmt.Errorf("%w: unauthorized", errTokenRejected))
+			case resp.StatusCode != http.StatusOK:
+				return retry.Unrecoverable(fmt.Errorf("unexpected status: %d", resp.StatusCode))
+			default:
+			}
+
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				return retry.Unrecoverable(err)
+			}
+			return nil
+		},
+		githubRetryDelay,
+		func(n uint, err error) {
+			debugf(ctx, "[RETRY] GitHub %s attempt %d: %v", path, n+1, err)
+		},
+	)
+	sp.setAttr("http.response.status_code", status)
+	sp.setError(err)
+	sp.finish()
+	return err
+}
+
+// defaultRetryAfter is how long to wait on a rate limit response that doesn't say,
+// per GitHub's guidance for secondary rate limits.
+const defaultRetryAfter = time.Minute
+
+// rateLimitError is a GitHub primary or secondary rate limit, carrying how long GitHub asked us to wait.
+type rateLimitError struct {
+	wait   time.Duration
+	status int
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited (status %d), retry after %v", e.status, e.wait)
+}
+
+// isRateLimited reports whether resp is a rate limit rather than an authorization failure.
+// GitHub uses 429 or 403 with rate limit headers; a bare 403 means access was denied.
+func isRateLimited(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		return resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0"
+	default:
+		return false
+	}
+}
+
+// rateLimitWait returns how long GitHub asked us to wait: Retry-After (seconds) wins,
+// then X-RateLimit-Reset (epoch seconds) when the quota is exhausted, else defaultRetryAfter.
+func rateLimitWait(resp *http.Response, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(time.Unix(reset, 0).Sub(now), 0)
+		}
+	}
+	return defaultRetryAfter
+}
+
+// checkRateLimit returns a retryable *rateLimitError when resp is a rate limit response.
+func checkRateLimit(ctx context.Context, resp *http.Response, what string) error {
+	if !isRateLimited(resp) {
+		return nil
+	}
+	err := &rateLimitError{status: resp.StatusCode, wait: rateLimitWait(resp, time.Now())}
+	logf(ctx, "[RETRY] GitHub %s %v", what, err)
+	return err
+}
+
+// githubRetryDelay waits as long as GitHub asked after a rate limit, and backs off
+// exponentially otherwise. retry.MaxDelay caps both.
+func githubRetryDelay(attempt uint, err error, config *retry.Config) time.Duration {
+	var rl *rateLimitError
+	if errors.As(err, &rl) {
+		return rl.wait
+	}
+	return retry.BackOffDelay(attempt, err, config)
+}
+
+// retryConfig tunes the backoff of outbound GitHub calls.
+type retryConfig struct {
+	Attempts  uint
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	MaxJitter time.Duration
+}
+
+// defaultRetryConfig retries for up to about two minutes before giving up.
+var defaultRetryConfig = retryConfig{
+	Attempts:  10,
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  30 * time.Second,
+	MaxJitter: time.Second,
+}
+
+// githubRetry is the backoff every outbound GitHub call uses, set from the
+// --github-retry-* flags by newServer.
+var githubRetry = defaultRetryConfig
+
+// do runs fn with retry.Do and c's options, holding a githubCalls slot for each attempt.
+// Slots are taken per attempt so backoff sleeps don't hold one, and a call that finds
+// every slot busy fails at once with errGitHubBusy rather than queueing again.
+func (c retryConfig) do(ctx context.Context, fn retry.RetryableFunc, delay retry.DelayTypeFunc, onRetry retry.OnRetryFunc) error {
+	return retry.Do(
+		func() error {
+			release, err := githubCalls.acquire(ctx)
+			if err != nil {
+				return retry.Unrecoverable(err)
+			}
+			defer release()
+			return fn()
+		},
+		c.options(ctx, delay, onRetry)...,
+	)
+}
+
+// options returns the retry options for one call: delay picks each wait (before
+// MaxJitter is added and the MaxDelay cap), and onRetry logs each failed attempt.
+func (c retryConfig) options(ctx context.Context, delay retry.DelayTypeFunc, onRetry retry.OnRetryFunc) []retry.Option {
+	return []retry.Option{
+		retry.Context(ctx),
+		retry.Attempts(c.Attempts),
+		retry.Delay(c.BaseDelay),
+		retry.MaxDelay(c.MaxDelay),
+		retry.DelayType(withJitter(delay)),
+		retry.WithTimer(retryTimer),
+		retry.MaxJitter(c.MaxJitter),
+		retry.OnRetry(onRetry),
+	}
+}
+
+// withJitter adds up to MaxJitter of random delay to each backoff, so callers that failed
+// together don't retry together. Rate-limit waits stay exact, since GitHub named the time.
+func withJitter(delay retry.DelayTypeFunc) retry.DelayTypeFunc {
+	return func(attempt uint, err error, config *retry.Config) time.Duration {
+		d := delay(attempt, err, config)
+		var rl *rateLimitError
+		if errors.As(err, &rl) {
+			return d
+		}
+		return d + retry.RandomDelay(attempt, err, config)
+	}
+}
+
+// retryTimer schedules retry delays. Tests replace it to observe waits without sleeping.
+var retryTimer retry.Timer = realTimer{}
+
+type realTimer struct{}
+
+func (realTimer) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
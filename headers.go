@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// extraHeader is one --extra-headers entry, added to every response.
+type extraHeader struct {
+	name  string
+	value string
+}
+
+// Parsed --extra-headers entries; empty adds nothing.
+var extraHeaders []extraHeader
+
+// protectedHeaders are set by securityHeaders, CORS, or the handlers themselves, so
+// --extra-headers may not replace them: a typo there could silently weaken the CSP or
+// framing protection of every response.
+var protectedHeaders = map[string]bool{
+	"Content-Security-Policy":             true,
+	"Content-Security-Policy-Report-Only": true,
+	"X-Frame-Options":                     true,
+	"X-Content-Type-Options":              true,
+	"X-Xss-Protection":                    true,
+	"Referrer-Policy":                     true,
+	"Permissions-Policy":                  true,
+	"Strict-Transport-Security":           true,
+	"Reporting-Endpoints":                 true,
+	"X-Request-Id":                        true,
+	"Set-Cookie":                          true,
+	"Cache-Control":                       true,
+	"Content-Type":                        true,
+	"Content-Length":                      true,
+	"Content-Encoding":                    true,
+	"Transfer-Encoding":                   true,
+	"Connection":                          true,
+	"Vary":                                true,
+	"Location":                            true,
+}
+
+// parseExtraHeaders parses comma-separated Name:value pairs for --extra-headers. Names
+// must be valid header tokens outside protectedHeaders and the Access-Control-* family;
+// values may not contain commas, which separate entries.
+func parseExtraHeaders(spec string) ([]extraHeader, error) {
+	var headers []extraHeader
+	seen := make(map[string]bool)
+	for entry := range strings.SplitSeq(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid header %q: want Name:value", entry)
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("header %s: value contains control characters", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if protectedHeaders[name] || strings.HasPrefix(name, "Access-Control-") {
+			return nil, fmt.Errorf("header %s is set by the server and can't be overridden", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate header %s", name)
+		}
+		seen[name] = true
+		headers = append(headers, extraHeader{name: name, value: value})
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// setExtraHeaders adds the --extra-headers entries to a response.
+func setExtraHeaders(h http.Header) {
+	for _, eh := range extraHeaders {
+		h.Set(eh.name, eh.value)
+	}
+}
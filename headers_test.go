@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseExtraHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []extraHeader
+		wantErr string
+	}{
+		{name: "empty", spec: ""},
+		{
+			name: "two headers",
+			spec: "x-deployment-region: us-east1, X-Compliance-Zone:eu ",
+			want: []extraHeader{{name: "X-Deployment-Region", value: "us-east1"}, {name: "X-Compliance-Zone", value: "eu"}},
+		},
+		{name: "csp override", spec: "Content-Security-Policy: default-src *", wantErr: "can't be overridden"},
+		{name: "csp override any case", spec: "content-security-policy:default-src *", wantErr: "can't be overridden"},
+		{name: "frame options override", spec: "X-Frame-Options:ALLOWALL", wantErr: "can't be overridden"},
+		{name: "cors override", spec: "Access-Control-Allow-Origin:*", wantErr: "can't be overridden"},
+		{name: "missing value", spec: "X-Region", wantErr: "want Name:value"},
+		{name: "bad name", spec: "X Region:us", wantErr: "invalid header name"},
+		{name: "duplicate", spec: "X-Region:us,x-region:eu", wantErr: "duplicate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExtraHeaders(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseExtraHeaders(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExtraHeaders(%q) error = %v", tt.spec, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseExtraHeaders(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("header %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExtraHeadersApplied(t *testing.T) {
+	orig := extraHeaders
+	extraHeaders = []extraHeader{{name: "X-Deployment-Region", value: "us-east1"}}
+	t.Cleanup(func() { extraHeaders = orig })
+
+	handler := newTestServer(t, Config{})
+	for _, path := range []string{"/", "/health", "/oauth/csrf", "/missing.ico"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://my."+baseDomain+path, http.NoBody))
+		if got := rr.Header().Get("X-Deployment-Region"); got != "us-east1" {
+			t.Errorf("%s: X-Deployment-Region = %q, want us-east1", path, got)
+		}
+		if rr.Header().Get("Content-Security-Policy") == "" || rr.Header().Get("X-Frame-Options") != "DENY" {
+			t.Errorf("%s: built-in security headers missing", path)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHeartbeatInterval keeps unauthenticated pings well inside GitHub's 60 requests
+	// an hour per IP; a rate-limited answer still proves GitHub is reachable anyway.
+	defaultHeartbeatInterval = 2 * time.Minute
+
+	// heartbeatDegradedFailures consecutive failed pings mark GitHub unreachable for /readyz.
+	heartbeatDegradedFailures = 3
+
+	// heartbeatMaxDoublings caps the backoff after failed pings at 8x the interval.
+	heartbeatMaxDoublings = 3
+)
+
+// heartbeatURL is pinged by the GitHub heartbeat. Tests point it at a stub.
+var heartbeatURL = "https://api.github.com/"
+
+// githubHeartbeat tracks GitHub API reachability from periodic unauthenticated pings, so
+// an outage shows up in /health and /readyz before users hit it.
+type githubHeartbeat struct {
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastError   string
+	latency     time.Duration
+	failures    int
+	mu          sync.Mutex
+}
+
+// heartbeatStatus is the heartbeat as reported by /debug/github. Ping errors can name
+// internal proxies and addresses, so the public endpoints get a publicHeartbeat instead.
+type heartbeatStatus struct {
+	LastAttempt         *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	Latency             string     `json:"latency,omitempty"`
+	Backoff             string     `json:"backoff,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Degraded            bool       `json:"degraded"`
+}
+
+// publicHeartbeat is the heartbeat as reported by /health and /readyz.
+type publicHeartbeat struct {
+	Status string `json:"status"` // unknown, ok, failing, or degraded
+}
+
+// public reduces s to its state, leaving the details to the debug listener.
+func (s heartbeatStatus) public() *publicHeartbeat {
+	switch {
+	case s.Degraded:
+		return &publicHeartbeat{Status: "degraded"}
+	case s.ConsecutiveFailures > 0:
+		return &publicHeartbeat{Status: "failing"}
+	case s.LastAttempt == nil:
+		return &publicHeartbeat{Status: "unknown"}
+	default:
+		return &publicHeartbeat{Status: "ok"}
+	}
+}
+
+var heartbeat = &githubHeartbeat{}
+
+// record updates the heartbeat with one ping's outcome, logging when GitHub becomes
+// unreachable or recovers rather than on every failure.
+func (h *githubHeartbeat) record(now time.Time, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastAttempt = now
+	if err != nil {
+		h.failures++
+		h.lastError = err.Error()
+		if h.failures == heartbeatDegradedFailures {
+			warnf("GitHub API unreachable after %d heartbeats: %v", h.failures, err)
+		}
+		return
+	}
+	if h.failures >= heartbeatDegradedFailures {
+		log.Printf("GitHub API reachable again after %d failed heartbeats", h.failures)
+	}
+	h.failures = 0
+	h.lastError = ""
+	h.lastSuccess = now
+	h.latency = latency
+}
+
+// backoff is how long to wait before the next ping: interval, doubled for each
+// consecutive failure up to heartbeatMaxDoublings times.
+func (h *githubHeartbeat) backoff(interval time.Duration) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return interval << min(h.failures, heartbeatMaxDoublings)
+}
+
+func (h *githubHeartbeat) status(interval time.Duration) heartbeatStatus {
+	backoff := h.backoff(interval)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := heartbeatStatus{
+		LastError:           h.lastError,
+		ConsecutiveFailures: h.failures,
+		Degraded:            h.failures >= heartbeatDegradedFailures,
+	}
+	if !h.lastAttempt.IsZero() {
+		attempt := h.lastAttempt.UTC()
+		s.LastAttempt = &attempt
+	}
+	if !h.lastSuccess.IsZero() {
+		success := h.lastSuccess.UTC()
+		s.LastSuccess = &success
+		s.Latency = h.latency.Round(time.Millisecond).String()
+	}
+	if backoff > interval {
+		s.Backoff = backoff.String()
+	}
+	return s
+}
+
+// degraded reports whether GitHub has failed heartbeatDegradedFailures pings in a row.
+func (h *githubHeartbeat) degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures >= heartbeatDegradedFailures
+}
+
+// pingGitHub makes one unauthenticated request to heartbeatURL. Any answer below 500,
+// including a rate limit, shows GitHub is up.
+func pingGitHub(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, heartbeatURL, http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	start := time.Now()
+	resp, err := apiClient.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return latency, err
+	}
+	if err := resp.Body.Close(); err != nil {
+		debugf(ctx, "Failed to close heartbeat response body: %v", err)
+	}
+	if resp.StatusCode >= 500 {
+		return latency, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return latency, nil
+}
+
+// beat pings GitHub once and records the result.
+func (h *githubHeartbeat) beat(ctx context.Context) {
+	latency, err := pingGitHub(ctx)
+	debugf(ctx, "GitHub heartbeat: latency=%v err=%v", latency.Round(time.Millisecond), err)
+	h.record(time.Now(), latency, err)
+}
+
+// runGitHubHeartbeat pings GitHub every interval until ctx is done, backing off while
+// pings fail.
+func runGitHubHeartbeat(ctx context.Context, h *githubHeartbeat, interval time.Duration) {
+	for {
+		h.beat(ctx)
+		timer := time.NewTimer(h.backoff(interval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// handleReadyz answers 200 while GitHub is reachable and 503 once the heartbeat has
+// failed heartbeatDegradedFailures times in a row, so a load balancer can route around
+// an instance that can't reach GitHub.
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	response := struct {
+		Status string           `json:"status"`
+		GitHub *publicHeartbeat `json:"github,omitempty"`
+	}{Status: "ready"}
+	status := http.StatusOK
+	if *heartbeatEvery > 0 {
+		s := heartbeat.status(*heartbeatEvery)
+		response.GitHub = s.public()
+		if s.Degraded {
+			response.Status = "degraded"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode readiness response: %v", err)
+	}
+}
+
+// handleHeartbeatStats serves the GitHub heartbeat on the loopback debug listener.
+func handleHeartbeatStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(heartbeat.status(*heartbeatEvery)); err != nil {
+		errorf("Failed to encode heartbeat stats: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGitHubHeartbeat(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(stub.Close)
+
+	origURL, origInterval := heartbeatURL, *heartbeatEvery
+	heartbeatURL = stub.URL
+	*heartbeatEvery = time.Minute
+	t.Cleanup(func() { heartbeatURL, *heartbeatEvery = origURL, origInterval })
+
+	h := &githubHeartbeat{}
+	ctx := context.Background()
+
+	h.beat(ctx)
+	s := h.status(time.Minute)
+	if s.LastSuccess == nil || s.ConsecutiveFailures != 0 || s.Degraded || s.Backoff != "" {
+		t.Errorf("after success: %+v", s)
+	}
+
+	status.Store(http.StatusBadGateway)
+	for i := 1; i <= heartbeatDegradedFailures; i++ {
+		h.beat(ctx)
+		if got := h.status(time.Minute).ConsecutiveFailures; got != i {
+			t.Fatalf("failures = %d, want %d", got, i)
+		}
+	}
+	s = h.status(time.Minute)
+	if !s.Degraded || s.LastError == "" || s.LastSuccess == nil {
+		t.Errorf("after %d failures: %+v", heartbeatDegradedFailures, s)
+	}
+	if got, want := h.backoff(time.Minute), 8*time.Minute; got != want {
+		t.Errorf("backoff = %v, want %v", got, want)
+	}
+
+	// A rate-limited answer still shows GitHub is reachable
+	status.Store(http.StatusForbidden)
+	h.beat(ctx)
+	if s := h.status(time.Minute); s.Degraded || s.ConsecutiveFailures != 0 || s.LastError != "" {
+		t.Errorf("after recovery: %+v", s)
+	}
+	if got := h.backoff(time.Minute); got != time.Minute {
+		t.Errorf("backoff after recovery = %v, want 1m", got)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	orig, origInterval := heartbeat, *heartbeatEvery
+	t.Cleanup(func() { heartbeat, *heartbeatEvery = orig, origInterval })
+
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		failures   int
+		wantStatus int
+		wantState  string
+	}{
+		{name: "heartbeat disabled", interval: 0, failures: heartbeatDegradedFailures, wantStatus: http.StatusOK, wantState: "ready"},
+		{name: "reachable", interval: time.Minute, failures: heartbeatDegradedFailures - 1, wantStatus: http.StatusOK, wantState: "ready"},
+		{name: "unreachable", interval: time.Minute, failures: heartbeatDegradedFailures, wantStatus: http.StatusServiceUnavailable, wantState: "degraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*heartbeatEvery = tt.interval
+			heartbeat = &githubHeartbeat{failures: tt.failures}
+
+			rr := httptest.NewRecorder()
+			newTestServer(t, Config{}).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/readyz", http.NoBody))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			var body struct {
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response %q: %v", rr.Body.String(), err)
+			}
+			if body.Status != tt.wantState {
+				t.Errorf("status field = %q, want %q", body.Status, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestHealthHidesHeartbeatError(t *testing.T) {
+	orig, origInterval := heartbeat, *heartbeatEvery
+	t.Cleanup(func() { heartbeat, *heartbeatEvery = orig, origInterval })
+	*heartbeatEvery = time.Minute
+	heartbeat = &githubHeartbeat{}
+	heartbeat.record(time.Now(), 0, errors.New("dial tcp 10.0.0.7:3128: connection refused"))
+
+	handler := newTestServer(t, Config{})
+	for _, path := range []string{"/health", "/readyz"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://"+baseDomain+path, http.NoBody))
+		if strings.Contains(rr.Body.String(), "10.0.0.7") || !strings.Contains(rr.Body.String(), `"github":{"status":"failing"}`) {
+			t.Errorf("%s = %s, want only the heartbeat state", path, rr.Body)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	newDebugMux(false).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/github", http.NoBody))
+	if !strings.Contains(rr.Body.String(), "10.0.0.7") {
+		t.Errorf("/debug/github = %s, want the last error", rr.Body)
+	}
+}
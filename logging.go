@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// logLevel is the minimum level written, set by --log-level. Plain log.Printf calls count
+// as info; debugf, warnf, and errorf log at their own levels, and audit records are
+// always written.
+var logLevel = new(slog.LevelVar)
+
+// levelAudit is above every configurable level, so audit records can't be turned off.
+const levelAudit = slog.LevelError + 4
+
+// parseLogLevel sets logLevel from a --log-level value: debug, info, warn, or error.
+func parseLogLevel(s string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return errors.New("want debug, info, warn, or error")
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func logEnabled(level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+// levelGate is installed as the standard logger's output so unleveled log.Printf calls
+// are dropped when --log-level is above info. Leveled helpers write past it.
+type levelGate struct {
+	out io.Writer
+}
+
+func (g *levelGate) Write(p []byte) (int, error) {
+	if !logEnabled(slog.LevelInfo) {
+		return len(p), nil
+	}
+	return g.out.Write(p)
+}
+
+// logAt writes msg at level with the standard logger's flags, bypassing levelGate.
+func logAt(level slog.Level, msg string) {
+	if !logEnabled(level) {
+		return
+	}
+	out := log.Writer()
+	if gate, ok := out.(*levelGate); ok {
+		out = gate.out
+	}
+	log.New(out, log.Prefix(), log.Flags()).Print(msg)
+}
+
+// debugf logs routine per-request detail, such as access lines and retry attempts, that
+// is only worth its volume when debugging. Like logf, it prefixes ctx's request ID.
+func debugf(ctx context.Context, format string, args ...any) {
+	if !logEnabled(slog.LevelDebug) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if id := requestIDFrom(ctx); id != "" {
+		msg = "[" + id + "] " + msg
+	}
+	logAt(slog.LevelDebug, msg)
+}
+
+// warnf logs like log.Printf at warn level, for [SECURITY] events.
+func warnf(format string, args ...any) {
+	logAt(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// errorf logs like log.Printf at error level, for failures an operator should see.
+func errorf(format string, args ...any) {
+	logAt(slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+// logThrottle lets a repeating warning through at most once per interval, so a flood
+// (every request at a cap, say) logs a line a minute rather than one per request.
+type logThrottle struct {
+	interval time.Duration
+	mu       sync.Mutex
+	last     time.Time
+	dropped  int
+}
+
+// allow reports whether to log at now, and how many occurrences were dropped since the
+// last one allowed.
+func (t *logThrottle) allow(now time.Time) (ok bool, dropped int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		t.dropped++
+		return false, 0
+	}
+	dropped, t.last, t.dropped = t.dropped, now, 0
+	return true, dropped
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setLogLevel overrides --log-level for the duration of a test.
+func setLogLevel(t *testing.T, level slog.Level) {
+	t.Helper()
+	orig := logLevel.Level()
+	logLevel.Set(level)
+	t.Cleanup(func() { logLevel.Set(orig) })
+}
+
+func TestParseLogLevel(t *testing.T) {
+	setLogLevel(t, slog.LevelInfo)
+	for _, tt := range []struct {
+		in   string
+		want slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"info", slog.LevelInfo},
+		{"WARN", slog.LevelWarn},
+		{"error", slog.LevelError},
+	} {
+		if err := parseLogLevel(tt.in); err != nil || logLevel.Level() != tt.want {
+			t.Errorf("parseLogLevel(%q) = %v, level %v; want %v", tt.in, err, logLevel.Level(), tt.want)
+		}
+	}
+	if err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel(verbose) succeeded, want an error")
+	}
+}
+
+func TestLogLevelFiltersRequestLogs(t *testing.T) {
+	tests := []struct {
+		level        slog.Level
+		wantAccess   bool
+		wantInfo     bool
+		wantSecurity bool
+	}{
+		{slog.LevelDebug, true, true, true},
+		{slog.LevelInfo, false, true, true},
+		{slog.LevelWarn, false, false, true},
+		{slog.LevelError, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			setLogLevel(t, tt.level)
+			logs := captureLog(t)
+			log.SetOutput(&levelGate{out: logs}) // as main installs it
+
+			handler := requestLogger(securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				log.Print("routine info line")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			})))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+			auditLog(auditAdminDenied, map[string]any{"ip": "192.0.2.1"})
+
+			out := logs.String()
+			for _, c := range []struct {
+				text string
+				want bool
+			}{
+				{"GET /oauth/user HTTP/1.1 from", tt.wantAccess},
+				{"routine info line", tt.wantInfo},
+				{"[SECURITY]", tt.wantSecurity},
+				{"[AUDIT]", true}, // never filtered
+			} {
+				if got := strings.Contains(out, c.text); got != c.want {
+					t.Errorf("logged %q = %v, want %v:\n%s", c.text, got, c.want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLogThrottle(t *testing.T) {
+	throttle := &logThrottle{interval: time.Minute}
+	now := time.Now()
+	if ok, dropped := throttle.allow(now); !ok || dropped != 0 {
+		t.Errorf("first allow() = %v, %d; want true, 0", ok, dropped)
+	}
+	for range 3 {
+		if ok, _ := throttle.allow(now.Add(time.Second)); ok {
+			t.Error("allow() within the interval = true, want false")
+		}
+	}
+	if ok, dropped := throttle.allow(now.Add(time.Minute)); !ok || dropped != 3 {
+		t.Errorf("allow() after the interval = %v, %d; want true, 3", ok, dropped)
+	}
+}
@@ -5,28 +5,32 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/codeGROOVE-dev/gsm"
-	"github.com/codeGROOVE-dev/retry"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // Constants for configuration.
@@ -35,41 +39,170 @@ const (
 	defaultAppID       = 1546081
 	defaultClientID    = "Iv23liYmAKkBpvhHAnQQ"
 	defaultRedirectURI = "https://reviewGOOSE.dev/oauth/callback"
+	defaultScopes      = "repo read:org"
 	baseDomain         = "reviewGOOSE.dev"
 
 	// Rate limiting.
-	rateLimitRequests = 10
-	rateLimitWindow   = 1 * time.Minute
+	defaultRateLimitRequests = 10
+	defaultRateLimitWindow   = 1 * time.Minute
+	defaultRateLimitSweep    = 1 * time.Minute
 
 	// Timeouts.
-	httpTimeout     = 10 * time.Second
-	shutdownTimeout = 30 * time.Second
-	stateExpiry     = 5 * time.Minute
+	httpTimeout              = 10 * time.Second
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultRequestTimeout    = 15 * time.Second
+	shutdownTimeout          = 30 * time.Second
+	defaultStateTTL          = 5 * time.Minute
+
+	// Auth codes are short-lived (10s is sufficient for modern browsers).
+	defaultAuthCodeTTL = 10 * time.Second
+	maxAuthCodeTTL     = 60 * time.Second
+
+	// Caching.
+	defaultUserCacheTTL = 60 * time.Second
+	invalidTokenTTL     = 30 * time.Second
+	maxInvalidTokens    = 10000 // bounds the negative cache to about 1MB of hashes
+
+	// /oauth/validate may cost a GitHub call per request, so it is limited per IP.
+	validatesPerMinute = 60
+
+	// /oauth/device/token may cost a GitHub call per poll, so it is limited per IP as well as per
+	// device code. Each flow polls about 12 times a minute, leaving room for a few CLIs behind one IP.
+	devicePollsPerMinute = 60
 
 	// Security.
 	maxRequestSize    = 1 << 20 // 1MB
 	maxHeaderSize     = 1 << 20 // 1MB
 	maxFailedLogins   = 5
 	failedLoginWindow = 15 * time.Minute
+
+	// The exchange body is a tiny {"auth_code": "..."}; it needn't be allowed the full 1MB.
+	defaultExchangeBodyLimit = 4 << 10 // 4KB
+
+	// Header fields allowed per request; MaxHeaderBytes alone admits hundreds of tiny ones.
+	defaultMaxHeaderCount = 100
+
+	// IPs with this many recent failed logins get the rate limit divided by flaggedLimitDivisor.
+	flaggedFailureThreshold = 3
+	flaggedLimitDivisor     = 5
+
+	// Outbound GitHub calls. The OAuth and API endpoints answer directly, so a redirect is
+	// unexpected and refused unless --github-max-redirects allows it.
+	defaultMaxRedirects = 0
+
+	// Overload protection.
+	defaultMaxConcurrent = 1000
+	overloadRetryAfter   = "1" // seconds
+
+	// HSTS: two years, the minimum the preload list accepts is one.
+	defaultHSTSMaxAge = 2 * 365 * 24 * time.Hour
+	minPreloadMaxAge  = 365 * 24 * time.Hour
+
+	// Cache lifetime for CSS and JS requested without a ?v= build timestamp.
+	defaultAssetCacheMaxAge = 5 * time.Minute
 )
 
-//go:embed index.html
+//go:embed index.html 404.html
 //go:embed assets/*
 var staticFiles embed.FS
 
 var (
+	checkConfig    = flag.Bool("check-config", false, "Validate the configuration, print a summary, and exit without starting the server")
+	devMode        = flag.Bool("dev", false, "Development: serve static files from --dev-dir, re-read on every request, instead of the embedded copies")
+	devDir         = flag.String("dev-dir", ".", "Directory holding index.html, 404.html, and assets/ for --dev")
+	maintenanceOn  = flag.Bool("maintenance", false, "Start in maintenance mode: everything but /health answers 503 (SIGUSR1 toggles it at runtime)")
+	verifyCreds    = flag.Bool("verify-credentials", false, "At startup, confirm GitHub recognizes each OAuth client ID and secret (via a token exchange with a dummy code) and exit if not")
+	printAuthURL   = flag.Bool("print-authorize-url", false, "Print the GitHub authorize URL /oauth/login would redirect to (with a dummy state) and exit")
+	configFile     = flag.String("config", "", "Path to a JSON config file (precedence: flag > env > config > default)")
 	port           = flag.String("port", "", "Port to listen on (overrides $PORT)")
+	listenAddr     = flag.String("listen-addr", "", "IP address to bind, e.g. 127.0.0.1 (default all interfaces)")
 	appID          = flag.Int("app-id", defaultAppID, "GitHub App ID")
 	clientID       = flag.String("client-id", defaultClientID, "GitHub OAuth Client ID")
 	clientSecret   = flag.String("client-secret", "", "GitHub OAuth Client Secret")
+	secretRefresh  = flag.Duration("secret-refresh-interval", defaultSecretRefresh, "How often to re-fetch rotated secrets from Secret Manager (0 disables)")
+	adminToken     = flag.String("admin-token", "", "Bearer token for operator endpoints like /debug/oauth-selftest (overrides $ADMIN_TOKEN; unset disables them)")
+	webhookSecret  = flag.String("webhook-secret", "", "GitHub App webhook secret (overrides $GITHUB_WEBHOOK_SECRET)")
 	redirectURI    = flag.String("redirect-uri", defaultRedirectURI, "OAuth redirect URI")
 	allowedOrigins = flag.String("allowed-origins", "", "Comma-separated list of allowed origins for CORS")
-
-	// Build timestamp for cache busting (set at startup).
-	buildTimestamp string
-
-	// Security: Track failed login attempts.
+	oauthApps      = flag.String("oauth-apps", "", "Comma-separated host=client_id OAuth apps for specific hosts (secret from $GITHUB_CLIENT_SECRET_<CLIENT_ID>)")
+	oauthScopes    = flag.String("oauth-scopes", defaultScopes, "Space-separated OAuth scopes to request")
+	rateLimitReqs  = flag.Int("rate-limit-requests", defaultRateLimitRequests, "Max auth code exchange requests per IP per window")
+	rateLimitWin   = flag.Duration("rate-limit-window", defaultRateLimitWindow, "Rate limit window for auth code exchange")
+	limiterSweep   = flag.Duration("rate-limit-sweep", defaultRateLimitSweep, "How often to drop rate limiter and failed-login entries for IPs with no recent requests")
+	authCodeTTL    = flag.Duration("auth-code-ttl", defaultAuthCodeTTL, "How long one-time auth codes stay valid (max 60s)")
+	heartbeatEvery = flag.Duration("github-heartbeat", defaultHeartbeatInterval, "How often to ping api.github.com to detect outages for /health and /readyz (0 disables)")
+	reuseAlertMax  = flag.Int("auth-code-reuse-alert", defaultReuseAlertThreshold, "Alert when more than this many auth code reuse attempts happen within --auth-code-reuse-window (0 disables)")
+	reuseAlertWin  = flag.Duration("auth-code-reuse-window", defaultReuseAlertWindow, "Window for --auth-code-reuse-alert")
+	reuseAlertURL  = flag.String("auth-code-reuse-webhook", "", "https:// URL to POST a JSON alert to when --auth-code-reuse-alert fires (alerts are always logged)")
+	maxRedirects   = flag.Int("github-max-redirects", defaultMaxRedirects, "Maximum redirects to follow on outbound GitHub OAuth and API calls (0 refuses all; avatar fetches always follow theirs)")
+	retryAttempts  = flag.Int("github-retry-attempts", int(defaultRetryConfig.Attempts), "Attempts per outbound GitHub call before giving up (1 disables retries)")
+	retryDelay     = flag.Duration("github-retry-delay", defaultRetryConfig.BaseDelay, "First backoff delay between GitHub call attempts; doubles with each retry")
+	retryMaxDelay  = flag.Duration("github-retry-max-delay", defaultRetryConfig.MaxDelay, "Longest backoff delay between GitHub call attempts, including rate limit waits")
+	retryJitter    = flag.Duration("github-retry-jitter", defaultRetryConfig.MaxJitter, "Maximum random jitter added to each GitHub retry backoff (rate-limit waits are exact)")
+	githubMaxCalls = flag.Int("github-max-concurrent", defaultGitHubConcurrency, "Maximum outbound GitHub calls in flight at once (0 disables)")
+	ghQueueTimeout = flag.Duration("github-queue-timeout", defaultGitHubQueueTimeout, "How long an outbound GitHub call waits for a free --github-max-concurrent slot before failing")
+	exchangeLimit  = flag.Int("exchange-body-limit", defaultExchangeBodyLimit, "Maximum /oauth/exchange request body in bytes; larger bodies get 413")
+	compressMin    = flag.Int("compress-min-size", defaultCompressMinSize, "Smallest static file or page in bytes served compressed; smaller ones always use the identity encoding")
+	maxHeaders     = flag.Int("max-header-count", defaultMaxHeaderCount, "Maximum header fields per request before answering 431 (0 disables)")
+	maxConcurrent  = flag.Int("max-concurrent", defaultMaxConcurrent, "Maximum requests handled at once before answering 503 (0 disables; /health is exempt)")
+	requestTimeout = flag.Duration("request-timeout", defaultRequestTimeout, "Maximum time a GitHub-bound handler may run before returning a JSON 503")
+	headerTimeout  = flag.Duration("read-header-timeout", defaultReadHeaderTimeout, "Maximum time a client may take to send request headers")
+	readTimeout    = flag.Duration("read-timeout", httpTimeout, "Maximum time a client may take to send the whole request")
+	writeTimeout   = flag.Duration("write-timeout", 0, "Maximum time to write a response (0 means --request-timeout plus 5s)")
+	idleTimeout    = flag.Duration("idle-timeout", defaultIdleTimeout, "How long an idle keep-alive connection stays open")
+	lockoutPeriod  = flag.Duration("lockout-duration", failedLoginWindow, "How long an IP stays locked out after too many failed logins")
+	assetMaxAge    = flag.Duration("asset-cache-max-age", defaultAssetCacheMaxAge, "Cache lifetime for CSS and JS requested without a ?v= version (0 sends no-cache); versioned URLs are cached immutably")
+	userCacheTTL   = flag.Duration("user-cache-ttl", defaultUserCacheTTL, "How long to cache GitHub user info lookups (0 disables)")
+	avatarProxy    = flag.Bool("avatar-proxy", false, "Serve GitHub avatars same-origin at /avatar?login=<user>, for networks that block avatars.githubusercontent.com")
+	avatarTTL      = flag.Duration("avatar-cache-ttl", defaultAvatarCacheTTL, "How long to cache avatars served by --avatar-proxy (0 disables)")
+	cspAssets      = flag.String("csp-asset-origins", "", "Comma-separated origins allowed to serve scripts, styles, fonts, and images (default reviewGOOSE.dev and subdomains)")
+	cspConnect     = flag.String("csp-connect-origins", "", "Comma-separated origins the frontend may connect to (default api.github.com and turn.github.codegroove.app)")
+	cspReport      = flag.Bool("csp-report", false, "Add report-uri/report-to to the CSP and log violation reports posted to /csp-report")
+	uaDeny         = flag.String("ua-denylist", "", "Comma-separated User-Agent substrings (case-insensitive) to answer with 403")
+	rejectEmptyUA  = flag.Bool("reject-empty-ua", false, "Answer requests without a User-Agent with 403 (except /health)")
+	hstsMaxAge     = flag.Duration("hsts-max-age", defaultHSTSMaxAge, "Strict-Transport-Security max-age (0 tells browsers to forget the policy)")
+	hstsSubdomains = flag.Bool("hsts-include-subdomains", true, "Add includeSubDomains to Strict-Transport-Security")
+	hstsPreload    = flag.Bool("hsts-preload", true, "Add preload to Strict-Transport-Security (requires includeSubDomains and a max-age of at least a year)")
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file; serves HTTPS directly instead of behind a proxy")
+	tlsKey         = flag.String("tls-key", "", "TLS private key file (required with --tls-cert)")
+	tlsAuto        = flag.Bool("tls-auto", false, "Obtain and renew certificates for the base domain from Let's Encrypt and serve HTTPS directly (needs port 443 reachable, or --http-redirect-port=80)")
+	tlsCacheDir    = flag.String("tls-cache-dir", "tls-cache", "Directory where --tls-auto keeps its ACME account key and certificates")
+	contactURIs    = flag.String("security-contact", "", "Comma-separated mailto:, tel:, or https:// contacts for /.well-known/security.txt (unset serves 404)")
+	disclosureURL  = flag.String("security-policy", "", "Vulnerability disclosure policy URL for security.txt")
+	securityTxtTTL = flag.Duration("security-txt-expiry", defaultSecurityTxtExpiry, "How far ahead security.txt's Expires field is set")
+	tokenPrefixes  = flag.String("token-prefixes", defaultTokenPrefixes, "Comma-separated prefixes an OAuth access token must start with")
+	checkTokenFmt  = flag.Bool("token-prefix-check", true, "Reject OAuth access tokens without one of --token-prefixes (disable for GitHub Enterprise token formats)")
+	logLevelName   = flag.String("log-level", "info", "Minimum log level: debug, info, warn, or error; [AUDIT] records are always written")
+	enableH2C      = flag.Bool("enable-h2c", false, "Accept HTTP/2 over plaintext (h2c, prior knowledge) for proxies that terminate TLS upstream")
+	redirectPort   = flag.String("http-redirect-port", "", "With TLS, also listen on this port and 308-redirect plain HTTP to HTTPS (e.g. 80)")
+	sessionMode    = flag.String("session-mode", sessionModeFragment, "How the OAuth callback hands over the token: fragment (one-time auth code), cookie (HttpOnly session), or token-cookie (auth code exchanged for an HttpOnly token cookie)")
+	enablePprof    = flag.Bool("enable-pprof", false, "Also serve net/http/pprof on the loopback-only debug listener")
+	pprofAddr      = flag.String("pprof-addr", defaultPprofAddr, "Loopback address for the debug listener (/debug/authcodes, /debug/github, /debug/ratelimit, and pprof with --enable-pprof)")
+	hashDebugIPs   = flag.Bool("debug-hash-ips", false, "Report IPs on /debug/ratelimit as per-process keyed hashes instead of addresses")
+	oauthDebugErrs = flag.Bool("oauth-debug-errors", false, "Show GitHub's OAuth error code and description on the callback failure page (for staging; production shows a generic message)")
+	cookieDomain   = flag.Bool("cookie-domain", false, "Set Domain=<base domain> on the oauth_state and oauth_return_to cookies so subdomains can read them (default host-only)")
+	stateTTL       = flag.Duration("oauth-state-ttl", defaultStateTTL, "How long a login may take: lifetime of the OAuth state and return_to cookies")
+	returnToAllow  = flag.String("return-to-hosts", "", "Comma-separated exact hostnames outside the base domain that return_to may redirect to (HTTPS only), e.g. partner.example.com")
+	defaultLanding = flag.String("default-landing", "", "Where to send users after login when return_to is missing or invalid (default my.<base domain>); must pass return_to validation")
+	successPage    = flag.String("install-success-template", "", "HTML template file replacing the GitHub App installation success page")
+	failurePage    = flag.String("install-failure-template", "", "HTML template file replacing the authentication failure page")
+	extraHdrs      = flag.String("extra-headers", "", "Comma-separated Name:value headers added to every response, e.g. X-Deployment-Region:us-east1 (security headers can't be overridden)")
+	trustedProxies = flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For is trusted")
+
+	// Build timestamp for cache busting, fixed at startup.
+	buildTime      = time.Now().Truncate(time.Second)
+	buildTimestamp = strconv.FormatInt(buildTime.Unix(), 10)
+
+	// Parsed --trusted-proxies ranges; empty means X-Forwarded-For is never trusted.
+	trustedProxyNets []netip.Prefix
+
+	// Cookie-mode sessions (--session-mode=cookie).
+	sessions = newSessionStore()
+
+	// Security: Track failed login attempts, and the IPs they locked out until when.
 	failedAttempts = make(map[string][]time.Time)
+	lockedUntil    = make(map[string]time.Time)
 	failedMutex    sync.Mutex
 
 	// One-time auth code exchange (token -> code mapping).
@@ -80,17 +213,43 @@ var (
 	// Rate limiter for auth code exchange endpoint (prevent brute force attacks).
 	exchangeRateLimiter *rateLimiter
 
+	// Rate limiter for /csp-report; nil unless --csp-report is set.
+	cspReportLimiter *rateLimiter
+
+	// Short-lived cache of GitHub user lookups for /oauth/user.
+	userInfoCache *userCache
+
+	// Tokens recently reported invalid by GitHub, to blunt /oauth/validate abuse.
+	invalidTokens *invalidTokenCache
+
+	// Rate limiter for /oauth/validate.
+	validateRateLimiter *rateLimiter
+
+	// Rate limiter for /oauth/device/token.
+	devicePollRateLimiter *rateLimiter
+
 	// CSRF protection using Go 1.25's CrossOriginProtection (Fetch Metadata).
 	csrfProtection *http.CrossOriginProtection
 )
 
 // authCodeData stores a one-time use auth code with expiration.
+// Tokens are encrypted at rest and only decrypted when the code is exchanged.
 type authCodeData struct {
-	expiry   time.Time
-	token    string
-	username string
-	returnTo string
-	used     bool
+	issued        time.Time
+	expiry        time.Time
+	sealedToken   []byte
+	sealedRefresh []byte // nil unless the OAuth app issues refresh tokens
+	username      string
+	returnTo      string
+	scopes        []string  // scopes the user actually granted, which may differ from those requested
+	tokenExpiry   time.Time // zero unless the OAuth app has token expiration enabled
+	refreshExpiry time.Time
+	flowStart     time.Time // when /oauth/login issued the state, to the second
+
+	// expiredAtExchange is set once an exchange found the code expired, so churn counts it
+	// under expired_at_exchange alone rather than again when cleanup sweeps it.
+	expiredAtExchange bool
+	used              bool
 }
 
 // rateLimiter implements a simple in-memory rate limiter.
@@ -101,44 +260,87 @@ type rateLimiter struct {
 	mu       sync.Mutex
 }
 
-func (rl *rateLimiter) limitHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ip := clientIP(r)
+// effectiveLimit is the limit for ip: the configured limit for a clean IP, and a fraction
+// of it (at least one request) for an IP with flaggedFailureThreshold recent failed logins,
+// so likely attackers are slowed well before lockout without affecting legitimate users.
+func (rl *rateLimiter) effectiveLimit(ip string, now time.Time) int {
+	if recentFailures(ip, now) < flaggedFailureThreshold {
+		return rl.limit
+	}
+	return max(1, rl.limit/flaggedLimitDivisor)
+}
 
-		rl.mu.Lock()
-		defer rl.mu.Unlock()
+// record counts a request from ip at now unless ip already has limit requests inside the
+// window, returning the count it found. The lock is held only for the bookkeeping, so a slow
+// handler never blocks other IPs or the /debug/ratelimit report.
+func (rl *rateLimiter) record(ip string, limit int, now time.Time) (count int, ok bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-		now := time.Now()
-		cutoff := now.Add(-rl.window)
+	cutoff := now.Add(-rl.window)
 
-		// Clean old requests - reuse slice to reduce allocations
-		validRequests := rl.requests[ip][:0]
-		for _, t := range rl.requests[ip] {
-			if t.After(cutoff) {
-				validRequests = append(validRequests, t)
-			}
+	// Clean old requests - reuse slice to reduce allocations
+	validRequests := rl.requests[ip][:0]
+	for _, t := range rl.requests[ip] {
+		if t.After(cutoff) {
+			validRequests = append(validRequests, t)
 		}
+	}
+
+	if len(validRequests) >= limit {
+		return len(validRequests), false
+	}
+	rl.requests[ip] = append(validRequests, now)
+	return len(validRequests), true
+}
 
-		if len(validRequests) >= rl.limit {
-			log.Printf("[SECURITY] Rate limit exceeded: ip=%s requests=%d limit=%d window=%v", ip, len(validRequests), rl.limit, rl.window)
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+func (rl *rateLimiter) limitHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		limit := rl.effectiveLimit(ip, time.Now())
+
+		if count, ok := rl.record(ip, limit, time.Now()); !ok {
+			fields := requestAuditFields(r, auditDenied)
+			fields["path"] = r.URL.Path
+			fields["requests"] = count
+			fields["limit"] = limit
+			fields["flagged"] = limit < rl.limit
+			fields["window"] = rl.window.String()
+			auditLog(auditRateLimited, fields)
+			writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded")
 			return
 		}
 
-		rl.requests[ip] = append(validRequests, now)
+		next(w, r)
+	}
+}
 
-		// Prevent memory exhaustion: periodically clean up IPs with no recent requests
-		// This protects against DoS attacks using many different IPs
-		if len(rl.requests)%100 == 0 {
-			for oldIP, times := range rl.requests {
-				if len(times) == 0 || (len(times) > 0 && times[len(times)-1].Before(cutoff)) {
-					delete(rl.requests, oldIP)
-				}
-			}
+// sweep drops IPs with no requests inside the window. Without it, a steady stream of
+// unique IPs would grow the map without bound.
+func (rl *rateLimiter) sweep(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := now.Add(-rl.window)
+	for ip, times := range rl.requests {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(rl.requests, ip)
 		}
+	}
+}
 
-		next(w, r)
+// sweepRateLimits drops stale entries from the rate limiters and failed login tracking.
+func sweepRateLimits(now time.Time) {
+	exchangeRateLimiter.sweep(now)
+	validateRateLimiter.sweep(now)
+	devicePollRateLimiter.sweep(now)
+	if cspReportLimiter != nil {
+		cspReportLimiter.sweep(now)
+	}
+	if avatarRateLimiter != nil {
+		avatarRateLimiter.sweep(now)
 	}
+	sweepFailedAttempts(now)
 }
 
 // isValidGitHubHandle validates that a string looks like a valid GitHub handle.
@@ -180,29 +382,142 @@ func isValidGitHubHandle(handle string) bool {
 
 // clientIP extracts the client IP address from the request.
 func clientIP(r *http.Request) string {
-	// SECURITY: Only use RemoteAddr to prevent header spoofing attacks
-	// X-Forwarded-For and X-Real-IP are trivially spoofable and should not be trusted
-	// for security-critical functions like rate limiting
+	// SECURITY: X-Forwarded-For and X-Real-IP are trivially spoofable, so by default only
+	// RemoteAddr is used for security-critical functions like rate limiting.
 	//
-	// When behind a trusted proxy (like Cloud Run), RemoteAddr will be the proxy IP
-	// This means rate limiting happens at the proxy level, which is acceptable
-	// as it still prevents single-source DoS attacks
-	ip := r.RemoteAddr
-	if colon := strings.LastIndex(ip, ":"); colon != -1 {
-		return ip[:colon]
+	// When RemoteAddr is a configured trusted proxy (like Cloud Run's front end), the
+	// rightmost X-Forwarded-For hop that isn't itself a trusted proxy is the real client:
+	// everything left of it was supplied by the client and can't be trusted.
+	ip := hostOnly(r.RemoteAddr)
+	if len(trustedProxyNets) == 0 || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// Garbage in the chain: fall back to the nearest hop we could verify
+			return ip
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			return hop
+		}
 	}
 	return ip
 }
 
+// hostOnly strips the port from a host:port address such as RemoteAddr, handling bracketed
+// IPv6 like [2001:db8::1]:443. An address without a port, bare or bracketed, is returned
+// without brackets.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// isTrustedProxy reports whether ip falls within a --trusted-proxies range.
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(strings.Trim(ip, "[]"))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxyNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated CIDR list. Bare IPs are treated as single-host ranges.
+func parseTrustedProxies(spec string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for entry := range strings.SplitSeq(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// requestHost returns the host the client originally requested, as reported by the proxy.
+// X-Original-Host is only believed when it names one of our own hosts; anything else is
+// logged and ignored in favor of r.Host, so a spoofed header can't steer redirects.
+func requestHost(r *http.Request) string {
+	host := r.Header.Get("X-Original-Host")
+	if host == "" {
+		return r.Host
+	}
+	if !trustedHost(host) {
+		warnf("[SECURITY] [%s] Ignoring untrusted X-Original-Host %q from %s", requestIDFrom(r.Context()), host, clientIP(r))
+		return r.Host
+	}
+	return host
+}
+
+// trustedHost reports whether host (optionally with a port) is the base domain, one of its
+// subdomains, a host with its own OAuth app, or the host of an allowed origin.
+func trustedHost(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.ContainsFunc(host, func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '.'
+	}) {
+		return false
+	}
+	base := strings.ToLower(baseDomain)
+	if host == base || strings.HasSuffix(host, "."+base) {
+		return true
+	}
+	if _, ok := oauthAppsByHost[host]; ok {
+		return true
+	}
+	for origin := range strings.SplitSeq(*allowedOrigins, ",") {
+		if u, err := url.Parse(strings.TrimSpace(origin)); err == nil && u.Host != "" && strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
 // securityHeaders adds security headers to all responses.
 func securityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add request ID for tracking
+		// Add request ID for tracking, keeping the client's only if it's safe to log
 		requestID := r.Header.Get("X-Request-ID")
-		if requestID == "" {
-			requestID = generateID(8)
+		if !validRequestID(requestID) {
+			id, err := generateIDE(8)
+			if err != nil {
+				errorf("Failed to generate request ID: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			requestID = id
 		}
 		w.Header().Set("X-Request-ID", requestID)
+		// Expose the ID to handlers so audit records can be correlated with access logs
+		r.Header.Set("X-Request-ID", requestID)
+		r = withRequestID(r, requestID)
 		// Prevent clickjacking
 		w.Header().Set("X-Frame-Options", "DENY")
 
@@ -218,86 +533,58 @@ func securityHeaders(next http.Handler) http.Handler {
 		// Permissions policy
 		w.Header().Set("Permissions-Policy", "geolocation=(), microphone=(), camera=()")
 
-		// Content Security Policy
-		csp := []string{
-			"default-src 'self' https://reviewGOOSE.dev https://*.reviewGOOSE.dev",
-			"script-src 'self' https://reviewGOOSE.dev https://*.reviewGOOSE.dev",
-			"style-src 'self' https://reviewGOOSE.dev https://*.reviewGOOSE.dev",
-			"img-src 'self' https://reviewGOOSE.dev https://*.reviewGOOSE.dev https://avatars.githubusercontent.com data:",
-			"connect-src 'self' https://api.github.com https://turn.github.codegroove.app",
-			"font-src 'self' https://reviewGOOSE.dev https://*.reviewGOOSE.dev",
-			"object-src 'none'",
-			"frame-src 'none'",
-			"base-uri 'self'",
-			"form-action 'self'",
-			"frame-ancestors 'none'",
-			"upgrade-insecure-requests",
-		}
-		w.Header().Set("Content-Security-Policy", strings.Join(csp, "; "))
-
-		// HSTS with preload (only for HTTPS)
+		// Content Security Policy, with a fresh nonce so served HTML can allow its own inline code
+		nonce, err := generateIDE(16)
+		if err != nil {
+			errorf("Failed to generate CSP nonce: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", csp.header(nonce))
+		if csp.ReportURI != "" {
+			w.Header().Set("Reporting-Endpoints", cspReportGroup+`="`+csp.ReportURI+`"`)
+		}
+		r = withCSPNonce(r, nonce)
+
+		// HSTS (only for HTTPS)
 		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-			// 2 years (recommended for preload), includeSubDomains, and preload directive
-			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains; preload")
+			w.Header().Set("Strict-Transport-Security", hstsHeader())
 		}
 
+		// Deployment-specific headers; parseExtraHeaders keeps them off the ones above
+		setExtraHeaders(w.Header())
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-// oauthTokenResponse represents the GitHub OAuth token response.
-type oauthTokenResponse struct {
-	AccessToken      string `json:"access_token"`
-	TokenType        string `json:"token_type"`
-	Scope            string `json:"scope"`
-	Error            string `json:"error"`
-	ErrorDescription string `json:"error_description"`
-}
-
-// githubUser represents a GitHub user.
-type githubUser struct {
-	Login string `json:"login"`
-	Name  string `json:"name"`
-	ID    int    `json:"id"`
-}
-
-// loadClientSecret retrieves the GitHub OAuth client secret from environment or Secret Manager.
-func loadClientSecret(ctx context.Context) string {
-	// Check environment variable first
-	if value := os.Getenv("GITHUB_CLIENT_SECRET"); value != "" {
-		log.Print("Using GITHUB_CLIENT_SECRET from environment variable")
-		return value
-	}
-
-	// Check if running in Cloud Run
-	isCloudRun := os.Getenv("K_SERVICE") != "" || os.Getenv("CLOUD_RUN_TIMEOUT_SECONDS") != ""
-	if !isCloudRun {
-		log.Print("Not running in Cloud Run, skipping Secret Manager")
-		return ""
-	}
-
-	// Fetch from Secret Manager (auto-detects project ID from metadata server)
-	log.Print("Fetching GITHUB_CLIENT_SECRET from Google Secret Manager")
-	secretValue, err := gsm.Fetch(ctx, "GITHUB_CLIENT_SECRET")
-	if err != nil {
-		log.Printf("Failed to fetch secret from Secret Manager: %v", err)
-		return ""
+// hstsHeader builds the Strict-Transport-Security value from the --hsts-* flags. The default
+// (two years, includeSubDomains, preload) suits an established deployment; during rollout,
+// drop preload and includeSubDomains until every subdomain serves HTTPS.
+func hstsHeader() string {
+	header := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds()))
+	if *hstsSubdomains {
+		header += "; includeSubDomains"
 	}
-
-	if secretValue == "" {
-		log.Print("WARNING: Secret Manager returned empty value for GITHUB_CLIENT_SECRET")
-	} else {
-		log.Print("Successfully fetched GITHUB_CLIENT_SECRET from Google Secret Manager")
+	if *hstsPreload {
+		header += "; preload"
 	}
-
-	return secretValue
+	return header
 }
 
 func main() {
 	flag.Parse()
 
-	// Set build timestamp for cache busting
-	buildTimestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	// Goroutines that outlive startup; stopped and awaited on shutdown
+	background := newBackgroundTasks()
+
+	// Apply config file values before environment fallbacks so env still takes precedence
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("Invalid config file %s: %v", *configFile, err)
+		}
+		log.Printf("Loaded config file %s", *configFile)
+	}
 
 	// Determine port with flag taking precedence over environment
 	serverPort := *port
@@ -307,6 +594,11 @@ func main() {
 	if serverPort == "" {
 		serverPort = defaultPort
 	}
+	*port = serverPort
+
+	if *listenAddr == "" {
+		*listenAddr = os.Getenv("LISTEN_ADDR")
+	}
 
 	// Allow environment variables to override empty flag values
 	if *appID == defaultAppID {
@@ -323,10 +615,35 @@ func main() {
 		}
 	}
 
-	// Load client secret from environment or Secret Manager
+	// Load secrets from environment or Secret Manager
 	if *clientSecret == "" {
-		ctx := context.Background()
-		*clientSecret = loadClientSecret(ctx)
+		*clientSecret = loadSecret(context.Background(), "GITHUB_CLIENT_SECRET")
+		// Secrets from Secret Manager may be rotated while we run; pick up new versions
+		if os.Getenv("GITHUB_CLIENT_SECRET") == "" && isCloudRun() && *secretRefresh > 0 {
+			background.run(func(ctx context.Context) {
+				watchSecret(ctx, &defaultClientSecret, "GITHUB_CLIENT_SECRET", secretManagerFetch, *secretRefresh)
+			})
+		}
+	}
+	defaultClientSecret.set(*clientSecret)
+	if *webhookSecret == "" {
+		*webhookSecret = loadSecret(context.Background(), "GITHUB_WEBHOOK_SECRET")
+	}
+	if *adminToken == "" {
+		*adminToken = loadSecret(context.Background(), "ADMIN_TOKEN")
+	}
+	// A shared keyring lets sealed tokens survive key rotation; without one a random key is used
+	if spec := loadSecret(context.Background(), "TOKEN_ENCRYPTION_KEYS"); spec != "" {
+		keyring, err := parseKeyring(spec)
+		if err != nil {
+			log.Fatalf("Invalid TOKEN_ENCRYPTION_KEYS: %v", err)
+		}
+		tokenKeys = keyring
+		if os.Getenv("TOKEN_ENCRYPTION_KEYS") == "" && isCloudRun() && *secretRefresh > 0 {
+			background.run(func(ctx context.Context) {
+				watchSecret(ctx, tokenKeys, "TOKEN_ENCRYPTION_KEYS", secretManagerFetch, *secretRefresh)
+			})
+		}
 	}
 
 	if *redirectURI == defaultRedirectURI || *redirectURI == "" {
@@ -335,101 +652,184 @@ func main() {
 		}
 	}
 
+	if *oauthApps == "" {
+		*oauthApps = os.Getenv("OAUTH_APPS")
+	}
 	if *allowedOrigins == "" {
 		if envAllowedOrigins := os.Getenv("ALLOWED_ORIGINS"); envAllowedOrigins != "" {
 			*allowedOrigins = envAllowedOrigins
 		}
 	}
 
-	// Initialize rate limiter for auth code exchange (strict: 10 attempts per minute per IP)
-	exchangeRateLimiter = &rateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    rateLimitRequests,
-		window:   rateLimitWindow,
+	if *trustedProxies == "" {
+		*trustedProxies = os.Getenv("TRUSTED_PROXIES")
 	}
 
-	// Initialize CSRF protection using Go 1.25's CrossOriginProtection
-	// Uses Fetch Metadata (Sec-Fetch-Site header) for reliable cross-origin detection
-	csrfProtection = http.NewCrossOriginProtection()
-	// Trust requests from our own domain and all subdomains
-	if err := csrfProtection.AddTrustedOrigin("https://" + baseDomain); err != nil {
-		log.Fatalf("CRITICAL: Failed to configure CSRF protection for base domain: %v", err)
-	}
-	if err := csrfProtection.AddTrustedOrigin("https://*." + baseDomain); err != nil {
-		log.Fatalf("CRITICAL: Failed to configure CSRF protection for subdomains: %v", err)
+	// The same checks gate startup and --check-config; only a pre-flight insists on a secret
+	err := applyConfig()
+	if *checkConfig && defaultClientSecret.get() == "" {
+		err = errors.Join(err, errors.New("client secret: not set by --client-secret, GITHUB_CLIENT_SECRET, or Secret Manager"))
 	}
-	// Allow localhost for development (covers all ports)
-	if err := csrfProtection.AddTrustedOrigin("http://localhost"); err != nil {
-		log.Fatalf("CRITICAL: Failed to configure CSRF protection for localhost: %v", err)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	// Set up routes
-	mux := http.NewServeMux()
+	if *checkConfig {
+		printConfigSummary(os.Stdout, serverPort)
+		return
+	}
+	if *printAuthURL {
+		printAuthorizeURLs(os.Stdout)
+		return
+	}
 
-	// OAuth endpoints
-	// Register API endpoints before catch-all to ensure they match first
-	// Auth code exchange has rate limiting + CSRF protection (Go 1.25 CrossOriginProtection)
-	mux.Handle("/oauth/exchange", csrfProtection.Handler(exchangeRateLimiter.limitHandler(handleExchangeAuthCode)))
-	mux.HandleFunc("/oauth/login", handleOAuthLogin)
-	mux.HandleFunc("/oauth/callback", handleOAuthCallback)
-	mux.HandleFunc("/oauth/user", handleGetUser)
+	// From here on, unleveled log lines count as info and honor --log-level
+	log.SetOutput(&levelGate{out: log.Writer()})
 
-	// Health check endpoint
-	mux.HandleFunc("/health", handleHealthCheck)
+	for host, app := range oauthAppsByHost {
+		log.Printf("OAuth app for %s: client_id=%s", host, app.clientID)
+	}
+	if len(trustedProxyNets) > 0 {
+		log.Printf("Trusting X-Forwarded-For from proxies: %v", trustedProxyNets)
+	}
 
-	// Serve everything else as SPA (including assets)
-	// This MUST be registered last as it's a catch-all
-	mux.HandleFunc("/", serveStaticFiles)
+	// Tracing is a no-op unless an OTLP collector is configured
+	shutdownTracing := func(context.Context) error { return nil }
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		if shutdownTracing, err = setupTracing(context.Background()); err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		log.Printf("Exporting traces to %s", endpoint)
+	}
 
-	// Wrap with security middleware
-	handler := requestLogger(requestSizeLimiter(securityHeaders(mux)))
+	// Track in-flight requests for graceful draining
+	inflight := &inFlightTracker{}
+	handler := inflight.track(newServer(configFromFlags()))
 
 	// Start server with graceful shutdown
-	addr := ":" + serverPort
-	srv := &http.Server{
-		Addr:           addr,
-		Handler:        handler,
-		ReadTimeout:    httpTimeout,
-		WriteTimeout:   httpTimeout,
-		IdleTimeout:    httpTimeout * 12, // 2 minutes
-		MaxHeaderBytes: maxHeaderSize,
+	addr := net.JoinHostPort(*listenAddr, serverPort)
+	srv := newHTTPServer(addr, handler)
+	var certManager *autocert.Manager
+	if *tlsAuto {
+		certManager = newCertManager(*tlsCacheDir, tlsAutoHosts())
+		srv.TLSConfig = certManager.TLSConfig()
 	}
 
-	log.Printf("Starting server on %s", addr)
+	switch {
+	case *tlsAuto:
+		log.Printf("Starting server on %s (TLS from Let's Encrypt for %s)", addr, strings.Join(tlsAutoHosts(), ", "))
+	case *tlsCert != "":
+		log.Printf("Starting server on %s (TLS)", addr)
+	case *enableH2C:
+		log.Printf("Starting server on %s (HTTP/1.1 and h2c)", addr)
+	default:
+		log.Printf("Starting server on %s", addr)
+	}
+	info := currentBuildInfo()
+	log.Printf("Build: version=%s commit=%s date=%s go=%s", info.Version, info.Commit, info.BuildDate, info.GoVersion)
 	log.Printf("GitHub App ID: %d", *appID)
 	log.Printf("OAuth Client ID: %s", *clientID)
 	log.Printf("OAuth Redirect URI: %s", *redirectURI)
-	if *clientSecret == "" {
+	if *devMode {
+		log.Printf("WARNING: Dev mode: serving static files from %s instead of the embedded assets", *devDir)
+	} else {
+		log.Printf("Serving %d embedded static assets", len(staticAssets))
+	}
+	if defaultClientSecret.get() == "" {
 		log.Print("WARNING: OAuth Client Secret not set. OAuth login will not work.")
 		log.Print("Set GITHUB_CLIENT_SECRET environment variable or use --client-secret flag")
 	} else {
 		log.Print("OAuth Client Secret: configured")
 	}
 
-	// Start auth code cleanup goroutine
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			authCodesMutex.Lock()
-			now := time.Now()
-			for code, data := range authCodes {
-				if now.After(data.expiry) {
-					delete(authCodes, code)
-				}
+	if *verifyCreds {
+		apps := map[string]oauthApp{baseDomain: appForHost(baseDomain)}
+		for host, app := range oauthAppsByHost {
+			apps[host] = app
+		}
+		for host, app := range apps {
+			if err := verifyOAuthCredentials(context.Background(), app); err != nil {
+				log.Fatalf("OAuth credential check for %s failed: %v", host, err)
 			}
-			authCodesMutex.Unlock()
+			log.Printf("OAuth credentials for %s verified with GitHub (client_id=%s)", host, app.clientID)
 		}
-	}()
+	}
+
+	// Start auth code cleanup goroutine
+	background.run(func(ctx context.Context) {
+		runEvery(ctx, authCodeCleanupInterval, cleanupExpired)
+	})
+
+	if *heartbeatEvery > 0 {
+		background.run(func(ctx context.Context) {
+			runGitHubHeartbeat(ctx, heartbeat, *heartbeatEvery)
+		})
+	}
+	background.run(watchMaintenanceSignal)
+	if *maintenanceOn {
+		warnf("Starting in maintenance mode; send SIGUSR1 to resume serving")
+	}
+
+	// Sweep rate limiter entries on their own schedule so memory is bounded however IPs arrive
+	background.run(func(ctx context.Context) {
+		runEvery(ctx, *limiterSweep, sweepRateLimits)
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
 
 	// Start server in goroutine
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := serve(srv, ln, *tlsCert, *tlsKey); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
 
+	// Operator stats, and profiling if enabled, on a loopback listener never exposed publicly.
+	// Only a requested pprof listener is worth failing startup over.
+	if debugLn, err := listenPprof(*pprofAddr); err != nil {
+		if *enablePprof {
+			log.Fatalf("Failed to start pprof listener: %v", err)
+		}
+		warnf("Debug listener disabled: %v", err)
+	} else {
+		debugSrv := &http.Server{Handler: newDebugMux(*enablePprof), ReadHeaderTimeout: httpTimeout}
+		if *enablePprof {
+			log.Printf("Serving pprof and debug stats on http://%s/debug/", debugLn.Addr())
+		} else {
+			log.Printf("Serving debug stats on http://%s/debug/", debugLn.Addr())
+		}
+		go func() {
+			if err := debugSrv.Serve(debugLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Debug listener failed: %v", err)
+			}
+		}()
+	}
+
+	// Optional plain-HTTP listener that only upgrades clients to HTTPS
+	var redirectSrv *http.Server
+	if *redirectPort != "" {
+		redirectSrv = &http.Server{
+			Addr:              net.JoinHostPort(*listenAddr, *redirectPort),
+			Handler:           httpsRedirect(serverPort),
+			ReadHeaderTimeout: httpTimeout,
+			IdleTimeout:       httpTimeout,
+			MaxHeaderBytes:    maxHeaderSize,
+		}
+		if certManager != nil {
+			// Answer Let's Encrypt's HTTP-01 challenges; everything else is redirected
+			redirectSrv.Handler = certManager.HTTPHandler(redirectSrv.Handler)
+		}
+		log.Printf("Redirecting HTTP on %s to HTTPS", redirectSrv.Addr)
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP redirect listener failed to start: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -437,137 +837,45 @@ func main() {
 
 	log.Println("Shutting down server...")
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
-	}
-
-	log.Println("Server exited")
-}
-
-func serveStaticFiles(w http.ResponseWriter, r *http.Request) {
-	// Only allow GET, HEAD, and OPTIONS methods
-	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
-		log.Printf("[serveStaticFiles] Rejecting %s request to %s (405)", r.Method, r.URL.Path)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Redirect base domain frontpage to codegroove.dev
-	currentHost := r.Header.Get("X-Original-Host")
-	if currentHost == "" {
-		currentHost = r.Host
-	}
 
-	// Check if this is the base domain (not a subdomain) and the frontpage
-	if strings.EqualFold(currentHost, baseDomain) && (r.URL.Path == "/" || r.URL.Path == "") {
-		http.Redirect(w, r, "https://codegroove.dev/reviewgoose/", http.StatusFound)
-		return
-	}
-
-	// CORS: Allow subdomains to load assets from naked domain
-	// Check Origin header and allow all subdomains of reviewGOOSE.dev
-	origin := r.Header.Get("Origin")
-	if origin != "" {
-		// Parse origin to validate it's one of our subdomains
-		if u, err := url.Parse(origin); err == nil {
-			host := strings.ToLower(u.Hostname())
-			baseDomainLower := strings.ToLower(baseDomain)
-			// Allow naked domain and all subdomains (case-insensitive)
-			if host == baseDomainLower || strings.HasSuffix(host, "."+baseDomainLower) {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type")
-				w.Header().Set("Vary", "Origin")
-			}
+	var redirectErr error
+	if redirectSrv != nil {
+		if redirectErr = redirectSrv.Shutdown(ctx); redirectErr != nil {
+			log.Printf("HTTP redirect listener forced to shutdown: %v", redirectErr)
 		}
 	}
-
-	// Handle preflight requests
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// Clean the path
-	path := filepath.Clean(r.URL.Path)
-
-	// Prevent directory traversal
-	if strings.Contains(path, "..") || strings.Contains(path, "~") {
-		http.NotFound(w, r)
-		return
+	summary := shutdownServer(ctx, srv, inflight)
+	cancel()
+	if summary.Err != nil {
+		log.Printf("Server forced to shutdown: %v", summary.Err)
+	} else if redirectErr != nil {
+		summary.Err = redirectErr
 	}
 
-	// Remove leading slash for embed.FS
-	if path == "/" || path == "." {
-		path = "index.html"
-	} else {
-		path = strings.TrimPrefix(path, "/")
-	}
+	background.stop()
+	log.Print("Background tasks stopped")
 
-	// Try to read the file from embedded FS
-	data, err := staticFiles.ReadFile(path)
-	if err != nil {
-		// If file not found and not an asset, serve index.html for SPA routing
-		if !strings.HasPrefix(path, "assets/") && !strings.HasSuffix(path, ".ico") {
-			data, err = staticFiles.ReadFile("index.html")
-			if err != nil {
-				log.Printf("Failed to serve fallback index.html: %v", err)
-				http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
-				return
-			}
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.Header().Set("Cache-Control", "no-cache")
-			if _, err := w.Write(data); err != nil {
-				log.Printf("Failed to write response: %v", err)
-			}
-			return
-		}
-		http.NotFound(w, r)
-		return
+	// Flush spans from the final requests before exiting
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
 	}
+	cancel()
 
-	// Set content type and cache headers based on file extension
-	switch {
-	case strings.HasSuffix(path, ".html"):
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// Never cache HTML files - they contain BUILD_TIMESTAMP references to versioned assets
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		w.Header().Set("Pragma", "no-cache")
-		w.Header().Set("Expires", "0")
-		// Replace BUILD_TIMESTAMP placeholder with actual timestamp for cache busting
-		data = []byte(strings.ReplaceAll(string(data), "BUILD_TIMESTAMP", buildTimestamp))
-	case strings.HasSuffix(path, ".css"):
-		w.Header().Set("Content-Type", "text/css; charset=utf-8")
-		// Cache CSS for 1 year since URL includes version query param
-		if r.URL.Query().Get("v") != "" {
-			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-		}
-	case strings.HasSuffix(path, ".js"):
-		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-		// Cache JS for 1 year since URL includes version query param
-		if r.URL.Query().Get("v") != "" {
-			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-		}
-	case strings.HasSuffix(path, ".json"):
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	case strings.HasSuffix(path, ".png"):
-		w.Header().Set("Content-Type", "image/png")
-	case strings.HasSuffix(path, ".jpg"), strings.HasSuffix(path, ".jpeg"):
-		w.Header().Set("Content-Type", "image/jpeg")
-	case strings.HasSuffix(path, ".svg"):
-		w.Header().Set("Content-Type", "image/svg+xml")
-	case strings.HasSuffix(path, ".ico"):
-		w.Header().Set("Content-Type", "image/x-icon")
-	default:
-		// No specific content type
-	}
+	log.Printf("Server exited: %s", summary)
+	os.Exit(summary.ExitCode())
+}
 
-	// Write the file content
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Failed to write file content: %v", err)
-	}
+// cleanupExpired drops expired auth codes, sessions, device flows, cached lookups, and avatars.
+func cleanupExpired(now time.Time) {
+	cleanupAuthCodes(now)
+	sessions.cleanup(now)
+	deviceFlows.cleanup(now)
+	userInfoCache.cleanup(now)
+	invalidTokens.cleanup(now)
+	revokedTokens.cleanup(now)
+	issuedTokens.cleanup(now)
+	avatars.cleanup(now)
 }
 
 // validateReturnToURL validates that a return_to URL is safe to redirect to.
@@ -590,13 +898,22 @@ func validateReturnToURL(returnTo string) string {
 	case "http", "https":
 		// Valid scheme, continue validation
 	default:
-		log.Printf("[SECURITY] Invalid return_to scheme: %s", urlScheme)
+		warnf("[SECURITY] Invalid return_to scheme: %s", urlScheme)
 		return ""
 	}
 
+	// Partner hosts from --return-to-hosts match exactly, and only over HTTPS
+	if returnToHosts[strings.ToLower(host)] {
+		if urlScheme != "https" {
+			warnf("[SECURITY] Invalid return_to scheme for allowlisted host %s: %s", host, urlScheme)
+			return ""
+		}
+		return returnTo
+	}
+
 	// Validate domain is ours
 	if host != baseDomain && !strings.HasSuffix(host, "."+baseDomain) {
-		log.Printf("[SECURITY] Invalid return_to domain: %s", host)
+		warnf("[SECURITY] Invalid return_to domain: %s", host)
 		return ""
 	}
 
@@ -617,7 +934,7 @@ func validateReturnToURL(returnTo string) string {
 			// Validate subdomain is a valid GitHub handle (prevents punycode, homograph attacks, etc.)
 			// unless it's a reserved subdomain
 			if !isReserved && !isValidGitHubHandle(subdomain) {
-				log.Printf("[SECURITY] Invalid GitHub handle in return_to subdomain: %s", subdomain)
+				warnf("[SECURITY] Invalid GitHub handle in return_to subdomain: %s", subdomain)
 				return ""
 			}
 		}
@@ -626,18 +943,119 @@ func validateReturnToURL(returnTo string) string {
 	return returnTo
 }
 
-func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
-	if *clientID == "" {
-		log.Print("OAuth login attempted but client ID not configured. Set GITHUB_CLIENT_ID environment variable or use --client-id flag")
-		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
-		return
+// returnToHosts are the exact hosts outside the base domain that return_to may name, from
+// --return-to-hosts. Populated once at startup and read-only afterwards.
+var returnToHosts = map[string]bool{}
+
+// parseReturnToHosts parses a comma-separated list of bare hostnames. Wildcards, ports,
+// schemes, and IP addresses are rejected: each entry must be one exact DNS name.
+func parseReturnToHosts(spec string) (map[string]bool, error) {
+	hosts := make(map[string]bool)
+	for host := range strings.SplitSeq(spec, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if !isValidHostname(host) {
+			return nil, fmt.Errorf("invalid host %q: want an exact hostname like partner.example.com", host)
+		}
+		hosts[host] = true
 	}
+	return hosts, nil
+}
 
-	// Get current host to determine return destination
-	currentHost := r.Header.Get("X-Original-Host")
-	if currentHost == "" {
-		currentHost = r.Host
+// isValidHostname reports whether host is a lowercase DNS name with at least two labels,
+// each 1-63 letters, digits, or inner hyphens, and a non-numeric top-level label.
+func isValidHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		if strings.ContainsFunc(label, func(c rune) bool {
+			return (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-'
+		}) {
+			return false
+		}
+	}
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
+
+// validateRedirectURI checks the configured OAuth redirect URI at startup, so a typo
+// fails fast rather than cryptically at callback time. It must use https (except on localhost),
+// end with /oauth/callback, and be hosted on baseDomain, a subdomain, or an allowed origin.
+func validateRedirectURI(redirect, origins string) error {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	isLocal := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && isLocal:
+	default:
+		return fmt.Errorf("scheme must be https (or http for localhost), got %q", u.Scheme)
+	}
+
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not contain credentials, query, or fragment")
+	}
+	if u.Path != "/oauth/callback" {
+		return fmt.Errorf("path must be /oauth/callback, got %q", u.Path)
+	}
+
+	base := strings.ToLower(baseDomain)
+	if isLocal || host == base || strings.HasSuffix(host, "."+base) {
+		return nil
+	}
+	for origin := range strings.SplitSeq(origins, ",") {
+		if strings.EqualFold(strings.TrimSpace(origin), u.Scheme+"://"+u.Host) {
+			return nil
+		}
 	}
+	return fmt.Errorf("host %q is not %s, a subdomain, or an allowed origin", host, baseDomain)
+}
+
+// authorizeURL is GitHub's authorization page for app, always returning to the registered callback.
+func authorizeURL(app oauthApp, state string) string {
+	return fmt.Sprintf(
+		"https://github.com/login/oauth/authorize?client_id=%s&redirect_uri=%s&scope=%s&state=%s",
+		url.QueryEscape(app.clientID),
+		url.QueryEscape(*redirectURI),
+		url.QueryEscape(*oauthScopes),
+		url.QueryEscape(state),
+	)
+}
+
+// printAuthorizeURLs writes the authorize URL handleOAuthLogin would redirect to, with a
+// placeholder state, for --print-authorize-url: the default app's first, then one
+// "host: URL" line per --oauth-apps entry.
+func printAuthorizeURLs(w io.Writer) {
+	const state = "dummy-state"
+	lines := []string{authorizeURL(appForHost(baseDomain), state)}
+	for _, host := range slices.Sorted(maps.Keys(oauthAppsByHost)) {
+		lines = append(lines, host+": "+authorizeURL(oauthAppsByHost[host], state))
+	}
+	if _, err := fmt.Fprintln(w, strings.Join(lines, "\n")); err != nil {
+		errorf("Failed to write authorize URL: %v", err)
+	}
+}
+
+func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	// Get current host to determine return destination
+	currentHost := requestHost(r)
 
 	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
 	scheme := "http"
@@ -659,18 +1077,32 @@ func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
 	// Store return_to in state
 	returnTo := r.URL.Query().Get("return_to")
 
+	// The return_to host selects which OAuth app handles this login
+	app := appForReturnTo(returnTo)
+	if app.clientID == "" {
+		log.Print("OAuth login attempted but client ID not configured. Set GITHUB_CLIENT_ID environment variable or use --client-id flag")
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Generate state for CSRF protection (include return_to)
-	stateData := generateID(16)
+	stateData, err := newOAuthState(time.Now())
+	if err != nil {
+		errorf("Failed to generate OAuth state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 	if returnTo != "" {
 		// Store return_to in cookie so callback can use it
 		returnCookie := &http.Cookie{
 			Name:     "oauth_return_to",
 			Value:    returnTo,
 			Path:     "/",
+			Domain:   oauthCookieDomain(),
 			HttpOnly: true,
 			Secure:   isSecure,
 			SameSite: http.SameSiteLaxMode, // Lax required for OAuth redirect from GitHub
-			MaxAge:   900,                  // 15 minutes
+			MaxAge:   int(stateTTL.Seconds()),
 		}
 		http.SetCookie(w, returnCookie)
 	}
@@ -680,65 +1112,55 @@ func handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
 		Name:     "oauth_state",
 		Value:    stateData,
 		Path:     "/",
+		Domain:   oauthCookieDomain(),
 		HttpOnly: true,
 		Secure:   isSecure,
 		SameSite: http.SameSiteLaxMode, // Lax required for OAuth redirect from GitHub
-		Expires:  time.Now().Add(stateExpiry),
+		MaxAge:   int(stateTTL.Seconds()),
 	}
 	http.SetCookie(w, stateCookie)
 
-	// Build authorization URL (always use reviewGOOSE.dev callback)
-	authURL := fmt.Sprintf(
-		"https://github.com/login/oauth/authorize?client_id=%s&redirect_uri=%s&scope=%s&state=%s",
-		url.QueryEscape(*clientID),
-		url.QueryEscape(*redirectURI),
-		url.QueryEscape("repo read:org"),
-		url.QueryEscape(stateData),
-	)
+	authURL := authorizeURL(app, stateData)
 
 	log.Printf("[OAuth] Starting OAuth with return_to=%s", returnTo)
 	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
-	if *clientID == "" || *clientSecret == "" {
+	// Resolve the OAuth app from the host this login will return to
+	returnTo := ""
+	if returnCookie, err := r.Cookie("oauth_return_to"); err == nil {
+		returnTo = returnCookie.Value
+	}
+	app := appForReturnTo(returnTo)
+
+	if !app.configured() {
 		log.Printf("OAuth callback attempted but not configured: client_id=%q client_secret_set=%v",
-			*clientID, *clientSecret != "")
+			app.clientID, app.clientSecret != "")
 		log.Print("Set GITHUB_CLIENT_SECRET environment variable or --client-secret flag")
 		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	if isLockedOut(clientIP(r)) {
+		fields := requestAuditFields(r, auditDenied)
+		fields["path"] = r.URL.Path
+		auditLog(auditLockoutRejection, fields)
+		http.Error(w, "Too many failed login attempts. Please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
 	// Check for OAuth errors from GitHub
 	if errCode := r.URL.Query().Get("error"); errCode != "" {
 		errDesc := r.URL.Query().Get("error_description")
 		log.Printf("OAuth error: %s - %s", errCode, errDesc)
 
-		// Return user-friendly error page
-		escapedMsg := strings.NewReplacer(
-			"&", "&amp;",
-			"<", "&lt;",
-			">", "&gt;",
-			"\"", "&quot;",
-			"'", "&#39;",
-		).Replace("Authentication was cancelled or failed. Please try again.")
-		html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Authentication Failed</title>
-</head>
-<body>
-    <h1>Authentication Failed</h1>
-    <p>%s</p>
-    <p>You can close this window and try again.</p>
-</body>
-</html>
-`, escapedMsg)
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if _, err := w.Write([]byte(html)); err != nil {
-			log.Printf("Failed to write error response: %v", err)
+		// Return user-friendly error page; staging can opt in to GitHub's details
+		data := pageData{Message: "Authentication was cancelled or failed. Please try again."}
+		if *oauthDebugErrs {
+			data.ErrorCode, data.ErrorDetail = errCode, errDesc
 		}
+		renderPage(w, r, installFailurePage, http.StatusOK, data)
 		return
 	}
 
@@ -751,41 +1173,20 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		log.Printf("GitHub App installation callback: installation_id=%s, setup_action=%s", installationID, setupAction)
 
 		// Return a success page for app installations
-		escapedAction := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&#39;").Replace(setupAction)
-		escapedID := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&#39;").Replace(installationID)
-
-		html := fmt.Sprintf(`
-<!DOCTYPE html>
-<html>
-<head>
-    <title>GitHub App Installation</title>
-</head>
-<body>
-    <h1>GitHub App Installed Successfully</h1>
-    <p>The GitHub App has been %s successfully.</p>
-    <p>Installation ID: %s</p>
-    <p>This window will close automatically in 3 seconds.</p>
-    <script>
-        // Auto-close after 3 seconds
-        setTimeout(function() {
-            window.close();
-        }, 3000);
-    </script>
-</body>
-</html>
-`, escapedAction, escapedID)
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if _, err := w.Write([]byte(html)); err != nil {
-			log.Printf("Failed to write GitHub App installation response: %v", err)
-		}
+		renderPage(w, r, installSuccessPage, http.StatusOK, pageData{
+			SetupAction:    setupAction,
+			InstallationID: installationID,
+		})
 		return
 	}
 
 	// Regular OAuth flow - verify state
 	state := r.URL.Query().Get("state")
 	if state == "" {
-		trackFailedAttempt(clientIP(r))
-		log.Printf("[OAuth] Missing state parameter from %s", clientIP(r))
+		trackFailedAttempt(r)
+		fields := requestAuditFields(r, auditDenied)
+		fields["reason"] = "missing state parameter"
+		auditLog(auditStateInvalid, fields)
 		clearStateCookie(w)
 		http.Error(w, "Missing state parameter", http.StatusBadRequest)
 		return
@@ -793,8 +1194,10 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 
 	cookie, err := r.Cookie("oauth_state")
 	if err != nil {
-		trackFailedAttempt(clientIP(r))
-		log.Printf("[OAuth] Missing oauth_state cookie from %s: %v", clientIP(r), err)
+		trackFailedAttempt(r)
+		fields := requestAuditFields(r, auditDenied)
+		fields["reason"] = "missing state cookie"
+		auditLog(auditStateInvalid, fields)
 		log.Printf("[OAuth] Available cookies: %d present", len(r.Cookies()))
 		clearStateCookie(w)
 		http.Error(w, "Invalid state", http.StatusBadRequest)
@@ -803,19 +1206,32 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Use constant-time comparison to prevent timing attacks
 	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
-		trackFailedAttempt(clientIP(r))
-		log.Printf("[OAuth] State mismatch from %s", clientIP(r))
+		trackFailedAttempt(r)
+		fields := requestAuditFields(r, auditDenied)
+		fields["reason"] = "state mismatch"
+		auditLog(auditStateInvalid, fields)
 		clearStateCookie(w)
 		http.Error(w, "Invalid state", http.StatusBadRequest)
 		return
 	}
 
+	// Cookies are only a hint to the browser; enforce the TTL server-side too
+	flowStart, _ := stateIssued(state)
+	if stateExpired(state, time.Now()) {
+		fields := requestAuditFields(r, auditDenied)
+		fields["reason"] = "state expired"
+		auditLog(auditStateInvalid, fields)
+		clearStateCookie(w)
+		http.Error(w, "Login took too long, please try again", http.StatusBadRequest)
+		return
+	}
+
 	log.Printf("[OAuth] State validation successful for %s", clientIP(r))
 
 	// Get authorization code
 	code := r.URL.Query().Get("code")
 	if code == "" || len(code) > 512 {
-		trackFailedAttempt(clientIP(r))
+		trackFailedAttempt(r)
 		clearStateCookie(w)
 		http.Error(w, "Invalid authorization code", http.StatusBadRequest)
 		return
@@ -823,25 +1239,33 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Exchange code for token (use registered callback URI)
 	ctx := r.Context()
-	token, err := exchangeCodeForToken(ctx, code, *redirectURI)
+	tokenResp, err := exchangeCodeForToken(ctx, app, code, *redirectURI)
+	if errors.Is(err, errGitHubBusy) {
+		// GitHub was never asked, so the code is still good and this is no failed login;
+		// the state cookie is kept so reloading the callback retries
+		debugf(ctx, "Deferred OAuth code exchange: %v", err)
+		w.Header().Set("Retry-After", overloadRetryAfter)
+		http.Error(w, "Server is at capacity, please retry", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		trackFailedAttempt(clientIP(r))
-		log.Printf("Failed to exchange code for token: %v", err)
+		trackFailedAttempt(r)
+		errorf("[%s] Failed to exchange code for token: %v", requestIDFrom(ctx), err)
 		http.Error(w, "Authentication failed", http.StatusInternalServerError)
 		return
 	}
 
 	// Fetch username to determine personal workspace
-	user, err := userInfo(ctx, token)
+	user, err := userInfo(ctx, tokenResp.AccessToken)
 	if err != nil {
-		log.Printf("Failed to get user info after OAuth: %v", err)
+		errorf("[%s] Failed to get user info after OAuth: %v", requestIDFrom(ctx), err)
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
 	}
 
 	// Validate username format
 	if !isValidGitHubHandle(user.Login) {
-		log.Printf("[SECURITY] Invalid username format from GitHub OAuth: %s", user.Login)
+		warnf("[SECURITY] Invalid username format from GitHub OAuth: %s", user.Login)
 		http.Error(w, "Invalid username format", http.StatusBadRequest)
 		return
 	}
@@ -849,18 +1273,9 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	// Clear the state cookie after all validations pass
 	clearStateCookie(w)
 
-	// Get return_to from cookie
-	returnTo := ""
-	if returnCookie, err := r.Cookie("oauth_return_to"); err == nil && returnCookie.Value != "" {
-		returnTo = returnCookie.Value
-		// Clear the return_to cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "oauth_return_to",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-		})
+	// Clear the return_to cookie now that it has been consumed
+	if returnTo != "" {
+		clearReturnToCookie(w)
 	}
 
 	// Validate return_to URL
@@ -870,23 +1285,76 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		scheme = "https"
 	}
 
-	// Validate and use return_to URL, or default to personal workspace (my subdomain)
+	// Validate and use return_to URL, or default to --default-landing or the personal workspace (my subdomain)
 	redirectURL := validateReturnToURL(returnTo)
+	if redirectURL == "" {
+		redirectURL = *defaultLanding
+	}
 	if redirectURL == "" {
 		redirectURL = fmt.Sprintf("%s://my.%s", scheme, baseDomain)
 	}
 
+	sealed, err := sealToken(tokenResp.AccessToken)
+	if err != nil {
+		errorf("Failed to encrypt token for auth code: %v", err)
+		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		return
+	}
+	var sealedRefresh []byte
+	if tokenResp.RefreshToken != "" {
+		if sealedRefresh, err = sealToken(tokenResp.RefreshToken); err != nil {
+			errorf("Failed to encrypt refresh token for auth code: %v", err)
+			http.Error(w, "Authentication failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	issuedTokens.record(tokenResp, time.Now())
+
+	if *sessionMode == sessionModeCookie {
+		// Server-side session: the browser only ever holds an opaque HttpOnly cookie
+		sessionID, err := sessions.create(sessionData{
+			sealedToken:   sealed,
+			sealedRefresh: sealedRefresh,
+			username:      user.Login,
+			expiry:        time.Now().Add(sessionTTL),
+		})
+		if err != nil {
+			errorf("Failed to create session: %v", err)
+			http.Error(w, "Authentication failed", http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, r, sessionID, int(sessionTTL.Seconds()))
+		fields := requestAuditFields(r, auditAllowed)
+		fields["username"] = user.Login
+		fields["session_mode"] = sessionModeCookie
+		auditLog(auditLoginSuccess, fields)
+		log.Printf("[OAuth] Redirecting to %s with session cookie", sanitizeURL(redirectURL))
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
+
 	// Create one-time auth code for secure token transfer
-	authCode := generateID(32)
-	authCodesMutex.Lock()
-	authCodes[authCode] = authCodeData{
-		token:    token,
-		username: user.Login,
-		expiry:   time.Now().Add(10 * time.Second), // Short-lived (10s sufficient for modern browsers)
-		returnTo: redirectURL,
-		used:     false,
+	authCode, err := generateIDE(32)
+	if err != nil {
+		errorf("Failed to generate auth code: %v", err)
+		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		return
 	}
-	authCodesMutex.Unlock()
+	issued := time.Now()
+	tokenExpiry, refreshExpiry := tokenResp.expiries(issued)
+	storeAuthCode(authCode, authCodeData{
+		sealedToken:   sealed,
+		sealedRefresh: sealedRefresh,
+		username:      user.Login,
+		issued:        issued,
+		expiry:        issued.Add(*authCodeTTL),
+		returnTo:      redirectURL,
+		scopes:        parseScopes(tokenResp.Scope),
+		tokenExpiry:   tokenExpiry,
+		refreshExpiry: refreshExpiry,
+		flowStart:     flowStart,
+		used:          false,
+	})
 
 	// Redirect with one-time auth code in fragment (not sent to server)
 	// Fragment identifiers are not sent in Referer headers or logged by servers
@@ -895,6 +1363,21 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectWithCode, http.StatusFound)
 }
 
+// contentSHA256Header optionally carries the hex SHA-256 of an /oauth/exchange body, so a
+// body mangled in transit is rejected instead of decoded.
+const contentSHA256Header = "X-Content-SHA256"
+
+// validContentSHA256 reports whether body matches the hex SHA-256 in header. Requests
+// without the header aren't checked.
+func validContentSHA256(header string, body []byte) bool {
+	if header == "" {
+		return true
+	}
+	want, err := hex.DecodeString(strings.TrimSpace(header))
+	sum := sha256.Sum256(body)
+	return err == nil && subtle.ConstantTimeCompare(want, sum[:]) == 1
+}
+
 func handleExchangeAuthCode(w http.ResponseWriter, r *http.Request) {
 	// Record start time for constant-time responses (prevent timing attacks)
 	startTime := time.Now()
@@ -909,27 +1392,62 @@ func handleExchangeAuthCode(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	log.Printf("[handleExchangeAuthCode] Called with method=%s path=%s", r.Method, r.URL.Path)
+	debugf(r.Context(), "[handleExchangeAuthCode] Called with method=%s path=%s", r.Method, r.URL.Path)
 	if r.Method != http.MethodPost {
-		log.Printf("[handleExchangeAuthCode] Rejecting non-POST request: %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		debugf(r.Context(), "[handleExchangeAuthCode] Rejecting non-POST request: %s", r.Method)
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if isLockedOut(clientIP(r)) {
+		fields := requestAuditFields(r, auditDenied)
+		fields["path"] = r.URL.Path
+		auditLog(auditLockoutRejection, fields)
+		writeJSONError(w, http.StatusTooManyRequests, errCodeLockedOut, "Too many failed login attempts. Please try again later.")
 		return
 	}
 
 	// CSRF Protection is handled by Go 1.25's CrossOriginProtection middleware (wraps this handler)
 	// It uses Fetch Metadata (Sec-Fetch-Site header) which is more reliable than Origin header
 
-	// Get auth code from request
+	// Get auth code from request, reading no more than the small exchange body limit
+	if r.ContentLength > int64(*exchangeLimit) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, "Request too large")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(*exchangeLimit))
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, "Request too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+		return
+	}
+	if !validContentSHA256(r.Header.Get(contentSHA256Header), body) {
+		warnf("[SECURITY] [%s] %s mismatch on %s from %s", requestIDFrom(r.Context()), contentSHA256Header, r.URL.Path, clientIP(r))
+		writeJSONError(w, http.StatusBadRequest, errCodeChecksumMismatch, contentSHA256Header+" does not match the request body")
+		return
+	}
 	var req struct {
 		AuthCode string `json:"auth_code"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
 		return
 	}
 
 	if req.AuthCode == "" {
-		http.Error(w, "Missing auth_code", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeMissingAuthCode, "Missing auth_code")
+		return
+	}
+
+	// Check how to hand over the token before the code is consumed
+	delivery, err := exchangeTokenDelivery(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
 
@@ -940,265 +1458,409 @@ func handleExchangeAuthCode(w http.ResponseWriter, r *http.Request) {
 	// Perform all validation checks before releasing lock
 	if !exists {
 		authCodesMutex.Unlock()
-		log.Printf("[OAuth] Invalid or expired auth code from %s", clientIP(r))
-		http.Error(w, "Invalid or expired auth code", http.StatusUnauthorized)
+		log.Printf("[OAuth] Auth code not found from %s (invalid, or expired and cleaned up)", clientIP(r))
+		writeJSONError(w, http.StatusUnauthorized, errCodeInvalidAuthCode, "Invalid or expired auth code")
 		return
 	}
 
 	if data.used {
+		authCodeCurrent.Reused++
 		authCodesMutex.Unlock()
-		log.Printf("[SECURITY] Attempt to reuse auth code from %s", clientIP(r))
-		http.Error(w, "Auth code already used", http.StatusUnauthorized)
+		authCodeReuses.Add(1)
+		authCodeReuseAlert.record(time.Now())
+		fields := requestAuditFields(r, auditDenied)
+		fields["username"] = data.username
+		auditLog(auditAuthCodeReuse, fields)
+		writeJSONError(w, http.StatusUnauthorized, errCodeAuthCodeUsed, "Auth code already used")
 		return
 	}
 
-	if time.Now().After(data.expiry) {
+	if now := time.Now(); now.After(data.expiry) {
+		if !data.expiredAtExchange {
+			authCodeCurrent.ExpiredAtExchange++
+			data.expiredAtExchange = true
+			authCodes[req.AuthCode] = data
+		}
 		authCodesMutex.Unlock()
-		log.Printf("[OAuth] Expired auth code from %s", clientIP(r))
-		http.Error(w, "Auth code expired", http.StatusUnauthorized)
+		log.Printf("[OAuth] Expired auth code from %s: expired %v ago (ttl=%v)", clientIP(r), now.Sub(data.expiry), *authCodeTTL)
+		writeJSONError(w, http.StatusUnauthorized, errCodeAuthCodeExpired, "Auth code expired")
 		return
 	}
 
-	// All validations passed - atomically delete the auth code before releasing lock
-	delete(authCodes, req.AuthCode)
+	// All validations passed - atomically spend the auth code before releasing lock.
+	// It stays behind, without its tokens, until expiry so reuse is recognized.
+	authCodes[req.AuthCode] = spentAuthCode(data)
+	authCodeCurrent.Used++
 	authCodesMutex.Unlock()
 
-	// Return token and username
+	// Decrypt only now, right before returning it
+	token, err := openToken(data.sealedToken)
+	if err != nil {
+		errorf("Failed to decrypt token for auth code: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Authentication failed")
+		return
+	}
+
+	var refreshToken string
+	if data.sealedRefresh != nil {
+		if refreshToken, err = openToken(data.sealedRefresh); err != nil {
+			errorf("Failed to decrypt refresh token for auth code: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Authentication failed")
+			return
+		}
+	}
+
+	if delivery != tokenDeliveryJSON {
+		if err := setTokenCookies(w, token); err != nil {
+			errorf("Failed to set token cookies: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Authentication failed")
+			return
+		}
+	}
+
+	// With the token only in an HttpOnly cookie, the body (and JavaScript) never sees it;
+	// refresh tokens aren't handed out that way
+	// Expiry times let the SPA schedule a refresh before the token dies
 	response := struct {
-		Token    string `json:"token"`
-		Username string `json:"username"`
+		TokenExpiresAt        time.Time `json:"token_expires_at,omitzero"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at,omitzero"`
+		Token                 string    `json:"token,omitempty"`
+		RefreshToken          string    `json:"refresh_token,omitempty"`
+		Username              string    `json:"username"`
+		Scopes                []string  `json:"scopes"`
 	}{
-		Token:    data.token,
-		Username: data.username,
+		TokenExpiresAt: data.tokenExpiry.UTC(),
+		Username:       data.username,
+		Scopes:         data.scopes,
+	}
+	if delivery != tokenDeliveryCookie {
+		response.Token, response.RefreshToken = token, refreshToken
+		if refreshToken != "" {
+			response.RefreshTokenExpiresAt = data.refreshExpiry.UTC()
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Failed to encode auth exchange response: %v", err)
+		errorf("Failed to encode auth exchange response: %v", err)
 	}
 
-	log.Printf("[OAuth] Successfully exchanged auth code for user %s", data.username)
+	fields := requestAuditFields(r, auditAllowed)
+	fields["username"] = data.username
+	fields["token_delivery"] = delivery
+	addFlowDurations(fields, data, time.Now())
+	auditLog(auditLoginSuccess, fields)
 }
 
-func handleGetUser(w http.ResponseWriter, r *http.Request) {
-	// Get token from Authorization header
+// addFlowDurations records how long a login took, from /oauth/login to this exchange, split
+// into the time until GitHub sent the user back (mostly the consent screen) and the handoff
+// from callback to exchange (the redirect and SPA load). The start is only second-accurate.
+func addFlowDurations(fields map[string]any, data authCodeData, now time.Time) {
+	if data.flowStart.IsZero() {
+		return
+	}
+	fields["flow_duration_ms"] = now.Sub(data.flowStart).Milliseconds()
+	fields["github_ms"] = data.issued.Sub(data.flowStart).Milliseconds()
+	fields["handoff_ms"] = now.Sub(data.issued).Milliseconds()
+}
+
+// bearerToken extracts the token from the Authorization header,
+// writing a 401 response and returning false if it is missing, malformed, or revoked.
+func bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
-		return
+		writeJSONError(w, http.StatusUnauthorized, errCodeMissingAuthorization, "Missing authorization header")
+		return "", false
 	}
 
 	token := strings.TrimPrefix(authHeader, "Bearer ")
-	if token == authHeader {
-		http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
-		return
+	if token == authHeader || token == "" {
+		writeJSONError(w, http.StatusUnauthorized, errCodeInvalidAuthorization, "Invalid authorization header")
+		return "", false
+	}
+	if rejectRevoked(w, r, token) {
+		return "", false
 	}
 
-	// Get user info from GitHub
-	ctx := r.Context()
-	user, err := userInfo(ctx, token)
-	if err != nil {
-		log.Printf("Failed to get user info: %v", err)
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+	return token, true
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and rotated refresh token.
+func handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		log.Printf("Failed to encode user response: %v", err)
+	app := appForHost(requestHost(r))
+	if !app.configured() {
+		log.Print("Token refresh attempted but OAuth client is not configured")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeNotConfigured, "Service temporarily unavailable")
+		return
 	}
-}
 
-func exchangeCodeForToken(ctx context.Context, code, redirectURI string) (string, error) {
-	// Validate inputs
-	if code == "" || redirectURI == "" {
-		return "", errors.New("invalid parameters")
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+		return
+	}
+	if req.RefreshToken == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeMissingRefreshToken, "Missing refresh_token")
+		return
+	}
+	// A revoked token's refresh token is revoked with it, so it can't mint a replacement
+	if rejectRevoked(w, r, req.RefreshToken) {
+		return
 	}
 
-	// Additional validation for code length to prevent injection
-	if len(code) > 512 {
-		return "", errors.New("authorization code too long")
+	tokenResp, err := refreshAccessToken(r.Context(), app, req.RefreshToken)
+	if errors.Is(err, errTokenRejected) {
+		trackFailedAttempt(r)
+		log.Printf("[OAuth] Refresh token rejected for %s: %v", clientIP(r), err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeInvalidRefreshToken, "Invalid or expired refresh token")
+		return
 	}
+	if err != nil {
+		errorf("Failed to refresh token: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeUpstreamError, "Failed to refresh token")
+		return
+	}
+	issuedTokens.record(tokenResp, time.Now())
 
-	var tokenResp oauthTokenResponse
+	response := struct {
+		Token                 string `json:"token"`
+		RefreshToken          string `json:"refresh_token"`
+		ExpiresIn             int    `json:"expires_in,omitempty"`
+		RefreshTokenExpiresIn int    `json:"refresh_token_expires_in,omitempty"`
+	}{
+		Token:                 tokenResp.AccessToken,
+		RefreshToken:          tokenResp.RefreshToken,
+		ExpiresIn:             tokenResp.ExpiresIn,
+		RefreshTokenExpiresIn: tokenResp.RefreshTokenExpiresIn,
+	}
 
-	// Retry with exponential backoff for up to 2 minutes
-	err := retry.Do(
-		func() error {
-			// Prepare request
-			data := url.Values{}
-			data.Set("client_id", *clientID)
-			data.Set("client_secret", *clientSecret)
-			data.Set("code", code)
-			data.Set("redirect_uri", redirectURI)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode refresh response: %v", err)
+	}
+}
 
-			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
-			defer cancel()
+// handleGetUser returns the token owner's profile. Optional ?include=email,orgs adds the
+// primary verified email and org list, at the cost of extra GitHub calls.
+func handleGetUser(w http.ResponseWriter, r *http.Request) {
+	token, ok := userToken(w, r)
+	if !ok {
+		return
+	}
 
-			req, err := http.NewRequestWithContext(
-				reqCtx,
-				http.MethodPost,
-				"https://github.com/login/oauth/access_token",
-				strings.NewReader(data.Encode()),
-			)
-			if err != nil {
-				return retry.Unrecoverable(err)
-			}
+	var includeEmail, includeOrgs bool
+	for field := range strings.SplitSeq(r.URL.Query().Get("include"), ",") {
+		switch strings.TrimSpace(field) {
+		case "email":
+			includeEmail = true
+		case "orgs":
+			includeOrgs = true
+		case "":
+		default:
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidInclude, "Invalid include parameter")
+			return
+		}
+	}
 
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			req.Header.Set("Accept", "application/json")
-
-			// Make request with timeout
-			client := &http.Client{
-				Timeout: httpTimeout,
-				CheckRedirect: func(_ *http.Request, via []*http.Request) error {
-					if len(via) >= 3 {
-						return errors.New("too many redirects")
-					}
-					return nil
-				},
-			}
+	// Get user info from GitHub (cached briefly to spare rate limit)
+	ctx := r.Context()
+	user, err := userInfoCache.lookup(ctx, token)
+	if err != nil {
+		errorf("Failed to get user info: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeUpstreamError, "Failed to get user info")
+		return
+	}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("[RETRY] Token exchange network error (will retry): %v", err)
-				return fmt.Errorf("token exchange failed: %w", err)
-			}
-			defer func() {
-				if err := resp.Body.Close(); err != nil {
-					log.Printf("Failed to close response body: %v", err)
-				}
-			}()
+	if !includeEmail && !includeOrgs {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(user); err != nil {
+			errorf("Failed to encode user response: %v", err)
+		}
+		return
+	}
 
-			// Retry on 5xx server errors
-			if resp.StatusCode >= 500 {
-				log.Printf("[RETRY] Token exchange returned %d (will retry)", resp.StatusCode)
-				return fmt.Errorf("token exchange returned status %d", resp.StatusCode)
-			}
+	response := struct {
+		*githubUser
+		Email *string     `json:"email,omitempty"`
+		Orgs  []githubOrg `json:"orgs,omitzero"`
+	}{githubUser: user}
+
+	if includeEmail {
+		email, err := userPrimaryEmail(ctx, token)
+		if err != nil {
+			errorf("Failed to get user emails: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeUpstreamError, "Failed to get user info")
+			return
+		}
+		// Present but empty when the user has no primary verified email
+		response.Email = &email
+	}
 
-			// Don't retry on 4xx client errors
-			if resp.StatusCode != http.StatusOK {
-				return retry.Unrecoverable(fmt.Errorf("token exchange returned status %d", resp.StatusCode))
-			}
+	if includeOrgs {
+		if response.Orgs, err = userOrgs(ctx, token); err != nil {
+			errorf("Failed to get user orgs: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeUpstreamError, "Failed to get user info")
+			return
+		}
+	}
 
-			// Read the entire response body
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return retry.Unrecoverable(fmt.Errorf("failed to read response body: %w", err))
-			}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode user response: %v", err)
+	}
+}
 
-			// Parse response
-			if err := json.Unmarshal(body, &tokenResp); err != nil {
-				log.Printf("Failed to parse token response: %v", err)
-				return retry.Unrecoverable(fmt.Errorf("failed to parse token response: %w", err))
-			}
+// handleValidateToken reports whether a token is still valid, so the frontend can
+// re-authenticate before making API calls that would fail.
+func handleValidateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
 
-			if tokenResp.AccessToken == "" {
-				log.Printf("Token response error: %s, description: %s", tokenResp.Error, tokenResp.ErrorDescription)
-				return retry.Unrecoverable(errors.New("no access token in response"))
-			}
+	app := appForHost(requestHost(r))
+	if !app.configured() {
+		log.Print("Token validation attempted but OAuth client is not configured")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeNotConfigured, "Service temporarily unavailable")
+		return
+	}
 
-			return nil
-		},
-		retry.Context(ctx),
-		retry.Attempts(10),                  // Reasonable number of attempts for 2 minutes
-		retry.Delay(100*time.Millisecond),   // Initial delay
-		retry.MaxDelay(30*time.Second),      // Cap delay at 30s
-		retry.DelayType(retry.BackOffDelay), // Exponential backoff
-		retry.MaxJitter(1*time.Second),      // Add jitter
-		retry.OnRetry(func(n uint, err error) {
-			log.Printf("[RETRY] Attempt %d: %v", n+1, err)
-		}),
-	)
-	if err != nil {
-		return "", err
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
 	}
 
-	// Validate token before returning
-	if len(tokenResp.AccessToken) < 40 || len(tokenResp.AccessToken) > 255 {
-		return "", errors.New("invalid token length")
+	response := struct {
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		Scopes    []string   `json:"scopes"`
+		Valid     bool       `json:"valid"`
+	}{
+		Scopes: []string{},
 	}
 
-	// Check token format
-	if !strings.HasPrefix(tokenResp.AccessToken, "ghp_") &&
-		!strings.HasPrefix(tokenResp.AccessToken, "gho_") &&
-		!strings.HasPrefix(tokenResp.AccessToken, "ghs_") &&
-		!strings.HasPrefix(tokenResp.AccessToken, "ghu_") {
-		return "", errors.New("unknown token format")
+	now := time.Now()
+	if invalidTokens.contains(token, now) {
+		log.Printf("[OAuth] Token validation served from negative cache for %s", clientIP(r))
+	} else {
+		details, err := checkToken(r.Context(), app, token)
+		if err != nil {
+			errorf("Failed to validate token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeUpstreamError, "Failed to validate token")
+			return
+		}
+		if details == nil {
+			invalidTokens.add(token, now)
+		} else {
+			response.Valid = true
+			response.ExpiresAt = details.ExpiresAt
+			if details.Scopes != nil {
+				response.Scopes = details.Scopes
+			}
+		}
 	}
 
-	log.Print("Successfully exchanged OAuth code for token")
-	return tokenResp.AccessToken, nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode token validation response: %v", err)
+	}
 }
 
-func userInfo(ctx context.Context, token string) (*githubUser, error) {
-	var user githubUser
-
-	// Retry with exponential backoff for up to 2 minutes
-	err := retry.Do(
-		func() error {
-			reqCtx, cancel := context.WithTimeout(ctx, httpTimeout)
-			defer cancel()
-
-			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "https://api.github.com/user", http.NoBody)
-			if err != nil {
-				return retry.Unrecoverable(err)
-			}
+// handleCheckOrgMembership reports whether the token owner is an active member of an org.
+func handleCheckOrgMembership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
 
-			req.Header.Set("Authorization", "Bearer "+token)
-			req.Header.Set("Accept", "application/vnd.github.v3+json")
+	org := r.URL.Query().Get("org")
+	if !isValidGitHubHandle(org) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOrg, "Invalid org parameter")
+		return
+	}
 
-			client := &http.Client{
-				Timeout: httpTimeout,
-				CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
-					return errors.New("unexpected redirect")
-				},
-			}
+	token, ok := bearerToken(w, r)
+	if !ok {
+		return
+	}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("[RETRY] GitHub user info network error (will retry): %v", err)
-				return err
-			}
-			defer func() {
-				if err := resp.Body.Close(); err != nil {
-					log.Printf("Failed to close response body: %v", err)
-				}
-			}()
+	membership, err := userOrgMembership(r.Context(), token, org)
+	if err != nil {
+		if errors.Is(err, errTokenRejected) {
+			writeJSONError(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid token")
+			return
+		}
+		errorf("Failed to check membership in org %s: %v", org, err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to check org membership")
+		return
+	}
 
-			// Retry on 5xx server errors
-			if resp.StatusCode >= 500 {
-				log.Printf("[RETRY] GitHub user info returned %d (will retry)", resp.StatusCode)
-				return fmt.Errorf("unexpected status: %d", resp.StatusCode)
-			}
+	response := struct {
+		Role   string `json:"role,omitempty"`
+		Member bool   `json:"member"`
+	}{}
+	// Pending invitations don't grant access yet
+	if membership != nil && membership.State == "active" {
+		response.Member = true
+		response.Role = membership.Role
+	}
 
-			// Don't retry on 4xx client errors (including 401 unauthorized)
-			if resp.StatusCode != http.StatusOK {
-				return retry.Unrecoverable(fmt.Errorf("unexpected status: %d", resp.StatusCode))
-			}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode org membership response: %v", err)
+	}
+}
 
-			if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-				return retry.Unrecoverable(err)
-			}
+// handleTokenRateLimit reports the token owner's remaining GitHub API quota,
+// so the dashboard can warn before requests start failing.
+func handleTokenRateLimit(w http.ResponseWriter, r *http.Request) {
+	token, ok := userToken(w, r)
+	if !ok {
+		return
+	}
 
-			return nil
-		},
-		retry.Context(ctx),
-		retry.Attempts(10),
-		retry.Delay(100*time.Millisecond),
-		retry.MaxDelay(30*time.Second),
-		retry.DelayType(retry.BackOffDelay),
-		retry.MaxJitter(1*time.Second),
-		retry.OnRetry(func(n uint, err error) {
-			log.Printf("[RETRY] User info attempt %d: %v", n+1, err)
-		}),
-	)
+	limits, err := tokenRateLimits(r.Context(), token)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, errTokenRejected) {
+			writeJSONError(w, http.StatusUnauthorized, errCodeInvalidToken, "Invalid token")
+			return
+		}
+		errorf("Failed to get rate limit: %v", err)
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamError, "Failed to get rate limit")
+		return
+	}
+
+	type bucket struct {
+		Reset     time.Time `json:"reset"`
+		Limit     int       `json:"limit"`
+		Remaining int       `json:"remaining"`
+		Used      int       `json:"used"`
+	}
+	toBucket := func(b rateLimitBucket) bucket {
+		return bucket{Reset: time.Unix(b.Reset, 0).UTC(), Limit: b.Limit, Remaining: b.Remaining, Used: b.Used}
+	}
+	response := struct {
+		Core    bucket `json:"core"`
+		Search  bucket `json:"search"`
+		GraphQL bucket `json:"graphql"`
+	}{
+		Core:    toBucket(limits.Resources.Core),
+		Search:  toBucket(limits.Resources.Search),
+		GraphQL: toBucket(limits.Resources.GraphQL),
 	}
 
-	log.Printf("Successfully fetched user info for: %s", user.Login)
-	return &user, nil
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode rate limit response: %v", err)
+	}
 }
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
@@ -1209,32 +1871,79 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	health := struct {
-		Timestamp  time.Time `json:"timestamp"`
-		Status     string    `json:"status"`
-		Version    string    `json:"version"`
-		OAuthReady bool      `json:"oauth_ready"`
+		Timestamp  time.Time        `json:"timestamp"`
+		Status     string           `json:"status"`
+		Version    string           `json:"version"`
+		OAuthReady bool             `json:"oauth_ready"`
+		GitHub     *publicHeartbeat `json:"github,omitempty"`
 	}{
 		Status:     "healthy",
-		Version:    "1.0.0",
+		Version:    currentBuildInfo().Version,
 		Timestamp:  time.Now(),
-		OAuthReady: *clientID != "" && *clientSecret != "",
+		OAuthReady: *clientID != "" && defaultClientSecret.get() != "",
+	}
+	// GitHub being down doesn't make this process unhealthy; /readyz reports it as degraded
+	if *heartbeatEvery > 0 {
+		health.GitHub = heartbeat.status(*heartbeatEvery).public()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(health); err != nil {
-		log.Printf("Failed to encode health response: %v", err)
+		errorf("Failed to encode health response: %v", err)
 	}
 }
 
-// generateID generates a cryptographically secure random ID.
-func generateID(bytes int) string {
+// randReader is the entropy source for IDs. Tests replace it to simulate failures.
+var randReader io.Reader = rand.Reader
+
+// generateIDE generates a cryptographically secure random ID, returning an error rather
+// than falling back to weak randomness if the system source fails.
+func generateIDE(bytes int) (string, error) {
 	b := make([]byte, bytes)
-	if _, err := rand.Read(b); err != nil {
-		// Critical security failure - do not fall back to weak randomness
-		panic(fmt.Sprintf("CRITICAL: Failed to generate secure random ID: %v", err))
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", fmt.Errorf("failed to generate secure random ID: %w", err)
 	}
-	return base64.URLEncoding.EncodeToString(b)
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// newOAuthState returns a random OAuth state value that records when it was issued.
+func newOAuthState(now time.Time) (string, error) {
+	id, err := generateIDE(16)
+	if err != nil {
+		return "", err
+	}
+	return id + "." + strconv.FormatInt(now.Unix(), 36), nil
+}
+
+// stateIssued returns when newOAuthState issued state, to the second, which is also when
+// the login started. ok is false for a malformed state.
+func stateIssued(state string) (issued time.Time, ok bool) {
+	_, stamp, found := strings.Cut(state, ".")
+	if !found {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(stamp, 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// stateExpired reports whether an OAuth state is older than --oauth-state-ttl or malformed.
+func stateExpired(state string, now time.Time) bool {
+	issued, ok := stateIssued(state)
+	return !ok || now.Sub(issued) > *stateTTL
+}
+
+// oauthCookieDomain is the Domain for the oauth_state and oauth_return_to cookies: empty
+// (host-only) by default, or the base domain with --cookie-domain so subdomains see them.
+// Cookies must be cleared with the Domain they were set with.
+func oauthCookieDomain() string {
+	if *cookieDomain {
+		return baseDomain
+	}
+	return ""
 }
 
 func clearStateCookie(w http.ResponseWriter) {
@@ -1242,26 +1951,79 @@ func clearStateCookie(w http.ResponseWriter) {
 		Name:     "oauth_state",
 		Value:    "",
 		Path:     "/",
+		Domain:   oauthCookieDomain(),
 		MaxAge:   -1,
 		HttpOnly: true,
 	})
 }
 
-// sanitizeURL removes sensitive parameters from URLs for logging.
+func clearReturnToCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oauth_return_to",
+		Value:    "",
+		Path:     "/",
+		Domain:   oauthCookieDomain(),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// sensitiveParams are query parameters whose values are redacted from logs on any path.
+var sensitiveParams = map[string]bool{
+	"code":          true,
+	"state":         true,
+	"auth_code":     true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"client_secret": true,
+}
+
+// oauthLoggableParams are the only query parameters whose values are logged under /oauth/,
+// where anything else may be a credential.
+var oauthLoggableParams = map[string]bool{
+	"error":        true,
+	"setup_action": true,
+	"org":          true,
+	"include":      true,
+}
+
+// sanitizeURL redacts sensitive query values and drops the fragment so URLs are safe to log,
+// e.g. /oauth/callback?code=abc&state=xyz becomes /oauth/callback?code=[REDACTED]&state=[REDACTED].
+// Parameter names and order are kept for debugging.
 func sanitizeURL(urlStr string) string {
 	u, err := url.Parse(urlStr)
 	if err != nil {
 		return "[INVALID_URL]"
 	}
 
-	// Remove fragment and query parameters
+	// Fragments carry one-time auth codes
 	u.Fragment = ""
-	u.RawQuery = ""
+	u.RawFragment = ""
+
+	if u.RawQuery != "" {
+		oauthPath := strings.HasPrefix(u.Path, "/oauth/")
+		var params []string
+		for param := range strings.SplitSeq(u.RawQuery, "&") {
+			rawKey, _, _ := strings.Cut(param, "=")
+			key, err := url.QueryUnescape(rawKey)
+			if err != nil {
+				key = rawKey
+			}
+			if sensitiveParams[strings.ToLower(key)] || (oauthPath && !oauthLoggableParams[strings.ToLower(key)]) {
+				param = rawKey + "=[REDACTED]"
+			}
+			params = append(params, param)
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
 
 	return u.String()
 }
 
-func trackFailedAttempt(ip string) {
+func trackFailedAttempt(r *http.Request) {
+	ip := clientIP(r)
+
 	failedMutex.Lock()
 	defer failedMutex.Unlock()
 
@@ -1278,22 +2040,141 @@ func trackFailedAttempt(ip string) {
 
 	failedAttempts[ip] = append(valid, now)
 
-	// Log if there are too many failed attempts
-	if len(failedAttempts[ip]) > maxFailedLogins {
-		log.Printf("[SECURITY] Excessive failed auth attempts: ip=%s count=%d window=15min", ip, len(failedAttempts[ip]))
+	// The failure that tips the IP into lockout starts it and is audited; the lockout
+	// runs its own --lockout-duration, independent of failedLoginWindow
+	if len(failedAttempts[ip]) >= maxFailedLogins && !now.Before(lockedUntil[ip]) {
+		lockedUntil[ip] = now.Add(*lockoutPeriod)
+		fields := requestAuditFields(r, auditDenied)
+		fields["count"] = len(failedAttempts[ip])
+		fields["window"] = failedLoginWindow.String()
+		fields["duration"] = lockoutPeriod.String()
+		auditLog(auditLockout, fields)
 	}
+}
 
-	// Prevent memory exhaustion: periodically clean up IPs with no recent failures
-	// This protects against DoS attacks using many different IPs
-	if len(failedAttempts)%100 == 0 {
-		for oldIP, times := range failedAttempts {
-			if len(times) == 0 || (len(times) > 0 && times[len(times)-1].Before(cutoff)) {
-				delete(failedAttempts, oldIP)
-			}
+// sweepFailedAttempts drops IPs with no failed logins inside failedLoginWindow, and
+// lockouts that have ended.
+func sweepFailedAttempts(now time.Time) {
+	failedMutex.Lock()
+	defer failedMutex.Unlock()
+
+	cutoff := now.Add(-failedLoginWindow)
+	for ip, times := range failedAttempts {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(failedAttempts, ip)
+		}
+	}
+	for ip, until := range lockedUntil {
+		if !now.Before(until) {
+			delete(lockedUntil, ip)
 		}
 	}
 }
 
+// recentFailures counts ip's failed logins within failedLoginWindow.
+func recentFailures(ip string, now time.Time) int {
+	failedMutex.Lock()
+	defer failedMutex.Unlock()
+
+	cutoff := now.Add(-failedLoginWindow)
+	recent := 0
+	for _, t := range failedAttempts[ip] {
+		if t.After(cutoff) {
+			recent++
+		}
+	}
+	return recent
+}
+
+// isLockedOut reports whether an IP's lockout, started by its maxFailedLogins-th failure
+// within failedLoginWindow, is still running.
+func isLockedOut(ip string) bool {
+	failedMutex.Lock()
+	defer failedMutex.Unlock()
+	return time.Now().Before(lockedUntil[ip])
+}
+
+// requestDeadline cancels the request's context after timeout, so handlers waiting on
+// GitHub are cut off rather than hanging. Unlike http.TimeoutHandler it doesn't buffer the
+// response or run the handler on another goroutine; whatever a handler writes once the
+// deadline has passed is replaced with a JSON 503.
+func requestDeadline(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		dw := &deadlineWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(dw, r.WithContext(ctx))
+		if !dw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			dw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// deadlineWriter passes a response through until its context's deadline passes, then
+// answers a JSON timeout error in place of the handler's response.
+type deadlineWriter struct {
+	http.ResponseWriter
+
+	ctx         context.Context //nolint:containedctx // the deadline being enforced
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (dw *deadlineWriter) WriteHeader(code int) {
+	if dw.wroteHeader {
+		return
+	}
+	dw.wroteHeader = true
+	if errors.Is(dw.ctx.Err(), context.DeadlineExceeded) {
+		dw.timedOut = true
+		h := dw.Header()
+		h.Del("Location")
+		h.Del("Content-Encoding")
+		writeJSONError(dw.ResponseWriter, http.StatusServiceUnavailable, errCodeTimeout, "Request timed out")
+		return
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *deadlineWriter) Write(b []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if dw.timedOut {
+		return len(b), nil
+	}
+	return dw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush.
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// concurrencyLimiter answers 503 once limit requests are already in progress, so load
+// spikes shed work instead of exhausting memory. /health is exempt so liveness checks
+// keep passing while the server is saturated. A limit of 0 disables it.
+func concurrencyLimiter(next http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", overloadRetryAfter)
+			http.Error(w, "Server is at capacity, please retry", http.StatusServiceUnavailable)
+		}
+	})
+}
+
 // requestSizeLimiter prevents large request bodies from exhausting server resources.
 func requestSizeLimiter(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1310,6 +2191,37 @@ func requestSizeLimiter(next http.Handler) http.Handler {
 	})
 }
 
+// headerCountLog throttles the too-many-headers warning, which a flood would otherwise
+// log on every request.
+var headerCountLog = &logThrottle{interval: time.Minute}
+
+// headerCountLimiter answers 431 to requests with more than limit header fields, so a
+// flood of tiny headers that fits under MaxHeaderBytes is refused before any handler
+// walks them. Repeated fields count once per line, and X-Request-ID, which securityHeaders
+// always sets, is not counted. A limit of 0 disables it.
+func headerCountLimiter(next http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for name, values := range r.Header {
+			if name != "X-Request-Id" {
+				count += len(values)
+			}
+		}
+		if count > limit {
+			if ok, dropped := headerCountLog.allow(time.Now()); ok {
+				warnf("[SECURITY] [%s] Too many header fields from %s: %d (limit %d; %d more since the last warning)",
+					requestIDFrom(r.Context()), clientIP(r), count, limit, dropped)
+			}
+			http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // requestLogger logs all HTTP requests and responses.
 func requestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1319,23 +2231,23 @@ func requestLogger(next http.Handler) http.Handler {
 		// Create a response writer wrapper to capture status code
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
-		// Log request
-		log.Printf("[%s] %s %s %s from %s", requestID, r.Method, r.URL.Path, r.Proto, clientIP(r))
+		// Log request; access lines are debug level since every request writes two
+		debugf(r.Context(), "[%s] %s %s %s from %s", requestID, r.Method, sanitizeURL(r.URL.RequestURI()), r.Proto, clientIP(r))
 
 		next.ServeHTTP(wrapped, r)
 
 		// Log response
 		duration := time.Since(start)
-		log.Printf("[%s] %d %s in %v", requestID, wrapped.statusCode, http.StatusText(wrapped.statusCode), duration)
+		debugf(r.Context(), "[%s] %d %s in %v", requestID, wrapped.statusCode, http.StatusText(wrapped.statusCode), duration)
 
 		// Log security events with structured data
 		switch wrapped.statusCode {
 		case http.StatusUnauthorized, http.StatusForbidden:
-			log.Printf("[SECURITY] [%s] Unauthorized access: method=%s path=%s ip=%s", requestID, r.Method, r.URL.Path, clientIP(r))
+			warnf("[SECURITY] [%s] Unauthorized access: method=%s path=%s ip=%s", requestID, r.Method, r.URL.Path, clientIP(r))
 		case http.StatusTooManyRequests:
-			log.Printf("[SECURITY] [%s] Rate limit exceeded: ip=%s", requestID, clientIP(r))
+			warnf("[SECURITY] [%s] Rate limit exceeded: ip=%s", requestID, clientIP(r))
 		case http.StatusInternalServerError:
-			log.Printf("[ERROR] [%s] Internal server error: method=%s path=%s ip=%s", requestID, r.Method, r.URL.Path, clientIP(r))
+			errorf("[ERROR] [%s] Internal server error: method=%s path=%s ip=%s", requestID, r.Method, r.URL.Path, clientIP(r))
 		default:
 			// Other status codes don't require special logging
 		}
@@ -2,9 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -258,3 +268,1218 @@ func (w *testResponseWriter) Write(b []byte) (int, error) {
 func (w *testResponseWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 }
+
+// setString overrides a flag value for the duration of a test.
+func setString(t *testing.T, p *string, v string) {
+	t.Helper()
+	orig := *p
+	*p = v
+	t.Cleanup(func() { *p = orig })
+}
+
+// setClientSecret sets the default OAuth client secret for the duration of a test.
+func setClientSecret(t *testing.T, v string) {
+	t.Helper()
+	orig := defaultClientSecret.get()
+	defaultClientSecret.set(v)
+	t.Cleanup(func() { defaultClientSecret.set(orig) })
+}
+
+func TestHandleValidateToken(t *testing.T) {
+	setClientSecret(t, "test_secret")
+	orig := invalidTokens
+	t.Cleanup(func() { invalidTokens = orig })
+	invalidTokens = newInvalidTokenCache(time.Minute)
+
+	var calls atomic.Int32
+	stubClient(t, &apiClient, func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != *clientID || pass != "test_secret" {
+			t.Errorf("token check missing client basic auth")
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("failed to read request body: %v", err)
+		}
+		if strings.Contains(string(body), "gho_valid") {
+			return stubResponse(http.StatusOK, `{"scopes":["repo","read:org"],"expires_at":"2030-01-01T00:00:00Z"}`), nil
+		}
+		return stubResponse(http.StatusNotFound, `{"message":"Not Found"}`), nil
+	})
+
+	validate := func(token string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/validate", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handleValidateToken(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	code, body := validate("gho_valid")
+	if code != http.StatusOK || !strings.Contains(body, `"valid":true`) || !strings.Contains(body, `"read:org"`) ||
+		!strings.Contains(body, `"expires_at":"2030-01-01T00:00:00Z"`) {
+		t.Errorf("valid token: status = %d, body = %s", code, body)
+	}
+
+	for range 2 {
+		code, body = validate("gho_revoked")
+		if code != http.StatusOK || !strings.Contains(body, `"valid":false`) {
+			t.Errorf("invalid token: status = %d, body = %s", code, body)
+		}
+	}
+
+	// The second invalid lookup is served from the negative cache
+	if got := calls.Load(); got != 2 {
+		t.Errorf("GitHub called %d times, want 2", got)
+	}
+}
+
+// resetFailedAttempts clears failed-login tracking before and after a test.
+func resetFailedAttempts(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		failedMutex.Lock()
+		failedAttempts = make(map[string][]time.Time)
+		lockedUntil = make(map[string]time.Time)
+		failedMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestFailedLoginLockout(t *testing.T) {
+	setClientSecret(t, "test_secret")
+	resetFailedAttempts(t)
+
+	callback := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/callback?code=abc&state=wrong", http.NoBody)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handleOAuthCallback(rr, req)
+		return rr.Code
+	}
+
+	// Each failed state check is recorded until the lockout threshold is reached
+	for i := range maxFailedLogins {
+		if code := callback(); code != http.StatusBadRequest {
+			t.Fatalf("attempt %d: status = %d, want 400", i+1, code)
+		}
+	}
+
+	for i := range 2 {
+		if code := callback(); code != http.StatusTooManyRequests {
+			t.Errorf("attempt %d: status = %d, want 429", maxFailedLogins+i+1, code)
+		}
+	}
+
+	if isLockedOut("192.0.2.2") {
+		t.Error("unrelated IP is locked out")
+	}
+}
+
+// A --lockout-duration longer than failedLoginWindow outlasts the failures that started it.
+func TestLockoutOutlastsFailureWindow(t *testing.T) {
+	setClientSecret(t, "test_secret")
+	resetFailedAttempts(t)
+	orig := *lockoutPeriod
+	t.Cleanup(func() { *lockoutPeriod = orig })
+	*lockoutPeriod = time.Hour
+
+	const ip = "192.0.2.1"
+	for range maxFailedLogins {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/callback?code=abc&state=wrong", http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		handleOAuthCallback(httptest.NewRecorder(), req)
+	}
+
+	// Once the failures have aged out of the window and been swept, the lockout remains
+	later := time.Now().Add(failedLoginWindow + time.Minute)
+	sweepFailedAttempts(later)
+	if recentFailures(ip, later) != 0 {
+		t.Fatal("failures inside the window survived the sweep")
+	}
+	if !isLockedOut(ip) {
+		t.Error("lockout ended with the failure window, want it to run the full --lockout-duration")
+	}
+
+	// And it ends, and is swept, once the duration is up
+	sweepFailedAttempts(time.Now().Add(time.Hour + time.Minute))
+	if isLockedOut(ip) {
+		t.Error("lockout outlived --lockout-duration")
+	}
+}
+
+// completeOAuthCallback drives handleOAuthCallback against stubbed GitHub endpoints
+// and returns the one-time auth code from the redirect fragment.
+func completeOAuthCallback(t *testing.T) string {
+	t.Helper()
+	rr := runOAuthCallback(t)
+	_, fragment, _ := strings.Cut(rr.Header().Get("Location"), "#auth_code=")
+	code, err := url.QueryUnescape(fragment)
+	if err != nil || code == "" {
+		t.Fatalf("no auth code in redirect %q", rr.Header().Get("Location"))
+	}
+	return code
+}
+
+// testOAuthState issues an OAuth state as if at now.
+func testOAuthState(t *testing.T, now time.Time) string {
+	t.Helper()
+	state, err := newOAuthState(now)
+	if err != nil {
+		t.Fatalf("newOAuthState() error = %v", err)
+	}
+	return state
+}
+
+// runOAuthCallback drives a successful handleOAuthCallback against stubbed GitHub endpoints,
+// sending any extra cookies (such as oauth_return_to) along with the state.
+func runOAuthCallback(t *testing.T, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	setClientSecret(t, "test_secret")
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"access_token":"`+testToken+`","token_type":"bearer","scope":"repo,read:org"}`), nil
+	})
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	state := testOAuthState(t, time.Now())
+	req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/oauth/callback?code=abc&state="+url.QueryEscape(state), http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "oauth_state", Value: state})
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	handleOAuthCallback(rr, req)
+
+	if rr.Code != http.StatusFound {
+		t.Fatalf("callback status = %d, want 302: %s", rr.Code, rr.Body.String())
+	}
+	return rr
+}
+
+// exchangeAuthCode posts an auth code to handleExchangeAuthCode.
+func exchangeAuthCode(code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", strings.NewReader(`{"auth_code":"`+code+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handleExchangeAuthCode(rr, req)
+	return rr
+}
+
+func TestAuthCodeTTL(t *testing.T) {
+	orig := *authCodeTTL
+	*authCodeTTL = 300 * time.Millisecond
+	t.Cleanup(func() { *authCodeTTL = orig })
+
+	// Just under the TTL succeeds and returns the decrypted token
+	code := completeOAuthCallback(t)
+	rr := exchangeAuthCode(code)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), testToken) {
+		t.Errorf("exchange within TTL: status = %d, body = %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"scopes":["repo","read:org"]`) {
+		t.Errorf("exchange body = %s, want granted scopes", rr.Body.String())
+	}
+
+	// The code is single-use
+	if rr := exchangeAuthCode(code); rr.Code != http.StatusUnauthorized {
+		t.Errorf("second exchange: status = %d, want 401", rr.Code)
+	}
+
+	// Just over the TTL is rejected as expired
+	code = completeOAuthCallback(t)
+	time.Sleep(*authCodeTTL + 50*time.Millisecond)
+	rr = exchangeAuthCode(code)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "expired") {
+		t.Errorf("exchange after TTL: status = %d, body = %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestExchangeBodyLimit(t *testing.T) {
+	resetFailedAttempts(t)
+	padding := strings.Repeat("A", defaultExchangeBodyLimit)
+
+	// Declared too large: rejected before reading the body
+	rr := exchangeAuthCode(padding)
+	if got := decodeAPIError(t, rr, http.StatusRequestEntityTooLarge); got != "request_too_large" {
+		t.Errorf("error = %q, want request_too_large", got)
+	}
+
+	// Streamed without a Content-Length: cut off at the limit while reading
+	req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", io.MultiReader(strings.NewReader(`{"auth_code":"`), strings.NewReader(padding)))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	handleExchangeAuthCode(rr, req)
+	if got := decodeAPIError(t, rr, http.StatusRequestEntityTooLarge); got != "request_too_large" {
+		t.Errorf("streamed error = %q, want request_too_large", got)
+	}
+
+	// A normal-sized body is still decoded
+	rr = exchangeAuthCode("unknown")
+	if got := decodeAPIError(t, rr, http.StatusUnauthorized); got != "invalid_auth_code" {
+		t.Errorf("small body error = %q, want invalid_auth_code", got)
+	}
+}
+
+func TestExchangeContentSHA256(t *testing.T) {
+	resetFailedAttempts(t)
+	exchange := func(body, checksum string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(contentSHA256Header, checksum)
+		rr := httptest.NewRecorder()
+		handleExchangeAuthCode(rr, req)
+		return rr
+	}
+	sum := func(body string) string {
+		s := sha256.Sum256([]byte(body))
+		return hex.EncodeToString(s[:])
+	}
+
+	// A matching checksum (in either case) lets the exchange proceed
+	code := completeOAuthCallback(t)
+	body := `{"auth_code":"` + code + `"}`
+	if rr := exchange(body, strings.ToUpper(sum(body))); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), testToken) {
+		t.Errorf("matching checksum: status = %d, body = %s", rr.Code, rr.Body)
+	}
+
+	// A mismatch is rejected before the code is looked at, so it isn't consumed
+	code = completeOAuthCallback(t)
+	body = `{"auth_code":"` + code + `"}`
+	for _, checksum := range []string{sum(`{"auth_code":"other"}`), "not-hex", sum(body)[:32]} {
+		if got := decodeAPIError(t, exchange(body, checksum), http.StatusBadRequest); got != "checksum_mismatch" {
+			t.Errorf("checksum %q: error = %q, want checksum_mismatch", checksum, got)
+		}
+	}
+	if rr := exchangeAuthCode(code); rr.Code != http.StatusOK {
+		t.Errorf("exchange after mismatches: status = %d, want 200", rr.Code)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	cancelled := make(chan error, 1)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	requestDeadline(slow, 50*time.Millisecond).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), errCodeTimeout) {
+		t.Errorf("status = %d, body = %s; want 503 %s", rr.Code, rr.Body, errCodeTimeout)
+	}
+	if err := <-cancelled; err == nil {
+		t.Error("handler context was not cancelled")
+	}
+
+	// A handler's own error after the deadline is replaced with the JSON timeout
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+	})
+	rr = httptest.NewRecorder()
+	requestDeadline(failing, 10*time.Millisecond).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Content-Type") != "application/json" || !strings.Contains(rr.Body.String(), errCodeTimeout) {
+		t.Errorf("status = %d, Content-Type = %q, body = %s; want a JSON 503", rr.Code, rr.Header().Get("Content-Type"), rr.Body)
+	}
+
+	// In time, the response streams through unbuffered and can be flushed
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			t.Errorf("Write() error = %v", err)
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush() error = %v", err)
+		}
+	})
+	rr = httptest.NewRecorder()
+	requestDeadline(streaming, time.Second).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+	if rr.Code != http.StatusOK || !rr.Flushed || rr.Body.String() != "partial" {
+		t.Errorf("status = %d, flushed = %v, body = %q; want the handler's flushed response", rr.Code, rr.Flushed, rr.Body)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	const limit = 3
+	started := make(chan struct{}, limit)
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := concurrencyLimiter(slow, limit)
+
+	// Saturate the semaphore with slow requests
+	done := make(chan int, limit)
+	for range limit {
+		go func() {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+			done <- rr.Code
+		}()
+	}
+	for range limit {
+		<-started
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status at capacity = %d, want 503", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != overloadRetryAfter {
+		t.Errorf("Retry-After = %q, want %q", got, overloadRetryAfter)
+	}
+
+	// Liveness checks bypass the limit
+	health := httptest.NewRecorder()
+	handler.ServeHTTP(health, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	if health.Code != http.StatusOK {
+		t.Errorf("/health status at capacity = %d, want 200", health.Code)
+	}
+
+	close(release)
+
+	for range limit {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("saturating request status = %d, want 200", code)
+		}
+	}
+
+	// Capacity is released once requests finish
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Errorf("status after draining = %d, want 200", rr.Code)
+	}
+}
+
+func TestHeaderCountLimiter(t *testing.T) {
+	handler := newTestServer(t, Config{MaxHeaders: defaultMaxHeaderCount})
+	origLog := headerCountLog
+	headerCountLog = &logThrottle{interval: time.Minute}
+	t.Cleanup(func() { headerCountLog = origLog })
+	logs := captureLog(t)
+
+	request := func(headers int) int {
+		req := httptest.NewRequest(http.MethodGet, "/health", http.NoBody)
+		for i := range headers {
+			req.Header.Set(fmt.Sprintf("X-Flood-%d", i), "x")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if got := request(200); got != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("200 headers: status = %d, want 431", got)
+	}
+	// The rejection still carries the security headers and a request ID
+	flood := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	for i := range 200 {
+		flood.Header.Set(fmt.Sprintf("X-Flood-%d", i), "x")
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, flood)
+	if rr.Header().Get("X-Request-ID") == "" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("431 headers = %v, want security headers and X-Request-ID", rr.Header())
+	}
+	if got := request(defaultMaxHeaderCount); got != http.StatusOK {
+		t.Errorf("%d headers: status = %d, want 200", defaultMaxHeaderCount, got)
+	}
+
+	// Repeated fields count once per value
+	req := httptest.NewRequest(http.MethodGet, "/health", http.NoBody)
+	for range 200 {
+		req.Header.Add("Accept-Encoding", "gzip")
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("200 repeated Accept-Encoding lines: status = %d, want 431", rr.Code)
+	}
+
+	// Three rejections log a single warning
+	if n := strings.Count(logs.String(), "Too many header fields"); n != 1 {
+		t.Errorf("logged %d header count warnings, want 1:\n%s", n, logs)
+	}
+
+	// 0 disables the limit
+	handler = newTestServer(t, Config{})
+	if got := request(200); got != http.StatusOK {
+		t.Errorf("200 headers with the limit disabled: status = %d, want 200", got)
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect string
+		origins  string
+		wantErr  bool
+	}{
+		{name: "default", redirect: defaultRedirectURI},
+		{name: "subdomain", redirect: "https://auth." + baseDomain + "/oauth/callback"},
+		{name: "localhost http", redirect: "http://localhost:8080/oauth/callback"},
+		{name: "allowed origin", redirect: "https://dash.example.com/oauth/callback", origins: "https://dash.example.com"},
+		{name: "http on public host", redirect: "http://" + baseDomain + "/oauth/callback", wantErr: true},
+		{name: "wrong path", redirect: "https://" + baseDomain + "/oauth/callbak", wantErr: true},
+		{name: "trailing slash", redirect: "https://" + baseDomain + "/oauth/callback/", wantErr: true},
+		{name: "foreign host", redirect: "https://evil.example.com/oauth/callback", wantErr: true},
+		{name: "lookalike host", redirect: "https://evilreviewGOOSE.dev/oauth/callback", wantErr: true},
+		{name: "query string", redirect: defaultRedirectURI + "?next=/", wantErr: true},
+		{name: "missing scheme", redirect: baseDomain + "/oauth/callback", wantErr: true},
+		{name: "unparseable", redirect: "https://%zz/oauth/callback", wantErr: true},
+		{name: "empty", redirect: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRedirectURI(tt.redirect, tt.origins)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRedirectURI(%q) error = %v, wantErr %v", tt.redirect, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenExpiries(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name        string
+		body        string
+		wantToken   time.Time
+		wantRefresh time.Time
+	}{
+		{name: "no expiration", body: `{"access_token":"x"}`},
+		{
+			name:        "expiring token",
+			body:        `{"access_token":"x","expires_in":28800,"refresh_token":"r","refresh_token_expires_in":15811200}`,
+			wantToken:   now.Add(8 * time.Hour),
+			wantRefresh: now.Add(15811200 * time.Second),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp oauthTokenResponse
+			if err := json.Unmarshal([]byte(tt.body), &resp); err != nil {
+				t.Fatal(err)
+			}
+			token, refresh := resp.expiries(now)
+			if !token.Equal(tt.wantToken) || !refresh.Equal(tt.wantRefresh) {
+				t.Errorf("expiries() = %v, %v, want %v, %v", token, refresh, tt.wantToken, tt.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestExchangeReturnsTokenExpiry(t *testing.T) {
+	resetAuthCodes(t)
+	resetFailedAttempts(t)
+	setClientSecret(t, "test_secret")
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"access_token":"`+testToken+`","token_type":"bearer","scope":"repo",`+
+			`"refresh_token":"ghr_abc","expires_in":28800,"refresh_token_expires_in":15811200}`), nil
+	})
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	state := testOAuthState(t, time.Now())
+	req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/oauth/callback?code=abc&state="+url.QueryEscape(state), http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "oauth_state", Value: state})
+	rr := httptest.NewRecorder()
+	before := time.Now()
+	handleOAuthCallback(rr, req)
+	_, fragment, _ := strings.Cut(rr.Header().Get("Location"), "#auth_code=")
+	code, err := url.QueryUnescape(fragment)
+	if err != nil || code == "" {
+		t.Fatalf("no auth code in redirect %q", rr.Header().Get("Location"))
+	}
+
+	rr = exchangeAuthCode(code)
+	var resp struct {
+		TokenExpiresAt        time.Time `json:"token_expires_at"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("exchange status = %d, body = %s", rr.Code, rr.Body)
+	}
+	if want := before.Add(8 * time.Hour); resp.TokenExpiresAt.Before(want.Add(-time.Second)) || resp.TokenExpiresAt.After(want.Add(time.Minute)) {
+		t.Errorf("token_expires_at = %v, want about %v", resp.TokenExpiresAt, want)
+	}
+	if want := before.Add(15811200 * time.Second); resp.RefreshTokenExpiresAt.Before(want.Add(-time.Second)) || resp.RefreshTokenExpiresAt.After(want.Add(time.Minute)) {
+		t.Errorf("refresh_token_expires_at = %v, want about %v", resp.RefreshTokenExpiresAt, want)
+	}
+
+	// Apps without token expiration send neither field
+	code = completeOAuthCallback(t)
+	if body := exchangeAuthCode(code).Body.String(); strings.Contains(body, "expires_at") {
+		t.Errorf("exchange without expiration = %s, want no expiry fields", body)
+	}
+}
+
+func TestHandleRefreshToken(t *testing.T) {
+	setClientSecret(t, "test_secret")
+	resetFailedAttempts(t)
+	stubClient(t, &oauthClient, func(r *http.Request) (*http.Response, error) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("failed to parse token request: %v", err)
+		}
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_secret") != "test_secret" {
+			t.Errorf("unexpected token request form: %v", r.PostForm)
+		}
+		if r.PostForm.Get("refresh_token") == "ghr_valid" {
+			return stubResponse(http.StatusOK, `{"access_token":"`+testToken+`","refresh_token":"ghr_rotated",`+
+				`"expires_in":28800,"refresh_token_expires_in":15811200,"token_type":"bearer"}`), nil
+		}
+		return stubResponse(http.StatusOK, `{"error":"bad_refresh_token","error_description":"The refresh token passed is incorrect or expired."}`), nil
+	})
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+		rr := httptest.NewRecorder()
+		handleRefreshToken(rr, req)
+		return rr
+	}
+
+	rr := refresh("ghr_valid")
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, `"token":"`+testToken+`"`) ||
+		!strings.Contains(body, `"refresh_token":"ghr_rotated"`) || !strings.Contains(body, `"expires_in":28800`) {
+		t.Errorf("valid refresh: status = %d, body = %s", rr.Code, body)
+	}
+
+	rr = refresh("ghr_expired")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expired refresh: status = %d, want 401", rr.Code)
+	}
+}
+
+func TestHandleCheckOrgMembership(t *testing.T) {
+	stubClient(t, &apiClient, func(r *http.Request) (*http.Response, error) {
+		if got := r.Header.Get("Authorization"); got != "Bearer gho_member" && got != "Bearer gho_expired" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if r.Header.Get("Authorization") == "Bearer gho_expired" {
+			return stubResponse(http.StatusUnauthorized, `{"message":"Bad credentials"}`), nil
+		}
+		switch r.URL.Path {
+		case "/user/memberships/orgs/codeGROOVE-dev":
+			return stubResponse(http.StatusOK, `{"state":"active","role":"admin"}`), nil
+		case "/user/memberships/orgs/invited":
+			return stubResponse(http.StatusOK, `{"state":"pending","role":"member"}`), nil
+		default:
+			return stubResponse(http.StatusNotFound, `{"message":"Not Found"}`), nil
+		}
+	})
+
+	tests := []struct {
+		name       string
+		org        string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "admin member", org: "codeGROOVE-dev", token: "gho_member", wantStatus: http.StatusOK, wantBody: `{"role":"admin","member":true}`},
+		{name: "not a member", org: "other-org", token: "gho_member", wantStatus: http.StatusOK, wantBody: `{"member":false}`},
+		{name: "pending invitation", org: "invited", token: "gho_member", wantStatus: http.StatusOK, wantBody: `{"member":false}`},
+		{name: "invalid org", org: "-bad-", token: "gho_member", wantStatus: http.StatusBadRequest},
+		{name: "rejected token", org: "codeGROOVE-dev", token: "gho_expired", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/oauth/org-membership?org="+url.QueryEscape(tt.org), http.NoBody)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			handleCheckOrgMembership(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rr.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleTokenRateLimit(t *testing.T) {
+	timer := &recordingTimer{}
+	origTimer := retryTimer
+	retryTimer = timer
+	t.Cleanup(func() { retryTimer = origTimer })
+
+	var calls int
+	stubClient(t, &apiClient, func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Authorization") == "Bearer gho_expired" {
+			return stubResponse(http.StatusUnauthorized, `{"message":"Bad credentials"}`), nil
+		}
+		if r.URL.Path != "/rate_limit" {
+			t.Errorf("requested %s, want /rate_limit", r.URL.Path)
+		}
+		// The first attempt hits a GitHub hiccup and is retried
+		if calls++; calls == 1 {
+			return stubResponse(http.StatusBadGateway, ""), nil
+		}
+		return stubResponse(http.StatusOK, `{"resources":{
+			"core":{"limit":5000,"used":4990,"remaining":10,"reset":1700000000},
+			"search":{"limit":30,"used":0,"remaining":30,"reset":1700000060},
+			"graphql":{"limit":5000,"used":5,"remaining":4995,"reset":1700003600}},
+			"rate":{"limit":5000,"used":4990,"remaining":10,"reset":1700000000}}`), nil
+	})
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/rate-limit", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handleTokenRateLimit(rr, req)
+		return rr
+	}
+
+	rr := get("gho_member")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	want := `{"core":{"reset":"2023-11-14T22:13:20Z","limit":5000,"remaining":10,"used":4990},` +
+		`"search":{"reset":"2023-11-14T22:14:20Z","limit":30,"remaining":30,"used":0},` +
+		`"graphql":{"reset":"2023-11-14T23:13:20Z","limit":5000,"remaining":4995,"used":5}}`
+	if got := strings.TrimSpace(rr.Body.String()); got != want {
+		t.Errorf("body = %s\nwant %s", got, want)
+	}
+	if calls != 2 || len(timer.delays) != 1 {
+		t.Errorf("GitHub called %d times with %d retry waits, want 2 and 1", calls, len(timer.delays))
+	}
+
+	if rr := get("gho_expired"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("rejected token status = %d, want 401", rr.Code)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	setString(t, allowedOrigins, "https://dash.example.com")
+	origApps := oauthAppsByHost
+	oauthAppsByHost = map[string]oauthApp{"staging.example.net": {clientID: "staging"}}
+	t.Cleanup(func() { oauthAppsByHost = origApps })
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		spoofed bool
+	}{
+		{name: "no header", header: "", want: "my." + baseDomain},
+		{name: "base domain", header: baseDomain, want: baseDomain},
+		{name: "subdomain with port", header: "team." + baseDomain + ":443", want: "team." + baseDomain + ":443"},
+		{name: "mixed case", header: "Team." + strings.ToUpper(baseDomain), want: "Team." + strings.ToUpper(baseDomain)},
+		{name: "allowed origin host", header: "dash.example.com", want: "dash.example.com"},
+		{name: "oauth app host", header: "staging.example.net", want: "staging.example.net"},
+		{name: "foreign host", header: "evil.example", want: "my." + baseDomain, spoofed: true},
+		{name: "lookalike suffix", header: "evil" + baseDomain, want: "my." + baseDomain, spoofed: true},
+		{name: "path smuggling", header: "evil.example/." + baseDomain, want: "my." + baseDomain, spoofed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/", http.NoBody)
+			if tt.header != "" {
+				req.Header.Set("X-Original-Host", tt.header)
+			}
+			if got := requestHost(req); got != tt.want {
+				t.Errorf("requestHost() = %q, want %q", got, tt.want)
+			}
+			if logged := strings.Contains(logs.String(), "[SECURITY]"); logged != tt.spoofed {
+				t.Errorf("security event logged = %v, want %v: %q", logged, tt.spoofed, logs)
+			}
+		})
+	}
+
+	// A spoofed foreign host can't dodge the base domain's front page redirect
+	req := httptest.NewRequest(http.MethodGet, "http://"+baseDomain+"/", http.NoBody)
+	req.Header.Set("X-Original-Host", "evil.example")
+	rr := httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Errorf("base domain front page with spoofed host: status = %d, want 302", rr.Code)
+	}
+}
+
+func TestReturnToHosts(t *testing.T) {
+	orig := returnToHosts
+	t.Cleanup(func() { returnToHosts = orig })
+	hosts, err := parseReturnToHosts(" Partner.example.com , ,app.partner.io")
+	if err != nil {
+		t.Fatalf("parseReturnToHosts() error = %v", err)
+	}
+	returnToHosts = hosts
+
+	tests := []struct {
+		returnTo string
+		ok       bool
+	}{
+		{returnTo: "https://partner.example.com/after-login?x=1", ok: true},
+		{returnTo: "https://PARTNER.example.com/", ok: true},
+		{returnTo: "https://app.partner.io/", ok: true},
+		{returnTo: "https://my." + baseDomain + "/", ok: true},
+		{returnTo: "http://partner.example.com/"},
+		{returnTo: "https://other.example.com/"},
+		{returnTo: "https://evil.partner.example.com/"},
+		{returnTo: "https://partner.example.com.evil.io/"},
+		{returnTo: "https://example.com/"},
+	}
+	for _, tt := range tests {
+		if got := validateReturnToURL(tt.returnTo); (got != "") != tt.ok {
+			t.Errorf("validateReturnToURL(%q) = %q, want accepted=%v", tt.returnTo, got, tt.ok)
+		}
+	}
+
+	for _, spec := range []string{"*.example.com", "partner.example.com:443", "https://partner.example.com", "localhost", "192.0.2.1", "-bad.example.com", "a..example.com"} {
+		if _, err := parseReturnToHosts(spec); err == nil {
+			t.Errorf("parseReturnToHosts(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	orig := trustedProxyNets
+	trustedProxyNets = nil
+	t.Cleanup(func() { trustedProxyNets = orig })
+
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{remoteAddr: "198.51.100.7:1234", want: "198.51.100.7"},
+		{remoteAddr: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{remoteAddr: "[::ffff:198.51.100.7]:443", want: "::ffff:198.51.100.7"},
+		{remoteAddr: "[fe80::1%eth0]:443", want: "fe80::1%eth0"},
+		{remoteAddr: "198.51.100.7", want: "198.51.100.7"},
+		{remoteAddr: "2001:db8::1", want: "2001:db8::1"},
+		{remoteAddr: "[2001:db8::1]", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.RemoteAddr = tt.remoteAddr
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP() with RemoteAddr %q = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+
+	// Both spellings of an IPv6 client share one rate limit and failed-login entry
+	resetFailedAttempts(t)
+	for _, addr := range []string{"[2001:db8::2]:1111", "[2001:db8::2]:2222"} {
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.RemoteAddr = addr
+		trackFailedAttempt(req)
+	}
+	if got := recentFailures("2001:db8::2", time.Now()); got != 2 {
+		t.Errorf("recentFailures(2001:db8::2) = %d, want 2 across source ports", got)
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	orig := trustedProxyNets
+	t.Cleanup(func() { trustedProxyNets = orig })
+
+	tests := []struct {
+		name       string
+		proxies    string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{name: "no proxies ignores xff", remoteAddr: "198.51.100.7:1234", xff: []string{"203.0.113.9"}, want: "198.51.100.7"},
+		{name: "spoofed xff from untrusted source", proxies: "10.0.0.0/8", remoteAddr: "198.51.100.7:1234", xff: []string{"203.0.113.9"}, want: "198.51.100.7"},
+		{name: "trusted proxy", proxies: "10.0.0.0/8", remoteAddr: "10.1.2.3:1234", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "client-prepended hops are ignored", proxies: "10.0.0.0/8", remoteAddr: "10.1.2.3:1234", xff: []string{"1.2.3.4, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "chain of trusted proxies", proxies: "10.0.0.0/8,192.0.2.50", remoteAddr: "10.1.2.3:1234", xff: []string{"203.0.113.9, 192.0.2.50", "10.9.9.9"}, want: "203.0.113.9"},
+		{name: "garbage hop", proxies: "10.0.0.0/8", remoteAddr: "10.1.2.3:1234", xff: []string{"203.0.113.9, not-an-ip"}, want: "10.1.2.3"},
+		{name: "trusted proxy without xff", proxies: "10.0.0.0/8", remoteAddr: "10.1.2.3:1234", want: "10.1.2.3"},
+		{name: "ipv6 proxy", proxies: "2001:db8::/32", remoteAddr: "[2001:db8::1]:443", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseTrustedProxies(tt.proxies)
+			if err != nil {
+				t.Fatalf("parseTrustedProxies(%q) error = %v", tt.proxies, err)
+			}
+			trustedProxyNets = nets
+
+			req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "not-a-cidr", "10.0.0.0/8,bogus"} {
+		if _, err := parseTrustedProxies(spec); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestHandleGetUserInclude(t *testing.T) {
+	origCache := userInfoCache
+	userInfoCache = newUserCache(0)
+	t.Cleanup(func() { userInfoCache = origCache })
+	stubClient(t, &apiClient, func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Path {
+		case "/user":
+			return stubResponse(http.StatusOK, `{"login":"octocat","name":"The Octocat","id":1,"avatar_url":"https://avatars.githubusercontent.com/u/1?v=4"}`), nil
+		case "/user/emails":
+			return stubResponse(http.StatusOK, `[{"email":"old@example.com","primary":false,"verified":true},`+
+				`{"email":"octocat@example.com","primary":true,"verified":true}]`), nil
+		case "/user/orgs":
+			return stubResponse(http.StatusOK, `[{"login":"codeGROOVE-dev","id":42}]`), nil
+		default:
+			t.Errorf("unexpected GitHub call: %s", r.URL.Path)
+			return stubResponse(http.StatusNotFound, `{}`), nil
+		}
+	})
+
+	tests := []struct {
+		include    string
+		wantStatus int
+		wantBody   string
+	}{
+		{include: "", wantStatus: http.StatusOK, wantBody: `{"login":"octocat","name":"The Octocat","id":1,"avatar_url":"https://avatars.githubusercontent.com/u/1?v=4"}`},
+		{include: "email", wantStatus: http.StatusOK, wantBody: `{"login":"octocat","name":"The Octocat","id":1,"avatar_url":"https://avatars.githubusercontent.com/u/1?v=4","email":"octocat@example.com"}`},
+		{include: "orgs", wantStatus: http.StatusOK, wantBody: `{"login":"octocat","name":"The Octocat","id":1,"avatar_url":"https://avatars.githubusercontent.com/u/1?v=4","orgs":[{"login":"codeGROOVE-dev","id":42}]}`},
+		{include: "email,orgs", wantStatus: http.StatusOK, wantBody: `{"login":"octocat","name":"The Octocat","id":1,"avatar_url":"https://avatars.githubusercontent.com/u/1?v=4","email":"octocat@example.com","orgs":[{"login":"codeGROOVE-dev","id":42}]}`},
+		{include: "repos", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run("include="+tt.include, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/oauth/user?include="+url.QueryEscape(tt.include), http.NoBody)
+			req.Header.Set("Authorization", "Bearer "+testToken)
+			rr := httptest.NewRecorder()
+			handleGetUser(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rr.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSanitizeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/oauth/callback?code=abc&state=xyz", want: "/oauth/callback?code=[REDACTED]&state=[REDACTED]"},
+		{in: "/oauth/callback?error=access_denied&state=xyz", want: "/oauth/callback?error=access_denied&state=[REDACTED]"},
+		{in: "/oauth/login?return_to=https%3A%2F%2Fmy.reviewGOOSE.dev%2F", want: "/oauth/login?return_to=[REDACTED]"},
+		{in: "/assets/app.js?v=123", want: "/assets/app.js?v=123"},
+		{in: "/some/route?token=gho_x&page=2", want: "/some/route?token=[REDACTED]&page=2"},
+		{in: "https://my.reviewGOOSE.dev/#auth_code=abc", want: "https://my.reviewGOOSE.dev/"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeURL(tt.in); got != tt.want {
+			t.Errorf("sanitizeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLoggerRedactsOAuthParams(t *testing.T) {
+	resetFailedAttempts(t)
+	setClientSecret(t, "test_secret")
+	setLogLevel(t, slog.LevelDebug)
+	logs := captureLog(t)
+
+	req := httptest.NewRequest(http.MethodGet,
+		"https://"+baseDomain+"/oauth/callback?code=secretcode123&state=secretstate456", http.NoBody)
+	rr := httptest.NewRecorder()
+	requestLogger(securityHeaders(http.HandlerFunc(handleOAuthCallback))).ServeHTTP(rr, req)
+
+	out := logs.String()
+	if !strings.Contains(out, "/oauth/callback?code=[REDACTED]&state=[REDACTED]") {
+		t.Errorf("request log missing redacted URL:\n%s", out)
+	}
+	for _, secret := range []string{"secretcode123", "secretstate456"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output contains %q:\n%s", secret, out)
+		}
+	}
+}
+
+func TestOAuthStateTTL(t *testing.T) {
+	resetFailedAttempts(t)
+	orig := *stateTTL
+	*stateTTL = 2 * time.Minute
+	t.Cleanup(func() { *stateTTL = orig })
+
+	req := httptest.NewRequest(http.MethodGet,
+		"https://"+baseDomain+"/oauth/login?return_to="+url.QueryEscape("https://my."+baseDomain+"/"), http.NoBody)
+	rr := httptest.NewRecorder()
+	handleOAuthLogin(rr, req)
+
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range rr.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, name := range []string{"oauth_state", "oauth_return_to"} {
+		c, ok := cookies[name]
+		if !ok {
+			t.Fatalf("login did not set %s", name)
+		}
+		if c.MaxAge != 120 {
+			t.Errorf("%s MaxAge = %d, want 120", name, c.MaxAge)
+		}
+	}
+
+	// The server rejects a state older than the TTL even if the browser still sends the cookie
+	now := time.Now()
+	if stateExpired(testOAuthState(t, now.Add(-time.Minute)), now) {
+		t.Error("state within TTL reported expired")
+	}
+	stale := testOAuthState(t, now.Add(-3*time.Minute))
+	if !stateExpired(stale, now) {
+		t.Error("state past TTL not reported expired")
+	}
+	if !stateExpired("no-timestamp", now) {
+		t.Error("state without timestamp not reported expired")
+	}
+
+	setClientSecret(t, "test_secret")
+	req = httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/oauth/callback?code=abc&state="+url.QueryEscape(stale), http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "oauth_state", Value: stale})
+	rr = httptest.NewRecorder()
+	handleOAuthCallback(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("stale state callback status = %d, want 400", rr.Code)
+	}
+}
+
+func TestOAuthCookieDomain(t *testing.T) {
+	resetFailedAttempts(t)
+	orig := *cookieDomain
+	t.Cleanup(func() { *cookieDomain = orig })
+
+	for _, tt := range []struct {
+		name       string
+		enabled    bool
+		wantDomain string
+	}{
+		{name: "host-only by default", enabled: false, wantDomain: ""},
+		{name: "base domain", enabled: true, wantDomain: baseDomain},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			*cookieDomain = tt.enabled
+
+			req := httptest.NewRequest(http.MethodGet,
+				"https://"+baseDomain+"/oauth/login?return_to="+url.QueryEscape("https://my."+baseDomain+"/"), http.NoBody)
+			rr := httptest.NewRecorder()
+			handleOAuthLogin(rr, req)
+			set := rr.Result().Cookies()
+
+			rr = httptest.NewRecorder()
+			clearStateCookie(rr)
+			for _, c := range append(set, rr.Result().Cookies()...) {
+				if c.Domain != tt.wantDomain {
+					t.Errorf("%s (MaxAge %d) Domain = %q, want %q", c.Name, c.MaxAge, c.Domain, tt.wantDomain)
+				}
+			}
+			if len(set) != 2 {
+				t.Errorf("login set %d cookies, want oauth_state and oauth_return_to", len(set))
+			}
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestRandomFailureReturns500(t *testing.T) {
+	resetFailedAttempts(t)
+	orig := randReader
+	randReader = failingReader{}
+	t.Cleanup(func() { randReader = orig })
+
+	if _, err := generateIDE(16); err == nil {
+		t.Error("generateIDE() succeeded with a failing reader")
+	}
+
+	handlers := map[string]http.Handler{
+		"securityHeaders": securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})),
+		"login": http.HandlerFunc(handleOAuthLogin),
+	}
+	for name, h := range handlers {
+		req := httptest.NewRequest(http.MethodGet,
+			"https://"+baseDomain+"/oauth/login?return_to="+url.QueryEscape("https://my."+baseDomain+"/"), http.NoBody)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s status = %d, want 500", name, rr.Code)
+		}
+	}
+}
+
+func TestDefaultLanding(t *testing.T) {
+	resetFailedAttempts(t)
+	setString(t, sessionMode, sessionModeFragment)
+	landing := func(cookies ...*http.Cookie) string {
+		loc := runOAuthCallback(t, cookies...).Header().Get("Location")
+		before, _, _ := strings.Cut(loc, "#")
+		return before
+	}
+
+	if got, want := landing(), "https://my."+baseDomain; got != want {
+		t.Errorf("unconfigured fallback = %q, want %q", got, want)
+	}
+
+	setString(t, defaultLanding, "https://dash."+baseDomain+"/welcome")
+	invalid := &http.Cookie{Name: "oauth_return_to", Value: "https://evil.example/"}
+	for name, cookies := range map[string][]*http.Cookie{"missing": nil, "invalid": {invalid}} {
+		if got := landing(cookies...); got != *defaultLanding {
+			t.Errorf("%s return_to: redirected to %q, want %q", name, got, *defaultLanding)
+		}
+	}
+
+	// A valid return_to still wins over the fallback
+	valid := "https://octocat." + baseDomain + "/"
+	if got := landing(&http.Cookie{Name: "oauth_return_to", Value: valid}); got != valid {
+		t.Errorf("valid return_to: redirected to %q, want %q", got, valid)
+	}
+}
+
+func TestAdaptiveRateLimit(t *testing.T) {
+	resetFailedAttempts(t)
+	limiter := &rateLimiter{requests: make(map[string][]time.Time), limit: 10, window: time.Minute}
+	now := time.Now()
+
+	const clean, flagged = "192.0.2.1", "192.0.2.2"
+	failedMutex.Lock()
+	failedAttempts[flagged] = []time.Time{now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute)}
+	// Failures outside the window don't count
+	failedAttempts[clean] = []time.Time{now.Add(-2 * failedLoginWindow), now.Add(-2 * failedLoginWindow), now.Add(-time.Minute)}
+	failedMutex.Unlock()
+
+	if got := limiter.effectiveLimit(clean, now); got != 10 {
+		t.Errorf("clean IP limit = %d, want 10", got)
+	}
+	if got := limiter.effectiveLimit(flagged, now); got != 2 {
+		t.Errorf("flagged IP limit = %d, want 2", got)
+	}
+	if got := (&rateLimiter{limit: 3}).effectiveLimit(flagged, now); got != 1 {
+		t.Errorf("flagged IP limit with a small base = %d, want 1", got)
+	}
+
+	// The handler enforces the effective limit
+	handler := limiter.limitHandler(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	allowed := func(ip string) int {
+		n := 0
+		for range 12 {
+			req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", http.NoBody)
+			req.RemoteAddr = ip + ":1234"
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code == http.StatusOK {
+				n++
+			}
+		}
+		return n
+	}
+	if got := allowed(clean); got != 10 {
+		t.Errorf("clean IP got %d requests through, want 10", got)
+	}
+	if got := allowed(flagged); got != 2 {
+		t.Errorf("flagged IP got %d requests through, want 2", got)
+	}
+}
+
+func TestSweepRateLimits(t *testing.T) {
+	resetFailedAttempts(t)
+	newTestServer(t, Config{RateLimitRequests: 10, RateLimitWindow: time.Minute})
+	now := time.Now()
+
+	const stale, fresh = "192.0.2.1", "192.0.2.2"
+	exchangeRateLimiter.requests[stale] = []time.Time{now.Add(-2 * time.Minute)}
+	exchangeRateLimiter.requests[fresh] = []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Second)}
+	failedMutex.Lock()
+	failedAttempts[stale] = []time.Time{now.Add(-failedLoginWindow - time.Minute)}
+	failedAttempts[fresh] = []time.Time{now.Add(-time.Minute)}
+	failedMutex.Unlock()
+
+	// Nothing is dropped before entries age out of their windows
+	sweepRateLimits(now.Add(-2 * time.Minute))
+	if len(exchangeRateLimiter.requests) != 2 || len(failedAttempts) != 2 {
+		t.Fatalf("early sweep dropped entries: requests=%v failed=%v", exchangeRateLimiter.requests, failedAttempts)
+	}
+
+	sweepRateLimits(now)
+	if _, ok := exchangeRateLimiter.requests[stale]; ok {
+		t.Error("stale rate limiter entry survived the sweep")
+	}
+	if _, ok := exchangeRateLimiter.requests[fresh]; !ok {
+		t.Error("rate limiter entry with a recent request was swept")
+	}
+	if _, ok := failedAttempts[stale]; ok {
+		t.Error("stale failed-login entry survived the sweep")
+	}
+	if _, ok := failedAttempts[fresh]; !ok {
+		t.Error("recent failed-login entry was swept")
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	origAge, origSub, origPreload := *hstsMaxAge, *hstsSubdomains, *hstsPreload
+	t.Cleanup(func() { *hstsMaxAge, *hstsSubdomains, *hstsPreload = origAge, origSub, origPreload })
+
+	handler := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }))
+	hsts := func(proto string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get("Strict-Transport-Security")
+	}
+
+	tests := []struct {
+		maxAge          time.Duration
+		subdomains, pre bool
+		want            string
+	}{
+		{defaultHSTSMaxAge, true, true, "max-age=63072000; includeSubDomains; preload"},
+		{5 * time.Minute, false, false, "max-age=300"},
+		{24 * time.Hour, true, false, "max-age=86400; includeSubDomains"},
+		{0, false, false, "max-age=0"},
+	}
+	for _, tt := range tests {
+		*hstsMaxAge, *hstsSubdomains, *hstsPreload = tt.maxAge, tt.subdomains, tt.pre
+		if got := hsts("https"); got != tt.want {
+			t.Errorf("HSTS = %q, want %q", got, tt.want)
+		}
+	}
+	if got := hsts("http"); got != "" {
+		t.Errorf("plain HTTP response carries HSTS %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// maintenanceRetryAfter is the Retry-After sent with maintenance 503s, in seconds.
+const maintenanceRetryAfter = "120"
+
+// maintenance is on while traffic is being drained for an upgrade. It starts from
+// --maintenance and flips on SIGUSR1.
+var maintenance atomic.Bool
+
+var maintenancePage = mustParsePage("templates/maintenance.html")
+
+// maintenanceExempt lists the paths still served during maintenance: the health check,
+// and the stylesheet and icon the maintenance page itself loads.
+var maintenanceExempt = map[string]bool{
+	"/health":           true,
+	"/assets/error.css": true,
+	"/favicon.ico":      true,
+}
+
+// maintenanceMode answers everything except maintenanceExempt with 503 while maintenance
+// is on: /oauth/* gets a JSON maintenance error the SPA can branch on, everything else the
+// maintenance page.
+func maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Load() || maintenanceExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		if strings.HasPrefix(r.URL.Path, "/oauth/") {
+			writeJSONError(w, http.StatusServiceUnavailable, errCodeMaintenance, "Down for maintenance, please retry shortly")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		renderPage(w, r, maintenancePage, http.StatusServiceUnavailable, pageData{})
+	})
+}
+
+// toggleMaintenance flips maintenance mode and logs the new state.
+func toggleMaintenance() {
+	for {
+		on := maintenance.Load()
+		if !maintenance.CompareAndSwap(on, !on) {
+			continue
+		}
+		if on {
+			log.Print("Maintenance mode disabled")
+		} else {
+			warnf("Maintenance mode enabled: answering everything but /health and the maintenance page assets with 503")
+		}
+		return
+	}
+}
+
+// watchMaintenanceSignal toggles maintenance mode on every SIGUSR1 until ctx is done.
+func watchMaintenanceSignal(ctx context.Context) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			toggleMaintenance()
+		}
+	}
+}
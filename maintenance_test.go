@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		maintenance bool
+		path        string
+		wantStatus  int
+		wantJSON    bool
+	}{
+		{name: "on: health", maintenance: true, path: "/health", wantStatus: http.StatusOK},
+		{name: "on: dashboard", maintenance: true, path: "/", wantStatus: http.StatusServiceUnavailable},
+		{name: "on: version", maintenance: true, path: "/version", wantStatus: http.StatusServiceUnavailable},
+		{name: "on: oauth", maintenance: true, path: "/oauth/csrf", wantStatus: http.StatusServiceUnavailable, wantJSON: true},
+		{name: "on: maintenance page stylesheet", maintenance: true, path: "/assets/error.css", wantStatus: http.StatusOK},
+		{name: "on: favicon", maintenance: true, path: "/favicon.ico", wantStatus: http.StatusOK},
+		{name: "on: other assets", maintenance: true, path: "/assets/app.js", wantStatus: http.StatusServiceUnavailable},
+		{name: "off: health", path: "/health", wantStatus: http.StatusOK},
+		{name: "off: dashboard", path: "/", wantStatus: http.StatusOK},
+		{name: "off: version", path: "/version", wantStatus: http.StatusOK},
+		{name: "off: oauth", path: "/oauth/csrf", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestServer(t, Config{Maintenance: tt.maintenance})
+			t.Cleanup(func() { maintenance.Store(false) })
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://my."+baseDomain+tt.path, http.NoBody))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus != http.StatusServiceUnavailable {
+				return
+			}
+			if rr.Header().Get("Retry-After") == "" {
+				t.Error("maintenance response has no Retry-After")
+			}
+			if tt.wantJSON {
+				var body apiError
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error != errCodeMaintenance {
+					t.Errorf("body = %q, want %q error", rr.Body.String(), errCodeMaintenance)
+				}
+				return
+			}
+			if !strings.Contains(rr.Body.String(), "Down for Maintenance") {
+				t.Errorf("body = %.200s, want the maintenance page", rr.Body)
+			}
+		})
+	}
+}
+
+func TestToggleMaintenance(t *testing.T) {
+	handler := newTestServer(t, Config{})
+	t.Cleanup(func() { maintenance.Store(false) })
+
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		toggleMaintenance()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/version", http.NoBody))
+		if rr.Code != want {
+			t.Errorf("after %d toggles: status = %d, want %d", i+1, rr.Code, want)
+		}
+	}
+}
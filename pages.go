@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates/*.html
+var pageTemplateFiles embed.FS
+
+// pageData is available to callback page templates. html/template escapes every field
+// for its context, so values taken from the query string are safe to render.
+type pageData struct {
+	SetupAction    string
+	InstallationID string
+	Message        string
+	ErrorCode      string // GitHub's error and error_description, only with --oauth-debug-errors
+	ErrorDetail    string
+	Nonce          string // CSP nonce for inline <script>/<style> tags
+	BuildTimestamp string
+}
+
+// Server-rendered pages shown at the end of the OAuth callback, replaceable at startup
+// with --install-success-template and --install-failure-template to brand a deployment.
+var (
+	installSuccessPage = mustParsePage("templates/install_success.html")
+	installFailurePage = mustParsePage("templates/install_failure.html")
+)
+
+func mustParsePage(name string) *template.Template {
+	return template.Must(template.ParseFS(pageTemplateFiles, name))
+}
+
+// loadPageTemplate parses an override template from disk.
+func loadPageTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("parse page template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderPage executes a page template for the request, filling in its CSP nonce.
+// Rendering into a buffer first means a template error yields a clean 500 rather than half a page.
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, status int, data pageData) {
+	data.Nonce = cspNonce(r)
+	data.BuildTimestamp = buildTimestamp
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		errorf("Failed to render %s: %v", tmpl.Name(), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		errorf("Failed to write %s: %v", tmpl.Name(), err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    *template.Template
+		data    pageData
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "install success escapes query values",
+			page: installSuccessPage,
+			data: pageData{SetupAction: `<script>alert(1)</script>`, InstallationID: `"><img src=x>`},
+			want: []string{
+				"GitHub App Installed Successfully",
+				"&lt;script&gt;alert(1)&lt;/script&gt;",
+				"&#34;&gt;&lt;img src=x&gt;",
+				`<script nonce="test-nonce">`,
+				"error.css?v=" + buildTimestamp,
+			},
+			notWant: []string{"<script>alert(1)", "<img src=x>"},
+		},
+		{
+			name: "install failure shows message",
+			page: installFailurePage,
+			data: pageData{Message: "Authentication was cancelled & failed"},
+			want: []string{"Authentication Failed", "cancelled &amp; failed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := withCSPNonce(httptest.NewRequest(http.MethodGet, "/oauth/callback", http.NoBody), "test-nonce")
+			w := httptest.NewRecorder()
+			renderPage(w, r, tt.page, http.StatusOK, tt.data)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			body := w.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("body missing %q:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("body contains unescaped %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadPageTemplateOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "success.html")
+	if err := os.WriteFile(path, []byte(`<h1>Acme</h1><p>{{.SetupAction}} #{{.InstallationID}}</p>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadPageTemplate(path)
+	if err != nil {
+		t.Fatalf("loadPageTemplate() error = %v", err)
+	}
+	orig := installSuccessPage
+	installSuccessPage = tmpl
+	t.Cleanup(func() { installSuccessPage = orig })
+	setClientSecret(t, "test_secret")
+
+	r := httptest.NewRequest(http.MethodGet, "/oauth/callback?installation_id=42&setup_action=%3Cb%3E", http.NoBody)
+	w := httptest.NewRecorder()
+	handleOAuthCallback(w, r)
+
+	if got, want := w.Body.String(), "<h1>Acme</h1><p>&lt;b&gt; #42</p>"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.html")
+	if err := os.WriteFile(bad, []byte(`{{.Unclosed`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPageTemplate(bad); err == nil {
+		t.Error("loadPageTemplate() accepted a malformed template")
+	}
+	if _, err := loadPageTemplate(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("loadPageTemplate() accepted a missing file")
+	}
+}
+
+func TestOAuthCallbackErrorDetails(t *testing.T) {
+	orig := *oauthDebugErrs
+	t.Cleanup(func() { *oauthDebugErrs = orig })
+	setClientSecret(t, "test_secret")
+
+	const query = "?error=access_denied&error_description=" + "The+user+has+denied+%3Cb%3Eyour%3C%2Fb%3E+application"
+	tests := []struct {
+		name    string
+		debug   bool
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "generic in production",
+			want:    []string{"Authentication was cancelled or failed"},
+			notWant: []string{"access_denied", "denied"},
+		},
+		{
+			name:    "detailed with flag",
+			debug:   true,
+			want:    []string{"Authentication was cancelled or failed", "<code>access_denied</code>", "The user has denied &lt;b&gt;your&lt;/b&gt; application"},
+			notWant: []string{"<b>your</b>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*oauthDebugErrs = tt.debug
+			w := httptest.NewRecorder()
+			handleOAuthCallback(w, httptest.NewRequest(http.MethodGet, "/oauth/callback"+query, http.NoBody))
+
+			body := w.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("body missing %q:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("body contains %q:\n%s", s, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+const defaultPprofAddr = "localhost:6060"
+
+// newDebugMux serves auth code metrics at /debug/authcodes, the GitHub heartbeat at
+// /debug/github, per-IP rate limiter state at /debug/ratelimit, and, with withPprof, the
+// net/http/pprof endpoints under /debug/pprof/. It is only ever mounted on the loopback
+// debug listener, never the public mux.
+func newDebugMux(withPprof bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	if withPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	mux.HandleFunc("/debug/authcodes", handleAuthCodeStats)
+	mux.HandleFunc("/debug/github", handleHeartbeatStats)
+	mux.HandleFunc("/debug/ratelimit", handleRateLimitStats)
+	return mux
+}
+
+// listenPprof binds the debug listener, refusing anything but a loopback address
+// so profiles (which expose command lines and memory contents) stay off the network.
+func listenPprof(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pprof address %q: %w", addr, err)
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("pprof address %q must be a loopback address", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
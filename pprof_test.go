@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPprofNotPublic(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveStaticFiles(rr, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/debug/pprof/", http.NoBody))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("public /debug/pprof/ status = %d, want 404", rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "profile") {
+		t.Error("public mux served pprof content")
+	}
+}
+
+func TestPprofDebugListener(t *testing.T) {
+	ln, err := listenPprof("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenPprof() error = %v", err)
+	}
+	srv := &http.Server{Handler: newDebugMux(true), ReadHeaderTimeout: time.Second}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("failed to close server: %v", err)
+		}
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Serve() = %v, want ErrServerClosed", err)
+		}
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("pprof request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("failed to close body: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("pprof index: status = %d, body = %.200s", resp.StatusCode, body)
+	}
+
+	// Without --enable-pprof the listener serves only the stats
+	rr := httptest.NewRecorder()
+	newDebugMux(false).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", http.NoBody))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("/debug/pprof/ without --enable-pprof: status = %d, want 404", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	newDebugMux(false).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/authcodes", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Errorf("/debug/authcodes without --enable-pprof: status = %d, want 200", rr.Code)
+	}
+
+	for _, addr := range []string{"0.0.0.0:0", ":0", "192.0.2.1:6060", "nope"} {
+		if ln, err := listenPprof(addr); err == nil {
+			_ = ln.Close() //nolint:errcheck // test cleanup
+			t.Errorf("listenPprof(%q) succeeded, want error", addr)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ipHashKey keys the IP hashes /debug/ratelimit reports with --debug-hash-ips. It is
+// random per process so a hash can't be reversed by hashing every IPv4 address.
+var ipHashKey = []byte(rand.Text())
+
+// rateLimitEntry is one tracked IP in the /debug/ratelimit report.
+type rateLimitEntry struct {
+	IP       string `json:"ip"`
+	Requests int    `json:"requests"` // inside the current window
+	Limit    int    `json:"limit"`    // lowered for IPs with recent failed logins
+	Limited  bool   `json:"limited"`
+	ResetIn  string `json:"reset_in"` // until the oldest counted request leaves the window
+}
+
+// rateLimitStats is one limiter in the /debug/ratelimit report.
+type rateLimitStats struct {
+	Window string           `json:"window"`
+	Limit  int              `json:"limit"`
+	IPs    []rateLimitEntry `json:"ips"`
+}
+
+// hashIP returns a short keyed hash of ip, stable for the life of the process.
+func hashIP(ip string) string {
+	mac := hmac.New(sha256.New, ipHashKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// snapshot reports the IPs with requests inside the window, busiest first. If only is set,
+// just that IP is reported. The limiter lock is held only while copying counts, and effective
+// limits are looked up after releasing it so failedMutex is never taken under rl.mu.
+func (rl *rateLimiter) snapshot(now time.Time, only string, hashIPs bool) rateLimitStats {
+	stats := rateLimitStats{Window: rl.window.String(), Limit: rl.limit, IPs: []rateLimitEntry{}}
+	cutoff := now.Add(-rl.window)
+	oldest := make(map[string]time.Time)
+
+	rl.mu.Lock()
+	for ip, times := range rl.requests {
+		if only != "" && ip != only {
+			continue
+		}
+		n := 0
+		for _, t := range times {
+			if t.After(cutoff) {
+				if n == 0 {
+					oldest[ip] = t
+				}
+				n++
+			}
+		}
+		if n > 0 {
+			stats.IPs = append(stats.IPs, rateLimitEntry{IP: ip, Requests: n})
+		}
+	}
+	rl.mu.Unlock()
+
+	for i := range stats.IPs {
+		e := &stats.IPs[i]
+		e.Limit = rl.effectiveLimit(e.IP, now)
+		e.Limited = e.Requests >= e.Limit
+		e.ResetIn = oldest[e.IP].Add(rl.window).Sub(now).Round(time.Millisecond).String()
+		if hashIPs {
+			e.IP = hashIP(e.IP)
+		}
+	}
+	slices.SortFunc(stats.IPs, func(a, b rateLimitEntry) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.IP, b.IP))
+	})
+	return stats
+}
+
+// handleRateLimitStats serves per-IP rate limiter state on the loopback debug listener,
+// keyed by limiter. ?ip= narrows the report to one address, which also works with
+// --debug-hash-ips.
+func handleRateLimitStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	only := r.URL.Query().Get("ip")
+	report := map[string]rateLimitStats{
+		"exchange":    exchangeRateLimiter.snapshot(now, only, *hashDebugIPs),
+		"validate":    validateRateLimiter.snapshot(now, only, *hashDebugIPs),
+		"device_poll": devicePollRateLimiter.snapshot(now, only, *hashDebugIPs),
+	}
+	if cspReportLimiter != nil {
+		report["csp_report"] = cspReportLimiter.snapshot(now, only, *hashDebugIPs)
+	}
+	if avatarRateLimiter != nil {
+		report["avatar"] = avatarRateLimiter.snapshot(now, only, *hashDebugIPs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errorf("Failed to encode rate limit stats: %v", err)
+	}
+}
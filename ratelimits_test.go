@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getRateLimitStats fetches /debug/ratelimit from the debug mux.
+func getRateLimitStats(t *testing.T, target string) map[string]rateLimitStats {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	newDebugMux(false).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	var report map[string]rateLimitStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	return report
+}
+
+func TestRateLimitStats(t *testing.T) {
+	resetFailedAttempts(t)
+	newTestServer(t, Config{RateLimitRequests: 3, RateLimitWindow: time.Minute})
+	orig := *hashDebugIPs
+	t.Cleanup(func() { *hashDebugIPs = orig })
+	*hashDebugIPs = false
+
+	const busy, quiet, stale = "192.0.2.1", "192.0.2.2", "192.0.2.3"
+	handler := exchangeRateLimiter.limitHandler(func(http.ResponseWriter, *http.Request) {})
+	for range 4 {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", http.NoBody)
+		req.RemoteAddr = busy + ":1234"
+		handler(httptest.NewRecorder(), req)
+	}
+	now := time.Now()
+	exchangeRateLimiter.mu.Lock()
+	exchangeRateLimiter.requests[quiet] = []time.Time{now.Add(-50 * time.Second)}
+	exchangeRateLimiter.requests[stale] = []time.Time{now.Add(-2 * time.Minute)}
+	exchangeRateLimiter.mu.Unlock()
+
+	stats := getRateLimitStats(t, "/debug/ratelimit")["exchange"]
+	if stats.Limit != 3 || stats.Window != "1m0s" {
+		t.Errorf("limit/window = %d/%s, want 3/1m0s", stats.Limit, stats.Window)
+	}
+	if len(stats.IPs) != 2 {
+		t.Fatalf("IPs = %+v, want busy and quiet only", stats.IPs)
+	}
+	if got := stats.IPs[0]; got.IP != busy || got.Requests != 3 || got.Limit != 3 || !got.Limited {
+		t.Errorf("busy entry = %+v, want 3 of 3 requests and limited", got)
+	}
+	got := stats.IPs[1]
+	if got.IP != quiet || got.Requests != 1 || got.Limited {
+		t.Errorf("quiet entry = %+v, want 1 request and not limited", got)
+	}
+	if reset, err := time.ParseDuration(got.ResetIn); err != nil || reset <= 0 || reset > 10*time.Second {
+		t.Errorf("quiet reset_in = %q, want about 10s", got.ResetIn)
+	}
+
+	if ips := getRateLimitStats(t, "/debug/ratelimit?ip="+quiet)["exchange"].IPs; len(ips) != 1 || ips[0].IP != quiet {
+		t.Errorf("?ip= report = %+v, want only %s", ips, quiet)
+	}
+
+	*hashDebugIPs = true
+	ips := getRateLimitStats(t, "/debug/ratelimit?ip="+busy)["exchange"].IPs
+	if len(ips) != 1 || ips[0].IP != hashIP(busy) || ips[0].Requests != 3 {
+		t.Errorf("hashed report = %+v, want %s with 3 requests", ips, hashIP(busy))
+	}
+	if hashIP(busy) == busy || hashIP(busy) == hashIP(quiet) {
+		t.Errorf("hashIP(%s) = %s, want a distinct hash", busy, hashIP(busy))
+	}
+}
+
+func TestRateLimiterReleasesLockBeforeHandler(t *testing.T) {
+	newTestServer(t, Config{RateLimitRequests: 3, RateLimitWindow: time.Minute})
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := exchangeRateLimiter.limitHandler(func(http.ResponseWriter, *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/oauth/exchange", http.NoBody))
+	}()
+	<-entered
+
+	// With a request still in its handler, the report and other requests go through
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		newDebugMux(false).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/debug/ratelimit", http.NoBody))
+		req := httptest.NewRequest(http.MethodPost, "/oauth/exchange", http.NoBody)
+		req.RemoteAddr = "192.0.2.9:1234"
+		exchangeRateLimiter.limitHandler(func(http.ResponseWriter, *http.Request) {})(httptest.NewRecorder(), req)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Error("limiter lock was held while the handler ran")
+	}
+	close(release)
+	<-done
+}
+
+func TestValidateRateLimited(t *testing.T) {
+	resetFailedAttempts(t)
+	handler := newTestServer(t, Config{})
+	for i := range validatesPerMinute + 1 {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/validate", http.NoBody))
+		if limited := rr.Code == http.StatusTooManyRequests; limited != (i == validatesPerMinute) {
+			t.Fatalf("request %d: status = %d", i+1, rr.Code)
+		}
+	}
+}
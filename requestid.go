@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLength caps a client-supplied X-Request-ID, which is echoed in logs and
+// audit records.
+const maxRequestIDLength = 64
+
+// validRequestID reports whether a client-supplied X-Request-ID can be kept: at most
+// maxRequestIDLength characters from [A-Za-z0-9._-], so it can't forge log lines or
+// bloat them. Anything else is replaced with a generated ID.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID returns r with its request ID in the context, so code that only sees
+// a context, like outbound GitHub calls, can tag its logs.
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestIDFrom returns the request ID securityHeaders stored in ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs like log.Printf, prefixed with ctx's request ID in the same "[id]" form
+// requestLogger uses, so every line of a single login can be grepped together.
+func logf(ctx context.Context, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if id := requestIDFrom(ctx); id != "" {
+		msg = "[" + id + "] " + msg
+	}
+	log.Print(msg)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenRevocationTTL is how long a revocation of a token this process didn't issue, or
+// issued without an expiry, is kept. GitHub App user tokens expire after 8 hours.
+const tokenRevocationTTL = 8 * time.Hour
+
+// maxIssuedTokens bounds the issued token index; past it, new pairs go unrecorded and
+// their revocations fall back to tokenRevocationTTL for both halves.
+const maxIssuedTokens = 100000
+
+// revocationList is an emergency kill-switch for compromised tokens: tokens whose hash is
+// listed are rejected even while GitHub still accepts them. It is per process, so every
+// instance has to be told about a revocation.
+type revocationList struct {
+	entries map[string]time.Time // token hash -> revoked until
+	ttl     time.Duration        // for tokens with no known expiry
+	mu      sync.Mutex
+}
+
+// revokedTokens isn't reset by newServer, so revocations survive rebuilding the handler.
+var revokedTokens = newRevocationList(tokenRevocationTTL)
+
+func newRevocationList(ttl time.Duration) *revocationList {
+	return &revocationList{
+		entries: make(map[string]time.Time),
+		ttl:     ttl,
+	}
+}
+
+// revoke lists a token hash as revoked until expiry, when GitHub stops honoring the token
+// anyway, or for the TTL from now when the expiry is zero. It returns when the entry lapses.
+func (l *revocationList) revoke(hash string, expiry, now time.Time) time.Time {
+	until := expiry
+	if until.IsZero() {
+		until = now.Add(l.ttl)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.entries[hash]) {
+		l.entries[hash] = until
+	}
+	return l.entries[hash]
+}
+
+// revoked reports whether token has been revoked.
+func (l *revocationList) revoked(token string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.entries[tokenHash(token)]
+	return ok && now.Before(until)
+}
+
+// cleanup removes entries whose tokens have expired.
+func (l *revocationList) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for hash, until := range l.entries {
+		if now.After(until) {
+			delete(l.entries, hash)
+		}
+	}
+}
+
+// issuedToken is an access token this process handed out, paired with the refresh token
+// issued alongside it, by hash, with the expiries GitHub gave each.
+type issuedToken struct {
+	accessHash    string
+	refreshHash   string // empty when the app doesn't issue refresh tokens
+	tokenExpiry   time.Time
+	refreshExpiry time.Time
+	expires       time.Time // when the index forgets the pair
+}
+
+// issuedTokenIndex finds an issued pair from either half's hash, so revoking an access
+// token also denies the refresh token that would mint its replacement, and the reverse.
+type issuedTokenIndex struct {
+	byHash  map[string]*issuedToken
+	fullLog *logThrottle
+	mu      sync.Mutex
+}
+
+func newIssuedTokenIndex() *issuedTokenIndex {
+	return &issuedTokenIndex{byHash: make(map[string]*issuedToken), fullLog: &logThrottle{interval: time.Minute}}
+}
+
+// issuedTokens isn't reset by newServer, for the same reason as revokedTokens.
+var issuedTokens = newIssuedTokenIndex()
+
+// record indexes a token response issued at now. Tokens with neither an expiry nor a
+// refresh token gain nothing from the index and are skipped.
+func (x *issuedTokenIndex) record(resp *oauthTokenResponse, now time.Time) {
+	tokenExpiry, refreshExpiry := resp.expiries(now)
+	if resp.RefreshToken == "" && tokenExpiry.IsZero() {
+		return
+	}
+	pair := &issuedToken{accessHash: tokenHash(resp.AccessToken), tokenExpiry: tokenExpiry, refreshExpiry: refreshExpiry}
+	if resp.RefreshToken != "" {
+		pair.refreshHash = tokenHash(resp.RefreshToken)
+	}
+	// Kept until the later expiry; pairs with neither are kept as long as a revocation
+	pair.expires = now.Add(tokenRevocationTTL)
+	for _, expiry := range []time.Time{tokenExpiry, refreshExpiry} {
+		if expiry.After(pair.expires) {
+			pair.expires = expiry
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.byHash) >= maxIssuedTokens {
+		if ok, dropped := x.fullLog.allow(now); ok {
+			warnf("Issued token index full at %d entries; revocations of new tokens won't cover their pair (%d more since the last warning)", maxIssuedTokens, dropped)
+		}
+		return
+	}
+	x.byHash[pair.accessHash] = pair
+	if pair.refreshHash != "" {
+		x.byHash[pair.refreshHash] = pair
+	}
+}
+
+// lookup returns the pair either half of which hashes to hash.
+func (x *issuedTokenIndex) lookup(hash string) (issuedToken, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	pair, ok := x.byHash[hash]
+	if !ok {
+		return issuedToken{}, false
+	}
+	return *pair, true
+}
+
+// cleanup drops pairs once both halves have expired.
+func (x *issuedTokenIndex) cleanup(now time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for hash, pair := range x.byHash {
+		if now.After(pair.expires) {
+			delete(x.byHash, hash)
+		}
+	}
+}
+
+// rejectRevoked writes a 401 and returns true if token has been revoked.
+func rejectRevoked(w http.ResponseWriter, r *http.Request, token string) bool {
+	if !revokedTokens.revoked(token, time.Now()) {
+		return false
+	}
+	warnf("[SECURITY] [%s] Rejected revoked token %s from %s", requestIDFrom(r.Context()), tokenHash(token), clientIP(r))
+	writeJSONError(w, http.StatusUnauthorized, errCodeTokenRevoked, "Token has been revoked")
+	return true
+}
+
+// handleRevokeToken adds a token to the revocation list. The body names it either by
+// token_hash (hex SHA-256 of the token, so the token itself needn't be shared) or by token.
+// If this process issued the token, the other half of its pair is revoked with it, and
+// each entry lasts until its token's own expiry.
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token     string `json:"token"`
+		TokenHash string `json:"token_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request")
+		return
+	}
+
+	hash := req.TokenHash
+	if req.Token != "" {
+		hash = tokenHash(req.Token)
+	}
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidTokenHash, "Provide token or a hex SHA-256 token_hash")
+		return
+	}
+
+	now := time.Now()
+	response := map[string]any{
+		"token_hash": hash,
+		"revoked_at": now.UTC(),
+	}
+	fields := requestAuditFields(r, auditAllowed)
+	fields["token_hash"] = hash
+
+	pair, issued := issuedTokens.lookup(hash)
+	switch {
+	case !issued:
+		response["expires_at"] = revokedTokens.revoke(hash, time.Time{}, now).UTC()
+	case hash == pair.refreshHash:
+		response["expires_at"] = revokedTokens.revoke(hash, pair.refreshExpiry, now).UTC()
+		response["paired_token_hash"] = pair.accessHash
+		revokedTokens.revoke(pair.accessHash, pair.tokenExpiry, now)
+	default:
+		response["expires_at"] = revokedTokens.revoke(hash, pair.tokenExpiry, now).UTC()
+		if pair.refreshHash != "" {
+			response["paired_token_hash"] = pair.refreshHash
+			revokedTokens.revoke(pair.refreshHash, pair.refreshExpiry, now)
+		}
+	}
+	if paired, ok := response["paired_token_hash"]; ok {
+		fields["paired_token_hash"] = paired
+	}
+	auditLog(auditTokenRevoked, fields)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode revocation response: %v", err)
+	}
+}
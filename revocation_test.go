@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokedTokenRejected(t *testing.T) {
+	setString(t, adminToken, "admin-secret")
+	origRevoked := revokedTokens
+	revokedTokens = newRevocationList(tokenRevocationTTL)
+	t.Cleanup(func() { revokedTokens = origRevoked })
+	stubClient(t, &apiClient, func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+	server := newTestServer(t, Config{UserCacheTTL: time.Minute})
+
+	getUser := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	revoke := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/debug/revoke-token", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := getUser(testToken); rr.Code != http.StatusOK {
+		t.Fatalf("status before revocation = %d, want 200: %s", rr.Code, rr.Body)
+	}
+
+	if rr := revoke(`{"token_hash":"` + tokenHash(testToken) + `"}`); rr.Code != http.StatusOK {
+		t.Fatalf("revoke status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	// The cached user must not let a revoked token through
+	if got := decodeAPIError(t, getUser(testToken), http.StatusUnauthorized); got != "token_revoked" {
+		t.Errorf("error = %q, want token_revoked", got)
+	}
+
+	// Cookie-authenticated requests are checked too
+	req := httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: tokenCookieName, Value: testToken})
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "csrf"})
+	req.Header.Set(csrfHeaderName, "csrf")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if got := decodeAPIError(t, rr, http.StatusUnauthorized); got != "token_revoked" {
+		t.Errorf("cookie auth error = %q, want token_revoked", got)
+	}
+
+	if rr := getUser("gho_other"); rr.Code != http.StatusOK {
+		t.Errorf("unrevoked token status = %d, want 200", rr.Code)
+	}
+	if rr := revoke(`{"token":"gho_other"}`); rr.Code != http.StatusOK {
+		t.Fatalf("revoke by token status = %d, want 200", rr.Code)
+	}
+	if rr := getUser("gho_other"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("token revoked by value: status = %d, want 401", rr.Code)
+	}
+
+	if got := decodeAPIError(t, revoke(`{"token_hash":"abc"}`), http.StatusBadRequest); got != "invalid_token_hash" {
+		t.Errorf("bad hash error = %q, want invalid_token_hash", got)
+	}
+
+	// Entries lapse once the token itself would have expired
+	later := time.Now().Add(tokenRevocationTTL + time.Minute)
+	revokedTokens.cleanup(later)
+	if revokedTokens.revoked(testToken, later) {
+		t.Error("revocation outlived its TTL")
+	}
+}
+
+func TestRevokeTokenRequiresAdmin(t *testing.T) {
+	resetFailedAttempts(t)
+	setString(t, adminToken, "admin-secret")
+	origRevoked := revokedTokens
+	revokedTokens = newRevocationList(tokenRevocationTTL)
+	t.Cleanup(func() { revokedTokens = origRevoked })
+
+	req := httptest.NewRequest(http.MethodPost, "/debug/revoke-token", strings.NewReader(`{"token":"gho_x"}`))
+	req.Header.Set("Authorization", "Bearer gho_x")
+	rr := httptest.NewRecorder()
+	newTestServer(t, Config{}).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+	if revokedTokens.revoked("gho_x", time.Now()) {
+		t.Error("non-admin request revoked a token")
+	}
+}
+
+func TestRevokeTokenRevokesPair(t *testing.T) {
+	setString(t, adminToken, "admin-secret")
+	origRevoked, origIssued := revokedTokens, issuedTokens
+	revokedTokens, issuedTokens = newRevocationList(tokenRevocationTTL), newIssuedTokenIndex()
+	t.Cleanup(func() { revokedTokens, issuedTokens = origRevoked, origIssued })
+	setClientSecret(t, "test_secret")
+	stubClient(t, &oauthClient, func(_ *http.Request) (*http.Response, error) {
+		t.Error("revoked refresh token was sent to GitHub")
+		return stubResponse(http.StatusOK, `{"access_token":"ghu_replacement"}`), nil
+	})
+	server := newTestServer(t, Config{})
+
+	now := time.Now()
+	issuedTokens.record(&oauthTokenResponse{
+		AccessToken:           "ghu_access",
+		RefreshToken:          "ghr_refresh",
+		ExpiresIn:             3600,
+		RefreshTokenExpiresIn: 86400,
+	}, now)
+
+	req := httptest.NewRequest(http.MethodPost, "/debug/revoke-token", strings.NewReader(`{"token":"ghu_access"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), tokenHash("ghr_refresh")) {
+		t.Errorf("response %s doesn't name the paired refresh token", rr.Body)
+	}
+
+	// The refresh token can't mint a replacement
+	req = httptest.NewRequest(http.MethodPost, "/oauth/refresh", strings.NewReader(`{"refresh_token":"ghr_refresh"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if got := decodeAPIError(t, rr, http.StatusUnauthorized); got != "token_revoked" {
+		t.Errorf("refresh error = %q, want token_revoked", got)
+	}
+
+	// Each revocation lasts as long as its own token
+	inTwoHours := now.Add(2 * time.Hour)
+	if revokedTokens.revoked("ghu_access", inTwoHours) {
+		t.Error("access token revocation outlived the token's expiry")
+	}
+	if !revokedTokens.revoked("ghr_refresh", inTwoHours) {
+		t.Error("refresh token revocation lapsed before the refresh token expired")
+	}
+}
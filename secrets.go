@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/codeGROOVE-dev/gsm"
+	"github.com/codeGROOVE-dev/retry"
+)
+
+const (
+	defaultSecretRefresh = 5 * time.Minute
+
+	// Startup fetches retry for roughly half a minute, so a transient Secret Manager
+	// outage doesn't leave OAuth disabled until the next restart.
+	secretFetchAttempts = 6
+	secretFetchDelay    = 500 * time.Millisecond
+)
+
+// rotatingSecret holds a secret that may be swapped while requests read it.
+type rotatingSecret struct {
+	value atomic.Pointer[string]
+}
+
+func (s *rotatingSecret) get() string {
+	if v := s.value.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// set stores v, reporting whether it differs from the previous value.
+func (s *rotatingSecret) set(v string) bool {
+	old := s.value.Swap(&v)
+	return old == nil || *old != v
+}
+
+// defaultClientSecret is the default OAuth app's client secret. Read it at use time,
+// not once per request flow's setup, so rotations take effect immediately.
+var defaultClientSecret rotatingSecret
+
+// secretSink receives rotated secret values, reporting whether the value changed.
+// rotatingSecret and tokenKeyring implement it.
+type secretSink interface {
+	set(v string) bool
+}
+
+// secretFetcher retrieves the current version of a named secret.
+type secretFetcher func(ctx context.Context, name string) (string, error)
+
+// secretManagerFetch reads from Google Secret Manager. Tests replace it.
+var secretManagerFetch secretFetcher = gsm.Fetch
+
+// isCloudRun reports whether the process is running in Cloud Run, where Secret Manager is available.
+func isCloudRun() bool {
+	return os.Getenv("K_SERVICE") != "" || os.Getenv("CLOUD_RUN_TIMEOUT_SECONDS") != ""
+}
+
+// watchSecret re-fetches a secret every interval and hands new versions to s until ctx is done.
+// Failed or empty fetches keep the current value, so a Secret Manager hiccup never blanks the secret.
+func watchSecret(ctx context.Context, s secretSink, name string, fetch secretFetcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		value, err := fetch(ctx, name)
+		if err != nil {
+			errorf("Failed to refresh %s from Secret Manager: %v", name, err)
+			continue
+		}
+		if value == "" {
+			log.Printf("WARNING: Secret Manager returned empty value for %s, keeping current secret", name)
+			continue
+		}
+		if s.set(value) {
+			log.Printf("%s rotated: picked up new value from Secret Manager", name)
+		}
+	}
+}
+
+// secretStatus finds the HTTP status in a gsm error. gsm returns plain formatted errors,
+// such as "failed to access secret: status 404", so the text is all there is to go on.
+var secretStatus = regexp.MustCompile(`status (\d{3})`)
+
+// transientSecretError reports whether a failed fetch is worth retrying: a network error,
+// a timed-out attempt, or Secret Manager (or the metadata server) answering 429 or 5xx,
+// the REST equivalents of gRPC's Unavailable and DeadlineExceeded. A missing secret,
+// denied access, or malformed name fails the same way every time.
+func transientSecretError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if m := secretStatus.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// fetchSecretWithRetry calls fetch with exponential backoff until it succeeds, fails with
+// an error transientSecretError says won't go away, the attempts run out, or ctx is done.
+func fetchSecretWithRetry(ctx context.Context, name string, fetch secretFetcher) (string, error) {
+	var value string
+	err := retry.Do(
+		func() error {
+			var err error
+			value, err = fetch(ctx, name)
+			return err
+		},
+		retry.Context(ctx),
+		retry.Attempts(secretFetchAttempts),
+		retry.Delay(secretFetchDelay),
+		retry.MaxDelay(10*time.Second),
+		retry.DelayType(retry.BackOffDelay),
+		retry.WithTimer(retryTimer),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(transientSecretError),
+		retry.OnRetry(func(n uint, err error) {
+			log.Printf("[RETRY] Secret Manager %s attempt %d: %v", name, n+1, err)
+		}),
+	)
+	return value, err
+}
+
+// loadSecret retrieves a secret from the named environment variable, or from the
+// Secret Manager secret of the same name when running in Cloud Run. Secret Manager
+// fetches are retried with backoff; once running, watchSecret keeps the last good value.
+func loadSecret(ctx context.Context, name string) string {
+	// Check environment variable first
+	if value := os.Getenv(name); value != "" {
+		log.Printf("Using %s from environment variable", name)
+		return value
+	}
+
+	if !isCloudRun() {
+		log.Printf("Not running in Cloud Run, skipping Secret Manager for %s", name)
+		return ""
+	}
+
+	// Fetch from Secret Manager (auto-detects project ID from metadata server)
+	log.Printf("Fetching %s from Google Secret Manager", name)
+	secretValue, err := fetchSecretWithRetry(ctx, name, secretManagerFetch)
+	if err != nil {
+		errorf("Failed to fetch %s from Secret Manager: %v", name, err)
+		return ""
+	}
+
+	if secretValue == "" {
+		log.Printf("WARNING: Secret Manager returned empty value for %s", name)
+	} else {
+		log.Printf("Successfully fetched %s from Google Secret Manager", name)
+	}
+
+	return secretValue
+}
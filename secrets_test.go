@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchSecret(t *testing.T) {
+	var s rotatingSecret
+	s.set("v1")
+
+	// The fake Secret Manager fails once, returns empty once, then serves a rotated value
+	var calls atomic.Int32
+	fetch := func(_ context.Context, name string) (string, error) {
+		if name != "GITHUB_CLIENT_SECRET" {
+			t.Errorf("fetched %q, want GITHUB_CLIENT_SECRET", name)
+		}
+		switch calls.Add(1) {
+		case 1:
+			return "", errors.New("unavailable")
+		case 2:
+			return "", nil
+		default:
+			return "v2", nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchSecret(ctx, &s, "GITHUB_CLIENT_SECRET", fetch, 5*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		if got := s.get(); got != "v1" && got != "v2" {
+			t.Fatalf("secret = %q mid-rotation, want v1 or v2", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give the third fetch time to be stored
+	for s.get() != "v2" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := s.get(); got != "v2" {
+		t.Errorf("secret = %q, want v2 after rotation", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("watchSecret did not stop when its context was canceled")
+	}
+}
+
+func TestAppForHostReadsRotatedSecret(t *testing.T) {
+	setClientSecret(t, "old_secret")
+	if got := appForHost(baseDomain).clientSecret; got != "old_secret" {
+		t.Fatalf("clientSecret = %q, want old_secret", got)
+	}
+	defaultClientSecret.set("new_secret")
+	if got := appForHost(baseDomain).clientSecret; got != "new_secret" {
+		t.Errorf("clientSecret = %q after rotation, want new_secret", got)
+	}
+}
+
+func TestLoadSecretRetries(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("K_SERVICE", "dashboard")
+	timer := &recordingTimer{}
+	origTimer, origFetch := retryTimer, secretManagerFetch
+	retryTimer = timer
+	t.Cleanup(func() { retryTimer, secretManagerFetch = origTimer, origFetch })
+
+	// Secret Manager is unreachable twice at startup, then answers
+	errRefused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	var calls int
+	secretManagerFetch = func(_ context.Context, _ string) (string, error) {
+		calls++
+		if calls < 3 {
+			return "", errRefused
+		}
+		return "s3cret", nil
+	}
+	if got := loadSecret(context.Background(), "ADMIN_TOKEN"); got != "s3cret" {
+		t.Errorf("loadSecret() = %q, want s3cret after retries", got)
+	}
+	if calls != 3 || len(timer.delays) != 2 {
+		t.Errorf("fetched %d times with %d waits, want 3 and 2", calls, len(timer.delays))
+	}
+	if len(timer.delays) == 2 && timer.delays[1] <= timer.delays[0] {
+		t.Errorf("retry delays %v do not back off", timer.delays)
+	}
+
+	// A persistent outage gives up after the configured attempts
+	calls = 0
+	secretManagerFetch = func(_ context.Context, _ string) (string, error) {
+		calls++
+		return "", errRefused
+	}
+	if got := loadSecret(context.Background(), "ADMIN_TOKEN"); got != "" {
+		t.Errorf("loadSecret() = %q during outage, want empty", got)
+	}
+	if calls != secretFetchAttempts {
+		t.Errorf("fetched %d times, want %d", calls, secretFetchAttempts)
+	}
+
+	// A missing secret won't appear on retry, so it fails at once
+	calls = 0
+	secretManagerFetch = func(_ context.Context, _ string) (string, error) {
+		calls++
+		return "", errors.New("failed to access secret: status 404")
+	}
+	if got := loadSecret(context.Background(), "ADMIN_TOKEN"); got != "" || calls != 1 {
+		t.Errorf("loadSecret() = %q after %d fetches of a missing secret, want empty after 1", got, calls)
+	}
+}
+
+func TestTransientSecretError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{fmt.Errorf("failed to access secret: %w", context.DeadlineExceeded), true},
+		{errors.New("failed to access secret: status 503"), true},
+		{errors.New("failed to get access token: metadata server status 500"), true},
+		{errors.New("failed to access secret: status 429"), true},
+		{errors.New("failed to access secret: status 404"), false},
+		{errors.New("failed to access secret: status 403"), false},
+		{errors.New("invalid secret name format"), false},
+		{context.Canceled, false},
+	} {
+		if got := transientSecretError(tt.err); got != tt.want {
+			t.Errorf("transientSecretError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// securityTxtPath is where RFC 9116 says researchers look for security contacts.
+const securityTxtPath = "/.well-known/security.txt"
+
+// defaultSecurityTxtExpiry keeps Expires well inside RFC 9116's recommended one year.
+const defaultSecurityTxtExpiry = 180 * 24 * time.Hour
+
+// validateSecurityContacts checks --security-contact: comma-separated mailto:, tel:, or
+// https: URIs, the schemes RFC 9116 allows for Contact.
+func validateSecurityContacts(spec string) error {
+	var errs []error
+	for contact := range strings.SplitSeq(spec, ",") {
+		contact = strings.TrimSpace(contact)
+		if contact == "" {
+			continue
+		}
+		u, err := url.Parse(contact)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%q: %w", contact, err))
+		case u.Scheme == "https" && u.Host != "", (u.Scheme == "mailto" || u.Scheme == "tel") && u.Opaque != "":
+		default:
+			errs = append(errs, fmt.Errorf("%q: want a mailto:, tel:, or https:// URI", contact))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// securityTxt renders the security.txt body. Expires is computed from now so a
+// long-running process never serves an expired file.
+func securityTxt(now time.Time) string {
+	var b strings.Builder
+	for contact := range strings.SplitSeq(*contactURIs, ",") {
+		if contact = strings.TrimSpace(contact); contact != "" {
+			fmt.Fprintf(&b, "Contact: %s\n", contact)
+		}
+	}
+	fmt.Fprintf(&b, "Expires: %s\n", now.Add(*securityTxtTTL).UTC().Truncate(24*time.Hour).Format(time.RFC3339))
+	if *disclosureURL != "" {
+		fmt.Fprintf(&b, "Policy: %s\n", *disclosureURL)
+	}
+	fmt.Fprintf(&b, "Canonical: https://%s%s\n", baseDomain, securityTxtPath)
+	b.WriteString("Preferred-Languages: en\n")
+	return b.String()
+}
+
+// handleSecurityTxt serves /.well-known/security.txt, or 404s when no contact is configured.
+func handleSecurityTxt(w http.ResponseWriter, r *http.Request) {
+	if *contactURIs == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write([]byte(securityTxt(time.Now()))); err != nil {
+		errorf("Failed to write security.txt: %v", err)
+	}
+}
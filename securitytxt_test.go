@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityTxt(t *testing.T) {
+	setString(t, contactURIs, "mailto:security@example.com, https://example.com/report")
+	setString(t, disclosureURL, "https://example.com/security-policy")
+	server := newTestServer(t, Config{})
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, securityTxtPath, http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"Contact: mailto:security@example.com\n",
+		"Contact: https://example.com/report\n",
+		"Policy: https://example.com/security-policy\n",
+		"Canonical: https://" + baseDomain + securityTxtPath + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q:\n%s", want, body)
+		}
+	}
+
+	_, expires, ok := strings.Cut(body, "Expires: ")
+	if !ok {
+		t.Fatalf("body has no Expires:\n%s", body)
+	}
+	expiry, err := time.Parse(time.RFC3339, strings.SplitN(expires, "\n", 2)[0])
+	if err != nil || !expiry.After(time.Now()) || expiry.After(time.Now().AddDate(1, 0, 0)) {
+		t.Errorf("Expires = %v (%v), want within the next year", expiry, err)
+	}
+
+	// Without a contact there is nothing to publish
+	setString(t, contactURIs, "")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, securityTxtPath, http.NoBody))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unconfigured status = %d, want 404", rr.Code)
+	}
+}
+
+func TestValidateSecurityContacts(t *testing.T) {
+	tests := []struct {
+		spec   string
+		wantOK bool
+	}{
+		{"", true},
+		{"mailto:security@example.com", true},
+		{"tel:+1-201-555-0123, https://example.com/security", true},
+		{"security@example.com", false},
+		{"http://example.com/security", false},
+		{"https://", false},
+	}
+	for _, tt := range tests {
+		if err := validateSecurityContacts(tt.spec); (err == nil) != tt.wantOK {
+			t.Errorf("validateSecurityContacts(%q) = %v, want ok %v", tt.spec, err, tt.wantOK)
+		}
+	}
+}
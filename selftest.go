@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// clientIDPattern matches GitHub App (Iv1./Iv23...) and OAuth app (Ov23... or legacy hex) client IDs.
+var clientIDPattern = regexp.MustCompile(`^(?:(?:Iv|Ov)[0-9A-Za-z.]{14,30}|[0-9a-f]{20})$`)
+
+// knownScopes are the OAuth scopes GitHub accepts, so typos in --oauth-scopes show up in the self-test.
+var knownScopes = map[string]bool{
+	"repo": true, "repo:status": true, "repo_deployment": true, "public_repo": true, "repo:invite": true,
+	"security_events": true, "admin:repo_hook": true, "write:repo_hook": true, "read:repo_hook": true,
+	"admin:org": true, "write:org": true, "read:org": true, "admin:public_key": true, "write:public_key": true,
+	"read:public_key": true, "admin:org_hook": true, "gist": true, "notifications": true, "user": true,
+	"read:user": true, "user:email": true, "user:follow": true, "project": true, "read:project": true,
+	"delete_repo": true, "write:packages": true, "read:packages": true, "delete:packages": true,
+	"admin:gpg_key": true, "write:gpg_key": true, "read:gpg_key": true, "codespace": true, "workflow": true,
+}
+
+// selftestCheck is one line of the self-test report.
+type selftestCheck struct {
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+	OK     bool   `json:"ok"`
+}
+
+// githubReachabilityURL is probed without credentials to confirm outbound access to GitHub's OAuth host.
+var githubReachabilityURL = "https://github.com/login/oauth"
+
+// requireAdmin guards operator endpoints with the shared --admin-token. Without a token
+// configured the endpoint doesn't exist, so it 404s like any unknown API path. Wrong
+// tokens count as failed logins, so guessing locks the IP out like it does for OAuth.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			writeAPINotFound(w)
+			return
+		}
+		if isLockedOut(clientIP(r)) {
+			fields := requestAuditFields(r, auditDenied)
+			fields["path"] = r.URL.Path
+			auditLog(auditLockoutRejection, fields)
+			http.Error(w, "Too many failed login attempts. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			trackFailedAttempt(r)
+			fields := requestAuditFields(r, auditDenied)
+			fields["path"] = r.URL.Path
+			auditLog(auditAdminDenied, fields)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleOAuthSelftest reports whether this deployment's OAuth settings look usable,
+// answering 200 when every check passes and 503 otherwise.
+func handleOAuthSelftest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := runOAuthSelftest(r.Context(), appForHost(requestHost(r)))
+	allOK := true
+	for _, c := range checks {
+		allOK = allOK && c.OK
+	}
+
+	report := struct {
+		Checks []selftestCheck `json:"checks"`
+		OK     bool            `json:"ok"`
+	}{Checks: checks, OK: allOK}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !allOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errorf("Failed to encode OAuth self-test report: %v", err)
+	}
+}
+
+// runOAuthSelftest checks the client ID, secret, redirect URI, scopes, and that GitHub is reachable.
+func runOAuthSelftest(ctx context.Context, app oauthApp) []selftestCheck {
+	check := func(name string, err error, detail string) selftestCheck {
+		if err != nil {
+			return selftestCheck{Name: name, Detail: err.Error()}
+		}
+		return selftestCheck{Name: name, Detail: detail, OK: true}
+	}
+
+	var checks []selftestCheck
+
+	var idErr error
+	if !clientIDPattern.MatchString(app.clientID) {
+		idErr = fmt.Errorf("client ID %q is not a GitHub client ID", app.clientID)
+	}
+	checks = append(checks, check("client_id", idErr, app.clientID))
+
+	var secretErr error
+	if app.clientSecret == "" {
+		secretErr = errors.New("client secret is not set")
+	}
+	checks = append(checks, check("client_secret", secretErr, "set"))
+
+	checks = append(checks, check("redirect_uri", validateRedirectURI(*redirectURI, *allowedOrigins), *redirectURI))
+
+	var unknown []string
+	for scope := range strings.FieldsSeq(*oauthScopes) {
+		if !knownScopes[scope] {
+			unknown = append(unknown, scope)
+		}
+	}
+	var scopeErr error
+	if len(unknown) > 0 {
+		scopeErr = fmt.Errorf("unknown scopes: %s", strings.Join(unknown, " "))
+	}
+	checks = append(checks, check("scopes", scopeErr, *oauthScopes))
+
+	checks = append(checks, check("authorize_url", nil, authorizeURL(app, "STATE")))
+
+	status, err := probeGitHub(ctx)
+	checks = append(checks, check("github_reachable", err, fmt.Sprintf("%s answered %d", githubReachabilityURL, status)))
+
+	return checks
+}
+
+// probeGitHub makes one unauthenticated request to GitHub's OAuth host. Any answer
+// below 500 means the network path and TLS work.
+func probeGitHub(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, githubReachabilityURL, http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("github.com unreachable: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		logf(ctx, "Failed to close response body: %v", err)
+	}
+	if resp.StatusCode >= 500 {
+		return resp.StatusCode, fmt.Errorf("%s answered %d", githubReachabilityURL, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// credentialProbeCode is sent as the authorization code when verifying credentials. It can
+// never be a real code, so the exchange grants nothing.
+const credentialProbeCode = "credential-check-not-a-real-code"
+
+// verifyOAuthCredentials asks GitHub whether it recognizes app's client ID and secret by
+// exchanging a code that can't be valid. GitHub checks the credentials first: it answers
+// incorrect_client_credentials for a bad pair and bad_verification_code (or another code
+// error) for a good one, so typos surface at deploy time instead of on the first login.
+func verifyOAuthCredentials(ctx context.Context, app oauthApp) error {
+	if !app.configured() {
+		return errors.New("client ID or secret is not set")
+	}
+	_, err := exchangeCodeForToken(ctx, app, credentialProbeCode, *redirectURI)
+	var oauthErr *oauthError
+	switch {
+	case err == nil:
+		return errors.New("GitHub issued a token for a dummy code")
+	case errors.As(err, &oauthErr) && oauthErr.Code == "incorrect_client_credentials":
+		return fmt.Errorf("GitHub rejected client ID %s and its secret: %s", app.clientID, oauthErr.Description)
+	case errors.As(err, &oauthErr):
+		return nil
+	default:
+		return fmt.Errorf("could not reach GitHub to verify client ID %s: %w", app.clientID, err)
+	}
+}
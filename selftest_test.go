@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOAuthSelftest(t *testing.T) {
+	setString(t, adminToken, "admin-secret")
+	stubClient(t, &oauthClient, func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("reachability probe sent credentials")
+		}
+		return stubResponse(http.StatusNotFound, ""), nil
+	})
+
+	tests := []struct {
+		name       string
+		secret     string
+		wantStatus int
+		wantFailed []string
+	}{
+		{name: "all pass", secret: "test_secret", wantStatus: http.StatusOK},
+		{name: "missing secret", secret: "", wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"client_secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClientSecret(t, tt.secret)
+
+			req := httptest.NewRequest(http.MethodGet, "https://"+baseDomain+"/debug/oauth-selftest", http.NoBody)
+			req.Header.Set("Authorization", "Bearer admin-secret")
+			rr := httptest.NewRecorder()
+			requireAdmin(handleOAuthSelftest)(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			var report struct {
+				Checks []selftestCheck `json:"checks"`
+				OK     bool            `json:"ok"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("invalid report %q: %v", rr.Body.String(), err)
+			}
+			if report.OK != (len(tt.wantFailed) == 0) {
+				t.Errorf("ok = %v, want %v", report.OK, len(tt.wantFailed) == 0)
+			}
+
+			var failed []string
+			names := make(map[string]bool)
+			for _, c := range report.Checks {
+				names[c.Name] = true
+				if !c.OK {
+					failed = append(failed, c.Name)
+				}
+			}
+			for _, name := range []string{"client_id", "client_secret", "redirect_uri", "scopes", "authorize_url", "github_reachable"} {
+				if !names[name] {
+					t.Errorf("report is missing check %q", name)
+				}
+			}
+			if len(failed) != len(tt.wantFailed) || (len(failed) > 0 && failed[0] != tt.wantFailed[0]) {
+				t.Errorf("failed checks = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestOAuthSelftestRequiresAdmin(t *testing.T) {
+	resetFailedAttempts(t)
+	setClientSecret(t, "test_secret")
+	tests := []struct {
+		name       string
+		configured string
+		auth       string
+		wantStatus int
+	}{
+		{name: "disabled without token", configured: "", auth: "Bearer anything", wantStatus: http.StatusNotFound},
+		{name: "missing credentials", configured: "admin-secret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", configured: "admin-secret", auth: "Bearer nope", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setString(t, adminToken, tt.configured)
+			req := httptest.NewRequest(http.MethodGet, "/debug/oauth-selftest", http.NoBody)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			requireAdmin(func(http.ResponseWriter, *http.Request) {
+				t.Error("handler ran without admin credentials")
+			})(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminLockout(t *testing.T) {
+	resetFailedAttempts(t)
+	setString(t, adminToken, "admin-secret")
+	var ran int
+	handler := requireAdmin(func(http.ResponseWriter, *http.Request) { ran++ })
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/oauth-selftest", http.NoBody)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	for i := range maxFailedLogins {
+		if code := request("guess"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: status = %d, want 401", i+1, code)
+		}
+	}
+	// Once locked out, even the right token is refused until the lockout ends
+	if code := request("admin-secret"); code != http.StatusTooManyRequests || ran != 0 {
+		t.Errorf("locked out admin request: status = %d, handler runs = %d, want 429 and 0", code, ran)
+	}
+}
+
+func TestVerifyOAuthCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "recognized", secret: "test_secret", status: http.StatusOK, body: `{"error":"bad_verification_code","error_description":"The code passed is incorrect or expired."}`},
+		{name: "recognized, redirect mismatch", secret: "test_secret", status: http.StatusOK, body: `{"error":"redirect_uri_mismatch"}`},
+		{name: "bad credentials", secret: "wrong", status: http.StatusOK, body: `{"error":"incorrect_client_credentials","error_description":"The client_id and/or client_secret passed are incorrect."}`, wantErr: "rejected client ID"},
+		{name: "unexpected status", secret: "test_secret", status: http.StatusNotFound, wantErr: "could not reach GitHub"},
+		{name: "missing secret", wantErr: "not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubClient(t, &oauthClient, func(r *http.Request) (*http.Response, error) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("invalid token request: %v", err)
+				}
+				if r.PostForm.Get("code") != credentialProbeCode || r.PostForm.Get("client_secret") != tt.secret {
+					t.Errorf("token request form = %v", r.PostForm)
+				}
+				return stubResponse(tt.status, tt.body), nil
+			})
+
+			err := verifyOAuthCredentials(context.Background(), oauthApp{clientID: defaultClientID, clientSecret: tt.secret})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyOAuthCredentials() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyOAuthCredentials() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
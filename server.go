@@ -0,0 +1,307 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings newServer wires into the handler. Settings validated by
+// applyConfig (OAuth apps, proxies, templates, CSP) are read from their globals.
+type Config struct {
+	// OAuthClient, APIClient, and AvatarClient replace the outbound GitHub clients; nil
+	// keeps the current ones.
+	OAuthClient  *http.Client
+	APIClient    *http.Client
+	AvatarClient *http.Client
+
+	// Retry sets the backoff for outbound GitHub calls; zero keeps the current settings.
+	Retry retryConfig
+
+	// GitHubConcurrency caps outbound GitHub calls in flight; a call waits up to
+	// GitHubQueueTimeout for a slot. Zero is unlimited.
+	GitHubConcurrency  int
+	GitHubQueueTimeout time.Duration
+
+	// BuildTime pins the cache-busting build timestamp; zero keeps the process start time.
+	BuildTime time.Time
+
+	RateLimitRequests int
+	RateLimitWindow   time.Duration
+	UserCacheTTL      time.Duration
+	RequestTimeout    time.Duration
+	MaxConcurrent     int
+	MaxHeaders        int
+	CompressMinSize   int
+
+	// ReuseAlertThreshold reuse attempts within ReuseAlertWindow trigger an alert, also
+	// posted to ReuseAlertWebhook when set; zero disables alerting.
+	ReuseAlertThreshold int
+	ReuseAlertWindow    time.Duration
+	ReuseAlertWebhook   string
+
+	// AvatarProxy serves GitHub avatars at /avatar, cached for AvatarCacheTTL (zero
+	// fetches every request).
+	AvatarProxy    bool
+	AvatarCacheTTL time.Duration
+
+	// Maintenance starts the server answering everything but /health with 503.
+	Maintenance bool
+
+	// DevDir serves static files from this directory on disk, re-read per request; empty
+	// serves the embedded assets.
+	DevDir string
+}
+
+// configFromFlags returns the Config described by the command line.
+func configFromFlags() Config {
+	cfg := Config{
+		OAuthClient:       newGitHubClient(*maxRedirects),
+		APIClient:         newGitHubClient(*maxRedirects),
+		AvatarClient:      newAvatarClient(),
+		RateLimitRequests: *rateLimitReqs,
+		RateLimitWindow:   *rateLimitWin,
+		UserCacheTTL:      *userCacheTTL,
+		RequestTimeout:    *requestTimeout,
+		MaxConcurrent:     *maxConcurrent,
+		MaxHeaders:        *maxHeaders,
+		CompressMinSize:   *compressMin,
+		Maintenance:       *maintenanceOn,
+		AvatarProxy:       *avatarProxy,
+		AvatarCacheTTL:    *avatarTTL,
+
+		GitHubConcurrency:  *githubMaxCalls,
+		GitHubQueueTimeout: *ghQueueTimeout,
+
+		ReuseAlertThreshold: *reuseAlertMax,
+		ReuseAlertWindow:    *reuseAlertWin,
+		ReuseAlertWebhook:   *reuseAlertURL,
+	}
+	cfg.Retry = retryConfig{
+		Attempts:  uint(*retryAttempts), //nolint:gosec // applyConfig rejects values below 1
+		BaseDelay: *retryDelay,
+		MaxDelay:  *retryMaxDelay,
+		MaxJitter: *retryJitter,
+	}
+	if *devMode {
+		cfg.DevDir = *devDir
+	}
+	return cfg
+}
+
+// newServer assembles the routes and middleware. Handlers share package state, so this
+// (re)initializes the rate limiter, caches, and CSRF protection; tests can call it
+// in-process with stub clients instead of starting the binary.
+func newServer(cfg Config) http.Handler {
+	if cfg.OAuthClient != nil {
+		oauthClient = cfg.OAuthClient
+	}
+	if cfg.APIClient != nil {
+		apiClient = cfg.APIClient
+	}
+	if cfg.AvatarClient != nil {
+		avatarClient = cfg.AvatarClient
+	}
+	if cfg.Retry != (retryConfig{}) {
+		githubRetry = cfg.Retry
+	}
+	githubCalls = newCallLimiter(cfg.GitHubConcurrency, cfg.GitHubQueueTimeout)
+	if !cfg.BuildTime.IsZero() {
+		buildTime = cfg.BuildTime.Truncate(time.Second)
+		buildTimestamp = strconv.FormatInt(buildTime.Unix(), 10)
+		htmlPages = loadHTMLPages()
+	}
+
+	// Initialize rate limiter for auth code exchange (strict: 10 attempts per minute per IP by default)
+	exchangeRateLimiter = &rateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    cfg.RateLimitRequests,
+		window:   cfg.RateLimitWindow,
+	}
+
+	validateRateLimiter = &rateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    validatesPerMinute,
+		window:   time.Minute,
+	}
+
+	devicePollRateLimiter = &rateLimiter{
+		requests: make(map[string][]time.Time),
+		limit:    devicePollsPerMinute,
+		window:   time.Minute,
+	}
+
+	devAssetDir = cfg.DevDir
+	compressMinSize = cfg.CompressMinSize
+	authCodeReuseAlert = nil
+	if cfg.ReuseAlertThreshold > 0 {
+		authCodeReuseAlert = &reuseAlert{
+			threshold: cfg.ReuseAlertThreshold,
+			window:    cfg.ReuseAlertWindow,
+			fire:      reuseAlertHook(cfg.ReuseAlertWebhook, cfg.ReuseAlertWindow),
+		}
+	}
+	maintenance.Store(cfg.Maintenance)
+	userInfoCache = newUserCache(cfg.UserCacheTTL)
+	invalidTokens = newInvalidTokenCache(invalidTokenTTL)
+
+	protection, err := newCSRFProtection()
+	if err != nil {
+		// The trusted origins are fixed and checked by applyConfig, so this is a programming error
+		panic("failed to configure CSRF protection: " + err.Error())
+	}
+	csrfProtection = protection
+
+	// Set up routes
+	mux := http.NewServeMux()
+
+	// Routes that wait on GitHub get a deadline on their request context; the rest
+	// answer from memory and aren't worth the wrapping
+	deadline := func(h http.Handler) http.Handler { return requestDeadline(h, cfg.RequestTimeout) }
+
+	// OAuth endpoints
+	// Register API endpoints before catch-all to ensure they match first
+	// Auth code exchange has rate limiting + CSRF protection (Go 1.25 CrossOriginProtection)
+	// Exchange, user, and validate are called cross-subdomain by the SPA, so they answer CORS preflights
+	// allowMethods answers OPTIONS and wrong methods before CSRF checks or rate limiting
+	// Browsers without Fetch Metadata must also echo the /oauth/csrf token on exchange
+	mux.Handle("/oauth/exchange", apiCORS(allowMethods(csrfProtect(requireCSRFToken(exchangeRateLimiter.limitHandler(handleExchangeAuthCode))), http.MethodPost)))
+	mux.Handle("/oauth/csrf", allowMethods(http.HandlerFunc(handleCSRFToken), http.MethodGet))
+	mux.Handle("/oauth/login", allowMethods(http.HandlerFunc(handleOAuthLogin), http.MethodGet))
+	mux.Handle("/oauth/callback", deadline(allowMethods(http.HandlerFunc(handleOAuthCallback), http.MethodGet)))
+	mux.Handle("/oauth/user", deadline(apiCORS(allowMethods(http.HandlerFunc(handleGetUser), http.MethodGet))))
+	mux.Handle("/oauth/validate", deadline(apiCORS(allowMethods(validateRateLimiter.limitHandler(handleValidateToken), http.MethodGet))))
+	mux.Handle("/oauth/rate-limit", deadline(apiCORS(allowMethods(http.HandlerFunc(handleTokenRateLimit), http.MethodGet))))
+	mux.Handle("/oauth/org-membership", deadline(allowMethods(http.HandlerFunc(handleCheckOrgMembership), http.MethodGet)))
+	mux.Handle("/oauth/session", allowMethods(csrfProtect(http.HandlerFunc(handleSession)), http.MethodGet, http.MethodDelete))
+	mux.Handle("/oauth/clear", allowMethods(csrfProtect(http.HandlerFunc(handleClearCookies)), http.MethodPost))
+	mux.Handle("/oauth/refresh", deadline(allowMethods(csrfProtect(exchangeRateLimiter.limitHandler(handleRefreshToken)), http.MethodPost)))
+	// Device flow for CLI clients; polling is throttled per device code and per IP
+	mux.Handle("/oauth/device/code", deadline(allowMethods(csrfProtect(exchangeRateLimiter.limitHandler(handleDeviceCode)), http.MethodPost)))
+	mux.Handle("/oauth/device/token", deadline(allowMethods(csrfProtect(devicePollRateLimiter.limitHandler(handleDevicePoll)), http.MethodPost)))
+
+	// Health check endpoint
+	mux.Handle("/health", allowMethods(http.HandlerFunc(handleHealthCheck), http.MethodGet))
+	mux.Handle("/readyz", allowMethods(http.HandlerFunc(handleReadyz), http.MethodGet))
+	mux.Handle("/version", allowMethods(http.HandlerFunc(handleVersion), http.MethodGet))
+	mux.Handle(securityTxtPath, allowMethods(http.HandlerFunc(handleSecurityTxt), http.MethodGet, http.MethodHead))
+
+	// GitHub App webhook events, verified against the webhook secret
+	mux.Handle("/webhook", allowMethods(http.HandlerFunc(handleWebhook), http.MethodPost))
+
+	// CSP violation reports, only when the policy asks browsers to send them
+	cspReportLimiter = nil
+	if csp.ReportURI != "" {
+		cspReportLimiter = &rateLimiter{
+			requests: make(map[string][]time.Time),
+			limit:    cspReportsPerMinute,
+			window:   time.Minute,
+		}
+		mux.Handle(cspReportPath, allowMethods(cspReportLimiter.limitHandler(handleCSPReport), http.MethodPost))
+	}
+
+	// Same-origin avatars for networks that block GitHub's avatar CDN
+	avatars, avatarRateLimiter = nil, nil
+	if cfg.AvatarProxy {
+		avatars = newAvatarCache(cfg.AvatarCacheTTL)
+		avatarRateLimiter = &rateLimiter{
+			requests: make(map[string][]time.Time),
+			limit:    avatarsPerMinute,
+			window:   time.Minute,
+		}
+		mux.Handle("/avatar", deadline(allowMethods(avatarRateLimiter.limitHandler(handleAvatar), http.MethodGet, http.MethodHead)))
+	}
+
+	// Operator diagnostics, behind --admin-token
+	mux.Handle("/debug/oauth-selftest", deadline(allowMethods(requireAdmin(handleOAuthSelftest), http.MethodGet)))
+	mux.Handle("/debug/revoke-token", allowMethods(requireAdmin(handleRevokeToken), http.MethodPost))
+
+	// Serve everything else as SPA (including assets)
+	// This MUST be registered last as it's a catch-all
+	mux.HandleFunc("/", serveStaticFiles)
+
+	// Wrap with security middleware. The load limiters sit inside securityHeaders so their
+	// 503 and 431 answers carry the same headers and request ID as any other response.
+	return traceRequests(requestLogger(requestSizeLimiter(securityHeaders(concurrencyLimiter(headerCountLimiter(maintenanceMode(userAgentFilter(trailingSlashRedirect(mux))), cfg.MaxHeaders), cfg.MaxConcurrent)))))
+}
+
+// newHTTPServer configures the public listener's connection timeouts and protocols from flags.
+// ReadHeaderTimeout is kept shorter than ReadTimeout so a client trickling headers
+// (slowloris) is cut off quickly instead of holding the connection for the full read window.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	write := *writeTimeout
+	if write == 0 {
+		write = *requestTimeout + 5*time.Second // Leave time to write the 503 from requestDeadline
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *headerTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      write,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    maxHeaderSize,
+	}
+	if *enableH2C {
+		// net/http serves h2c itself, so x/net/http2/h2c isn't needed. Only prior-knowledge
+		// connections are accepted; the deprecated Upgrade: h2c handshake is not.
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// trailingSlashRedirect sends /oauth/login/ and the like to the route without the slash,
+// instead of letting them fall through to the SPA catch-all. Only paths whose trimmed
+// form is an exact registered route are redirected, so asset directories are untouched.
+// GET and HEAD get a 301; other methods get a 308 so the method and body are kept.
+func trailingSlashRedirect(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) > 1 && strings.HasSuffix(path, "/") {
+			trimmed := strings.TrimRight(path, "/")
+			probe := r.Clone(r.Context())
+			probe.URL.Path, probe.URL.RawPath = trimmed, ""
+			if _, pattern := mux.Handler(probe); pattern == trimmed {
+				target := trimmed
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				code := http.StatusMovedPermanently
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					code = http.StatusPermanentRedirect
+				}
+				http.Redirect(w, r, target, code)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods answers OPTIONS with 204 and other methods outside methods with a JSON 405,
+// both carrying an Allow header, so clients can discover what a route supports.
+// Behind apiCORS it also narrows Access-Control-Allow-Methods to the route's methods.
+func allowMethods(next http.Handler, methods ...string) http.Handler {
+	allow := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", allow)
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer builds the full handler in-process, restoring the package state
+// newServer replaces when the test ends.
+func newTestServer(t *testing.T, cfg Config) http.Handler {
+	t.Helper()
+	origOAuth, origAPI, origAvatar, origAvatars := oauthClient, apiClient, avatarClient, avatars
+	origBuildTime, origTimestamp, origPages, origDevDir := buildTime, buildTimestamp, htmlPages, devAssetDir
+	origLimiter, origUsers, origInvalid, origCSRF := exchangeRateLimiter, userInfoCache, invalidTokens, csrfProtection
+	origCompress, origCalls, origAvatarLimiter, origValidate := compressMinSize, githubCalls, avatarRateLimiter, validateRateLimiter
+	origDevicePoll := devicePollRateLimiter
+	t.Cleanup(func() {
+		compressMinSize, githubCalls, avatarRateLimiter, validateRateLimiter = origCompress, origCalls, origAvatarLimiter, origValidate
+		devicePollRateLimiter = origDevicePoll
+		oauthClient, apiClient, avatarClient, avatars = origOAuth, origAPI, origAvatar, origAvatars
+		buildTime, buildTimestamp, htmlPages, devAssetDir = origBuildTime, origTimestamp, origPages, origDevDir
+		exchangeRateLimiter, userInfoCache, invalidTokens, csrfProtection = origLimiter, origUsers, origInvalid, origCSRF
+	})
+
+	if cfg.RateLimitRequests == 0 {
+		cfg.RateLimitRequests = defaultRateLimitRequests
+		cfg.RateLimitWindow = defaultRateLimitWindow
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.CompressMinSize == 0 {
+		cfg.CompressMinSize = defaultCompressMinSize
+	}
+	return newServer(cfg)
+}
+
+func TestNewServerSmoke(t *testing.T) {
+	stub := &http.Client{Transport: roundTripFunc(func(_ *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusInternalServerError, ""), nil
+	})}
+	built := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := newTestServer(t, Config{OAuthClient: stub, APIClient: stub, BuildTime: built})
+	if oauthClient != stub || apiClient != stub {
+		t.Fatal("newServer did not install the injected GitHub clients")
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/health status = %d, want 200", rr.Code)
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil || health.Status != "healthy" {
+		t.Errorf("/health body = %q (err %v)", rr.Body.String(), err)
+	}
+	// Served through the middleware stack, not just the handler
+	if rr.Header().Get("X-Request-ID") == "" || rr.Header().Get("Content-Security-Policy") == "" {
+		t.Error("/health response is missing security middleware headers")
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "https://my."+baseDomain+"/", http.NoBody))
+	body, err := io.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "?v=1735787045"; !strings.Contains(string(body), want) {
+		t.Errorf("index.html not templated with the pinned build time %s", want)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		host, port string
+		wantErr    bool
+	}{
+		{host: "", port: "8080"},
+		{host: "127.0.0.1", port: "8080"},
+		{host: "::1", port: "8080"},
+		{host: "[::1]", port: "8080"},
+		{host: "localhost", port: "8080", wantErr: true},
+		{host: "127.0.0.300", port: "8080", wantErr: true},
+		{host: "127.0.0.1", port: "http", wantErr: true},
+		{host: "127.0.0.1", port: "70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateListenAddr(tt.host, tt.port); (err != nil) != tt.wantErr {
+			t.Errorf("validateListenAddr(%q, %q) error = %v, wantErr %v", tt.host, tt.port, err, tt.wantErr)
+		}
+	}
+
+	// A loopback-only bind accepts connections on that address
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", "0"))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := &http.Server{Handler: newTestServer(t, Config{}), ReadHeaderTimeout: time.Second}
+	go func() { _ = srv.Serve(ln) }() //nolint:errcheck // closed below
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("failed to close server: %v", err)
+		}
+	})
+
+	if host, _, _ := net.SplitHostPort(ln.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("bound to %s, want 127.0.0.1", host)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("GET /health on loopback bind: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("failed to close body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	handler := newTestServer(t, Config{})
+
+	routes := []string{
+		"/oauth/exchange", "/oauth/login", "/oauth/callback", "/oauth/user", "/oauth/validate",
+		"/oauth/org-membership", "/oauth/session", "/oauth/refresh", "/oauth/device/code",
+		"/oauth/device/token", "/oauth/csrf", "/webhook", "/health", "/version", "/debug/oauth-selftest",
+	}
+	for _, route := range routes {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, route+"/?a=1", http.NoBody))
+		if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != route+"?a=1" {
+			t.Errorf("GET %s/: status %d, Location %q; want 301 to %s?a=1", route, rr.Code, rr.Header().Get("Location"), route)
+		}
+
+		// Without the slash the route's own handler answers
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, route, http.NoBody))
+		if rr.Code == http.StatusMovedPermanently {
+			t.Errorf("GET %s redirected to %q", route, rr.Header().Get("Location"))
+		}
+	}
+
+	// Other methods keep their method and body across the redirect
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/oauth/exchange/", strings.NewReader(`{}`)))
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Location") != "/oauth/exchange" {
+		t.Errorf("POST /oauth/exchange/: status %d, Location %q; want 308", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Directory-like paths that aren't routes are left to the static handler
+	for _, path := range []string{"/", "/assets/", "/oauth/", "/login/"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+path, http.NoBody))
+		if rr.Code == http.StatusMovedPermanently || rr.Code == http.StatusPermanentRedirect {
+			t.Errorf("GET %s redirected to %q", path, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAllowHeader(t *testing.T) {
+	handler := newTestServer(t, Config{})
+
+	routes := map[string]string{
+		"/oauth/exchange":       "POST, OPTIONS",
+		"/oauth/csrf":           "GET, OPTIONS",
+		"/oauth/login":          "GET, OPTIONS",
+		"/oauth/callback":       "GET, OPTIONS",
+		"/oauth/user":           "GET, OPTIONS",
+		"/oauth/validate":       "GET, OPTIONS",
+		"/oauth/rate-limit":     "GET, OPTIONS",
+		"/oauth/org-membership": "GET, OPTIONS",
+		"/oauth/session":        "GET, DELETE, OPTIONS",
+		"/oauth/refresh":        "POST, OPTIONS",
+		"/oauth/device/code":    "POST, OPTIONS",
+		"/oauth/device/token":   "POST, OPTIONS",
+		"/webhook":              "POST, OPTIONS",
+		"/health":               "GET, OPTIONS",
+		"/version":              "GET, OPTIONS",
+		"/debug/oauth-selftest": "GET, OPTIONS",
+		"/debug/revoke-token":   "POST, OPTIONS",
+		securityTxtPath:         "GET, HEAD, OPTIONS",
+		"/assets/app.js":        "GET, HEAD, OPTIONS",
+	}
+	for route, want := range routes {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, "http://my."+baseDomain+route, http.NoBody))
+		if rr.Code != http.StatusNoContent && rr.Code != http.StatusOK {
+			t.Errorf("OPTIONS %s status = %d, want 204", route, rr.Code)
+		}
+		if got := rr.Header().Get("Allow"); got != want {
+			t.Errorf("OPTIONS %s Allow = %q, want %q", route, got, want)
+		}
+
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "http://my."+baseDomain+route, http.NoBody))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("PUT %s status = %d, want 405", route, rr.Code)
+		}
+		if got := rr.Header().Get("Allow"); got != want {
+			t.Errorf("PUT %s Allow = %q, want %q", route, got, want)
+		}
+	}
+
+	// Cross-subdomain preflights advertise only the route's methods
+	req := httptest.NewRequest(http.MethodOptions, "/oauth/user", http.NoBody)
+	req.Header.Set("Origin", "https://my."+baseDomain)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Allow-Methods"); got != "GET, OPTIONS" {
+		t.Errorf("/oauth/user Access-Control-Allow-Methods = %q, want GET, OPTIONS", got)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h2cClient := func() *http.Client {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		return &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 5 * time.Second}
+	}
+	start := func(t *testing.T, enabled bool) string {
+		t.Helper()
+		orig := *enableH2C
+		*enableH2C = enabled
+		t.Cleanup(func() { *enableH2C = orig })
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		srv := newHTTPServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.Proto) //nolint:errcheck // test handler
+		}))
+		//nolint:errcheck // Serve returns ErrServerClosed once the test closes it
+		go srv.Serve(ln)
+		t.Cleanup(func() { _ = srv.Close() }) //nolint:errcheck // test cleanup
+		return "http://" + ln.Addr().String() + "/"
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		url := start(t, true)
+		resp, err := h2cClient().Get(url)
+		if err != nil {
+			t.Fatalf("h2c request failed: %v", err)
+		}
+		defer resp.Body.Close() //nolint:errcheck // test cleanup
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body: %v", err)
+		}
+		if resp.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+			t.Errorf("negotiated %s, handler saw %s; want HTTP/2.0", resp.Proto, body)
+		}
+
+		// HTTP/1.1 clients keep working
+		resp, err = http.Get(url)
+		if err != nil {
+			t.Fatalf("HTTP/1.1 request failed: %v", err)
+		}
+		_ = resp.Body.Close() //nolint:errcheck // test cleanup
+		if resp.Proto != "HTTP/1.1" {
+			t.Errorf("plain client negotiated %s, want HTTP/1.1", resp.Proto)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		resp, err := h2cClient().Get(start(t, false))
+		if err == nil {
+			_ = resp.Body.Close() //nolint:errcheck // test cleanup
+			t.Errorf("h2c request succeeded with %s, want it refused", resp.Proto)
+		}
+	})
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	origHeader, origRead := *headerTimeout, *readTimeout
+	*headerTimeout, *readTimeout = 100*time.Millisecond, 10*time.Second
+	t.Cleanup(func() { *headerTimeout, *readTimeout = origHeader, origRead })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := newHTTPServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	if srv.ReadHeaderTimeout != 100*time.Millisecond || srv.ReadTimeout != 10*time.Second {
+		t.Errorf("timeouts = %v header, %v read; want the flag values", srv.ReadHeaderTimeout, srv.ReadTimeout)
+	}
+	//nolint:errcheck // Serve returns ErrServerClosed once the test closes it
+	go srv.Serve(ln)
+	t.Cleanup(func() { _ = srv.Close() }) //nolint:errcheck // test cleanup
+
+	// A slowloris client sends part of the headers and then stalls
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // test cleanup
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// The server drops it after the header timeout, long before the read timeout
+	start := time.Now()
+	if err := conn.SetReadDeadline(start.Add(5 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	_, err = io.ReadAll(conn)
+	if elapsed := time.Since(start); err != nil || elapsed > 2*time.Second {
+		t.Errorf("slow-header connection closed after %v (err %v), want about 100ms", elapsed, err)
+	}
+}
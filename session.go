@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session modes select how the OAuth callback hands the token to the frontend.
+const (
+	// sessionModeFragment passes a one-time auth code in the URL fragment for /oauth/exchange.
+	sessionModeFragment = "fragment"
+	// sessionModeCookie sets an HttpOnly cookie holding an opaque session ID for /oauth/session.
+	sessionModeCookie = "cookie"
+	// sessionModeTokenCookie works like fragment mode, but /oauth/exchange puts the token in an
+	// HttpOnly cookie instead of the response, so it is never visible to JavaScript.
+	sessionModeTokenCookie = "token-cookie"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionTTL        = 8 * time.Hour
+
+	// The __Host- prefix makes browsers insist on Secure, Path=/, and no Domain, so
+	// both cookies stay scoped to the workspace subdomain that exchanged the code.
+	tokenCookieName = "__Host-token"
+	csrfCookieName  = "__Host-csrf"
+	csrfHeaderName  = "X-CSRF-Token"
+)
+
+// How /oauth/exchange hands over the token, chosen with its ?cookie= parameter.
+const (
+	tokenDeliveryJSON   = "json" // in the response body (default)
+	tokenDeliveryBoth   = "also" // in the body and the HttpOnly token cookie
+	tokenDeliveryCookie = "only" // only in the HttpOnly token cookie
+)
+
+// exchangeTokenDelivery picks the token delivery for an exchange request. Token-cookie
+// mode always uses the cookie alone, so a client can't ask for the token in the body.
+func exchangeTokenDelivery(r *http.Request) (string, error) {
+	if *sessionMode == sessionModeTokenCookie {
+		return tokenDeliveryCookie, nil
+	}
+	switch mode := r.URL.Query().Get("cookie"); mode {
+	case "":
+		return tokenDeliveryJSON, nil
+	case tokenDeliveryBoth, tokenDeliveryCookie:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("cookie must be %q or %q", tokenDeliveryBoth, tokenDeliveryCookie)
+	}
+}
+
+// validateSessionMode checks the --session-mode flag.
+func validateSessionMode(mode string) error {
+	switch mode {
+	case sessionModeFragment, sessionModeCookie, sessionModeTokenCookie:
+		return nil
+	default:
+		return fmt.Errorf("must be %q, %q, or %q, got %q", sessionModeFragment, sessionModeCookie, sessionModeTokenCookie, mode)
+	}
+}
+
+// sessionData maps a session ID to the user's token, sealed like auth codes so raw
+// tokens never sit in memory longer than needed.
+type sessionData struct {
+	expiry        time.Time
+	sealedToken   []byte
+	sealedRefresh []byte
+	username      string
+}
+
+// sessionStore holds cookie-mode sessions.
+type sessionStore struct {
+	entries map[string]sessionData
+	mu      sync.Mutex
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{entries: make(map[string]sessionData)}
+}
+
+// create stores a session and returns its ID.
+func (s *sessionStore) create(data sessionData) (string, error) {
+	id, err := generateIDE(32)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.entries[id] = data
+	s.mu.Unlock()
+	return id, nil
+}
+
+// get returns the session for id if it exists and hasn't expired.
+func (s *sessionStore) get(id string, now time.Time) (sessionData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.entries[id]
+	if !ok || now.After(data.expiry) {
+		return sessionData{}, false
+	}
+	return data, true
+}
+
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	delete(s.entries, id)
+	s.mu.Unlock()
+}
+
+// cleanup removes expired sessions.
+func (s *sessionStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, data := range s.entries {
+		if now.After(data.expiry) {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// sessionCookieDomain scopes the cookie to baseDomain when serving it or a subdomain,
+// so a session started on the auth host is visible to the user's workspace subdomain.
+func sessionCookieDomain(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	base := strings.ToLower(baseDomain)
+	if host == base || strings.HasSuffix(host, "."+base) {
+		return base
+	}
+	return ""
+}
+
+// setSessionCookie sets (or with an empty id, clears) the session cookie.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		Domain:   sessionCookieDomain(requestHost(r)),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setTokenCookies stores token in an HttpOnly cookie, alongside a random CSRF token the
+// SPA can read and echo in X-CSRF-Token (double-submit), since a cookie alone would
+// authenticate any request the browser sends.
+func setTokenCookies(w http.ResponseWriter, token string) error {
+	csrf, err := generateIDE(32)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	setCSRFCookie(w, csrf)
+	return nil
+}
+
+// clearAuthCookies expires every cookie the OAuth flow sets on this host: the login
+// state and return_to, the session cookie (ending its server-side session too), and
+// the token and CSRF cookies.
+func clearAuthCookies(w http.ResponseWriter, r *http.Request) {
+	clearStateCookie(w)
+	clearReturnToCookie(w)
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		sessions.remove(cookie.Value)
+	}
+	setSessionCookie(w, r, "", -1)
+
+	for _, name := range []string{tokenCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == tokenCookieName,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+// handleClearCookies gives the SPA a clean slate when stale OAuth cookies keep a login
+// from succeeding.
+func handleClearCookies(w http.ResponseWriter, r *http.Request) {
+	clearAuthCookies(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write([]byte(`{"status":"cleared"}` + "\n")); err != nil {
+		errorf("Failed to write clear cookies response: %v", err)
+	}
+}
+
+// userToken returns the caller's GitHub token from the Authorization header or, failing
+// that, the token cookie. Cookie-authenticated requests must echo the CSRF cookie in
+// X-CSRF-Token. It writes a 401 or 403 and returns false when neither is usable or the token is revoked.
+func userToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(tokenCookieName)
+	if r.Header.Get("Authorization") != "" || err != nil || cookie.Value == "" {
+		return bearerToken(w, r)
+	}
+
+	if !validCSRFToken(r) {
+		warnf("[SECURITY] CSRF token mismatch on cookie-authenticated request from %s", clientIP(r))
+		writeJSONError(w, http.StatusForbidden, errCodeInvalidCSRFToken, "Invalid CSRF token")
+		return "", false
+	}
+	if rejectRevoked(w, r, cookie.Value) {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// handleSession returns the token for the caller's session cookie (GET), or ends the session (DELETE).
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Never let an intermediary cache a response carrying a token
+	w.Header().Set("Cache-Control", "no-store")
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		writeJSONError(w, http.StatusUnauthorized, errCodeNoSession, "No session")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		sessions.remove(cookie.Value)
+		setSessionCookie(w, r, "", -1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, ok := sessions.get(cookie.Value, time.Now())
+	if !ok {
+		setSessionCookie(w, r, "", -1)
+		writeJSONError(w, http.StatusUnauthorized, errCodeSessionExpired, "Session expired")
+		return
+	}
+
+	token, err := openToken(data.sealedToken)
+	if err != nil {
+		errorf("Failed to decrypt token for session: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Authentication failed")
+		return
+	}
+	if rejectRevoked(w, r, token) {
+		sessions.remove(cookie.Value)
+		setSessionCookie(w, r, "", -1)
+		return
+	}
+	var refreshToken string
+	if data.sealedRefresh != nil {
+		if refreshToken, err = openToken(data.sealedRefresh); err != nil {
+			errorf("Failed to decrypt refresh token for session: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeServerError, "Authentication failed")
+			return
+		}
+	}
+
+	response := struct {
+		ExpiresAt    time.Time `json:"expires_at"`
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token,omitempty"`
+		Username     string    `json:"username"`
+	}{
+		ExpiresAt:    data.expiry,
+		Token:        token,
+		RefreshToken: refreshToken,
+		Username:     data.username,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		errorf("Failed to encode session response: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCookieMode(t *testing.T) {
+	resetFailedAttempts(t)
+	setString(t, sessionMode, sessionModeCookie)
+
+	rr := runOAuthCallback(t)
+	if loc := rr.Header().Get("Location"); strings.Contains(loc, "auth_code") {
+		t.Errorf("cookie mode redirect carries an auth code: %q", loc)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("callback did not set a session cookie")
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.Domain != strings.ToLower(baseDomain) {
+		t.Errorf("cookie = %+v, want HttpOnly, Secure, Domain=%s", cookie, baseDomain)
+	}
+	if strings.Contains(cookie.Value, testToken) {
+		t.Error("cookie holds the raw token")
+	}
+
+	getSession := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://my."+baseDomain+"/oauth/session", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: cookie.Value})
+		rr := httptest.NewRecorder()
+		handleSession(rr, req)
+		return rr
+	}
+
+	rr = getSession()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("session status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Token    string `json:"token"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid session response: %v", err)
+	}
+	if resp.Token != testToken || resp.Username != "octocat" {
+		t.Errorf("session = %+v, want token for octocat", resp)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+
+	// The session stays usable until it expires
+	if rr := getSession(); rr.Code != http.StatusOK {
+		t.Errorf("repeat session status = %d, want 200", rr.Code)
+	}
+
+	sessions.mu.Lock()
+	data := sessions.entries[cookie.Value]
+	data.expiry = time.Now().Add(-time.Second)
+	sessions.entries[cookie.Value] = data
+	sessions.mu.Unlock()
+
+	if rr := getSession(); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expired session status = %d, want 401", rr.Code)
+	}
+	sessions.cleanup(time.Now())
+	if _, ok := sessions.get(cookie.Value, time.Now()); ok {
+		t.Error("expired session survived cleanup")
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	id, err := sessions.create(sessionData{sealedToken: []byte("x"), expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/oauth/session", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: id})
+	rr := httptest.NewRecorder()
+	handleSession(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("logout status = %d, want 204", rr.Code)
+	}
+	if _, ok := sessions.get(id, time.Now()); ok {
+		t.Error("session still valid after logout")
+	}
+
+	rr = httptest.NewRecorder()
+	handleSession(rr, httptest.NewRequest(http.MethodGet, "/oauth/session", http.NoBody))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("no-cookie status = %d, want 401", rr.Code)
+	}
+}
+
+func TestTokenCookieMode(t *testing.T) {
+	resetFailedAttempts(t)
+	setString(t, sessionMode, sessionModeTokenCookie)
+	origCache := userInfoCache
+	userInfoCache = newUserCache(0)
+	t.Cleanup(func() { userInfoCache = origCache })
+
+	code := completeOAuthCallback(t)
+	rr := exchangeAuthCode(code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("exchange status = %d: %s", rr.Code, rr.Body)
+	}
+	if body := rr.Body.String(); strings.Contains(body, testToken) || !strings.Contains(body, `"username":"octocat"`) {
+		t.Errorf("exchange body = %q, want only the username", body)
+	}
+
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range rr.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	token, csrf := cookies[tokenCookieName], cookies[csrfCookieName]
+	if token == nil || csrf == nil {
+		t.Fatalf("exchange set cookies %v, want %s and %s", cookies, tokenCookieName, csrfCookieName)
+	}
+	if token.Value != testToken || !token.HttpOnly || !token.Secure || token.SameSite != http.SameSiteStrictMode || token.Domain != "" {
+		t.Errorf("token cookie = %+v, want HttpOnly, Secure, SameSite=Strict, host-only", token)
+	}
+	if csrf.HttpOnly || !csrf.Secure || csrf.SameSite != http.SameSiteStrictMode || csrf.Value == "" {
+		t.Errorf("CSRF cookie = %+v, want readable, Secure, SameSite=Strict", csrf)
+	}
+
+	getUser := func(csrfHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://my."+baseDomain+"/oauth/user", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: tokenCookieName, Value: token.Value})
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrf.Value})
+		if csrfHeader != "" {
+			req.Header.Set(csrfHeaderName, csrfHeader)
+		}
+		rr := httptest.NewRecorder()
+		handleGetUser(rr, req)
+		return rr
+	}
+
+	if rr := getUser(csrf.Value); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"login":"octocat"`) {
+		t.Errorf("cookie-authenticated /oauth/user = %d %q, want 200 with user", rr.Code, rr.Body)
+	}
+	if rr := getUser(""); rr.Code != http.StatusForbidden {
+		t.Errorf("missing CSRF header status = %d, want 403", rr.Code)
+	}
+	if rr := getUser("forged"); rr.Code != http.StatusForbidden {
+		t.Errorf("mismatched CSRF header status = %d, want 403", rr.Code)
+	}
+
+	// Without either credential the request is unauthenticated
+	rr = httptest.NewRecorder()
+	handleGetUser(rr, httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials status = %d, want 401", rr.Code)
+	}
+}
+
+func TestExchangeCookieDelivery(t *testing.T) {
+	resetFailedAttempts(t)
+
+	exchange := func(query string) *httptest.ResponseRecorder {
+		code := completeOAuthCallback(t)
+		req := httptest.NewRequest(http.MethodPost, "/oauth/exchange"+query, strings.NewReader(`{"auth_code":"`+code+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handleExchangeAuthCode(rr, req)
+		return rr
+	}
+	tokenCookie := func(rr *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == tokenCookieName {
+				return c
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		query      string
+		wantBody   bool
+		wantCookie bool
+	}{
+		{query: "", wantBody: true},
+		{query: "?cookie=also", wantBody: true, wantCookie: true},
+		{query: "?cookie=only", wantCookie: true},
+	}
+	for _, tt := range tests {
+		t.Run("exchange"+tt.query, func(t *testing.T) {
+			rr := exchange(tt.query)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rr.Code, rr.Body)
+			}
+			if got := strings.Contains(rr.Body.String(), testToken); got != tt.wantBody {
+				t.Errorf("token in body = %v, want %v: %s", got, tt.wantBody, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), `"username":"octocat"`) {
+				t.Errorf("body = %s, want the username", rr.Body)
+			}
+			c := tokenCookie(rr)
+			if (c != nil) != tt.wantCookie {
+				t.Fatalf("token cookie = %+v, want set: %v", c, tt.wantCookie)
+			}
+			if c != nil && (c.Value != testToken || !c.HttpOnly || !c.Secure || c.Domain != "") {
+				t.Errorf("token cookie = %+v, want the token, HttpOnly, Secure, host-only", c)
+			}
+		})
+	}
+
+	// An unknown mode is rejected without consuming the code
+	code := completeOAuthCallback(t)
+	req := httptest.NewRequest(http.MethodPost, "/oauth/exchange?cookie=yes", strings.NewReader(`{"auth_code":"`+code+`"}`))
+	rr := httptest.NewRecorder()
+	handleExchangeAuthCode(rr, req)
+	if got := decodeAPIError(t, rr, http.StatusBadRequest); got != "invalid_request" {
+		t.Errorf("error = %q, want invalid_request", got)
+	}
+	if rr := exchangeAuthCode(code); rr.Code != http.StatusOK {
+		t.Errorf("exchange after rejected mode = %d, want the code still usable", rr.Code)
+	}
+
+	// Token-cookie mode never puts the token in the body, whatever the client asks for
+	setString(t, sessionMode, sessionModeTokenCookie)
+	if rr := exchange("?cookie=also"); strings.Contains(rr.Body.String(), testToken) || tokenCookie(rr) == nil {
+		t.Errorf("token-cookie mode exchange = %s, want the token only in the cookie", rr.Body)
+	}
+}
+
+func TestClearAuthCookies(t *testing.T) {
+	id, err := sessions.create(sessionData{sealedToken: []byte("x"), expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "https://my."+baseDomain+"/oauth/clear", http.NoBody)
+	for _, name := range []string{"oauth_state", "oauth_return_to", sessionCookieName, tokenCookieName, csrfCookieName} {
+		value := "stale"
+		if name == sessionCookieName {
+			value = id
+		}
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	rr := httptest.NewRecorder()
+	newTestServer(t, Config{}).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body)
+	}
+	cleared := make(map[string]bool)
+	for _, c := range rr.Result().Cookies() {
+		if c.MaxAge != -1 {
+			t.Errorf("%s MaxAge = %d, want -1", c.Name, c.MaxAge)
+		}
+		cleared[c.Name] = true
+	}
+	for _, name := range []string{"oauth_state", "oauth_return_to", sessionCookieName, tokenCookieName, csrfCookieName} {
+		if !cleared[name] {
+			t.Errorf("%s was not cleared", name)
+		}
+	}
+	if _, ok := sessions.get(id, time.Now()); ok {
+		t.Error("server-side session survived /oauth/clear")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainLogInterval controls how often shutdown reports requests still in flight.
+const drainLogInterval = 5 * time.Second
+
+// exitForcedShutdown is the process exit code when shutdown had to abandon requests,
+// so orchestrators can tell a forced stop from a clean one (exit 0).
+const exitForcedShutdown = 1
+
+// shutdownSummary describes how a shutdown went.
+type shutdownSummary struct {
+	Err      error         // why shutdown was forced; nil when it was clean
+	InFlight int64         // requests in flight when shutdown began
+	Stranded int64         // requests still running when shutdown gave up
+	Elapsed  time.Duration // time spent draining
+}
+
+// Forced reports whether shutdown gave up before everything drained.
+func (s shutdownSummary) Forced() bool {
+	return s.Err != nil
+}
+
+// ExitCode is the process exit code for this shutdown.
+func (s shutdownSummary) ExitCode() int {
+	if s.Forced() {
+		return exitForcedShutdown
+	}
+	return 0
+}
+
+// String formats the summary as key=value pairs for the log.
+func (s shutdownSummary) String() string {
+	return fmt.Sprintf("forced=%t in_flight=%d stranded=%d elapsed=%s exit_code=%d",
+		s.Forced(), s.InFlight, s.Stranded, s.Elapsed.Round(time.Millisecond), s.ExitCode())
+}
+
+// inFlightTracker counts requests in progress so shutdown can report on draining.
+type inFlightTracker struct {
+	wg    sync.WaitGroup
+	count atomic.Int64
+}
+
+// track wraps a handler so each request is counted until it completes.
+func (t *inFlightTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		t.count.Add(1)
+		defer func() {
+			t.count.Add(-1)
+			t.wg.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownServer stops accepting connections and waits for in-flight requests to drain,
+// logging progress periodically until they finish or ctx expires.
+func shutdownServer(ctx context.Context, srv *http.Server, inflight *inFlightTracker) shutdownSummary {
+	start := time.Now()
+	summary := shutdownSummary{InFlight: inflight.count.Load()}
+	log.Printf("Draining %d in-flight requests", summary.InFlight)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(drainLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Printf("Waiting for %d in-flight requests to finish", inflight.count.Load())
+			}
+		}
+	}()
+
+	summary.Err = srv.Shutdown(ctx)
+
+	// Shutdown returns once connections are idle; make sure every handler has returned too.
+	// No new requests are accepted at this point, so waiting on the group is safe.
+	drained := make(chan struct{})
+	go func() {
+		inflight.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Print("All in-flight requests completed")
+	case <-ctx.Done():
+		summary.Stranded = inflight.count.Load()
+		log.Printf("Shutdown timed out with %d requests still in flight", summary.Stranded)
+		if summary.Err == nil {
+			summary.Err = ctx.Err()
+		}
+	}
+
+	summary.Elapsed = time.Since(start)
+	return summary
+}
+
+// backgroundTasks runs the server's long-lived goroutines (cleanup, sweeps, secret
+// refresh, heartbeat) under one context, so shutdown can stop them and wait for them
+// to return.
+type backgroundTasks struct {
+	ctx    context.Context //nolint:containedctx // shared by every task until stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// run starts fn in a goroutine; fn must return once its context is done.
+func (b *backgroundTasks) run(fn func(ctx context.Context)) {
+	b.wg.Go(func() { fn(b.ctx) })
+}
+
+// stop cancels every task and waits for them to return.
+func (b *backgroundTasks) stop() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// runEvery calls fn with the tick time every interval until ctx is done.
+func runEvery(ctx context.Context, interval time.Duration, fn func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			fn(now)
+		}
+	}
+}
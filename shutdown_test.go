@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestShutdownWaitsForInFlight verifies shutdown blocks until a slow handler finishes.
+func TestShutdownWaitsForInFlight(t *testing.T) {
+	var finished atomic.Bool
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		finished.Store(true)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	inflight := &inFlightTracker{}
+	srv := &http.Server{Handler: inflight.track(slow), ReadHeaderTimeout: time.Second}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		_ = srv.Serve(ln) //nolint:errcheck // returns ErrServerClosed on shutdown
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err == nil {
+			_ = resp.Body.Close() //nolint:errcheck // best-effort close
+		}
+	}()
+
+	<-started
+	if got := inflight.count.Load(); got != 1 {
+		t.Errorf("in-flight count = %d, want 1", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	summary := shutdownServer(ctx, srv, inflight)
+	if summary.Forced() || summary.ExitCode() != 0 {
+		t.Fatalf("shutdownServer() = %s, want a clean shutdown", summary)
+	}
+	if summary.InFlight != 1 || summary.Stranded != 0 {
+		t.Errorf("in_flight = %d, stranded = %d, want 1 and 0", summary.InFlight, summary.Stranded)
+	}
+
+	if !finished.Load() {
+		t.Error("shutdown returned before the in-flight request finished")
+	}
+	if got := inflight.count.Load(); got != 0 {
+		t.Errorf("in-flight count after shutdown = %d, want 0", got)
+	}
+}
+
+// TestShutdownForced verifies a shutdown that times out is reported as forced with a non-zero exit code.
+func TestShutdownForced(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	stuck := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	inflight := &inFlightTracker{}
+	srv := &http.Server{Handler: inflight.track(stuck), ReadHeaderTimeout: time.Second}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		_ = srv.Serve(ln) //nolint:errcheck // returns ErrServerClosed on shutdown
+	}()
+	t.Cleanup(func() {
+		close(release)
+		inflight.wg.Wait()
+	})
+
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err == nil {
+			_ = resp.Body.Close() //nolint:errcheck // best-effort close
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	logs := captureLog(t)
+	summary := shutdownServer(ctx, srv, inflight)
+
+	if !summary.Forced() || !errors.Is(summary.Err, context.DeadlineExceeded) {
+		t.Errorf("Err = %v, want a forced shutdown from the deadline", summary.Err)
+	}
+	if summary.ExitCode() != exitForcedShutdown {
+		t.Errorf("ExitCode() = %d, want %d", summary.ExitCode(), exitForcedShutdown)
+	}
+	if summary.InFlight != 1 || summary.Stranded != 1 {
+		t.Errorf("in_flight = %d, stranded = %d, want 1 and 1", summary.InFlight, summary.Stranded)
+	}
+	if got := summary.String(); !strings.Contains(got, "forced=true in_flight=1 stranded=1") || !strings.Contains(got, "exit_code=1") {
+		t.Errorf("summary = %q", got)
+	}
+	if !strings.Contains(logs.String(), "Shutdown timed out with 1 requests still in flight") {
+		t.Errorf("log = %q, want the timeout reported", logs)
+	}
+}
+
+// TestBackgroundTasksStop verifies stop cancels periodic goroutines and waits for them.
+func TestBackgroundTasksStop(t *testing.T) {
+	background := newBackgroundTasks()
+
+	var ticks atomic.Int32
+	var exited atomic.Int32
+	ticked := make(chan struct{}, 1)
+	for range 2 {
+		background.run(func(ctx context.Context) {
+			defer exited.Add(1)
+			runEvery(ctx, time.Millisecond, func(time.Time) {
+				ticks.Add(1)
+				select {
+				case ticked <- struct{}{}:
+				default:
+				}
+			})
+		})
+	}
+	background.run(func(ctx context.Context) {
+		defer exited.Add(1)
+		watchMaintenanceSignal(ctx)
+	})
+	<-ticked
+
+	stopped := make(chan struct{})
+	go func() {
+		background.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop() did not return after cancel")
+	}
+	if got := exited.Load(); got != 3 {
+		t.Errorf("%d tasks exited, want 3", got)
+	}
+
+	// Nothing ticks once stop has returned
+	after := ticks.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := ticks.Load(); got != after {
+		t.Errorf("ticks went from %d to %d after stop", after, got)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// staticAsset is an embedded file with its precomputed compressed variants and validator.
+type staticAsset struct {
+	etag string // strong ETag of data; empty for templated content
+	data []byte
+	gzip []byte // nil when the type is already compressed or gzip doesn't shrink it
+	br   []byte // likewise for Brotli
+}
+
+// rootAssets maps the well-known paths browsers request at the site root to their
+// embedded files, so icons and the manifest resolve without an HTML <link> to follow.
+var rootAssets = map[string]string{
+	"favicon.ico":          "assets/favicon.ico",
+	"apple-touch-icon.png": "assets/apple-touch-icon.png",
+	"site.webmanifest":     "assets/site.webmanifest",
+}
+
+// staticAssets holds every embedded file, precompressed once at startup to avoid per-request cost.
+var staticAssets = loadStaticAssets()
+
+// loadStaticAssets reads all embedded files and precomputes compressed variants for text-based types.
+func loadStaticAssets() map[string]staticAsset {
+	assets := make(map[string]staticAsset)
+	err := fs.WalkDir(staticFiles, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := staticFiles.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		assets[path] = newStaticAsset(path, data)
+		return nil
+	})
+	if err != nil {
+		// The embedded FS is compiled in, so this can only be a programming error
+		panic("failed to load embedded assets: " + err.Error())
+	}
+	return assets
+}
+
+// newStaticAsset computes the ETag and, for text-based types, the compressed variants of data.
+func newStaticAsset(path string, data []byte) staticAsset {
+	sum := sha256.Sum256(data)
+	asset := staticAsset{data: data, etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+	if compressible(path) {
+		asset.gzip = gzipBytes(data)
+		asset.br = brotliBytes(data, brotliStartupLevel)
+	}
+	return asset
+}
+
+// devAssetDir is the --dev directory static files are read from on every request, so
+// edits show up on reload without a rebuild. Empty (the default) serves the embedded copies.
+var devAssetDir string
+
+// devServable reports whether path is one of the files production embeds: the two HTML
+// pages and anything under assets/, which includes every rootAssets target. The dev
+// directory is usually the checkout, so anything else (source, .git, config) stays private.
+func devServable(path string) bool {
+	return path == "index.html" || path == "404.html" || strings.HasPrefix(path, "assets/")
+}
+
+// lookupAsset returns the static file at path, from devAssetDir in dev mode.
+func lookupAsset(path string) (staticAsset, bool) {
+	if devAssetDir == "" {
+		asset, ok := staticAssets[path]
+		return asset, ok
+	}
+	if !devServable(path) {
+		return staticAsset{}, false
+	}
+	data, err := fs.ReadFile(os.DirFS(devAssetDir), path)
+	if err != nil {
+		return staticAsset{}, false
+	}
+	return newStaticAsset(path, data), true
+}
+
+// lookupHTMLPage returns the templated HTML page at path. In dev mode it is re-read and
+// given a fresh timestamp on every request, so ?v= asset URLs change whenever the page is
+// reloaded; the shared buildTimestamp is left alone.
+func lookupHTMLPage(path string) htmlPage {
+	if devAssetDir == "" {
+		return htmlPages[path]
+	}
+	asset, ok := lookupAsset(path)
+	if !ok {
+		return htmlPages[path]
+	}
+	return newHTMLPage(asset.data, strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// compressible reports whether a file type benefits from compression.
+// Already-compressed formats like .png and .ico are skipped.
+func compressible(path string) bool {
+	switch filepath.Ext(path) {
+	case ".html", ".css", ".js", ".svg", ".json", ".webmanifest":
+		return true
+	default:
+		return false
+	}
+}
+
+// gzipBytes compresses data at the default level, which pages with a per-request nonce
+// pay for on every request, returning nil if compression doesn't make it smaller.
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil
+	}
+	if err := zw.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// brotliStartupLevel compresses the assets precomputed at startup. The best level (11)
+// is about 10% smaller but takes around a second, which every cold start would pay.
+const brotliStartupLevel = 9
+
+// brotliBytes compresses data at level, returning nil if compression doesn't make it smaller.
+func brotliBytes(data []byte, level int) []byte {
+	var buf bytes.Buffer
+	bw := brotli.NewWriterLevel(&buf, level)
+	if _, err := bw.Write(data); err != nil {
+		return nil
+	}
+	if err := bw.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// preferredEncoding picks the content coding to send from offered, which is ordered by
+// server preference, using the quality values in an Accept-Encoding header. Codings the
+// client doesn't list (and no "*" covers) or lists with q=0 are never chosen; ties go to
+// the earlier offer. It returns "" when the identity encoding should be sent.
+func preferredEncoding(acceptEncoding string, offered ...string) string {
+	quality := make(map[string]float64)
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		quality[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		q, listed := quality[coding]
+		if !listed {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+func serveStaticFiles(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET, HEAD, and OPTIONS methods
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+		debugf(r.Context(), "[serveStaticFiles] Rejecting %s request to %s (405)", r.Method, r.URL.Path)
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Redirect base domain frontpage to codegroove.dev
+	currentHost := requestHost(r)
+
+	// Check if this is the base domain (not a subdomain) and the frontpage
+	if strings.EqualFold(currentHost, baseDomain) && (r.URL.Path == "/" || r.URL.Path == "") {
+		http.Redirect(w, r, "https://codegroove.dev/reviewgoose/", http.StatusFound)
+		return
+	}
+
+	// Fetch Metadata: refuse cross-site script and style loads from untrusted origins
+	if crossSiteAssetBlocked(r) {
+		warnf("[SECURITY] Blocked cross-site %s load of %s from origin %q (%s)",
+			r.Header.Get("Sec-Fetch-Dest"), r.URL.Path, r.Header.Get("Origin"), clientIP(r))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// CORS: Allow subdomains to load assets from naked domain
+	if origin := r.Header.Get("Origin"); origin != "" && isAllowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type")
+		w.Header().Set("Vary", "Origin")
+	}
+
+	// Handle preflight requests
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Clean the path
+	path := filepath.Clean(r.URL.Path)
+
+	// Prevent directory traversal
+	if strings.Contains(path, "..") || strings.Contains(path, "~") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Remove leading slash for embed.FS
+	if path == "/" || path == "." {
+		path = "index.html"
+	} else {
+		path = strings.TrimPrefix(path, "/")
+	}
+	if embedded, ok := rootAssets[path]; ok {
+		path = embedded
+	}
+
+	// Look up the file in the embedded asset table (or on disk in dev mode)
+	asset, ok := lookupAsset(path)
+	if !ok {
+		switch {
+		case isAPIPath(path):
+			writeAPINotFound(w)
+			return
+		case !spaFallback(path):
+			serveNotFound(w, r)
+			return
+		default:
+			// Client-side route: the SPA router in index.html handles it
+			path = "index.html"
+			if asset, ok = lookupAsset(path); !ok {
+				errorf("Failed to serve fallback index.html: not embedded")
+				http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+
+	// Cache headers by file type; http.ServeContent sets Content-Type from the extension
+	switch filepath.Ext(path) {
+	case ".html":
+		// Never cache HTML files - they contain BUILD_TIMESTAMP references to versioned assets
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		asset = lookupHTMLPage(path).render(cspNonce(r))
+	case ".css", ".js", ".webmanifest", ".png", ".ico":
+		w.Header().Set("Cache-Control", assetCacheControl(r))
+	}
+
+	writeAsset(w, r, path, asset)
+}
+
+// assetCacheControl caches CSS, JS, icons, and the manifest for a year when the URL carries the ?v= build
+// timestamp, since a new build changes the URL. Unversioned requests (hand-typed URLs,
+// local development) get a short --asset-cache-max-age so edits still show up soon.
+func assetCacheControl(r *http.Request) string {
+	if r.URL.Query().Get("v") != "" {
+		return "public, max-age=31536000, immutable"
+	}
+	if *assetMaxAge <= 0 {
+		return "no-cache"
+	}
+	return "public, max-age=" + strconv.Itoa(int(assetMaxAge.Seconds()))
+}
+
+// htmlPage is an embedded HTML file with BUILD_TIMESTAMP substituted once at startup.
+// Pages using the CSP_NONCE placeholder are kept split around it so each request
+// only joins in its nonce; pages without one are served from the precomputed asset.
+type htmlPage struct {
+	asset staticAsset // templated page and compressed variants; no ETag, as it would outlive the timestamp
+	parts [][]byte    // asset.data split at each nonce placeholder
+}
+
+// htmlPages holds every embedded HTML file, templated and compressed once.
+var htmlPages = loadHTMLPages()
+
+func loadHTMLPages() map[string]htmlPage {
+	pages := make(map[string]htmlPage)
+	for path, asset := range staticAssets {
+		if filepath.Ext(path) != ".html" {
+			continue
+		}
+		pages[path] = newHTMLPage(asset.data, buildTimestamp)
+	}
+	return pages
+}
+
+func newHTMLPage(page []byte, timestamp string) htmlPage {
+	data := templateHTML(page, timestamp)
+	return htmlPage{
+		asset: staticAsset{data: data, gzip: gzipBytes(data), br: brotliBytes(data, brotliStartupLevel)},
+		parts: bytes.Split(data, []byte(cspNoncePlaceholder)),
+	}
+}
+
+// templateHTML substitutes timestamp, normally the process-wide buildTimestamp, for
+// BUILD_TIMESTAMP to bust caches.
+func templateHTML(page []byte, timestamp string) []byte {
+	return bytes.ReplaceAll(page, []byte("BUILD_TIMESTAMP"), []byte(timestamp))
+}
+
+// render returns the page for a request with the given CSP nonce.
+func (p htmlPage) render(nonce string) staticAsset {
+	if len(p.parts) <= 1 {
+		return p.asset
+	}
+	data := bytes.Join(p.parts, []byte(nonce))
+	return staticAsset{data: data, gzip: gzipBytes(data), br: brotliBytes(data, brotli.DefaultCompression)}
+}
+
+// isAPIPath reports whether a path belongs to the JSON API, whose clients expect JSON errors.
+// debug/ is included so debug endpoints that aren't served publicly 404 rather than hitting the SPA.
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "oauth/") || strings.HasPrefix(path, "debug/")
+}
+
+// spaFallback reports whether a missing path should be answered with index.html so the
+// frontend router can handle it. Asset, icon, and manifest requests are real files and get a 404 instead.
+func spaFallback(path string) bool {
+	return !strings.HasPrefix(path, "assets/") && !strings.HasSuffix(path, ".ico") && !strings.HasSuffix(path, ".webmanifest")
+}
+
+// writeAPINotFound answers an unknown API path with a JSON 404.
+func writeAPINotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	if _, err := w.Write([]byte(`{"error":"not found"}` + "\n")); err != nil {
+		errorf("Failed to write not found response: %v", err)
+	}
+}
+
+// serveNotFound writes the embedded 404 page.
+func serveNotFound(w http.ResponseWriter, r *http.Request) {
+	page := lookupHTMLPage("404.html").render(cspNonce(r)).data
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(page); err != nil {
+		errorf("Failed to write 404 page: %v", err)
+	}
+}
+
+// defaultCompressMinSize is the smallest body worth gzipping; below it the gzip header
+// and the CPU cost outweigh the bytes saved.
+const defaultCompressMinSize = 1024
+
+// compressMinSize is the --compress-min-size threshold, set by newServer. Assets smaller
+// than this are served with the identity encoding whatever Accept-Encoding says.
+var compressMinSize = defaultCompressMinSize
+
+// writeAsset writes an asset through http.ServeContent, using a compressed variant when
+// one exists, the asset is at least compressMinSize bytes, and the client accepts it.
+// Brotli is offered ahead of gzip, as it is smaller for the same content.
+// Assets with an ETag get Range and conditional request support; templated HTML has
+// none and is always written in full, or headers only for HEAD.
+func writeAsset(w http.ResponseWriter, r *http.Request, name string, asset staticAsset) {
+	data := asset.data
+	etag := asset.etag
+	var offered []string
+	if asset.br != nil {
+		offered = append(offered, "br")
+	}
+	if asset.gzip != nil {
+		offered = append(offered, "gzip")
+	}
+	if len(offered) > 0 && len(asset.data) >= compressMinSize {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if coding := preferredEncoding(r.Header.Get("Accept-Encoding"), offered...); coding != "" {
+			w.Header().Set("Content-Encoding", coding)
+			data = asset.gzip
+			if coding == "br" {
+				data = asset.br
+			}
+			// Each encoding is a distinct representation and needs its own strong ETag
+			if etag != "" {
+				etag = strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+			}
+		}
+	}
+
+	modtime := buildTime
+	if etag == "" {
+		// A templated page differs per process, and per request with a nonce, so a range of
+		// one response can't be stitched to another; without a modtime it is never 304'd either
+		modtime = time.Time{}
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+	} else {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, name, modtime, bytes.NewReader(data))
+}
+
+// assetTypes pins the Content-Type http.ServeContent picks for each served extension,
+// since the system MIME table it otherwise consults varies by host.
+var assetTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "application/javascript; charset=utf-8",
+	".json":        "application/json; charset=utf-8",
+	".webmanifest": "application/manifest+json",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".svg":         "image/svg+xml",
+	".ico":         "image/x-icon",
+}
+
+func init() {
+	for ext, typ := range assetTypes {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			panic("invalid asset type for " + ext + ": " + err.Error())
+		}
+	}
+}
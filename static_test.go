@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestStaticCompression(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "js with br", path: "/assets/app.js", acceptEncoding: "gzip, deflate, br", wantEncoding: "br"},
+		{name: "css with gzip", path: "/assets/styles.css?v=1", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{name: "js without compression", path: "/assets/app.js", acceptEncoding: "", wantEncoding: ""},
+		{name: "js with gzip refused", path: "/assets/app.js", acceptEncoding: "gzip;q=0, identity", wantEncoding: ""},
+		{name: "png never compressed", path: "/assets/army.png", acceptEncoding: "gzip, br", wantEncoding: ""},
+		{name: "html with gzip", path: "/index.html", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{name: "html with br", path: "/index.html", acceptEncoding: "br", wantEncoding: "br"},
+		{name: "br preferred", path: "/assets/app.js", acceptEncoding: "br, gzip", wantEncoding: "br"},
+		{name: "gzip weighted above br", path: "/assets/app.js", acceptEncoding: "br;q=0.5, gzip", wantEncoding: "gzip"},
+		{name: "br via wildcard", path: "/assets/app.js", acceptEncoding: "*;q=0.5", wantEncoding: "br"},
+		{name: "small css below threshold", path: "/assets/error.css", acceptEncoding: "gzip, br", wantEncoding: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+tt.path, http.NoBody)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			serveStaticFiles(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rr.Code)
+			}
+			got := rr.Header().Get("Content-Encoding")
+			if got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			var body []byte
+			var err error
+			switch got {
+			case "":
+				return
+			case "br":
+				body, err = io.ReadAll(brotli.NewReader(rr.Body))
+			case "gzip":
+				zr, zerr := gzip.NewReader(rr.Body)
+				if zerr != nil {
+					t.Fatalf("invalid gzip body: %v", zerr)
+				}
+				body, err = io.ReadAll(zr)
+			}
+			if err != nil {
+				t.Fatalf("failed to decompress body: %v", err)
+			}
+			if len(body) == 0 || bytes.Contains(body, []byte("BUILD_TIMESTAMP")) {
+				t.Errorf("decompressed body is empty or untemplated")
+			}
+			if rr.Header().Get("Vary") == "" {
+				t.Error("missing Vary header on compressed response")
+			}
+		})
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	orig := compressMinSize
+	t.Cleanup(func() { compressMinSize = orig })
+
+	small, large := len(staticAssets["assets/error.css"].data), len(staticAssets["assets/app.js"].data)
+	tests := []struct {
+		minSize  int
+		path     string
+		wantGzip bool
+	}{
+		{minSize: defaultCompressMinSize, path: "/assets/error.css", wantGzip: false},
+		{minSize: defaultCompressMinSize, path: "/assets/app.js", wantGzip: true},
+		{minSize: 0, path: "/assets/error.css", wantGzip: true},
+		{minSize: small, path: "/assets/error.css", wantGzip: true},
+		{minSize: large + 1, path: "/assets/app.js", wantGzip: false},
+	}
+	for _, tt := range tests {
+		compressMinSize = tt.minSize
+		req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+tt.path, http.NoBody)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		serveStaticFiles(rr, req)
+
+		if got := rr.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+			t.Errorf("min size %d, %s: gzip = %v, want %v", tt.minSize, tt.path, got, tt.wantGzip)
+		}
+		if !tt.wantGzip && rr.Header().Get("Vary") != "" {
+			t.Errorf("min size %d, %s: Vary = %q on an uncompressible response", tt.minSize, tt.path, rr.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestPreferredEncoding(t *testing.T) {
+	tests := []struct {
+		accept  string
+		offered []string
+		want    string
+	}{
+		{accept: "br, gzip", offered: []string{"br", "gzip"}, want: "br"},
+		{accept: "gzip, br", offered: []string{"br", "gzip"}, want: "br"},
+		{accept: "gzip;q=0.9, br;q=0.5", offered: []string{"br", "gzip"}, want: "gzip"},
+		{accept: "br;q=0, gzip", offered: []string{"br", "gzip"}, want: "gzip"},
+		{accept: "br, gzip", offered: []string{"gzip"}, want: "gzip"},
+		{accept: "GZIP; Q=0.5", offered: []string{"gzip"}, want: "gzip"},
+		{accept: "*", offered: []string{"br", "gzip"}, want: "br"},
+		{accept: "*;q=0.1, br;q=0", offered: []string{"br", "gzip"}, want: "gzip"},
+		{accept: "gzip;q=0", offered: []string{"gzip"}, want: ""},
+		{accept: "gzip;q=0.000", offered: []string{"gzip"}, want: ""},
+		{accept: "gzip;q=bogus", offered: []string{"gzip"}, want: ""},
+		{accept: "deflate", offered: []string{"gzip"}, want: ""},
+		{accept: "", offered: []string{"gzip"}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := preferredEncoding(tt.accept, tt.offered...); got != tt.want {
+			t.Errorf("preferredEncoding(%q, %q) = %q, want %q", tt.accept, tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/app.js?v=1", http.NoBody)
+	rr := httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q; want 200 with an ETag", rr.Code, etag)
+	}
+
+	// A matching If-None-Match gets 304 with no body
+	req = httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/app.js?v=1", http.NoBody)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("304 response has %d byte body", rr.Body.Len())
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Errorf("304 ETag = %q, want %q", rr.Header().Get("ETag"), etag)
+	}
+
+	// A stale ETag gets the full body
+	req = httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/app.js?v=1", http.NoBody)
+	req.Header.Set("If-None-Match", `"stale"`)
+	rr = httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.Len() == 0 {
+		t.Errorf("status = %d with %d byte body, want 200 with content", rr.Code, rr.Body.Len())
+	}
+
+	// The gzip representation has a distinct ETag
+	req = httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/app.js?v=1", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	gzipETag := rr.Header().Get("ETag")
+	if gzipETag == etag || gzipETag == "" {
+		t.Errorf("gzip ETag = %q, want distinct from identity ETag %q", gzipETag, etag)
+	}
+
+	// As does the Brotli one
+	req = httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/app.js?v=1", http.NoBody)
+	req.Header.Set("Accept-Encoding", "br")
+	rr = httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	if got := rr.Header().Get("ETag"); got == etag || got == gzipETag || got == "" {
+		t.Errorf("br ETag = %q, want distinct from %q and %q", got, etag, gzipETag)
+	}
+}
+
+func TestStaticAssetCacheControl(t *testing.T) {
+	orig := *assetMaxAge
+	t.Cleanup(func() { *assetMaxAge = orig })
+
+	tests := []struct {
+		path   string
+		maxAge time.Duration
+		want   string
+	}{
+		{"/assets/app.js?v=123", 5 * time.Minute, "public, max-age=31536000, immutable"},
+		{"/assets/error.css?v=123", 0, "public, max-age=31536000, immutable"},
+		{"/assets/app.js", 5 * time.Minute, "public, max-age=300"},
+		{"/assets/error.css", time.Hour, "public, max-age=3600"},
+		{"/assets/app.js", 0, "no-cache"},
+	}
+	for _, tt := range tests {
+		*assetMaxAge = tt.maxAge
+		rr := httptest.NewRecorder()
+		serveStaticFiles(rr, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+tt.path, http.NoBody))
+		if got := rr.Header().Get("Cache-Control"); rr.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s with max age %v: status %d, Cache-Control = %q, want %q", tt.path, tt.maxAge, rr.Code, got, tt.want)
+		}
+	}
+}
+
+func TestStaticRootAssets(t *testing.T) {
+	orig := *assetMaxAge
+	*assetMaxAge = 5 * time.Minute
+	t.Cleanup(func() { *assetMaxAge = orig })
+
+	tests := []struct {
+		path        string
+		embedded    string
+		contentType string
+	}{
+		{"/favicon.ico", "assets/favicon.ico", "image/x-icon"},
+		{"/apple-touch-icon.png", "assets/apple-touch-icon.png", "image/png"},
+		{"/site.webmanifest", "assets/site.webmanifest", "application/manifest+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			serveStaticFiles(rr, httptest.NewRequest(http.MethodGet, "http://"+baseDomain+tt.path, http.NoBody))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rr.Code)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Header().Get("Cache-Control"); got != "public, max-age=300" {
+				t.Errorf("Cache-Control = %q, want public, max-age=300", got)
+			}
+			if !bytes.Equal(rr.Body.Bytes(), staticAssets[tt.embedded].data) {
+				t.Errorf("body is not the embedded %s", tt.embedded)
+			}
+		})
+	}
+
+	// The manifest's icons must themselves resolve
+	var manifest struct {
+		Icons []struct {
+			Src string `json:"src"`
+		} `json:"icons"`
+	}
+	if err := json.Unmarshal(staticAssets["assets/site.webmanifest"].data, &manifest); err != nil {
+		t.Fatalf("manifest is not JSON: %v", err)
+	}
+	for _, icon := range manifest.Icons {
+		if _, ok := staticAssets[rootAssets[strings.TrimPrefix(icon.Src, "/")]]; !ok {
+			t.Errorf("manifest icon %s is not embedded", icon.Src)
+		}
+	}
+}
+
+func TestStaticRange(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/assets/army.png", http.NoBody)
+	req.Header.Set("Range", "bytes=0-10")
+	rr := httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rr.Code)
+	}
+	if rr.Body.Len() != 11 {
+		t.Errorf("body length = %d, want 11", rr.Body.Len())
+	}
+	if got := rr.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+
+	// HTML is templated per process and never range-served
+	req = httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/index.html", http.NoBody)
+	req.Header.Set("Range", "bytes=0-10")
+	rr = httptest.NewRecorder()
+	serveStaticFiles(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("HTML status = %d, want 200", rr.Code)
+	}
+}
+
+func TestStaticNotFound(t *testing.T) {
+	tests := []struct {
+		name            string
+		path            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "missing asset", path: "/assets/nope.js", wantStatus: http.StatusNotFound, wantContentType: "text/html; charset=utf-8", wantBody: "Page not found"},
+		{name: "missing icon", path: "/nope.ico", wantStatus: http.StatusNotFound, wantContentType: "text/html; charset=utf-8", wantBody: "Page not found"},
+		{name: "missing manifest", path: "/app.webmanifest", wantStatus: http.StatusNotFound, wantContentType: "text/html; charset=utf-8", wantBody: "Page not found"},
+		{name: "unknown api path", path: "/oauth/nope", wantStatus: http.StatusNotFound, wantContentType: "application/json", wantBody: `{"error":"not found"}`},
+		{name: "spa route", path: "/some/route", wantStatus: http.StatusOK, wantContentType: "text/html; charset=utf-8", wantBody: `<div id="app">`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+tt.path, http.NoBody)
+			rr := httptest.NewRecorder()
+			serveStaticFiles(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			body := rr.Body.String()
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body missing %q", tt.wantBody)
+			}
+			if strings.Contains(body, "BUILD_TIMESTAMP") {
+				t.Error("body is untemplated")
+			}
+		})
+	}
+}
+
+func TestStaticHead(t *testing.T) {
+	for _, path := range []string{"/assets/app.js", "/index.html", "/some/route"} {
+		t.Run(path, func(t *testing.T) {
+			get := httptest.NewRecorder()
+			serveStaticFiles(get, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+path, http.NoBody))
+
+			head := httptest.NewRecorder()
+			serveStaticFiles(head, httptest.NewRequest(http.MethodHead, "http://my."+baseDomain+path, http.NoBody))
+
+			if head.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", head.Code)
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD body has %d bytes, want 0", head.Body.Len())
+			}
+			if got, want := head.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+				t.Errorf("Content-Length = %q, want %q", got, want)
+			}
+			for _, h := range []string{"Content-Type", "Cache-Control", "ETag"} {
+				if got, want := head.Header().Get(h), get.Header().Get(h); got != want {
+					t.Errorf("%s = %q, want %q as for GET", h, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStaticHTMLTemplatedOnce(t *testing.T) {
+	page, ok := htmlPages["index.html"]
+	if !ok {
+		t.Fatal("index.html was not templated at startup")
+	}
+	if !bytes.Contains(page.asset.data, []byte("?v="+buildTimestamp)) || bytes.Contains(page.asset.data, []byte("BUILD_TIMESTAMP")) {
+		t.Error("cached index.html does not carry the build timestamp")
+	}
+	if page.asset.gzip == nil || page.asset.br == nil {
+		t.Error("cached index.html is missing a compressed variant")
+	}
+
+	// Requests serve the cached bytes rather than re-templating
+	rr := httptest.NewRecorder()
+	serveStaticFiles(rr, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/", http.NoBody))
+	if !bytes.Equal(rr.Body.Bytes(), page.asset.data) {
+		t.Error("served index.html differs from the cached page")
+	}
+}
+
+// BenchmarkServeHTML compares serving the startup-templated index.html
+// against templating and compressing it on every request, as was done before.
+func BenchmarkServeHTML(b *testing.B) {
+	b.Run("cached", func(b *testing.B) {
+		req := httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+"/", http.NoBody)
+		req.Header.Set("Accept-Encoding", "gzip")
+		b.ReportAllocs()
+		for b.Loop() {
+			serveStaticFiles(httptest.NewRecorder(), req)
+		}
+	})
+	b.Run("per-request", func(b *testing.B) {
+		raw := staticAssets["index.html"].data
+		b.ReportAllocs()
+		for b.Loop() {
+			data := []byte(strings.ReplaceAll(string(raw), "BUILD_TIMESTAMP", buildTimestamp))
+			_ = gzipBytes(data)
+		}
+	})
+}
+
+func TestDevModeServesFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("index.html", `<link href="/assets/dev.css?v=BUILD_TIMESTAMP">`)
+	write("404.html", "not here")
+	write("assets/dev.css", "body { color: red; }")
+	write("main.go", "package main")
+	if _, embedded := staticAssets["assets/dev.css"]; embedded {
+		t.Fatal("assets/dev.css is embedded; pick another name")
+	}
+
+	handler := newTestServer(t, Config{DevDir: dir})
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://my."+baseDomain+path, http.NoBody))
+		return rr
+	}
+
+	if rr := get("/assets/dev.css"); rr.Code != http.StatusOK || rr.Body.String() != "body { color: red; }" {
+		t.Errorf("GET /assets/dev.css = %d %q, want the on-disk file", rr.Code, rr.Body)
+	}
+
+	// Edits show up without restarting
+	write("assets/dev.css", "body { color: blue; }")
+	if rr := get("/assets/dev.css"); rr.Body.String() != "body { color: blue; }" {
+		t.Errorf("after edit: body = %q, want the new content", rr.Body)
+	}
+
+	// HTML is templated per request rather than with the startup timestamp
+	rr := get("/")
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "BUILD_TIMESTAMP") || !strings.Contains(rr.Body.String(), "dev.css?v=") {
+		t.Errorf("GET / = %d %q, want the templated on-disk index.html", rr.Code, rr.Body)
+	}
+
+	// Embedded files aren't consulted in dev mode
+	if rr := get("/assets/app.js"); rr.Code != http.StatusNotFound {
+		t.Errorf("GET /assets/app.js status = %d, want 404 when it isn't on disk", rr.Code)
+	}
+
+	// Only the files production embeds are served, not the rest of the dev directory
+	if rr := get("/main.go"); strings.Contains(rr.Body.String(), "package main") {
+		t.Errorf("GET /main.go = %d %q, want the SPA fallback rather than the file", rr.Code, rr.Body)
+	}
+
+	// Without --dev the embedded assets are served
+	handler = newTestServer(t, Config{})
+	if rr := get("/assets/dev.css"); rr.Code != http.StatusNotFound {
+		t.Errorf("embedded mode: GET /assets/dev.css status = %d, want 404", rr.Code)
+	}
+}
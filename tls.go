@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// validateTLSFlags checks that --tls-cert and --tls-key are given together, and not
+// alongside --tls-auto.
+func validateTLSFlags(certFile, keyFile string, auto bool) error {
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("--tls-cert and --tls-key must be set together")
+	}
+	if auto && certFile != "" {
+		return errors.New("--tls-auto can't be combined with --tls-cert and --tls-key")
+	}
+	return nil
+}
+
+// tlsAutoHosts are the hosts --tls-auto requests certificates for: the base domain and
+// any host with its own OAuth app.
+func tlsAutoHosts() []string {
+	hosts := []string{strings.ToLower(baseDomain)}
+	for host := range oauthAppsByHost {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// newCertManager returns the --tls-auto certificate manager, which obtains and renews
+// certificates for hosts from Let's Encrypt and caches them in cacheDir so restarts
+// don't run into its rate limits. Challenges are answered over TLS-ALPN-01 on the
+// HTTPS listener, which must be reachable on port 443, or HTTP-01 on the redirect
+// listener.
+func newCertManager(cacheDir string, hosts []string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+	}
+}
+
+// serve accepts connections on ln, terminating TLS itself when a certificate file or a
+// TLS config (from --tls-auto) is configured. Without either, it serves plain HTTP and
+// relies on an upstream proxy for TLS.
+func serve(srv *http.Server, ln net.Listener, certFile, keyFile string) error {
+	if certFile != "" || srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, certFile, keyFile)
+	}
+	return srv.Serve(ln)
+}
+
+// httpsRedirect permanently redirects every request to its https:// equivalent,
+// keeping host, path, and query. A 308 preserves the method and body.
+// tlsPort is omitted from the target when it's the HTTPS default.
+func httpsRedirect(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// No port; a bare IPv6 literal keeps its brackets, which are re-added below
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+		if host == "" {
+			http.Error(w, "Missing host", http.StatusBadRequest)
+			return
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // bare IPv6 literal
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and returns its paths and parsed form.
+func writeSelfSignedCert(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealthCheck)
+	srv := &http.Server{Handler: securityHeaders(mux), ReadHeaderTimeout: time.Second}
+	done := make(chan error, 1)
+	go func() { done <- serve(srv, ln, certFile, keyFile) }()
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("failed to close server: %v", err)
+		}
+		if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serve() = %v, want ErrServerClosed", err)
+		}
+	})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+	}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("failed to close body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.TLS == nil {
+		t.Error("response was not served over TLS")
+	}
+	// r.TLS is set server-side, so HSTS applies without X-Forwarded-Proto
+	if resp.Header.Get("Strict-Transport-Security") == "" {
+		t.Error("missing HSTS header on TLS response")
+	}
+}
+
+func TestValidateTLSFlags(t *testing.T) {
+	if err := validateTLSFlags("cert.pem", "", false); err == nil {
+		t.Error("cert without key accepted")
+	}
+	if err := validateTLSFlags("", "key.pem", false); err == nil {
+		t.Error("key without cert accepted")
+	}
+	if err := validateTLSFlags("cert.pem", "key.pem", true); err == nil {
+		t.Error("--tls-auto with a certificate file accepted")
+	}
+	if err := validateTLSFlags("", "", false); err != nil {
+		t.Errorf("plain HTTP rejected: %v", err)
+	}
+	if err := validateTLSFlags("", "", true); err != nil {
+		t.Errorf("--tls-auto rejected: %v", err)
+	}
+}
+
+func TestCertManagerHostPolicy(t *testing.T) {
+	orig := oauthAppsByHost
+	oauthAppsByHost = map[string]oauthApp{"staging.reviewgoose.dev": {clientID: "Iv23staging"}}
+	t.Cleanup(func() { oauthAppsByHost = orig })
+
+	m := newCertManager(t.TempDir(), tlsAutoHosts())
+	for host, wantOK := range map[string]bool{
+		"reviewgoose.dev":         true,
+		"staging.reviewgoose.dev": true,
+		"evil.example.com":        false,
+		"other.reviewgoose.dev":   false,
+	} {
+		if err := m.HostPolicy(t.Context(), host); (err == nil) != wantOK {
+			t.Errorf("HostPolicy(%s) = %v, want allowed %v", host, err, wantOK)
+		}
+	}
+}
+
+func TestServeTLSConfig(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	// --tls-auto hands serve a TLS config that gets certificates on demand, and no files
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(handleHealthCheck),
+		ReadHeaderTimeout: time.Second,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &pair, nil
+		}},
+	}
+	done := make(chan error, 1)
+	go func() { done <- serve(srv, ln, "", "") }()
+	t.Cleanup(func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("failed to close server: %v", err)
+		}
+		<-done
+	})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+	}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("failed to close body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("status = %d, TLS = %v, want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		tlsPort string
+		target  string
+		want    string
+	}{
+		{tlsPort: "443", target: "http://my.reviewGOOSE.dev/some/route?a=1&b=2", want: "https://my.reviewGOOSE.dev/some/route?a=1&b=2"},
+		{tlsPort: "443", target: "http://my.reviewGOOSE.dev:80/", want: "https://my.reviewGOOSE.dev/"},
+		{tlsPort: "8443", target: "http://localhost/oauth/login?return_to=x", want: "https://localhost:8443/oauth/login?return_to=x"},
+		{tlsPort: "443", target: "http://[::1]:80/a%2Fb", want: "https://[::1]/a%2Fb"},
+		{tlsPort: "443", target: "http://[::1]/", want: "https://[::1]/"},
+		{tlsPort: "8443", target: "http://[::1]/", want: "https://[::1]:8443/"},
+		{tlsPort: "8443", target: "http://[2001:db8::1]:80/x", want: "https://[2001:db8::1]:8443/x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, http.NoBody)
+			rr := httptest.NewRecorder()
+			httpsRedirect(tt.tlsPort).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusPermanentRedirect {
+				t.Errorf("status = %d, want 308", rr.Code)
+			}
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Distributed tracing with the OpenTelemetry SDK and W3C Trace Context (traceparent)
+// propagation. Spans are exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set,
+// and tracing is a no-op otherwise.
+
+// Span kinds for startSpan.
+const (
+	spanKindServer = trace.SpanKindServer
+	spanKindClient = trace.SpanKindClient
+)
+
+// tracer creates spans; nil disables tracing.
+var tracer trace.Tracer
+
+// traceContext reads and writes traceparent headers.
+var traceContext propagation.TraceContext
+
+// setupTracing points tracer at an OTLP/HTTP collector configured by the standard
+// OTEL_EXPORTER_OTLP_* environment variables. The returned func flushes buffered spans
+// and stops the exporter, and must be called on shutdown.
+func setupTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("review-dash"))),
+	)
+	tracer = provider.Tracer("github.com/r2r/dashboard")
+	return provider.Shutdown, nil
+}
+
+// span is a single timed operation within a trace.
+type span struct {
+	otel trace.Span
+}
+
+// startSpan begins a span as a child of any span in ctx. Returns a nil span when tracing is off;
+// all span methods are nil-safe so callers need not check.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	ctx, s := tracer.Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &span{otel: s}
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case string:
+		s.otel.SetAttributes(attribute.String(key, v))
+	case int:
+		s.otel.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.otel.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.otel.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.otel.RecordError(err)
+	s.otel.SetStatus(codes.Error, err.Error())
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.otel.End()
+}
+
+// injectTraceparent propagates the span in ctx to an outbound request.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	traceContext.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// traceRequests creates a server span for each request, continuing any incoming trace.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		defer s.finish()
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		s.setAttr("http.response.status_code", wrapped.statusCode)
+		if wrapped.statusCode >= 500 {
+			s.otel.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+		}
+	})
+}
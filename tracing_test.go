@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans enables tracing for the test, collecting finished spans in memory.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		tracer = nil
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Errorf("shutting down tracer provider: %v", err)
+		}
+	})
+	return rec
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, a := range s.Attributes() {
+		if string(a.Key) == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingSpans(t *testing.T) {
+	rec := recordSpans(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var outboundTraceparent string
+	stubClient(t, &apiClient, func(r *http.Request) (*http.Response, error) {
+		outboundTraceparent = r.Header.Get("Traceparent")
+		return stubResponse(http.StatusOK, `{"login":"octocat","id":1}`), nil
+	})
+
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := userInfo(r.Context(), testToken); err != nil {
+			t.Errorf("userInfo failed: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody)
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	client, server := spans[0], spans[1]
+
+	if server.SpanKind() != trace.SpanKindServer || server.SpanContext().TraceID().String() != traceID {
+		t.Errorf("server span kind=%v trace=%s, want continuation of incoming trace", server.SpanKind(), server.SpanContext().TraceID())
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want incoming span ID", server.Parent().SpanID())
+	}
+	if client.SpanKind() != trace.SpanKindClient || client.SpanContext().TraceID() != server.SpanContext().TraceID() ||
+		client.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("client span is not a child of the server span")
+	}
+	if spanAttr(client, "server.address").AsString() != "api.github.com" ||
+		spanAttr(client, "http.response.status_code").AsInt64() != 200 || spanAttr(client, "retry.count").Type() != attribute.INT64 {
+		t.Errorf("client span attrs = %+v", client.Attributes())
+	}
+	if !strings.HasPrefix(outboundTraceparent, "00-"+traceID+"-") {
+		t.Errorf("outbound traceparent = %q, want trace %s propagated", outboundTraceparent, traceID)
+	}
+}
+
+func TestTracingServerError(t *testing.T) {
+	rec := recordSpans(t)
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/oauth/user", http.NoBody))
+
+	spans := rec.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Errorf("spans = %+v, want one failed server span", spans)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	tracer = nil
+	ctx, s := startSpan(t.Context(), "noop", spanKindClient)
+	if s != nil || ctx != t.Context() {
+		t.Error("startSpan created a span with tracing disabled")
+	}
+	// Span methods are nil-safe
+	s.setAttr("key", "value")
+	s.setError(nil)
+	s.finish()
+}
+
+func TestTracingIgnoresInvalidTraceparent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ok: false},
+		{header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: false},
+		{header: "00-xyz-00f067aa0ba902b7-01", ok: false},
+		{header: "", ok: false},
+	}
+	for _, tt := range tests {
+		rec := recordSpans(t)
+		req := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		req.Header.Set("Traceparent", tt.header)
+		traceRequests(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := rec.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("traceparent %q: recorded %d spans, want 1", tt.header, len(spans))
+		}
+		if continued := spans[0].Parent().IsValid(); continued != tt.ok {
+			t.Errorf("traceparent %q continued = %v, want %v", tt.header, continued, tt.ok)
+		}
+	}
+}
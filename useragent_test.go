@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserAgentFilter(t *testing.T) {
+	origList, origEmpty := uaDenylist, *rejectEmptyUA
+	t.Cleanup(func() { uaDenylist, *rejectEmptyUA = origList, origEmpty })
+	logs := captureLog(t)
+
+	handler := userAgentFilter(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	status := func(path, ua string) int {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		req.Header.Del("User-Agent")
+		if ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Off by default: nothing is blocked
+	uaDenylist, *rejectEmptyUA = nil, false
+	if got := status("/", ""); got != http.StatusOK {
+		t.Errorf("empty UA with filter off: status %d, want 200", got)
+	}
+
+	uaDenylist = parseUADenylist(" SQLMap , masscan,,")
+	*rejectEmptyUA = true
+	tests := []struct {
+		name, path, ua string
+		want           int
+	}{
+		{"browser", "/", "Mozilla/5.0 (Macintosh) Safari/605.1.15", http.StatusOK},
+		{"denied substring", "/oauth/login", "sqlmap/1.7.2#stable (https://sqlmap.org)", http.StatusForbidden},
+		{"denied substring, any case", "/", "MassCan/1.3", http.StatusForbidden},
+		{"empty UA", "/oauth/user", "", http.StatusForbidden},
+		{"blank UA", "/", "   ", http.StatusForbidden},
+		{"health probe without UA", "/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := status(tt.path, tt.ua); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "[SECURITY]") || !strings.Contains(logs.String(), "matched sqlmap") {
+		t.Errorf("blocked requests not logged: %q", logs.String())
+	}
+}
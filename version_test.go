@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func getVersion(t *testing.T) buildInfo {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleVersion(rr, httptest.NewRequest(http.MethodGet, "/version", http.NoBody))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	var info buildInfo
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	return info
+}
+
+func TestVersionDefaults(t *testing.T) {
+	info := getVersion(t)
+	if info.Version != "dev" {
+		t.Errorf("version = %q, want dev", info.Version)
+	}
+	if info.Commit == "" || info.BuildDate == "" {
+		t.Errorf("commit = %q, build_date = %q, want non-empty defaults", info.Commit, info.BuildDate)
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("go_version = %q, want %q", info.GoVersion, runtime.Version())
+	}
+}
+
+func TestVersionInjected(t *testing.T) {
+	setString(t, &version, "v1.2.3")
+	setString(t, &commit, "0123abcd")
+	setString(t, &buildDate, "2025-01-02T03:04:05Z")
+
+	want := buildInfo{Version: "v1.2.3", Commit: "0123abcd", BuildDate: "2025-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if got := getVersion(t); got != want {
+		t.Errorf("version = %+v, want %+v", got, want)
+	}
+
+	// /health reports the same version
+	rr := httptest.NewRecorder()
+	handleHealthCheck(rr, httptest.NewRequest(http.MethodGet, "/health", http.NoBody))
+	var health struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&health); err != nil {
+		t.Fatalf("invalid health JSON: %v", err)
+	}
+	if health.Version != "v1.2.3" {
+		t.Errorf("health version = %q, want v1.2.3", health.Version)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// webhookPayloadLimit caps webhook bodies; GitHub's own limit is 25MB but
+// the events we handle are far smaller.
+const webhookPayloadLimit = maxRequestSize
+
+// webhookHandler processes one GitHub App event type.
+type webhookHandler func(ctx context.Context, delivery string, payload json.RawMessage) error
+
+// webhookHandlers dispatches events by their X-GitHub-Event type.
+// Unlisted events are acknowledged and ignored.
+var webhookHandlers = map[string]webhookHandler{
+	"ping":                      handlePingEvent,
+	"installation":              handleInstallationEvent,
+	"installation_repositories": handleInstallationEvent,
+	"pull_request":              handlePullRequestEvent,
+}
+
+// validWebhookSignature checks an X-Hub-Signature-256 header against the payload in constant time.
+func validWebhookSignature(secret string, payload []byte, header string) bool {
+	got, ok := strings.CutPrefix(header, "sha256=")
+	if !ok || secret == "" {
+		return false
+	}
+	sig, err := hex.DecodeString(got)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// handleWebhook receives GitHub App events, verifying they were signed with the webhook secret.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *webhookSecret == "" {
+		log.Print("Webhook received but no webhook secret is configured. Set GITHUB_WEBHOOK_SECRET or --webhook-secret")
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, webhookPayloadLimit+1))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(payload) > webhookPayloadLimit {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	delivery := r.Header.Get("X-GitHub-Delivery")
+	if !validWebhookSignature(*webhookSecret, payload, r.Header.Get("X-Hub-Signature-256")) {
+		fields := requestAuditFields(r, auditDenied)
+		fields["delivery"] = delivery
+		auditLog(auditWebhookSignature, fields)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	handler, ok := webhookHandlers[event]
+	if !ok {
+		log.Printf("[webhook] Ignoring %q event (delivery %s)", event, delivery)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := handler(r.Context(), delivery, payload); err != nil {
+		errorf("[webhook] Failed to handle %s event (delivery %s): %v", event, delivery, err)
+		http.Error(w, "Failed to process event", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePingEvent(_ context.Context, delivery string, payload json.RawMessage) error {
+	var event struct {
+		Zen string `json:"zen"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	log.Printf("[webhook] Ping (delivery %s): %s", delivery, event.Zen)
+	return nil
+}
+
+func handleInstallationEvent(_ context.Context, delivery string, payload json.RawMessage) error {
+	var event struct {
+		Action       string `json:"action"`
+		Installation struct {
+			Account struct {
+				Login string `json:"login"`
+			} `json:"account"`
+			ID int64 `json:"id"`
+		} `json:"installation"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	log.Printf("[webhook] Installation %d for %s: %s (delivery %s)",
+		event.Installation.ID, event.Installation.Account.Login, event.Action, delivery)
+	return nil
+}
+
+func handlePullRequestEvent(_ context.Context, delivery string, payload json.RawMessage) error {
+	var event struct {
+		Action     string `json:"action"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Number int `json:"number"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	log.Printf("[webhook] Pull request %s#%d: %s (delivery %s)", event.Repository.FullName, event.Number, event.Action, delivery)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func signWebhook(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleWebhook(t *testing.T) {
+	setString(t, webhookSecret, "webhook_secret")
+
+	var handled []string
+	orig := webhookHandlers["pull_request"]
+	webhookHandlers["pull_request"] = func(_ context.Context, delivery string, _ json.RawMessage) error {
+		handled = append(handled, delivery)
+		return nil
+	}
+	t.Cleanup(func() { webhookHandlers["pull_request"] = orig })
+
+	payload := `{"action":"opened","number":1,"repository":{"full_name":"codeGROOVE-dev/review-dash"}}`
+
+	tests := []struct {
+		name       string
+		event      string
+		body       string
+		signature  string
+		wantStatus int
+		wantCalled bool
+	}{
+		{name: "valid signature", event: "pull_request", body: payload, signature: signWebhook("webhook_secret", payload), wantStatus: http.StatusNoContent, wantCalled: true},
+		{name: "tampered payload", event: "pull_request", body: strings.Replace(payload, "opened", "closed", 1), signature: signWebhook("webhook_secret", payload), wantStatus: http.StatusUnauthorized},
+		{name: "wrong secret", event: "pull_request", body: payload, signature: signWebhook("other_secret", payload), wantStatus: http.StatusUnauthorized},
+		{name: "missing signature", event: "pull_request", body: payload, wantStatus: http.StatusUnauthorized},
+		{name: "sha1 signature", event: "pull_request", body: payload, signature: "sha1=" + strings.Repeat("0", 40), wantStatus: http.StatusUnauthorized},
+		{name: "unhandled event", event: "star", body: payload, signature: signWebhook("webhook_secret", payload), wantStatus: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			req.Header.Set("X-GitHub-Event", tt.event)
+			req.Header.Set("X-GitHub-Delivery", "delivery-1")
+			if tt.signature != "" {
+				req.Header.Set("X-Hub-Signature-256", tt.signature)
+			}
+			rr := httptest.NewRecorder()
+			handleWebhook(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if called := len(handled) > 0; called != tt.wantCalled {
+				t.Errorf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookUnconfigured(t *testing.T) {
+	setString(t, webhookSecret, "")
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+	req.Header.Set("X-Hub-Signature-256", signWebhook("", "{}"))
+	rr := httptest.NewRecorder()
+	handleWebhook(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rr.Code)
+	}
+}